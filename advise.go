@@ -0,0 +1,62 @@
+// advise.go -- control the paging of the mapped regions of a DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+)
+
+// The platform specific parts are in madvise_*.go and mlock_*.go:
+//   - madvise() tells the OS how a mapped region will be accessed; it does
+//     nothing on platforms without madvise.
+//   - mlock() locks a mapped region in memory; it fails with errNoMlock on
+//     platforms without mlock.
+
+// Advise tells the OS how the memory mapped offset table - and the whole
+// file of a DB opened by NewDBReaderMmap() - will be accessed. Lookups
+// touch random entries of the offset table: AdviceRandom stops the OS
+// from reading ahead around each of them and AdviceWillNeed pages the
+// table in now rather than during the first lookups. Offset tables that
+// are read into memory aren't affected.
+func (rd *DBReader) Advise(a Advice) error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	defer rd.leave()
+
+	for _, b := range [][]byte{rd.mmap, rd.fmap} {
+		if b == nil {
+			continue
+		}
+		if err := madvise(b, a); err != nil {
+			return fmt.Errorf("%s: madvise: %w", rd.fn, err)
+		}
+	}
+	return nil
+}
+
+// LockOffsets locks the memory mapped offset table in memory so that it is
+// never paged out - e.g., on hosts under memory pressure; it stays locked
+// until the DB is closed. Locking needs enough of the locked memory limit
+// (RLIMIT_MEMLOCK on unix) for the whole table. Offset tables that are read
+// into memory aren't locked.
+func (rd *DBReader) LockOffsets() error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	defer rd.leave()
+
+	if rd.mmap == nil {
+		return nil
+	}
+	if err := mlock(rd.mmap); err != nil {
+		return fmt.Errorf("%s: mlock: %w", rd.fn, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// align_test.go -- test suite for aligned records and direct I/O
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestRecordAlign(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	for _, a := range []int{100, 256, 2 << 20, 1000} {
+		_, err := NewDBWriterWithOptions(fn, WriterOptions{RecordAlign: a})
+		assert(err != nil, "created a DB with record alignment %d", a)
+	}
+	_, err := NewDBWriterWithOptions(fn, WriterOptions{RecordAlign: 4096, Compress: true})
+	assert(err != nil, "created a compressed DB with aligned records")
+
+	keys := make([][]byte, 500)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = bytes.Repeat([]byte{byte(i)}, i*7)
+	}
+
+	key := []byte("0123456789abcdef")
+	for _, opt := range []WriterOptions{
+		{RecordAlign: 512},
+		{RecordAlign: 4096, Key: key},
+		{RecordAlign: 512, SplitValues: true},
+		{RecordAlign: 4096, Locality: true, PrefixCompress: true},
+	} {
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys[:400], vals[:400])
+		assert(err == nil, "can't add key-vals: %s", err)
+		if opt.Key == nil {
+			for i := 400; i < len(keys); i++ {
+				_, err = wr.AddKeyValReader(keys[i], bytes.NewReader(vals[i]), int64(len(vals[i])))
+				assert(err == nil, "can't stream key %s: %s", keys[i], err)
+			}
+		} else {
+			_, err = wr.AddKeyVals(keys[400:], vals[400:])
+			assert(err == nil, "can't add key-vals: %s", err)
+		}
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		for _, m := range []LoadMode{LoadFile, LoadDirect} {
+			rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, Key: opt.Key})
+			assert(err == nil, "read failed: %s", err)
+
+			a := uint64(opt.RecordAlign)
+			assert(rd.Info().RecordAlign == a, "exp alignment %d, saw %d", a, rd.Info().RecordAlign)
+			for i := range rd.offsets {
+				off := rd.offset(uint64(i))
+				assert(off%a == 0, "record %d at off %d isn't aligned to %d", i, off, a)
+			}
+
+			for i, k := range keys {
+				v, err := rd.Find(k)
+				assert(err == nil, "can't find key %s: %s", k, err)
+				assert(bytes.Equal(v, vals[i]), "key %s: value mismatch", k)
+			}
+
+			err = rd.VerifyAll()
+			assert(err == nil, "verify failed: %s", err)
+			rd.Close()
+		}
+	}
+}
+
+func TestDirectReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/direct%d", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	b := make([]byte, 3*directBlock+100)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	err := ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write file: %s", err)
+
+	fd, err := os.Open(fn)
+	assert(err == nil, "can't open file: %s", err)
+	defer fd.Close()
+
+	d := &directReader{fd}
+	c := &directCursor{ra: d}
+
+	spans := [][2]int{
+		{0, 10}, {5, 90}, {directBlock - 3, 10}, {100, 2 * directBlock},
+		{3 * directBlock, 100}, {0, len(b)}, {0, 20 * directBlock},
+		{len(b) - 10, 20}, {len(b) + 5, 10},
+	}
+	for _, ra := range []io.ReaderAt{d, c, d} {
+		for _, s := range spans {
+			off, n := s[0], s[1]
+
+			p := make([]byte, n)
+			m, err := ra.ReadAt(p, int64(off))
+
+			exp := 0
+			if off < len(b) {
+				exp = copy(make([]byte, n), b[off:])
+				assert(bytes.Equal(p[:m], b[off:off+m]), "%T: read %d at %d: data mismatch", ra, n, off)
+			}
+			assert(m == exp, "%T: read %d at %d: exp %d bytes, saw %d", ra, n, off, exp, m)
+			if m < n {
+				assert(err == io.EOF, "%T: short read %d at %d: %v", ra, n, off, err)
+			} else {
+				assert(err == nil, "%T: read %d at %d: %s", ra, n, off, err)
+			}
+		}
+	}
+
+	x := alignedBuf(100)
+	assert(len(x) == 100, "aligned buffer of %d bytes", len(x))
+	assert(uintptr(unsafe.Pointer(&x[0]))%directBlock == 0, "buffer isn't aligned")
+}
@@ -0,0 +1,218 @@
+// batch.go -- batched lookups in a constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Batches with fewer than this many disk reads per CPU are read serially.
+const minBatchPerCPU = 64
+
+// a key in a batch that has to be read from disk
+type batchRead struct {
+	i   int // index of the key in the batch
+	h   uint64
+	off uint64
+}
+
+// FindMany looks up all the keys in 'keys' and returns their values and
+// errors: vals[i] and errs[i] are the results of Find(keys[i]). The disk
+// reads are sorted by offset so that large batches read the file in one
+// sequential pass; large batches are read concurrently.
+func (rd *DBReader) FindMany(keys [][]byte) ([][]byte, []error) {
+	return rd.findMany(keys, 0)
+}
+
+// FindManyParallel is like FindMany except the disk reads of any batch are
+// done by a pool of 'workers' goroutines (default: the number of CPUs) -
+// so that upto 'workers' reads are in flight at a time. Fast storage (e.g.,
+// NVMe) serves concurrent reads with much higher throughput than serial
+// ones. The workers take the reads in order of their offset; vals[i] and
+// errs[i] are still the results of Find(keys[i]).
+func (rd *DBReader) FindManyParallel(keys [][]byte, workers int) ([][]byte, []error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return rd.findMany(keys, workers)
+}
+
+// lookup 'keys' like FindMany(); if 'workers' is positive, the disk reads
+// are done by a pool of that many goroutines.
+func (rd *DBReader) findMany(keys [][]byte, workers int) ([][]byte, []error) {
+	vals := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	if !rd.enter() {
+		for i := range errs {
+			errs[i] = ErrClosed
+		}
+		return vals, errs
+	}
+	defer rd.leave()
+
+	now := time.Now()
+
+	defer func() {
+		rd.ctr.lookups(uint64(len(keys)), time.Since(now))
+	}()
+
+	// the records read by the batch aren't pooled; but a cached record
+	// may be - and the batch may evict it. So its value is copied.
+	done := func(i int, r *record) {
+		if r.deleted || rd.expired(r, now) {
+			errs[i] = ErrNoKey
+			return
+		}
+		if r.pool != nil {
+			vals[i] = append([]byte(nil), r.val...)
+			return
+		}
+		vals[i] = r.val
+	}
+
+	todo := make([]batchRead, 0, len(keys))
+	for i, k := range keys {
+		h := rd.keyHash(0, rd.normKey(k))
+		if r, ok := rd.cache.Get(h); ok {
+			rd.ctr.add(&rd.ctr.hits, MetricCacheHits, 1)
+			done(i, r)
+			continue
+		}
+
+		rd.ctr.add(&rd.ctr.misses, MetricCacheMisses, 1)
+		if rd.neg != nil && rd.neg.Contains(h) {
+			rd.ctr.add(&rd.ctr.neghits, MetricNegativeHits, 1)
+			errs[i] = ErrNoKey
+			continue
+		}
+
+		if rd.bloom != nil && !rd.bloom.has(h) {
+			rd.ctr.add(&rd.ctr.bloomrej, MetricBloomRejects, 1)
+			errs[i] = ErrNoKey
+			continue
+		}
+
+		j, err := rd.bb.find(h)
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: %w", rd.fn, err)
+			continue
+		}
+		if j == 0 {
+			rd.absent(h)
+			errs[i] = ErrNoKey
+			continue
+		}
+
+		off, ok := rd.slotOffset(j, h)
+		if !ok {
+			rd.absent(h)
+			errs[i] = ErrNoKey
+			continue
+		}
+
+		todo = append(todo, batchRead{i, h, off})
+	}
+
+	sort.Slice(todo, func(i, j int) bool {
+		return todo[i].off < todo[j].off
+	})
+
+	read1 := func(x batchRead) {
+		r, err := rd.decodeRecord(x.off)
+		if err != nil {
+			errs[x.i] = err
+			return
+		}
+
+		if r.hash != x.h {
+			rd.absent(x.h)
+			errs[x.i] = ErrNoKey
+			return
+		}
+		if r.ns != 0 {
+			errs[x.i] = ErrNoKey
+			return
+		}
+		if err = rd.decodeValue(r); err != nil {
+			errs[x.i] = err
+			return
+		}
+
+		rd.cache.Add(x.h, r)
+		done(x.i, r)
+	}
+
+	read := func(todo []batchRead) {
+		for _, x := range todo {
+			read1(x)
+		}
+	}
+
+	if workers > 0 {
+		readPool(todo, workers, read1)
+		return vals, errs
+	}
+
+	ncpu := runtime.NumCPU()
+	if len(todo) < ncpu*minBatchPerCPU {
+		read(todo)
+		return vals, errs
+	}
+
+	// each worker reads a contiguous range of offsets
+	var wg sync.WaitGroup
+
+	z := len(todo) / ncpu
+	wg.Add(ncpu)
+	for i := 0; i < ncpu; i++ {
+		x := z * i
+		y := x + z
+		if i == ncpu-1 {
+			y = len(todo)
+		}
+		go func(todo []batchRead) {
+			read(todo)
+			wg.Done()
+		}(todo[x:y])
+	}
+
+	wg.Wait()
+	return vals, errs
+}
+
+// call 'read' for each of 'todo' from a pool of 'workers' goroutines; each
+// takes the next of 'todo' in order.
+func readPool(todo []batchRead, workers int, read func(x batchRead)) {
+	if workers > len(todo) {
+		workers = len(todo)
+	}
+
+	var wg sync.WaitGroup
+	var next int64 = -1
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				j := atomic.AddInt64(&next, 1)
+				if j >= int64(len(todo)) {
+					return
+				}
+				read(todo[j])
+			}
+		}()
+	}
+	wg.Wait()
+}
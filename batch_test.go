@@ -0,0 +1,109 @@
+// batch_test.go -- test suite for batched lookups
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestFindMany(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	n := 5000
+	keys := make([][]byte, 0, n+1)
+	vals := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+		vals = append(vals, []byte(fmt.Sprintf("val-%d", i)))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 128)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// some of the batch is cached
+	for i := 0; i < 10; i++ {
+		_, err = rd.Find(keys[i])
+		assert(err == nil, "can't find key %s: %s", keys[i], err)
+	}
+
+	keys = append(keys, []byte("missing"))
+	v, errs := rd.FindMany(keys)
+	assert(len(v) == len(keys) && len(errs) == len(keys), "wrong result size")
+
+	for i := 0; i < n; i++ {
+		assert(errs[i] == nil, "key %s: %s", keys[i], errs[i])
+		assert(string(v[i]) == string(vals[i]), "key %s: exp '%s', saw '%s'", keys[i], vals[i], v[i])
+	}
+	assert(errs[n] == ErrNoKey, "found missing key")
+	assert(v[n] == nil, "missing key has a value")
+}
+
+func TestFindManyParallel(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	n := 5000
+	keys := make([][]byte, n)
+	vals := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// every 7th key of the batch is missing
+	var q, exp [][]byte
+	for i := n - 1; i >= 0; i-- {
+		if i%7 == 0 {
+			q = append(q, []byte(fmt.Sprintf("missing-%d", i)))
+			exp = append(exp, nil)
+		}
+		q = append(q, keys[i])
+		exp = append(exp, vals[i])
+	}
+
+	for _, w := range []int{0, 1, 4, 64} {
+		for _, sz := range []int{1, 10, len(q)} {
+			rd, err := NewDBReader(fn, 128)
+			assert(err == nil, "read failed: %s", err)
+
+			v, errs := rd.FindManyParallel(q[:sz], w)
+			assert(len(v) == sz && len(errs) == sz, "%d workers: wrong result size", w)
+
+			for i := range v {
+				if exp[i] == nil {
+					assert(errs[i] == ErrNoKey, "%d workers: found missing key %s", w, q[i])
+					continue
+				}
+				assert(errs[i] == nil, "%d workers: key %s: %s", w, q[i], errs[i])
+				assert(string(v[i]) == string(exp[i]), "%d workers: key %s: exp '%s', saw '%s'", w, q[i], exp[i], v[i])
+			}
+			rd.Close()
+		}
+	}
+}
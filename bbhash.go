@@ -18,12 +18,13 @@ package bbhash
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"os"
 
 	"crypto/rand"
 	"encoding/binary"
 	"sync"
+	"time"
 )
 
 // BBHash represents a computed minimal perfect hash for a given set of keys.
@@ -32,6 +33,71 @@ type BBHash struct {
 	ranks []uint64
 	salt  uint64
 	g     float64 // gamma - rankvector size expansion factor
+
+	// statistics of the construction; see ConstructionStats()
+	stats ConstructionStats
+
+	// fingerprint of the key in each slot; nil if the MPH has none. See
+	// NewWithFingerprints().
+	fps []uint32
+
+	// levels after bits[] that are loaded on first use; nil if all the
+	// levels are in bits[]. See levels.go.
+	lazy *lazyLevels
+}
+
+// ConstructionStats describes the construction of a BBHash; see
+// BBHash.ConstructionStats().
+type ConstructionStats struct {
+	// Number of keys
+	Keys uint64
+
+	// Total number of keys that collided and were redone at the next
+	// level; the sum of the collisions of all the levels.
+	Redo uint64
+
+	// Wall clock time of the construction
+	Time time.Duration
+
+	// Statistics of each level
+	Levels []LevelStats
+}
+
+// LevelStats describes the construction of a level of a BBHash
+type LevelStats struct {
+	// Number of keys hashed at this level; and the size of its
+	// bitvector
+	Keys uint64
+	Bits uint64
+
+	// Number of keys that collided at this level; they are redone at
+	// the next level.
+	Collisions uint64
+
+	// True if the keys were hashed by concurrent goroutines
+	Concurrent bool
+
+	// Wall clock time of the two passes over the keys: detecting the
+	// collisions and assigning the bits of the keys that didn't collide.
+	Preprocess time.Duration
+	Assign     time.Duration
+}
+
+// String returns a human readable description of the stats
+func (s *ConstructionStats) String() string {
+	var b bytes.Buffer
+
+	b.WriteString(fmt.Sprintf("%d keys, %d levels, %d redone; %s\n", s.Keys, len(s.Levels), s.Redo, s.Time))
+	for i := range s.Levels {
+		l := &s.Levels[i]
+		mode := "serial"
+		if l.Concurrent {
+			mode = "concurrent"
+		}
+		b.WriteString(fmt.Sprintf("  %d: %d keys, %d bits, %d collisions; %s: preprocess %s, assign %s\n",
+			i, l.Keys, l.Bits, l.Collisions, mode, l.Preprocess, l.Assign))
+	}
+	return b.String()
 }
 
 // state used by go-routines when we concurrentize the algorithm
@@ -44,7 +110,11 @@ type state struct {
 
 	lvl uint
 
-	bb *BBHash
+	bb  *BBHash
+	log Logger
+
+	// start of the construction
+	start time.Time
 }
 
 // Gamma is an expansion factor for each of the bitvectors we build.
@@ -60,25 +130,31 @@ const MaxLevel uint = 200
 // Minimum number of keys before we use a concurrent algorithm
 const MinParallelKeys int = 20000
 
-// set to true for verbose debug
-const debug bool = false
-
 // New creates a new minimal hash function to represent the keys in 'keys'.
 // This constructor selects a faster concurrent algorithm if the number of
 // keys are greater than 'MinParallelKeys'.
 // Once the construction is complete, callers can use "Find()" to find the
 // unique mapping for each key in 'keys'.
 func New(g float64, keys []uint64) (*BBHash, error) {
+	return newWithSalt(g, rand64(), keys, nil)
+}
+
+// like New() except the hash functions use salt 'salt'; the MPH is a
+// deterministic function of the salt, gamma and the set of keys. The
+// progress of the construction is logged to 'log' if it isn't nil.
+func newWithSalt(g float64, salt uint64, keys []uint64, log Logger) (*BBHash, error) {
 	if g <= 1.0 {
 		g = 2.0
 	}
 	bb := &BBHash{
-		salt: rand64(),
+		salt: salt,
 		g:    g,
 	}
 
 	n := len(keys)
-	s := bb.newState(n)
+	s := bb.newState(n, n)
+	s.log = log
+	logf(log, "bbhash: salt %#x, gamma %4.2f, %d keys, %d bits", salt, g, n, s.A.Size())
 
 	var err error
 
@@ -105,7 +181,7 @@ func NewSerial(g float64, keys []uint64) (*BBHash, error) {
 		salt: rand64(),
 		g:    g,
 	}
-	s := bb.newState(len(keys))
+	s := bb.newState(len(keys), len(keys))
 	err := s.singleThread(keys)
 	if err != nil {
 		return nil, err
@@ -123,7 +199,7 @@ func NewConcurrent(g float64, keys []uint64) (*BBHash, error) {
 		salt: rand64(),
 		g:    g,
 	}
-	s := bb.newState(len(keys))
+	s := bb.newState(len(keys), len(keys))
 	err := s.concurrent(keys)
 	if err != nil {
 		return nil, err
@@ -131,11 +207,27 @@ func NewConcurrent(g float64, keys []uint64) (*BBHash, error) {
 	return bb, nil
 }
 
+// ConstructionStats returns the statistics of the construction of the
+// BBHash - e.g., to tell if a slow build is spent hashing or in a cascade of
+// collisions. A BBHash that was unmarshaled has no statistics.
+func (bb *BBHash) ConstructionStats() ConstructionStats {
+	s := bb.stats
+	s.Levels = append([]LevelStats(nil), s.Levels...)
+	return s
+}
+
 // Find returns a unique integer representing the minimal hash for key 'k'.
 // The return value is meaningful ONLY for keys in the original key set (provided
 // at the time of construction of the minimal-hash).
 // If the key is in the original key-set
 func (bb *BBHash) Find(k uint64) uint64 {
+	i, _ := bb.find(k)
+	return i
+}
+
+// find is like Find except it returns an error if a level that isn't
+// loaded yet can't be.
+func (bb *BBHash) find(k uint64) (uint64, error) {
 	for lvl, bv := range bb.bits {
 		i := hash(k, bb.salt, uint(lvl)) % bv.Size()
 
@@ -144,23 +236,69 @@ func (bb *BBHash) Find(k uint64) uint64 {
 		}
 
 		rank := 1 + bb.ranks[lvl] + bv.Rank(i)
-		return rank
+		return rank, nil
 	}
 
-	return 0
+	if bb.lazy != nil {
+		return bb.lazy.find(k, bb.salt, len(bb.bits))
+	}
+	return 0, nil
 }
 
-// setup state for serial or concurrent execution
-func (bb *BBHash) newState(nkeys int) *state {
+// NewWithFingerprints is like New except a 32-bit fingerprint of each key
+// is stored in its slot: FindChecked() then tells keys that aren't in
+// 'keys' from those that are - except for 1 in 2^32 of them. The
+// fingerprints take 4 bytes per key and are marshaled with the MPH.
+func NewWithFingerprints(g float64, keys []uint64) (*BBHash, error) {
+	bb, err := New(g, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	bb.fps = make([]uint32, len(keys))
+	for _, k := range keys {
+		bb.fps[bb.Find(k)-1] = bb.fingerprint(k)
+	}
+	return bb, nil
+}
+
+// FindChecked is like Find except it returns ErrNoKey for a key that isn't
+// in the original key set - rather than the index of some other key. It
+// needs the fingerprints of the keys (see NewWithFingerprints()); without
+// them, membership is unknowable and it returns ErrNoFingerprints.
+func (bb *BBHash) FindChecked(k uint64) (uint64, error) {
+	if bb.fps == nil {
+		return 0, ErrNoFingerprints
+	}
+
+	i := bb.Find(k)
+	if i == 0 || bb.fps[i-1] != bb.fingerprint(k) {
+		return 0, ErrNoKey
+	}
+	return i, nil
+}
+
+// return the fingerprint of key 'k'; it is independent of the hashes of
+// the levels.
+func (bb *BBHash) fingerprint(k uint64) uint32 {
+	return uint32(hash(k, bb.salt, MaxLevel+1))
+}
+
+// ErrNoFingerprints is returned by BBHash.FindChecked() when the MPH has no
+// fingerprints of its keys.
+var ErrNoFingerprints = errors.New("bbhash: MPH has no fingerprints")
+
+// setup state for serial or concurrent execution of 'nkeys' keys; the
+// list of keys that collide starts with room for 'nredo' keys.
+func (bb *BBHash) newState(nkeys, nredo int) *state {
 	sz := uint(nkeys)
 	s := &state{
-		A:    newbitVector(sz, bb.g),
-		coll: newbitVector(sz, bb.g),
-		redo: make([]uint64, 0, sz),
-		bb:   bb,
+		A:     newbitVector(sz, bb.g),
+		coll:  newbitVector(sz, bb.g),
+		redo:  make([]uint64, 0, nredo),
+		bb:    bb,
+		start: time.Now(),
 	}
-
-	//printf("bbhash: salt %#x, gamma %4.2f %d keys A %d bits", bb.salt, bb.g, nkeys, s.A.Size())
 	return s
 }
 
@@ -169,10 +307,12 @@ func (s *state) singleThread(keys []uint64) error {
 	A := s.A
 
 	for {
-		//printf("lvl %d: %d keys A %d bits", s.lvl, len(keys), A.Size())
+		t0 := time.Now()
 		preprocess(s, keys)
+		t1 := time.Now()
 		A.Reset()
 		assign(s, keys)
+		s.levelDone(len(keys), t0, t1, false)
 
 		keys, A = s.nextLevel()
 		if keys == nil {
@@ -183,19 +323,46 @@ func (s *state) singleThread(keys []uint64) error {
 			return fmt.Errorf("can't find minimal perf hash after %d tries", s.lvl)
 		}
 	}
-	s.bb.preComputeRank()
+	s.finish()
 	return nil
 }
 
+// record the stats of the current level: 'n' keys were preprocessed from
+// 't0' and assigned from 't1' until now. This must be called before
+// nextLevel().
+func (s *state) levelDone(n int, t0, t1 time.Time, concurrent bool) {
+	l := LevelStats{
+		Keys:       uint64(n),
+		Bits:       s.A.Size(),
+		Collisions: uint64(len(s.redo)),
+		Concurrent: concurrent,
+		Preprocess: t1.Sub(t0),
+		Assign:     time.Since(t1),
+	}
+	s.bb.stats.Levels = append(s.bb.stats.Levels, l)
+}
+
+// complete the construction: compute the ranks and the stats
+func (s *state) finish() {
+	s.bb.preComputeRank()
+
+	st := &s.bb.stats
+	st.Time = time.Since(s.start)
+	if len(st.Levels) > 0 {
+		st.Keys = st.Levels[0].Keys
+	}
+	for i := range st.Levels {
+		st.Redo += st.Levels[i].Collisions
+	}
+}
+
 // pre-process to detect colliding bits
 func preprocess(s *state, keys []uint64) {
 	A := s.A
 	coll := s.coll
 	salt := s.bb.salt
 	sz := A.Size()
-	//printf("lvl %d => sz %d", s.lvl, sz)
 	for _, k := range keys {
-		//printf("   key %#x..", k)
 		i := hash(k, salt, s.lvl) % sz
 
 		if coll.IsSet(i) {
@@ -238,7 +405,6 @@ func (s *state) appendRedo(k []uint64) {
 
 	s.Lock()
 	s.redo = append(s.redo, k...)
-	//printf("lvl %d: redo += %d keys", s.lvl, len(k))
 	s.Unlock()
 }
 
@@ -250,12 +416,13 @@ func (s *state) nextLevel() ([]uint64, *bitVector) {
 	s.bb.bits = append(s.bb.bits, s.A)
 	s.A = nil
 
-	//printf("lvl %d: next-step: remaining: %d keys", s.lvl, len(s.redo))
 	keys := s.redo
 	if len(keys) == 0 {
 		return nil, nil
 	}
 
+	logf(s.log, "bbhash: %d keys collided at level %d; bumped to level %d", len(keys), s.lvl, s.lvl+1)
+
 	s.redo = s.redo[:0]
 	s.A = newbitVector(uint(len(keys)), s.bb.g)
 	s.coll.Reset()
@@ -267,11 +434,11 @@ func (s *state) nextLevel() ([]uint64, *bitVector) {
 func (bb BBHash) String() string {
 	var b bytes.Buffer
 
-	b.WriteString(fmt.Sprintf("BBHash: salt %#x; %d levels\n", bb.salt, len(bb.bits)))
+	b.WriteString(fmt.Sprintf("BBHash: salt %#x; %d levels\n", bb.salt, bb.levels()))
 
-	for i, bv := range bb.bits {
-		sz := humansize(bv.Words() * 8)
-		b.WriteString(fmt.Sprintf("  %d: %d bits (%s)\n", i, bv.Size(), sz))
+	for i, bits := range bb.levelBits() {
+		sz := humansize(bits / 8)
+		b.WriteString(fmt.Sprintf("  %d: %d bits (%s)\n", i, bits, sz))
 	}
 
 	return b.String()
@@ -290,6 +457,40 @@ func (bb *BBHash) preComputeRank() {
 	}
 }
 
+// return the number of keys in the MPH
+func (bb *BBHash) keys() uint64 {
+	n := len(bb.bits)
+	if n == 0 {
+		return 0
+	}
+	if bb.lazy != nil {
+		return bb.lazy.nkeys
+	}
+	return bb.ranks[n-1] + bb.bits[n-1].ComputeRank()
+}
+
+// return the number of levels of the MPH
+func (bb *BBHash) levels() int {
+	if bb.lazy != nil {
+		return len(bb.bits) + len(bb.lazy.off)
+	}
+	return len(bb.bits)
+}
+
+// return the number of bits of each level of the MPH
+func (bb *BBHash) levelBits() []uint64 {
+	v := make([]uint64, 0, bb.levels())
+	for _, bv := range bb.bits {
+		v = append(v, bv.Size())
+	}
+	if bb.lazy != nil {
+		for _, w := range bb.lazy.words {
+			v = append(v, 64*w)
+		}
+	}
+	return v
+}
+
 // One round of Zi Long Tan's superfast hash
 func hash(key, salt uint64, lvl uint) uint64 {
 	const m uint64 = 0x880355f21e6d1965
@@ -323,16 +524,29 @@ func rand64() uint64 {
 	return binary.BigEndian.Uint64(b[:])
 }
 
-func printf(f string, v ...interface{}) {
-	if !debug {
-		return
-	}
+// rng is a source of random numbers; a seeded rng yields a reproducible
+// sequence derived from its seed (splitmix64). It is not safe for
+// concurrent use.
+type rng struct {
+	seeded bool
+	state  uint64
+}
+
+// return a rng; if 'seeded' is true, the sequence is derived from 'seed'
+func newRng(seeded bool, seed uint64) *rng {
+	return &rng{seeded: seeded, state: seed}
+}
 
-	s := fmt.Sprintf(f, v...)
-	if n := len(s); s[n-1] != '\n' {
-		s += "\n"
+// return the next random number
+func (r *rng) next() uint64 {
+	if !r.seeded {
+		return rand64()
 	}
 
-	os.Stdout.WriteString(s)
-	os.Stdout.Sync()
+	r.state += 0x9e3779b97f4a7c15
+
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
 }
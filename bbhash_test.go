@@ -112,3 +112,87 @@ func TestBBMarshal(t *testing.T) {
 	}
 
 }
+
+func TestConstructionStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, n := range []int{1000, 2 * MinParallelKeys} {
+		keys := make([]uint64, n)
+		for i := range keys {
+			keys[i] = rand64()
+		}
+
+		b, err := New(2.0, keys)
+		assert(err == nil, "%d: construction failed: %s", n, err)
+
+		st := b.ConstructionStats()
+		assert(st.Keys == uint64(n), "%d: exp %d keys, saw %d", n, n, st.Keys)
+		assert(len(st.Levels) == len(b.bits), "%d: exp %d levels, saw %d", n, len(b.bits), len(st.Levels))
+		assert(st.Time > 0, "%d: no construction time", n)
+		assert(st.Levels[0].Concurrent == (n > MinParallelKeys), "%d: level 0 concurrent %v", n, st.Levels[0].Concurrent)
+
+		// the keys that collide at a level are the keys of the next
+		var redo uint64
+		for i, l := range st.Levels {
+			assert(l.Bits == b.bits[i].Size(), "%d: level %d: exp %d bits, saw %d", n, i, b.bits[i].Size(), l.Bits)
+			if i+1 < len(st.Levels) {
+				assert(l.Collisions == st.Levels[i+1].Keys, "%d: level %d: %d collisions, %d keys at next level",
+					n, i, l.Collisions, st.Levels[i+1].Keys)
+			} else {
+				assert(l.Collisions == 0, "%d: last level has %d collisions", n, l.Collisions)
+			}
+			redo += l.Collisions
+		}
+		assert(st.Redo == redo, "%d: exp %d redone, saw %d", n, redo, st.Redo)
+
+		// the stats are a copy
+		st.Levels[0].Keys = 0
+		assert(b.ConstructionStats().Levels[0].Keys == uint64(n), "%d: stats not copied", n)
+	}
+}
+
+func TestFindChecked(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([]uint64, 10000)
+	seen := make(map[uint64]bool)
+	for i := range keys {
+		keys[i] = rand64()
+		seen[keys[i]] = true
+	}
+
+	b, err := New(2.0, keys)
+	assert(err == nil, "construction failed: %s", err)
+
+	_, err = b.FindChecked(keys[0])
+	assert(err == ErrNoFingerprints, "no fingerprints: %v", err)
+
+	b, err = NewWithFingerprints(2.0, keys)
+	assert(err == nil, "construction failed: %s", err)
+
+	var buf bytes.Buffer
+	err = b.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+	assert(uint64(buf.Len()) == b.MarshalBinarySize(), "marshal size: exp %d, saw %d", b.MarshalBinarySize(), buf.Len())
+
+	b2, err := UnmarshalBBHash(&buf)
+	assert(err == nil, "unmarshal failed: %s", err)
+
+	for _, bb := range []*BBHash{b, b2} {
+		for i, k := range keys {
+			j, err := bb.FindChecked(k)
+			assert(err == nil, "key %d <%#x>: %s", i, k, err)
+			assert(j == bb.Find(k), "key %d <%#x>: exp %d, saw %d", i, k, bb.Find(k), j)
+		}
+
+		// a false positive is a 1 in 2^32 event
+		for i := 0; i < 100000; i++ {
+			k := rand64()
+			if seen[k] {
+				continue
+			}
+			_, err := bb.FindChecked(k)
+			assert(err == ErrNoKey, "absent key <%#x>: %v", k, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// bloom.go -- Bloom filter of the keys of a DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// A DB built with WriterOptions.BloomBits has a Bloom filter over the
+// hashes of its keys in the section 'secBloom'. Readers consult it before
+// the MPH: most keys that aren't in the DB are rejected without reading a
+// record. The section is:
+//   - k      uint32    number of probes per key
+//   - resv   uint32
+//   - words  []uint64  the bits of the filter
+//
+// All integers are big-endian.
+
+// max number of probes per key
+const maxBloomProbes = 16
+
+type bloomFilter struct {
+	k uint32
+	v []uint64
+}
+
+// make a filter of 'bitsPerKey' bits for each of the key hashes in 'keys'
+func newBloomFilter(keys []uint64, bitsPerKey int) *bloomFilter {
+	m := (uint64(len(keys))*uint64(bitsPerKey) + 63) / 64
+	if m == 0 {
+		m = 1
+	}
+
+	// the optimal number of probes is ln(2) * bits per key
+	k := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > maxBloomProbes {
+		k = maxBloomProbes
+	}
+
+	f := &bloomFilter{
+		k: k,
+		v: make([]uint64, m),
+	}
+	for _, h := range keys {
+		f.add(h)
+	}
+	return f
+}
+
+// the probes of a key hash are h, h+d, h+2d, .. modulo the size of the
+// filter (double hashing).
+func (f *bloomFilter) add(h uint64) {
+	m := uint64(len(f.v)) * 64
+	d := bits.RotateLeft64(h, 32) | 1
+	for i := uint32(0); i < f.k; i++ {
+		j := h % m
+		f.v[j/64] |= 1 << (j % 64)
+		h += d
+	}
+}
+
+// return false if the key hash 'h' is definitely not in the filter
+func (f *bloomFilter) has(h uint64) bool {
+	m := uint64(len(f.v)) * 64
+	d := bits.RotateLeft64(h, 32) | 1
+	for i := uint32(0); i < f.k; i++ {
+		j := h % m
+		if (f.v[j/64] & (1 << (j % 64))) == 0 {
+			return false
+		}
+		h += d
+	}
+	return true
+}
+
+// encode the filter for the section 'secBloom'
+func (f *bloomFilter) marshal() []byte {
+	be := binary.BigEndian
+	b := make([]byte, 8+8*len(f.v))
+	be.PutUint32(b[:4], f.k)
+	for i, w := range f.v {
+		be.PutUint64(b[8+8*i:], w)
+	}
+	return b
+}
+
+// decode the section 'secBloom'
+func unmarshalBloomFilter(b []byte) (*bloomFilter, error) {
+	if len(b) < 16 || len(b)%8 != 0 {
+		return nil, fmt.Errorf("%w: bad bloom filter", ErrCorrupt)
+	}
+
+	be := binary.BigEndian
+	f := &bloomFilter{
+		k: be.Uint32(b[:4]),
+		v: make([]uint64, (len(b)-8)/8),
+	}
+	if f.k < 1 || f.k > maxBloomProbes {
+		return nil, fmt.Errorf("%w: bloom filter with %d probes", ErrCorrupt, f.k)
+	}
+
+	for i := range f.v {
+		f.v[i] = be.Uint64(b[8+8*i:])
+	}
+	return f, nil
+}
@@ -0,0 +1,89 @@
+// bloom_test.go -- test suite for the Bloom filter of a DB
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([]uint64, 10000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	f := newBloomFilter(keys, 10)
+	assert(f.k == 7, "exp 7 probes, saw %d", f.k)
+	for _, h := range keys {
+		assert(f.has(h), "key %#x not in filter", h)
+	}
+
+	var fp int
+	for i := 0; i < 100000; i++ {
+		if f.has(rand64()) {
+			fp++
+		}
+	}
+	assert(fp < 2000, "too many false positives: %d", fp)
+
+	g, err := unmarshalBloomFilter(f.marshal())
+	assert(err == nil, "can't unmarshal: %s", err)
+	assert(g.k == f.k && len(g.v) == len(f.v), "unmarshal mismatch")
+	for i := range f.v {
+		assert(f.v[i] == g.v[i], "word %d mismatch", i)
+	}
+
+	_, err = unmarshalBloomFilter(make([]byte, 16))
+	assert(err != nil, "unmarshaled filter with no probes")
+}
+
+func TestBloomDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	_, err := NewDBWriterWithOptions(fn, WriterOptions{BloomBits: -1})
+	assert(err != nil, "created db with negative bloom bits")
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{BloomBits: 10})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.bloom != nil, "db has no bloom filter")
+	for _, k := range keys {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+
+	rd.ResetStats()
+	for i := 0; i < 10000; i++ {
+		_, err = rd.Find([]byte(fmt.Sprintf("missing-%d", i)))
+		assert(err == ErrNoKey, "missing key: exp ErrNoKey, saw %v", err)
+	}
+
+	_, errs := rd.FindMany([][]byte{[]byte("missing"), keys[0]})
+	assert(errs[0] == ErrNoKey && errs[1] == nil, "find many: %v", errs)
+
+	st := rd.Stats()
+	assert(st.BloomRejects > 9500, "exp most missing keys rejected, saw %d", st.BloomRejects)
+	assert(st.Reads < 500, "too many reads for missing keys: %d", st.Reads)
+}
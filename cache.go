@@ -0,0 +1,130 @@
+// cache.go -- caches of decoded records
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"container/list"
+	"sync"
+)
+
+// recordCache holds decoded records indexed by the hash of their key. It is
+// safe for concurrent use.
+type recordCache interface {
+	Get(h uint64) (*record, bool)
+	Add(h uint64, r *record)
+	Len() int
+	Purge()
+
+	// hashes of the cached records; the least recently used first where
+	// the cache tracks recency.
+	Keys() []uint64
+
+	// true if the records the cache evicts are released; see
+	// record.release().
+	releases() bool
+}
+
+// LRU cache bounded by the total size of the cached keys and values
+type byteCache struct {
+	sync.Mutex
+
+	max  int64
+	size int64
+
+	ll *list.List
+	m  map[uint64]*list.Element
+}
+
+// an entry in the byteCache LRU list
+type byteEntry struct {
+	h uint64
+	r *record
+}
+
+func newByteCache(max int64) *byteCache {
+	return &byteCache{
+		max: max,
+		ll:  list.New(),
+		m:   make(map[uint64]*list.Element),
+	}
+}
+
+// size of record 'r' for the purpose of caching
+func recordSize(r *record) int64 {
+	return int64(len(r.key) + len(r.val))
+}
+
+func (c *byteCache) Get(h uint64) (*record, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.m[h]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*byteEntry).r, true
+	}
+	return nil, false
+}
+
+// add 'r' and evict the least recently used records until the cache is
+// within its bounds; records larger than the cache aren't cached.
+func (c *byteCache) Add(h uint64, r *record) {
+	z := recordSize(r)
+	if z > c.max {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.m[h]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.m[h] = c.ll.PushFront(&byteEntry{h, r})
+	c.size += z
+
+	for c.size > c.max {
+		e := c.ll.Back()
+		x := e.Value.(*byteEntry)
+		c.ll.Remove(e)
+		delete(c.m, x.h)
+		c.size -= recordSize(x.r)
+		x.r.release()
+	}
+}
+
+func (c *byteCache) releases() bool { return true }
+
+func (c *byteCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *byteCache) Keys() []uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	k := make([]uint64, 0, c.ll.Len())
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		k = append(k, e.Value.(*byteEntry).h)
+	}
+	return k
+}
+
+func (c *byteCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ll.Init()
+	c.m = make(map[uint64]*list.Element)
+	c.size = 0
+}
@@ -0,0 +1,51 @@
+// cache_arc.go -- ARC cache of decoded records
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !bbhash_stdlib
+
+package bbhash
+
+import (
+	"github.com/opencoff/golang-lru"
+)
+
+// ARC cache bounded by the number of records
+type arcCache struct {
+	c *lru.ARCCache
+}
+
+func newARCCache(n int) (*arcCache, error) {
+	c, err := lru.NewARC(n)
+	if err != nil {
+		return nil, err
+	}
+	return &arcCache{c}, nil
+}
+
+func (a *arcCache) Get(h uint64) (*record, bool) {
+	if v, ok := a.c.Get(h); ok {
+		return v.(*record), true
+	}
+	return nil, false
+}
+
+func (a *arcCache) Add(h uint64, r *record) { a.c.Add(h, r) }
+func (a *arcCache) Len() int                { return a.c.Len() }
+func (a *arcCache) Purge()                  { a.c.Purge() }
+
+// the ARC cache doesn't report the records it evicts
+func (a *arcCache) releases() bool { return false }
+
+func (a *arcCache) Keys() []uint64 {
+	v := a.c.Keys()
+	k := make([]uint64, len(v))
+	for i := range v {
+		k[i] = v[i].(uint64)
+	}
+	return k
+}
@@ -0,0 +1,285 @@
+// cache_policy.go -- selectable policies of the record cache
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// CachePolicy selects how the record cache of a DBReader evicts records;
+// see ReaderOptions.CachePolicy and DBReader.SetCachePolicy().
+type CachePolicy int
+
+const (
+	// Adaptive replacement cache (the default); it balances recency and
+	// frequency. A bbhash_stdlib build uses CacheLRU instead.
+	CacheARC CachePolicy = iota
+
+	// Least recently used records are evicted first
+	CacheLRU
+
+	// Like CacheLRU except the cache is split into independently locked
+	// shards by the hash of the key; lookups from many goroutines don't
+	// contend on one lock.
+	CacheShardedLRU
+
+	// CLOCK (second chance): a record that isn't looked up again before
+	// the clock hand comes around is evicted; so records that are read
+	// once - e.g., by a scan - are evicted before the records that are
+	// read often. Cache hits only set a bit under a shared lock; lookups
+	// of cached records from many goroutines don't serialize.
+	CacheClock
+)
+
+var cachePolicyNames = map[CachePolicy]string{
+	CacheARC:        "arc",
+	CacheLRU:        "lru",
+	CacheShardedLRU: "sharded-lru",
+	CacheClock:      "clock",
+}
+
+// String returns the name of the cache policy
+func (p CachePolicy) String() string {
+	if s, ok := cachePolicyNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("CachePolicy(%d)", int(p))
+}
+
+// SetCachePolicy replaces the record cache with a cache of upto 'n' records
+// (default 128) that evicts them by policy 'p'. This must be called before
+// the DB is queried.
+func (rd *DBReader) SetCachePolicy(p CachePolicy, n int) error {
+	if n <= 0 {
+		n = 128
+	}
+
+	c, err := newRecordCache(p, n)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rd.fn, err)
+	}
+	rd.cache = c
+	return nil
+}
+
+// make a record cache of 'n' records with policy 'p'
+func newRecordCache(p CachePolicy, n int) (recordCache, error) {
+	switch p {
+	case CacheARC:
+		return newARCCache(n)
+	case CacheLRU:
+		return newRecordLRU(n)
+	case CacheShardedLRU:
+		return newShardedCache(n)
+	case CacheClock:
+		return newClockCache(n)
+	}
+	return nil, fmt.Errorf("unknown cache policy %d", int(p))
+}
+
+// make an LRU cache of 'n' records that releases the records it evicts
+func newRecordLRU(n int) (*lruCache[*record], error) {
+	c, err := newLRUCache[*record](n)
+	if err != nil {
+		return nil, err
+	}
+	c.evict = (*record).release
+	return c, nil
+}
+
+// LRU cache split into shards by the hash of the key
+type shardedCache struct {
+	shards []*lruCache[*record]
+	mask   uint64
+}
+
+// smallest number of records in a shard
+const minShardSize = 16
+
+func newShardedCache(n int) (*shardedCache, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("bbhash: invalid cache size %d", n)
+	}
+
+	// a power of 2 shards - a few per CPU - of at least minShardSize
+	// records each.
+	ns := 1
+	for ns < 4*runtime.GOMAXPROCS(0) && n/(2*ns) >= minShardSize {
+		ns *= 2
+	}
+
+	c := &shardedCache{
+		shards: make([]*lruCache[*record], ns),
+		mask:   uint64(ns - 1),
+	}
+
+	// the first n%ns shards hold one more record
+	for i := range c.shards {
+		m := n / ns
+		if i < n%ns {
+			m++
+		}
+		s, err := newRecordLRU(m)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = s
+	}
+	return c, nil
+}
+
+// the shard of hash 'h'; the high bits are mixed in so that hashes that
+// differ only in their high bits are spread too.
+func (c *shardedCache) shard(h uint64) *lruCache[*record] {
+	return c.shards[(h^(h>>32))&c.mask]
+}
+
+func (c *shardedCache) Get(h uint64) (*record, bool) { return c.shard(h).Get(h) }
+func (c *shardedCache) Add(h uint64, r *record)      { c.shard(h).Add(h, r) }
+
+func (c *shardedCache) Len() int {
+	var n int
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// the hashes of each shard are in order of recency; the shards aren't
+func (c *shardedCache) Keys() []uint64 {
+	var k []uint64
+	for _, s := range c.shards {
+		k = append(k, s.Keys()...)
+	}
+	return k
+}
+
+func (c *shardedCache) releases() bool { return true }
+
+func (c *shardedCache) Purge() {
+	for _, s := range c.shards {
+		s.Purge()
+	}
+}
+
+// CLOCK cache: the records are in a ring of slots swept by the clock hand.
+// A hit sets the reference bit of the slot; the hand clears the bits it
+// passes and evicts the first record whose bit is clear.
+type clockCache struct {
+	sync.RWMutex
+
+	max   int
+	hand  int
+	slots []clockSlot
+	m     map[uint64]int
+}
+
+type clockSlot struct {
+	h   uint64
+	r   *record
+	ref uint32
+}
+
+func newClockCache(n int) (*clockCache, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("bbhash: invalid cache size %d", n)
+	}
+
+	c := &clockCache{
+		max: n,
+		m:   make(map[uint64]int),
+	}
+	return c, nil
+}
+
+func (c *clockCache) Get(h uint64) (*record, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	i, ok := c.m[h]
+	if !ok {
+		return nil, false
+	}
+
+	s := &c.slots[i]
+	if atomic.LoadUint32(&s.ref) == 0 {
+		atomic.StoreUint32(&s.ref, 1)
+	}
+	return s.r, true
+}
+
+// add 'r' to a free slot; or to the slot of the first unreferenced record
+// after the hand. New records start unreferenced - so they are evicted
+// first unless they are looked up again.
+func (c *clockCache) Add(h uint64, r *record) {
+	c.Lock()
+	defer c.Unlock()
+
+	if i, ok := c.m[h]; ok {
+		c.slots[i].r = r
+		c.slots[i].ref = 1
+		return
+	}
+
+	if len(c.slots) < c.max {
+		c.m[h] = len(c.slots)
+		c.slots = append(c.slots, clockSlot{h: h, r: r})
+		return
+	}
+
+	for c.slots[c.hand].ref != 0 {
+		c.slots[c.hand].ref = 0
+		c.hand = (c.hand + 1) % len(c.slots)
+	}
+
+	s := &c.slots[c.hand]
+	delete(c.m, s.h)
+	s.r.release()
+	*s = clockSlot{h: h, r: r}
+	c.m[h] = c.hand
+	c.hand = (c.hand + 1) % len(c.slots)
+}
+
+func (c *clockCache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.slots)
+}
+
+// the hashes of unreferenced records are before the referenced ones
+func (c *clockCache) Keys() []uint64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	k := make([]uint64, 0, len(c.slots))
+	for _, ref := range []uint32{0, 1} {
+		for i := range c.slots {
+			s := &c.slots[i]
+			if atomic.LoadUint32(&s.ref) == ref {
+				k = append(k, s.h)
+			}
+		}
+	}
+	return k
+}
+
+func (c *clockCache) releases() bool { return true }
+
+func (c *clockCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.slots = nil
+	c.m = make(map[uint64]int)
+	c.hand = 0
+}
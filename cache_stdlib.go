@@ -0,0 +1,25 @@
+// cache_stdlib.go -- record cache of a bbhash_stdlib build
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build bbhash_stdlib
+
+package bbhash
+
+// A bbhash_stdlib build has no ARC cache; the record cache is an LRU
+// bounded by the number of records.
+type arcCache struct {
+	*lruCache[*record]
+}
+
+func newARCCache(n int) (*arcCache, error) {
+	c, err := newRecordLRU(n)
+	if err != nil {
+		return nil, err
+	}
+	return &arcCache{c}, nil
+}
@@ -0,0 +1,364 @@
+// cache_test.go -- test suite for the record caches
+
+package bbhash
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestByteCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	c := newByteCache(100)
+	for i := 0; i < 10; i++ {
+		r := &record{
+			key: []byte(fmt.Sprintf("k%d", i)),
+			val: make([]byte, 18),
+		}
+		c.Add(uint64(i), r)
+	}
+
+	// each record is 20 bytes; the 5 most recent fit
+	assert(c.Len() == 5, "exp 5 records, saw %d", c.Len())
+	assert(c.size == 100, "exp 100 bytes, saw %d", c.size)
+
+	_, ok := c.Get(4)
+	assert(!ok, "evicted record in cache")
+
+	// touch the oldest; the next oldest is evicted next
+	_, ok = c.Get(5)
+	assert(ok, "record 5 not in cache")
+	c.Add(10, &record{key: []byte("k10"), val: make([]byte, 17)})
+	_, ok = c.Get(5)
+	assert(ok, "recently used record evicted")
+	_, ok = c.Get(6)
+	assert(!ok, "least recently used record not evicted")
+
+	c.Add(11, &record{key: []byte("big"), val: make([]byte, 100)})
+	_, ok = c.Get(11)
+	assert(!ok, "oversized record cached")
+
+	c.Purge()
+	assert(c.Len() == 0 && c.size == 0, "purge failed")
+}
+
+func TestCachePolicy(t *testing.T) {
+	assert := newAsserter(t)
+
+	policies := []CachePolicy{CacheARC, CacheLRU, CacheShardedLRU, CacheClock}
+	for _, p := range policies {
+		_, err := newRecordCache(p, 0)
+		assert(err != nil, "%s: created an empty cache", p)
+
+		c, err := newRecordCache(p, 100)
+		assert(err == nil, "%s: can't create cache: %s", p, err)
+
+		for i := 0; i < 1000; i++ {
+			c.Add(uint64(i), &record{key: []byte(fmt.Sprintf("k%d", i))})
+		}
+		assert(c.Len() <= 100 && c.Len() > 50, "%s: exp upto 100 records, saw %d", p, c.Len())
+
+		r, ok := c.Get(999)
+		assert(ok && string(r.key) == "k999", "%s: latest record not in cache", p)
+		_, ok = c.Get(0)
+		assert(!ok, "%s: oldest record in cache", p)
+
+		c.Purge()
+		assert(c.Len() == 0, "%s: purge failed", p)
+	}
+
+	_, err := newRecordCache(CachePolicy(99), 100)
+	assert(err != nil, "created a cache with an unknown policy")
+	assert(CacheShardedLRU.String() == "sharded-lru", "policy name %s", CacheShardedLRU)
+
+	// a scan doesn't evict records that are looked up again in every
+	// sweep of the clock hand
+	c, err := newClockCache(100)
+	assert(err == nil, "can't create cache: %s", err)
+	for i := 0; i < 50; i++ {
+		c.Add(uint64(i), &record{})
+	}
+	for i := 1000; i < 2000; i++ {
+		if i%25 == 0 {
+			for j := 0; j < 50; j++ {
+				c.Get(uint64(j))
+			}
+		}
+		c.Add(uint64(i), &record{})
+	}
+	for i := 0; i < 50; i++ {
+		_, ok := c.Get(uint64(i))
+		assert(ok, "clock: hot record %d evicted by a scan", i)
+	}
+	assert(c.Len() == 100, "clock: exp 100 records, saw %d", c.Len())
+
+	// lookups through each policy
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 200)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, p := range policies {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Cache: 1000, CachePolicy: p})
+		assert(err == nil, "%s: read failed: %s", p, err)
+
+		for i := 0; i < 2; i++ {
+			for _, k := range keys {
+				v, err := rd.Find(k)
+				assert(err == nil && string(v) == string(k), "%s: can't find key %s: %v", p, k, err)
+			}
+		}
+
+		st := rd.Stats()
+		assert(st.CacheHits == uint64(len(keys)), "%s: exp %d hits, saw %d", p, len(keys), st.CacheHits)
+		rd.Close()
+	}
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{CachePolicy: CachePolicy(99)})
+	assert(err != nil, "opened a db with an unknown cache policy")
+}
+
+func BenchmarkCache(b *testing.B) {
+	const n = 4096
+
+	// records of 4x the cache; a quarter of the lookups are of a hot set
+	// and the rest are a scan over all of them.
+	recs := make([]*record, 4*n)
+	for i := range recs {
+		recs[i] = &record{key: []byte(fmt.Sprintf("key-%d", i))}
+	}
+
+	for _, p := range []CachePolicy{CacheARC, CacheLRU, CacheShardedLRU, CacheClock} {
+		b.Run(p.String(), func(b *testing.B) {
+			c, err := newRecordCache(p, n)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var hits, misses uint64
+			b.RunParallel(func(pb *testing.PB) {
+				var h, m uint64
+				i := rand64()
+				for pb.Next() {
+					i++
+					j := i % uint64(len(recs))
+					if i%4 == 0 {
+						j = (i * 0x9e3779b97f4a7c15) % (n / 2)
+					}
+					if _, ok := c.Get(j); ok {
+						h++
+						continue
+					}
+					m++
+					c.Add(j, recs[j])
+				}
+				atomic.AddUint64(&hits, h)
+				atomic.AddUint64(&misses, m)
+			})
+			b.ReportMetric(float64(hits)/float64(hits+misses), "hit-ratio")
+		})
+	}
+}
+
+func TestCacheBytes(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%03d", i))
+		vals[i] = make([]byte, 1000)
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 1000)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	rd.SetCacheBytes(10 * 1024)
+	for _, k := range keys {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+
+	assert(rd.cache.Len() == 10, "exp 10 cached records, saw %d", rd.cache.Len())
+}
+
+// a ReaderAt that always fails
+type badReader struct{}
+
+func (b badReader) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk read")
+}
+
+func TestNegativeCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	err = rd.SetNegativeCache(1000)
+	assert(err == nil, "can't enable negative cache: %s", err)
+
+	missing := make([][]byte, 500)
+	for i := range missing {
+		missing[i] = []byte(fmt.Sprintf("missing-%d", i))
+		_, err = rd.Find(missing[i])
+		assert(err == ErrNoKey, "found missing key %s", missing[i])
+	}
+	assert(rd.neg.Len() == len(missing), "exp %d absent keys, saw %d", len(missing), rd.neg.Len())
+
+	// absent keys are answered without reading the disk
+	ra := rd.ra
+	rd.ra = badReader{}
+	for _, k := range missing {
+		_, err = rd.Find(k)
+		assert(err == ErrNoKey, "key %s: exp ErrNoKey, saw %v", k, err)
+	}
+
+	_, errs := rd.FindMany(missing)
+	for i, err := range errs {
+		assert(err == ErrNoKey, "key %s: exp ErrNoKey, saw %v", missing[i], err)
+	}
+	rd.ra = ra
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil && string(v) == string(vals[i]), "can't find key %s: %v", k, err)
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := [][]byte{[]byte("k1"), []byte("k2"), []byte("k3")}
+	vals := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3")}
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	st := rd.Stats()
+	assert(st.Lookups == 0 && st.Reads == 0, "stats not zero after open: %s", st.String())
+
+	for _, k := range keys {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+	_, err = rd.Find(keys[0])
+	assert(err == nil, "can't find key %s: %s", keys[0], err)
+
+	st = rd.Stats()
+	assert(st.Lookups == 4, "exp 4 lookups, saw %d", st.Lookups)
+	assert(st.CacheHits == 1 && st.CacheMisses == 3, "exp 1 hit, 3 misses; saw %d, %d", st.CacheHits, st.CacheMisses)
+	assert(st.Reads >= 3 && st.BytesRead > 0, "exp at least 3 reads, saw %d", st.Reads)
+	assert(st.ChecksumFailures == 0, "exp no checksum failures, saw %d", st.ChecksumFailures)
+	assert(st.Latency > 0, "no latency")
+
+	rd.ResetStats()
+	st = rd.Stats()
+	assert(st.Lookups == 0 && st.CacheHits == 0 && st.Reads == 0, "stats not reset: %s", st.String())
+}
+
+func TestWarm(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReaderMmap(fn, 1000)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	err = rd.Warm(append(keys[:10:10], []byte("missing")))
+	assert(err == nil, "warm failed: %s", err)
+	assert(rd.cache.Len() == 10, "exp 10 cached records, saw %d", rd.cache.Len())
+
+	rd.ResetStats()
+	for _, k := range keys[:10] {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+	st := rd.Stats()
+	assert(st.CacheHits == 10 && st.CacheMisses == 0, "exp 10 hits, saw %d hits %d misses", st.CacheHits, st.CacheMisses)
+
+	// the first 10 records have 10 bytes of key and value
+	rd.cache.Purge()
+	err = rd.WarmAll(100)
+	assert(err == nil, "warm all failed: %s", err)
+	assert(rd.cache.Len() == 10, "exp 10 cached records, saw %d", rd.cache.Len())
+
+	err = rd.WarmAll(0)
+	assert(err == nil, "warm all failed: %s", err)
+	assert(rd.cache.Len() == len(keys), "exp %d cached records, saw %d", len(keys), rd.cache.Len())
+}
@@ -0,0 +1,156 @@
+// cachestate.go -- save and restore the contents of the record cache
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The cache state saved by SaveCacheState() is:
+//   - magic    [4]byte   "BBCS"
+//   - version  uint32    1
+//   - csum     [32]byte  strong checksum of the DB
+//   - n        uint64    number of hashes
+//   - hashes   [n]uint64 hashes of the cached keys; least recently used first
+//   - sum      [32]byte  SHA512-256 of the preceding bytes
+//
+// The hashes are salted by the DB; so the state can only be loaded into a
+// reader of the same DB.
+
+const cacheStateVersion = 1
+
+var cacheStateMagic = []byte("BBCS")
+
+// ErrCacheState is returned when a saved cache state is corrupt or is of a
+// different DB.
+var ErrCacheState = errors.New("invalid cache state")
+
+// SaveCacheState writes the hashes of the keys in the record cache to 'w';
+// a restarted service can read the same records into its cache with
+// LoadCacheState() - rather than waiting for the lookups of its hot keys
+// to fill the cache. Only the hashes are saved; not the keys or values.
+func (rd *DBReader) SaveCacheState(w io.Writer) error {
+	if rd.isClosed() {
+		return ErrClosed
+	}
+
+	hashes := rd.cache.Keys()
+
+	var b bytes.Buffer
+	var x [8]byte
+
+	be := binary.BigEndian
+
+	b.Write(cacheStateMagic)
+	be.PutUint32(x[:4], cacheStateVersion)
+	b.Write(x[:4])
+	b.Write(rd.csum[:])
+	be.PutUint64(x[:], uint64(len(hashes)))
+	b.Write(x[:])
+
+	for _, h := range hashes {
+		be.PutUint64(x[:], h)
+		b.Write(x[:])
+	}
+
+	sum := sha512.Sum512_256(b.Bytes())
+	b.Write(sum[:])
+
+	n, err := w.Write(b.Bytes())
+	if err != nil {
+		return err
+	}
+	if n != b.Len() {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// LoadCacheState reads the records whose hashes were saved by
+// SaveCacheState() into the record cache. Hashes of keys that are no
+// longer in the DB are skipped; if the state holds more records than the
+// cache, the most recently used ones are kept. It returns an error
+// matching ErrCacheState if the state is corrupt or was saved by a reader
+// of another DB. The reads are counted in Stats().
+func (rd *DBReader) LoadCacheState(r io.Reader) error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	defer rd.leave()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// magic, version, csum, n and the trailing checksum
+	const minSize = 4 + 4 + 32 + 8 + 32
+
+	if len(b) < minSize || !bytes.Equal(b[:4], cacheStateMagic) {
+		return fmt.Errorf("%s: %w: bad header", rd.fn, ErrCacheState)
+	}
+
+	be := binary.BigEndian
+	if v := be.Uint32(b[4:8]); v != cacheStateVersion {
+		return fmt.Errorf("%s: %w: unsupported version %d", rd.fn, ErrCacheState, v)
+	}
+
+	body, sum := b[:len(b)-32], b[len(b)-32:]
+	if csum := sha512.Sum512_256(body); !bytes.Equal(csum[:], sum) {
+		return fmt.Errorf("%s: %w: checksum mismatch", rd.fn, ErrCacheState)
+	}
+	if !bytes.Equal(body[8:40], rd.csum[:]) {
+		return fmt.Errorf("%s: %w: saved by a reader of another DB", rd.fn, ErrCacheState)
+	}
+
+	n := be.Uint64(body[40:48])
+	hashes := body[48:]
+	if uint64(len(hashes)) != n*8 {
+		return fmt.Errorf("%s: %w: exp %d hashes, saw %d bytes", rd.fn, ErrCacheState, n, len(hashes))
+	}
+
+	for i := 0; i < len(hashes); i += 8 {
+		if err := rd.cacheHash(be.Uint64(hashes[i : i+8])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read the record whose key has hash 'h' into the cache; it is not an
+// error if there isn't one.
+func (rd *DBReader) cacheHash(h uint64) error {
+	i, err := rd.bb.find(h)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rd.fn, err)
+	}
+	if i == 0 {
+		return nil
+	}
+
+	off, ok := rd.slotOffset(i, h)
+	if !ok {
+		return nil
+	}
+
+	r, err := rd.decodeRecordFrom(rd.ra, off, nil)
+	if err != nil {
+		return err
+	}
+
+	if r.hash == h {
+		rd.cache.Add(h, r)
+	}
+	return nil
+}
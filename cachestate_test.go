@@ -0,0 +1,84 @@
+// cachestate_test.go -- test suite for saving the cache state
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestCacheState(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	otherfn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+	defer os.Remove(otherfn)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	for _, f := range []string{fn, otherfn} {
+		wr, err := NewDBWriter(f)
+		assert(err == nil, "can't create db: %s", err)
+		_, err = wr.AddKeyVals(keys, keys)
+		assert(err == nil, "can't add key-vals: %s", err)
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+	}
+
+	for _, p := range []CachePolicy{CacheARC, CacheLRU, CacheShardedLRU, CacheClock} {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Cache: 100, CachePolicy: p})
+		assert(err == nil, "%s: read failed: %s", p, err)
+
+		// the hot keys are the last ones looked up
+		for _, k := range keys[:200] {
+			_, err = rd.Find(k)
+			assert(err == nil, "%s: can't find key %s: %s", p, k, err)
+		}
+
+		var b bytes.Buffer
+		err = rd.SaveCacheState(&b)
+		assert(err == nil, "%s: save failed: %s", p, err)
+		state := b.Bytes()
+		rd.Close()
+
+		// a restarted reader
+		rd, err = NewDBReaderWithOptions(fn, ReaderOptions{Cache: 100, CachePolicy: p})
+		assert(err == nil, "%s: read failed: %s", p, err)
+
+		err = rd.LoadCacheState(bytes.NewReader(state))
+		assert(err == nil, "%s: load failed: %s", p, err)
+		assert(rd.cache.Len() > 50, "%s: exp upto 100 cached records, saw %d", p, rd.cache.Len())
+
+		rd.ResetStats()
+		for _, k := range keys[190:200] {
+			v, err := rd.Find(k)
+			assert(err == nil && bytes.Equal(v, k), "%s: can't find key %s: %v", p, k, err)
+		}
+		st := rd.Stats()
+		assert(st.CacheHits == 10, "%s: exp 10 hits, saw %d", p, st.CacheHits)
+
+		// a corrupt state
+		bad := append([]byte{}, state...)
+		bad[len(bad)/2] ^= 0x1
+		err = rd.LoadCacheState(bytes.NewReader(bad))
+		assert(errors.Is(err, ErrCacheState), "%s: loaded a corrupt state: %v", p, err)
+		err = rd.LoadCacheState(bytes.NewReader(state[:20]))
+		assert(errors.Is(err, ErrCacheState), "%s: loaded a truncated state: %v", p, err)
+		rd.Close()
+
+		// the state of another DB
+		rd, err = NewDBReader(otherfn, 100)
+		assert(err == nil, "%s: read failed: %s", p, err)
+		err = rd.LoadCacheState(bytes.NewReader(state))
+		assert(errors.Is(err, ErrCacheState), "%s: loaded the state of another db: %v", p, err)
+		assert(rd.cache.Len() == 0, "%s: cached records of another db", p)
+		rd.Close()
+	}
+}
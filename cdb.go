@@ -0,0 +1,249 @@
+// cdb.go -- import records from and export records to cdb files
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// A cdb (D. J. Bernstein's constant database) is:
+//   - header   [256]{pos, len uint32}: position and number of slots of
+//     each hash table
+//   - records  {klen, dlen uint32; key; data}
+//   - tables   [256][len]{hash, pos uint32}: the slots of a table; a
+//     record with hash 'h' is in table h%256, starting at slot
+//     (h/256)%len, and a slot with pos 0 is empty.
+//
+// All integers are little-endian; so a cdb is limited to 4GB.
+
+const (
+	cdbTables = 256
+	cdbHeader = cdbTables * 8
+)
+
+// the cdb hash of 'key'
+func cdbHash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = ((h << 5) + h) ^ uint32(c)
+	}
+	return h
+}
+
+// a cdb slot
+type cdbSlot struct {
+	hash uint32
+	pos  uint32
+}
+
+// ExportCDB writes the records of the DB to 'w' as a cdb file - so that
+// tools that speak cdb can read them. The records of a key set have empty
+// data. cdb has no namespaces; a key that is in several namespaces is
+// written once per namespace - and cdb lookups return the first. Expired
+// records are not exported; values are written as stored in the DB.
+// It returns an error if the cdb would be larger than 4GB.
+// Returns number of records exported.
+func (rd *DBReader) ExportCDB(w io.Writer) (uint64, error) {
+	now := time.Now()
+
+	// the cdb header is before the records and names the position of the
+	// hash tables after them; so the records are read twice: once to lay
+	// them out and once to write them.
+	var slots []cdbSlot
+
+	pos := uint64(cdbHeader)
+	err := rd.iterate(func(r *record) error {
+		if rd.expired(r, now) || r.deleted {
+			return nil
+		}
+
+		slots = append(slots, cdbSlot{cdbHash(r.key), uint32(pos)})
+		pos += 8 + uint64(len(r.key)) + uint64(len(r.val))
+		if pos > math.MaxUint32 {
+			return fmt.Errorf("%s: records exceed the 4GB limit of cdb", rd.fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the slots of each table
+	var count [cdbTables]int
+	for i := range slots {
+		count[slots[i].hash%cdbTables]++
+	}
+
+	var hdr [cdbHeader]byte
+	var tpos [cdbTables]uint64
+
+	le := binary.LittleEndian
+	for i := range count {
+		tpos[i] = pos
+		le.PutUint32(hdr[i*8:], uint32(pos))
+		le.PutUint32(hdr[i*8+4:], uint32(2*count[i]))
+		pos += 16 * uint64(count[i])
+	}
+	if pos > math.MaxUint32 {
+		return 0, fmt.Errorf("%s: cdb exceeds the 4GB limit", rd.fn)
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err = bw.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	var x [8]byte
+	err = rd.iterate(func(r *record) error {
+		if rd.expired(r, now) || r.deleted {
+			return nil
+		}
+
+		le.PutUint32(x[:4], uint32(len(r.key)))
+		le.PutUint32(x[4:], uint32(len(r.val)))
+		bw.Write(x[:])
+		bw.Write(r.key)
+		_, err := bw.Write(r.val)
+		n++
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if n != uint64(len(slots)) {
+		return 0, fmt.Errorf("%s: DB changed during cdb export", rd.fn)
+	}
+
+	// fill each table; collisions probe the next slots
+	tables := make([][]cdbSlot, cdbTables)
+	for i := range tables {
+		tables[i] = make([]cdbSlot, 2*count[i])
+	}
+
+	for _, s := range slots {
+		t := tables[s.hash%cdbTables]
+		j := int(s.hash/cdbTables) % len(t)
+		for t[j].pos != 0 {
+			j = (j + 1) % len(t)
+		}
+		t[j] = s
+	}
+
+	for _, t := range tables {
+		for _, s := range t {
+			le.PutUint32(x[:4], s.hash)
+			le.PutUint32(x[4:], s.pos)
+			if _, err = bw.Write(x[:]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err = bw.Flush(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// AddCDBFile adds the records of cdb file 'fn' - e.g., to migrate a cdb to
+// this format. Records with duplicate keys are discarded - just as cdb
+// lookups return the first record of a key. Records with an empty key are
+// skipped; in strict mode, they are an error. A truncated or corrupt file
+// is an error matching ErrMalformedInput.
+// Returns number of records added.
+func (w *DBWriter) AddCDBFile(fn string) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	ch, ps := cdbRecords(fd, w.strict)
+	return w.addFromSource(fn, ch, ps)
+}
+
+// read the records of the cdb in 'fd' asynchronously and send them on the
+// returned chan; the chan is closed after the last record. The records end
+// where the first hash table begins.
+func cdbRecords(fd io.Reader, strict bool) (chan *record, *parseState) {
+	ch := make(chan *record, 10)
+	ps := &parseState{}
+
+	go func() {
+		defer close(ch)
+
+		rd := bufio.NewReader(fd)
+
+		var hdr [cdbHeader]byte
+		if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+			ps.err = fmt.Errorf("cdb header: %s: %w", err, ErrMalformedInput)
+			return
+		}
+
+		le := binary.LittleEndian
+		end := uint64(le.Uint32(hdr[:4]))
+		if end < cdbHeader {
+			ps.err = fmt.Errorf("cdb: bad table position %d: %w", end, ErrMalformedInput)
+			return
+		}
+
+		var x [8]byte
+		var n int
+		for pos := uint64(cdbHeader); pos < end; {
+			n++
+			if _, err := io.ReadFull(rd, x[:]); err != nil {
+				ps.err = fmt.Errorf("cdb record %d: %s: %w", n, err, ErrMalformedInput)
+				return
+			}
+
+			klen := uint64(le.Uint32(x[:4]))
+			dlen := uint64(le.Uint32(x[4:]))
+			pos += 8 + klen + dlen
+			if pos > end {
+				ps.err = fmt.Errorf("cdb record %d: overlaps hash tables: %w", n, ErrMalformedInput)
+				return
+			}
+
+			b := make([]byte, klen+dlen)
+			if _, err := io.ReadFull(rd, b); err != nil {
+				ps.err = fmt.Errorf("cdb record %d: %s: %w", n, err, ErrMalformedInput)
+				return
+			}
+
+			if klen == 0 {
+				if strict {
+					ps.err = fmt.Errorf("cdb record %d: empty key: %w", n, ErrMalformedInput)
+					return
+				}
+				ps.skipped++
+				continue
+			}
+
+			ch <- &record{
+				key: b[:klen:klen],
+				val: b[klen:],
+			}
+		}
+	}()
+
+	return ch, ps
+}
@@ -0,0 +1,119 @@
+// cdb_test.go -- test suite for the cdb importer and exporter
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestCDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	cfn := fmt.Sprintf("%s/mph%d.cdb", os.TempDir(), rand64())
+	fn2 := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+	defer os.Remove(cfn)
+	defer os.Remove(fn2)
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i*i))
+	}
+	vals[7] = nil
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	var b bytes.Buffer
+	n, err := rd.ExportCDB(&b)
+	assert(err == nil, "export failed: %s", err)
+	assert(n == uint64(len(keys)), "exp %d records, saw %d", len(keys), n)
+
+	// look up each key the way cdb does
+	cdb := b.Bytes()
+	for i, k := range keys {
+		v, ok := cdbFind(cdb, k)
+		assert(ok, "cdb: can't find key %s", k)
+		assert(bytes.Equal(v, vals[i]), "cdb: key %s: exp %q, saw %q", k, vals[i], v)
+	}
+	_, ok := cdbFind(cdb, []byte("no-such-key"))
+	assert(!ok, "cdb: found absent key")
+
+	err = os.WriteFile(cfn, cdb, 0600)
+	assert(err == nil, "can't write cdb: %s", err)
+
+	wr, err = NewDBWriter(fn2)
+	assert(err == nil, "can't create db: %s", err)
+	n, err = wr.AddCDBFile(cfn)
+	assert(err == nil, "can't add cdb: %s", err)
+	assert(n == uint64(len(keys)), "exp %d records, saw %d", len(keys), n)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd2, err := NewDBReader(fn2, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd2.Close()
+
+	for i, k := range keys {
+		v, err := rd2.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: exp %q, saw %q", k, vals[i], v)
+	}
+
+	// truncated cdb
+	err = os.WriteFile(cfn, cdb[:cdbHeader+100], 0600)
+	assert(err == nil, "can't write cdb: %s", err)
+
+	wr, err = NewDBWriter(fn2)
+	assert(err == nil, "can't create db: %s", err)
+	defer wr.Abort()
+
+	_, err = wr.AddCDBFile(cfn)
+	assert(errors.Is(err, ErrMalformedInput), "truncated cdb: %v", err)
+}
+
+// find 'key' in cdb 'b' by its hash tables
+func cdbFind(b, key []byte) ([]byte, bool) {
+	le := binary.LittleEndian
+
+	h := cdbHash(key)
+	t := (h % cdbTables) * 8
+	tpos, tlen := le.Uint32(b[t:]), le.Uint32(b[t+4:])
+	if tlen == 0 {
+		return nil, false
+	}
+
+	for i, j := uint32(0), (h/cdbTables)%tlen; i < tlen; i, j = i+1, (j+1)%tlen {
+		s := b[tpos+j*8:]
+		sh, pos := le.Uint32(s), le.Uint32(s[4:])
+		if pos == 0 {
+			return nil, false
+		}
+		if sh != h {
+			continue
+		}
+
+		klen, dlen := le.Uint32(b[pos:]), le.Uint32(b[pos+4:])
+		k := b[pos+8 : pos+8+klen]
+		if bytes.Equal(k, key) {
+			return b[pos+8+klen : pos+8+klen+dlen], true
+		}
+	}
+	return nil, false
+}
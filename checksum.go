@@ -0,0 +1,196 @@
+// checksum.go -- strong checksum of the DB metadata
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// The trailer of a DB is a SHA512-256 checksum of the file header and the
+// metadata that follows the records: the offset table, the MPH and the
+// sections. In a DB with flagChunkSum, the metadata is split into chunks
+// of csumChunk bytes (the last may be shorter) and the trailer is the
+// SHA512-256 of the file header followed by the SHA512-256 of each chunk.
+// The chunks are verified concurrently; so opening a large DB is bounded
+// by the disk rather than by one core hashing the metadata.
+const csumChunk = 16 * 1024 * 1024
+
+// In a DB with flagCRC32C, the trailer is preceded by the CRC32C
+// (Castagnoli) of the same bytes - big-endian and covered by the strong
+// checksum. CPUs compute it an order of magnitude faster than SHA512-256;
+// ReaderOptions.QuickCheck verifies it instead of the strong checksum
+// when a DB is opened. It detects accidental corruption, not tampering.
+const crcSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// digest is the interface of the hash of the metadata
+type digest interface {
+	io.Writer
+	Sum(b []byte) []byte
+}
+
+// chunkDigest hashes the metadata in chunks
+type chunkDigest struct {
+	root  digest
+	chunk digest
+	n     int
+}
+
+// return the hash of the metadata of a DB with the file header 'hdrb';
+// 'chunked' selects the chunked scheme.
+func newDigest(chunked bool, hdrb []byte) digest {
+	if !chunked {
+		h := sha512.New512_256()
+		h.Write(hdrb)
+		return h
+	}
+
+	d := &chunkDigest{
+		root:  sha512.New512_256(),
+		chunk: sha512.New512_256(),
+	}
+	d.root.Write(hdrb)
+	return d
+}
+
+func (d *chunkDigest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := csumChunk - d.n
+		if m > len(p) {
+			m = len(p)
+		}
+
+		d.chunk.Write(p[:m])
+		d.n += m
+		p = p[m:]
+		if d.n == csumChunk {
+			d.endChunk()
+		}
+	}
+	return n, nil
+}
+
+// Sum returns the checksum; the digest can't be written to afterwards.
+func (d *chunkDigest) Sum(b []byte) []byte {
+	if d.n > 0 {
+		d.endChunk()
+	}
+	return d.root.Sum(b)
+}
+
+// add the hash of the current chunk to the root
+func (d *chunkDigest) endChunk() {
+	d.root.Write(d.chunk.Sum(nil))
+	d.chunk = sha512.New512_256()
+	d.n = 0
+}
+
+// return the chunked checksum of the file header 'hdrb' and the 'sz'
+// bytes of metadata at 'off' in 'ra'; the chunks are hashed concurrently.
+func chunkedChecksum(ra io.ReaderAt, hdrb []byte, off, sz int64) ([]byte, error) {
+	sums, errs := chunkSums(ra, off, sz, csumChunk)
+
+	h := sha512.New512_256()
+	h.Write(hdrb)
+	for i := range sums {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		h.Write(sums[i])
+	}
+	return h.Sum(nil), nil
+}
+
+// return the SHA512-256 of each chunk of 'chunk' bytes of the 'sz' bytes
+// at 'off' in 'ra' - and the error of reading each chunk. The chunks are
+// hashed concurrently.
+func chunkSums(ra io.ReaderAt, off, sz, chunk int64) ([][]byte, []error) {
+	n := int((sz + chunk - 1) / chunk)
+	sums := make([][]byte, n)
+	errs := make([]error, n)
+
+	ncpu := runtime.GOMAXPROCS(-1)
+	if ncpu > n {
+		ncpu = n
+	}
+
+	var wg sync.WaitGroup
+	ch := make(chan int, n)
+	for i := 0; i < n; i++ {
+		ch <- i
+	}
+	close(ch)
+
+	wg.Add(ncpu)
+	for j := 0; j < ncpu; j++ {
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				start := off + int64(i)*chunk
+				m := off + sz - start
+				if m > chunk {
+					m = chunk
+				}
+
+				h := sha512.New512_256()
+				nw, err := io.Copy(h, io.NewSectionReader(ra, start, m))
+				if err == nil && nw != m {
+					err = fmt.Errorf("partial read at off %d, exp %d, saw %d: %w", start, m, nw, ErrTooSmall)
+				}
+				sums[i], errs[i] = h.Sum(nil), err
+			}
+		}()
+	}
+	wg.Wait()
+	return sums, errs
+}
+
+// verify the CRC32C of the file header 'hdrb' and the metadata of the DB
+// of 'sz' bytes in 'ra'; return the strong checksum in its trailer.
+func (rd *DBReader) verifyCRC(ra io.ReaderAt, hdrb []byte, hdr *header, sz int64) ([32]byte, error) {
+	var csum [32]byte
+	var b [crcSize]byte
+
+	offtbl := int64(hdr.offtbl)
+	if offtbl > sz-32-crcSize {
+		return csum, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+	}
+
+	crc := crc32.New(crcTable)
+	crc.Write(hdrb)
+
+	expsz := sz - offtbl - 32 - crcSize
+	nw, err := io.Copy(crc, io.NewSectionReader(ra, offtbl, expsz))
+	if err != nil {
+		return csum, fmt.Errorf("%s: i/o error: %w", rd.fn, err)
+	}
+	if nw != expsz {
+		return csum, fmt.Errorf("%s: partial read while verifying CRC, exp %d, saw %d: %w", rd.fn, expsz, nw, ErrTooSmall)
+	}
+
+	if _, err = ra.ReadAt(b[:], sz-32-crcSize); err != nil {
+		return csum, fmt.Errorf("%s: i/o error: %w", rd.fn, err)
+	}
+	if exp := binary.BigEndian.Uint32(b[:]); exp != crc.Sum32() {
+		return csum, fmt.Errorf("%s: %w; exp CRC %#x, saw %#x", rd.fn, ErrBadChecksum, exp, crc.Sum32())
+	}
+
+	if _, err = ra.ReadAt(csum[:], sz-32); err != nil {
+		return csum, fmt.Errorf("%s: can't read checksum: %w", rd.fn, err)
+	}
+	return csum, nil
+}
@@ -0,0 +1,198 @@
+// checksum_test.go -- test suite for the chunked checksum
+
+package bbhash
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestChunkDigest(t *testing.T) {
+	assert := newAsserter(t)
+
+	hdr := []byte("header")
+	b := make([]byte, 2*csumChunk+csumChunk/2+13)
+	for i := range b {
+		b[i] = byte(i ^ i>>9)
+	}
+
+	for _, sz := range []int{0, 1, csumChunk - 1, csumChunk, csumChunk + 1, len(b) - 100} {
+		off := len(b) - sz
+
+		// write in uneven pieces
+		d := newDigest(true, hdr)
+		for p := b[off:]; len(p) > 0; {
+			n := 1 + int(rand64()%(1<<20))
+			if n > len(p) {
+				n = len(p)
+			}
+			d.Write(p[:n])
+			p = p[n:]
+		}
+		exp := d.Sum(nil)
+
+		csum, err := chunkedChecksum(bytes.NewReader(b), hdr, int64(off), int64(sz))
+		assert(err == nil, "%d: checksum failed: %s", sz, err)
+		assert(bytes.Equal(csum, exp), "%d: checksum mismatch:\nexp %x\nsaw %x", sz, exp, csum)
+
+		// even a single chunk isn't the linear checksum
+		if sz == 0 {
+			continue
+		}
+		h := sha512.New512_256()
+		h.Write(hdr)
+		h.Write(b[off:])
+		assert(!bytes.Equal(h.Sum(nil), csum), "%d: chunked checksum is linear", sz)
+	}
+
+	_, err := chunkedChecksum(bytes.NewReader(b), hdr, int64(len(b)-10), 20)
+	assert(errors.Is(err, ErrTooSmall), "short read: %v", err)
+}
+
+func TestChunkSum(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	flags := binary.BigEndian.Uint32(b[4:8])
+	assert((flags&flagChunkSum) > 0, "chunked checksum not in header: %#x", flags)
+
+	// corrupt the offset table
+	offtbl := binary.BigEndian.Uint64(b[24:32])
+	c := append([]byte{}, b...)
+	c[offtbl] ^= 0x1
+	err = ioutil.WriteFile(fn, c, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReader(fn, 10)
+	assert(errors.Is(err, ErrBadChecksum), "opened a corrupt db: %v", err)
+
+	// a DB with a linear checksum
+	binary.BigEndian.PutUint32(b[4:8], flags&^flagChunkSum)
+	fixChecksum(b)
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "can't open db with a linear checksum: %s", err)
+	defer rd.Close()
+
+	assert((rd.flags&flagChunkSum) == 0, "chunked checksum in header: %#x", rd.flags)
+	err = rd.VerifyMetadata()
+	assert(err == nil, "verify metadata failed: %s", err)
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+}
+
+func TestQuickCheck(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	assert(uint64(len(b)) == wr.Stats().FileSize, "exp file size %d, saw %d", wr.Stats().FileSize, len(b))
+
+	flags := binary.BigEndian.Uint32(b[4:8])
+	assert((flags&flagCRC32C) > 0, "CRC not in header: %#x", flags)
+
+	modes := []LoadMode{LoadFile, LoadMmap, LoadMemory}
+	for _, m := range modes {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, QuickCheck: true})
+		assert(err == nil, "%d: read failed: %s", m, err)
+
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%d: can't find key %s: %s", m, k, err)
+			assert(bytes.Equal(v, k), "%d: key %s: value mismatch", m, k)
+		}
+
+		err = rd.VerifyMetadata()
+		assert(err == nil, "%d: verify failed: %s", m, err)
+		rd.Close()
+	}
+
+	// a corrupt strong checksum isn't detected by the CRC
+	c := append([]byte{}, b...)
+	c[len(c)-1] ^= 0x1
+	err = ioutil.WriteFile(fn, c, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{QuickCheck: true})
+	assert(err == nil, "quick check failed: %s", err)
+	err = rd.VerifyMetadata()
+	assert(errors.Is(err, ErrBadChecksum), "corrupt checksum not detected: %v", err)
+	rd.Close()
+
+	// corrupt metadata
+	offtbl := binary.BigEndian.Uint64(b[24:32])
+	c = append([]byte{}, b...)
+	c[offtbl+7] ^= 0x80
+	err = ioutil.WriteFile(fn, c, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	for _, m := range modes {
+		_, err = NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, QuickCheck: true})
+		assert(errors.Is(err, ErrBadChecksum), "%d: opened a corrupt db: %v", m, err)
+	}
+
+	// a DB without a CRC is verified in full
+	c = append([]byte{}, b[:len(b)-32-crcSize]...)
+	c = append(c, b[len(b)-32:]...)
+	binary.BigEndian.PutUint32(c[4:8], flags&^flagCRC32C)
+	fixChecksum(c)
+	err = ioutil.WriteFile(fn, c, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err = NewDBReaderWithOptions(fn, ReaderOptions{QuickCheck: true})
+	assert(err == nil, "can't open db without a CRC: %s", err)
+	v, err := rd.Find(keys[7])
+	assert(err == nil && bytes.Equal(v, keys[7]), "can't find key %s: %v", keys[7], err)
+	rd.Close()
+
+	c[offtbl+7] ^= 0x80
+	err = ioutil.WriteFile(fn, c, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{QuickCheck: true})
+	assert(errors.Is(err, ErrBadChecksum), "opened a corrupt db without a CRC: %v", err)
+}
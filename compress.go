@@ -0,0 +1,247 @@
+// compress.go -- compressed record regions
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// In a compressed DB (see WriterOptions.Compress), the record region is
+// split into blocks of 'compressBlock' bytes and each block is compressed
+// on its own. The records keep their offsets in the uncompressed region:
+// the offset table and the back references between records refer to these
+// offsets. The compressed blocks are stored back to back from the end of
+// the file header; a block that doesn't shrink is stored as is.
+//
+// The block index is in the section 'secBlocks':
+//   - codec   byte    compression algorithm (blockDeflate)
+//   - resv    3 bytes
+//   - bsize   uint32  size of an uncompressed block
+//   - end     uint64  end of the uncompressed record region
+//   - blocks  []uint32 stored size of each block; the top bit is set
+//     if the block is stored uncompressed.
+//
+// All integers are big-endian.
+const (
+	compressBlock = 65536
+
+	// number of uncompressed blocks cached by a reader
+	blockCacheSize = 16
+
+	// compression algorithms
+	blockDeflate byte = 1
+
+	// the block is stored uncompressed
+	blockRaw uint32 = 1 << 31
+)
+
+// compress the records in [64, w.off) in place into blocks; return the
+// file offset where the compressed blocks end. In place compression is
+// safe because a block is never stored in more space than it had. The
+// records read back are verified against the running hash of the records;
+// the blocks are hashed afresh as they are written.
+func (w *DBWriter) compressRecords() (uint64, error) {
+	nblk := (w.off - 64 + compressBlock - 1) / compressBlock
+
+	idx := make([]byte, 16, 16+4*nblk)
+	idx[0] = blockDeflate
+	binary.BigEndian.PutUint32(idx[4:8], compressBlock)
+	binary.BigEndian.PutUint64(idx[8:16], w.off)
+
+	var out bytes.Buffer
+
+	fw, err := flate.NewWriter(&out, flate.DefaultCompression)
+	if err != nil {
+		return 0, err
+	}
+
+	rsum, dsum := newDigest(true, nil), newDigest(true, nil)
+
+	buf := make([]byte, compressBlock)
+	rpos, wpos := uint64(64), uint64(64)
+	for rpos < w.off {
+		n := w.off - rpos
+		if n > compressBlock {
+			n = compressBlock
+		}
+
+		b := buf[:n]
+		if _, err := w.fd.ReadAt(b, int64(rpos)); err != nil {
+			return 0, err
+		}
+		rsum.Write(b)
+
+		out.Reset()
+		fw.Reset(&out)
+		fw.Write(b)
+		if err := fw.Close(); err != nil {
+			return 0, err
+		}
+
+		sz := uint32(out.Len())
+		if uint64(out.Len()) < n {
+			b = out.Bytes()
+		} else {
+			sz = uint32(n) | blockRaw
+		}
+
+		if _, err := w.fd.WriteAt(b, int64(wpos)); err != nil {
+			return 0, err
+		}
+		dsum.Write(b)
+
+		var z [4]byte
+		binary.BigEndian.PutUint32(z[:], sz)
+		idx = append(idx, z[:]...)
+
+		rpos += n
+		wpos += uint64(len(b))
+	}
+
+	if !bytes.Equal(rsum.Sum(nil), w.dsum.Sum(nil)) {
+		return 0, fmt.Errorf("%s: records changed in the temp file: %w", w.fntmp, ErrBadChecksum)
+	}
+
+	w.blocks = idx
+	w.dsum = dsum
+	return wpos, nil
+}
+
+// index of the compressed blocks of a DB
+type blockIndex struct {
+	bsize uint64
+	end   uint64
+
+	// file offset and stored size of each block
+	off []uint64
+	sz  []uint32
+}
+
+// decode the block index 'b' of a DB whose compressed blocks end at file
+// offset 'max'.
+func newBlockIndex(b []byte, max uint64) (*blockIndex, error) {
+	if len(b) < 16 || (len(b)-16)%4 != 0 {
+		return nil, fmt.Errorf("%w: bad block index", ErrCorrupt)
+	}
+
+	be := binary.BigEndian
+	if b[0] != blockDeflate {
+		return nil, fmt.Errorf("unsupported compression %d", b[0])
+	}
+
+	x := &blockIndex{
+		bsize: uint64(be.Uint32(b[4:8])),
+		end:   be.Uint64(b[8:16]),
+	}
+
+	n := uint64(len(b)-16) / 4
+	if x.bsize == 0 || x.end < 64 || (x.end-64+x.bsize-1)/x.bsize != n {
+		return nil, fmt.Errorf("%w: bad block index", ErrCorrupt)
+	}
+
+	x.off = make([]uint64, n)
+	x.sz = make([]uint32, n)
+
+	off := uint64(64)
+	for i := uint64(0); i < n; i++ {
+		sz := be.Uint32(b[16+4*i:])
+		z := uint64(sz &^ blockRaw)
+		if z > x.bsize || z > max-off {
+			return nil, fmt.Errorf("%w: bad block index", ErrCorrupt)
+		}
+
+		x.off[i] = off
+		x.sz[i] = sz
+		off += z
+	}
+	return x, nil
+}
+
+// blockReader reads the uncompressed record region of a compressed DB from
+// the compressed blocks in 'ra'; recently used blocks are cached. It is
+// safe for concurrent use.
+type blockReader struct {
+	ra    io.ReaderAt
+	idx   *blockIndex
+	cache *lruCache[[]byte]
+}
+
+func newBlockReader(ra io.ReaderAt, idx *blockIndex) *blockReader {
+	c, _ := newLRUCache[[]byte](blockCacheSize)
+	return &blockReader{
+		ra:    ra,
+		idx:   idx,
+		cache: c,
+	}
+}
+
+// ReadAt reads from the uncompressed record region; it is an error to read
+// outside the region.
+func (r *blockReader) ReadAt(p []byte, off int64) (int, error) {
+	x := r.idx
+	if off < 64 || uint64(off) >= x.end {
+		return 0, fmt.Errorf("%w: read at %d outside record region", ErrCorruptRecord, off)
+	}
+
+	var n int
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		if pos >= x.end {
+			return n, io.EOF
+		}
+
+		i := (pos - 64) / x.bsize
+		b, err := r.block(i)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], b[pos-64-i*x.bsize:])
+	}
+	return n, nil
+}
+
+// return the uncompressed block 'i'
+func (r *blockReader) block(i uint64) ([]byte, error) {
+	if v, ok := r.cache.Get(i); ok {
+		return v, nil
+	}
+
+	x := r.idx
+	n := x.bsize
+	if z := x.end - 64 - i*x.bsize; z < n {
+		n = z
+	}
+
+	sz := x.sz[i]
+	b := make([]byte, sz&^blockRaw)
+	if _, err := r.ra.ReadAt(b, int64(x.off[i])); err != nil {
+		return nil, err
+	}
+
+	if (sz & blockRaw) == 0 {
+		u := make([]byte, n)
+		fr := flate.NewReader(bytes.NewReader(b))
+		if _, err := io.ReadFull(fr, u); err != nil {
+			return nil, fmt.Errorf("%w: block %d at off %d: %s", ErrCorrupt, i, x.off[i], err)
+		}
+		b = u
+	}
+
+	if uint64(len(b)) != n {
+		return nil, fmt.Errorf("%w: block %d at off %d", ErrCorrupt, i, x.off[i])
+	}
+
+	r.cache.Add(i, b)
+	return b, nil
+}
@@ -0,0 +1,105 @@
+// compress_test.go -- test suite for compressed DBs
+
+package bbhash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestCompressed(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	_, err := NewDBWriterWithOptions(fn, WriterOptions{Compress: true, SplitValues: true})
+	assert(err != nil, "created a compressed split DB")
+
+	keys := make([][]byte, 5000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("/some/common/path/%d", i))
+		vals[i] = bytes.Repeat([]byte(fmt.Sprintf("value %d;", i)), 10)
+	}
+
+	// incompressible values are stored in raw blocks
+	for i := 0; i < 100; i++ {
+		vals[i] = make([]byte, 4096)
+		rand.Read(vals[i])
+	}
+
+	build := func(fn string, opt WriterOptions) BuildStats {
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+		return wr.Stats()
+	}
+
+	opt := WriterOptions{
+		PrefixCompress: true,
+		Compress:       true,
+	}
+
+	st := build(fn, opt)
+
+	fn2 := fn + ".plain"
+	defer os.Remove(fn2)
+	opt.Compress = false
+	plain := build(fn2, opt)
+	const raw = 100 * 4096
+	assert(st.RecordBytes < raw+(plain.RecordBytes-raw)/2, "records not compressed: %d vs %d", st.RecordBytes, plain.RecordBytes)
+
+	fi, err := os.Stat(fn)
+	assert(err == nil, "can't stat %s: %s", fn, err)
+	assert(uint64(fi.Size()) == st.FileSize, "exp file size %d, saw %d", st.FileSize, fi.Size())
+
+	open := []func() (*DBReader, error){
+		func() (*DBReader, error) { return NewDBReader(fn, 10) },
+		func() (*DBReader, error) { return NewDBReaderMmap(fn, 10) },
+		func() (*DBReader, error) { return NewDBReaderInMemory(fn, 10, true) },
+		func() (*DBReader, error) { return NewSharedDBReader(fn, 10) },
+	}
+
+	for j, fp := range open {
+		rd, err := fp()
+		assert(err == nil, "%d: read failed: %s", j, err)
+		assert(rd.blocks != nil, "%d: DB isn't compressed", j)
+
+		var nraw int
+		for _, sz := range rd.blocks.sz {
+			if (sz & blockRaw) > 0 {
+				nraw++
+			}
+		}
+		assert(nraw > 0 && nraw < len(rd.blocks.sz), "%d: exp some raw blocks, saw %d", j, nraw)
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%d: can't find key %s: %s", j, k, err)
+			assert(bytes.Equal(v, vals[i]), "%d: key %s: value mismatch", j, k)
+		}
+
+		v, err := rd.UnsafeFind(keys[7])
+		assert(err == nil && bytes.Equal(v, vals[7]), "%d: unsafe find failed: %s", j, err)
+
+		err = rd.VerifyAll()
+		assert(err == nil, "%d: verify failed: %s", j, err)
+
+		n := 0
+		err = rd.Range(func(k, v []byte) bool {
+			n++
+			return true
+		})
+		assert(err == nil && n == len(keys), "%d: exp %d records, saw %d: %s", j, len(keys), n, err)
+		rd.Close()
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	"runtime"
 	"sync"
+	"time"
 )
 
 // run the BBHash algorithm concurrently on a sharded set of keys.
@@ -32,16 +33,15 @@ func (s *state) concurrent(keys []uint64) error {
 		var wg sync.WaitGroup
 
 		// Pre-process keys and detect colliding entries
+		t0 := time.Now()
 		wg.Add(ncpu)
 		for i := 0; i < ncpu; i++ {
-			i := i
 			x := z * uint64(i)
 			y := x + z
 			if i == (ncpu - 1) {
 				y += r
 			}
 			go func(x, y uint64) {
-				//printf("lvl %d: cpu %d; Pre-process shard %d:%d", s.lvl, i, x, y)
 				preprocess(s, keys[x:y])
 				wg.Done()
 			}(x, y)
@@ -51,17 +51,16 @@ func (s *state) concurrent(keys []uint64) error {
 		wg.Wait()
 
 		// Assignment step
+		t1 := time.Now()
 		A.Reset()
 		wg.Add(ncpu)
 		for i := 0; i < ncpu; i++ {
-			i := i
 			x := z * uint64(i)
 			y := x + z
 			if i == (ncpu - 1) {
 				y += r
 			}
 			go func(x, y uint64) {
-				//printf("lvl %d: cpu %d; Assign shard %d:%d", s.lvl, i, x, y)
 				assign(s, keys[x:y])
 				wg.Done()
 			}(x, y)
@@ -69,6 +68,7 @@ func (s *state) concurrent(keys []uint64) error {
 
 		// synchronization point #2
 		wg.Wait()
+		s.levelDone(int(nkey), t0, t1, true)
 		keys, A = s.nextLevel()
 		if keys == nil {
 			break
@@ -85,7 +85,7 @@ func (s *state) concurrent(keys []uint64) error {
 
 	}
 
-	s.bb.preComputeRank()
+	s.finish()
 
 	return nil
 }
@@ -0,0 +1,87 @@
+// crypto.go -- at-rest encryption of records in the constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Encrypted DBs use AES-256-GCM. The caller supplied key is never used
+// directly; instead we derive a per-DB key from it and the DB salt. Since the
+// salt is random for every DB, two DBs built with the same caller key never
+// share an encryption key - and thus never reuse a (key, nonce) pair even
+// though the nonces are derived from file offsets.
+//
+// Nonces are 12 bytes:
+//   - 4 byte big-endian domain (records or offset-table)
+//   - 8 byte big-endian file offset of the encrypted item
+const (
+	nonceRecord uint32 = 0
+	nonceOffTbl uint32 = 1
+)
+
+// Size of the GCM authentication tag
+const gcmOverhead = 16
+
+// derive the per-DB AEAD and the key-check value for 'key' and 'salt'.
+// The key-check value is stored in the file header and lets readers detect
+// a wrong key at open time.
+func newAEAD(key []byte, salt uint64) (cipher.AEAD, uint64, error) {
+	if len(key) < 16 {
+		return nil, 0, ErrShortKey
+	}
+
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], salt)
+
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("bbhash db key"))
+	m.Write(s[:])
+	k := m.Sum(nil)
+
+	m = hmac.New(sha256.New, k)
+	m.Write([]byte("bbhash key check"))
+	kcv := binary.BigEndian.Uint64(m.Sum(nil)[:8])
+
+	blk, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return aead, kcv, nil
+}
+
+// make a nonce for an item in domain 'dom' at file offset 'off'
+func nonce(dom uint32, off uint64) []byte {
+	var n [12]byte
+
+	be := binary.BigEndian
+	be.PutUint32(n[:4], dom)
+	be.PutUint64(n[4:], off)
+	return n[:]
+}
+
+// ErrShortKey is returned when the encryption key is shorter than 16 bytes.
+var ErrShortKey = errors.New("encryption key too short")
+
+// ErrEncrypted is returned when opening an encrypted DB without a key.
+var ErrEncrypted = errors.New("DB is encrypted; key required")
+
+// ErrBadKey is returned when the key provided to open an encrypted DB is wrong.
+var ErrBadKey = errors.New("incorrect decryption key")
@@ -0,0 +1,99 @@
+// datasum.go -- checksum of the record region of a DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The writer hashes the records as it writes them - the bytes of the file
+// from the end of the file header to the end of the last record (or
+// compressed block) - with the chunked scheme of the metadata checksum
+// (see checksum.go). Freeze() stores the result in the section 'secData':
+//   - end    uint64    file offset of the end of the records
+//   - sum    [32]byte  chunked SHA512-256 of the records
+//
+// The section is covered by the strong checksum of the metadata; so
+// DBReader.VerifyData() can check all the records of the DB without
+// decoding them. Records that are rewritten at Freeze() (e.g., by
+// WriterOptions.Locality) are hashed as they are rewritten; records that
+// are compressed are verified against the running hash as they are read
+// back - so records corrupted in the temp file fail Freeze().
+
+// size of the section 'secData'
+const dataSumSize = 8 + 32
+
+// add the 'n' bytes at 'off' of the temp file to the hash of the records;
+// the bytes were written directly to the file.
+func (w *DBWriter) hashWritten(off, n uint64) error {
+	if w.dsum == nil {
+		return nil
+	}
+
+	_, err := io.Copy(w.dsum, io.NewSectionReader(w.fd, int64(off), int64(n)))
+	return err
+}
+
+// return the hash of the records in the temp file - which start after the
+// padding of the file header.
+func (w *DBWriter) newDataSum() digest {
+	d := newDigest(true, nil)
+	d.Write(make([]byte, w.padding(64)))
+	return d
+}
+
+// return the section 'secData' of the records that end at 'end'
+func (w *DBWriter) dataSection(end uint64) []byte {
+	b := make([]byte, 8, dataSumSize)
+	binary.BigEndian.PutUint64(b, end)
+	return w.dsum.Sum(b)
+}
+
+// VerifyData verifies the checksum of all the records of the DB - the
+// bytes from the end of the file header to the end of the last record.
+// Unlike VerifyAll(), it doesn't decode the records; the chunks of the
+// records are hashed concurrently. It returns an error matching
+// ErrBadChecksum if any record is corrupt; DBs built before the data
+// checksum was added don't have it.
+func (rd *DBReader) VerifyData() error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	defer rd.leave()
+
+	if rd.dsum == nil {
+		return fmt.Errorf("%s: DB has no data checksum", rd.fn)
+	}
+
+	end := binary.BigEndian.Uint64(rd.dsum[:8])
+	sum, err := chunkedChecksum(rd.mra, nil, 64, int64(end-64))
+	if err != nil {
+		return fmt.Errorf("%s: i/o error: %w", rd.fn, err)
+	}
+
+	if !bytes.Equal(sum, rd.dsum[8:]) {
+		return rd.badsum(fmt.Errorf("%s: records: %w", rd.fn, ErrBadChecksum))
+	}
+	return nil
+}
+
+// validate the section 'secData' of a DB whose offset table is at 'offtbl'
+func checkDataSum(b []byte, offtbl uint64) error {
+	if len(b) != dataSumSize {
+		return fmt.Errorf("%w: data checksum is %d bytes", ErrCorrupt, len(b))
+	}
+
+	if end := binary.BigEndian.Uint64(b[:8]); end < 64 || end > offtbl {
+		return fmt.Errorf("%w: records end at %d; exp at most %d", ErrCorrupt, end, offtbl)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// datasum_test.go -- test suite for the checksum of the records
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDataChecksum(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([][]byte, 2000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d-%s", i, strings.Repeat("x", i%50)))
+	}
+
+	opts := map[string]WriterOptions{
+		"plain":    {},
+		"locality": {Locality: true, DedupValues: true},
+		"split":    {SplitValues: true},
+		"compress": {Compress: true},
+		"aligned":  {RecordAlign: 512},
+	}
+
+	for nm, opt := range opts {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "%s: can't create db: %s", nm, err)
+		_, err = wr.AddKeyVals(keys[:1000], vals[:1000])
+		assert(err == nil, "%s: can't add key-vals: %s", nm, err)
+
+		// streamed values are hashed as written
+		if !opt.Compress {
+			for i := 1000; i < len(keys); i++ {
+				_, err = wr.AddKeyValReader(keys[i], bytes.NewReader(vals[i]), int64(len(vals[i])))
+				assert(err == nil, "%s: can't stream record %d: %s", nm, i, err)
+			}
+		} else {
+			_, err = wr.AddKeyVals(keys[1000:], vals[1000:])
+			assert(err == nil, "%s: can't add key-vals: %s", nm, err)
+		}
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "%s: freeze failed: %s", nm, err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "%s: read failed: %s", nm, err)
+		assert(rd.Info().DataChecksum != nil, "%s: no data checksum", nm)
+
+		err = rd.VerifyData()
+		assert(err == nil, "%s: verify failed: %s", nm, err)
+		rd.Close()
+
+		// corrupt a record
+		fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+		assert(err == nil, "%s: can't open: %s", nm, err)
+		_, err = fd.WriteAt([]byte{0xa5, 0x5a}, 1200)
+		assert(err == nil, "%s: can't write: %s", nm, err)
+		fd.Close()
+
+		rd, err = NewDBReader(fn, 10)
+		assert(err == nil, "%s: read failed: %s", nm, err)
+		err = rd.VerifyData()
+		assert(errors.Is(err, ErrBadChecksum), "%s: corrupt record: %v", nm, err)
+		rd.Close()
+	}
+}
+
+func TestDataChecksumFreeze(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{Compress: true})
+	assert(err == nil, "can't create db: %s", err)
+	defer wr.Abort()
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		_, err = wr.AddKeyVals([][]byte{k}, [][]byte{k})
+		assert(err == nil, "can't add key-vals: %s", err)
+	}
+
+	// records corrupted in the temp file fail the build
+	err = wr.bw.Flush()
+	assert(err == nil, "flush: %s", err)
+	_, err = wr.fd.WriteAt([]byte{0xff}, 200)
+	assert(err == nil, "can't write: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(errors.Is(err, ErrBadChecksum), "corrupt temp file: %v", err)
+}
@@ -3,9 +3,18 @@
 package bbhash
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 	"flag"
 
 	"github.com/opencoff/go-fasthash"
@@ -62,3 +71,2335 @@ func TestDB(t *testing.T) {
 		assert(string(s) == string(v), "key %s: value mismatch; exp %s, saw %s", k, v, string(s))
 	}
 }
+
+func TestEncryptedDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	vals := make([][]byte, len(keyw))
+	keys := make([][]byte, len(keyw))
+
+	for i, s := range keyw {
+		h := fasthash.Hash64(0xdeadbeefbaadf00d, []byte(s))
+		vals[i] = []byte(fmt.Sprintf("%#x", h))
+		keys[i] = []byte(s)
+	}
+
+	for _, encOffsets := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+
+		wr, err := NewEncryptedDBWriter(fn, key, encOffsets)
+		assert(err == nil, "can't create db: %s", err)
+
+		n, err := wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-val: %s", err)
+		assert(int(n) == len(keys), "fewer keys added; exp %d, saw %d", len(keys), n)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		_, err = NewDBReader(fn, 10)
+		assert(errors.Is(err, ErrEncrypted), "opened encrypted db without key: %v", err)
+
+		_, err = NewEncryptedDBReader(fn, 10, []byte("not the right key at all"))
+		assert(errors.Is(err, ErrBadKey), "opened encrypted db with bad key: %v", err)
+
+		rd, err := NewEncryptedDBReader(fn, 10, key)
+		assert(err == nil, "read failed: %s", err)
+
+		for i, k := range keys {
+			v := vals[i]
+
+			s, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(string(s) == string(v), "key %s: value mismatch; exp %s, saw %s", k, v, string(s))
+		}
+
+		rd.Close()
+		os.Remove(fn)
+	}
+}
+
+func TestLargeRecords(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	bigk := bytes.Repeat([]byte("k"), 70000)
+	bigv := bytes.Repeat([]byte("v"), 1<<20)
+
+	keys := [][]byte{bigk, []byte("small")}
+	vals := [][]byte{bigv, []byte("value")}
+
+	n, err := wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-val: %s", err)
+	assert(n == 2, "fewer keys added; exp 2, saw %d", n)
+
+	// text lines with very long keys must not be dropped
+	line := fmt.Sprintf("%s 1.2.3.4\n", bytes.Repeat([]byte("t"), 66000))
+	n, err = wr.AddTextStream(strings.NewReader(line), " ")
+	assert(err == nil, "can't add text: %s", err)
+	assert(n == 1, "long text key dropped")
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", i, err)
+		assert(bytes.Equal(v, vals[i]), "key %d: value mismatch", i)
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewKeySetWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	n, err := wr.AddKeys(keys[:5])
+	assert(err == nil, "can't add keys: %s", err)
+	assert(n == 5, "fewer keys added; exp 5, saw %d", n)
+
+	n, err = wr.AddTextStream(strings.NewReader(strings.Join(keyw[5:], "\n")), " \t")
+	assert(err == nil, "can't add text: %s", err)
+	assert(int(n) == len(keyw)-5, "fewer keys added; exp %d, saw %d", len(keyw)-5, n)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		assert(rd.Contains(k), "key %s not in set", k)
+
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(len(v) == 0, "key %s: unexpected value %s", k, v)
+	}
+
+	assert(!rd.Contains([]byte("not-a-key")), "unknown key in set")
+
+	// plain DBs can't take keys without values
+	wr, err = NewDBWriter(fn + ".x")
+	assert(err == nil, "can't create db: %s", err)
+	defer wr.Abort()
+
+	_, err = wr.AddKeys(keys)
+	assert(err == ErrNotKeySet, "added keys to a non key set: %v", err)
+}
+
+func TestMetadata(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	meta := []byte(`{"schema": 3, "source": "hosts-2018-06-01"}`)
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.SetMetadata(meta)
+	assert(err == nil, "can't set metadata: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(bytes.Equal(rd.Metadata(), meta), "metadata mismatch; exp %s, saw %s", meta, rd.Metadata())
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir, err := ioutil.TempDir("", "mphdb")
+	assert(err == nil, "can't make tmpdir: %s", err)
+	defer os.RemoveAll(dir)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	opt := WriterOptions{
+		Perm:       0640,
+		TmpDir:     dir,
+		PageSize:   512,
+		Gamma:      3.0,
+		SyncWrites: true,
+	}
+
+	wr, err := NewDBWriterWithOptions(fn, opt)
+	assert(err == nil, "can't create db: %s", err)
+	assert(filepath.Dir(wr.fntmp) == dir, "tmp file %s not in %s", wr.fntmp, dir)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "can't stat: %s", err)
+	assert(st.Mode().Perm() == 0640, "perm mismatch; exp 0640, saw %#o", st.Mode().Perm())
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+
+	_, err = NewDBWriterWithOptions(fn, WriterOptions{PageSize: 1000})
+	assert(err != nil, "accepted bad page size")
+}
+
+func TestLowMemory(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{LowMemory: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	// enough keys to exercise the concurrent paths
+	const N = MinParallelKeys + 5000
+	keys := make([][]byte, N)
+	vals := make([][]byte, N)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	// duplicates: the first value must win
+	_, err = wr.AddKeyVals(keys[:100], keys[:100])
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(wr.TotalKeys() == N, "dedup failed; exp %d, saw %d", N, wr.TotalKeys())
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.TotalKeys() == N, "key count mismatch; exp %d, saw %d", N, rd.TotalKeys())
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: value mismatch; exp %s, saw %s", k, vals[i], v)
+	}
+}
+
+func TestMergeDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	var fns [3]string
+	for i := range fns {
+		fns[i] = fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fns[i])
+	}
+
+	// two DBs with one overlapping key
+	half := len(keyw) / 2
+	for i, ks := range [][]string{keyw[:half+1], keyw[half:]} {
+		wr, err := NewDBWriter(fns[i])
+		assert(err == nil, "can't create db: %s", err)
+
+		for _, k := range ks {
+			v := fmt.Sprintf("%s-%d", k, i)
+			_, err = wr.AddKeyVals([][]byte{[]byte(k)}, [][]byte{[]byte(v)})
+			assert(err == nil, "can't add key-val: %s", err)
+		}
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+	}
+
+	wr, err := NewDBWriter(fns[2])
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddDBFile(fns[0])
+	assert(err == nil, "can't add db: %s", err)
+	assert(int(n) == half+1, "db0: exp %d keys, saw %d", half+1, n)
+
+	n, err = wr.AddDBFile(fns[1])
+	assert(err == nil, "can't add db: %s", err)
+	assert(int(n) == len(keyw)-half-1, "db1: exp %d keys, saw %d", len(keyw)-half-1, n)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fns[2], 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.TotalKeys() == len(keyw), "exp %d keys, saw %d", len(keyw), rd.TotalKeys())
+	for i, k := range keyw {
+		exp := fmt.Sprintf("%s-0", k)
+		if i > half {
+			exp = fmt.Sprintf("%s-1", k)
+		}
+
+		v, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(v) == exp, "key %s: exp %s, saw %s", k, exp, v)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	wr.SetMetadata([]byte("meta"))
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// rebuild in place with a different gamma
+	err = Rebuild(fn, fn, 3.0)
+	assert(err == nil, "rebuild failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(string(rd.Metadata()) == "meta", "metadata lost")
+	assert(rd.TotalKeys() == len(keys), "exp %d keys, saw %d", len(keys), rd.TotalKeys())
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+}
+
+func TestRebuildWithOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	key := []byte("0123456789abcdef")
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{Key: key})
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	wr.SetMetadata([]byte("meta"))
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// an encrypted DB can't be rebuilt without its key
+	err = Rebuild(fn, fn, 3.0)
+	assert(err != nil, "rebuilt an encrypted db without its key")
+
+	// rebuild in place with a new key and key hash
+	nkey := []byte("fedcba9876543210")
+	err = RebuildWithOptions(fn, fn, key, WriterOptions{Key: nkey, KeyHash: KeyHashXXH3, Gamma: 3.0})
+	assert(err == nil, "rebuild failed: %s", err)
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{Key: key})
+	assert(err != nil, "opened the rebuilt db with the old key")
+
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Key: nkey})
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert((rd.flags&flagXXH3) > 0, "key hash not changed")
+	assert(string(rd.Metadata()) == "meta", "metadata lost")
+	assert(rd.TotalKeys() == len(keys), "exp %d keys, saw %d", len(keys), rd.TotalKeys())
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+
+	err = RebuildWithOptions(fn, fn, nkey, WriterOptions{KeyNormalizerName: "lower"})
+	assert(err != nil, "rebuilt with a new key normalizer")
+}
+
+func TestLocality(t *testing.T) {
+	assert := newAsserter(t)
+
+	key := []byte("0123456789abcdef")
+	opts := []WriterOptions{
+		{Locality: true},
+		{Locality: true, LowMemory: true},
+		{Locality: true, Key: key, EncryptOffsets: true},
+	}
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	for _, opt := range opts {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-val: %s", err)
+
+		// duplicates are garbage that the new layout drops
+		_, err = wr.AddKeyVals(keys[:100], keys[:100])
+		assert(err == nil, "can't add key-val: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewEncryptedDBReader(fn, 10, opt.Key)
+		assert(err == nil, "read failed: %s", err)
+
+		// records are in the same order as the offset table
+		for i := 1; i < len(rd.offsets); i++ {
+			assert(rd.offsets[i-1] < rd.offsets[i], "offset %d out of order", i)
+		}
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch; exp %s, saw %s", k, vals[i], v)
+		}
+		rd.Close()
+	}
+}
+
+func TestPrefixCompress(t *testing.T) {
+	assert := newAsserter(t)
+
+	key := []byte("0123456789abcdef")
+	opts := []WriterOptions{
+		{},
+		{PrefixCompress: true},
+		{PrefixCompress: true, Locality: true},
+		{PrefixCompress: true, Key: key},
+	}
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("https://www.example.com/some/long/path/%06d", i))
+		vals[i] = []byte(fmt.Sprintf("%d", i))
+	}
+
+	var sizes []int64
+	for _, opt := range opts {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-val: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewEncryptedDBReader(fn, 10, opt.Key)
+		assert(err == nil, "read failed: %s", err)
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch; exp %s, saw %s", k, vals[i], v)
+		}
+
+		// a key that differs only in the suffix must not be found
+		_, ok := rd.Lookup([]byte("https://www.example.com/some/long/path/xxxxxx"))
+		assert(!ok, "found non-existent key")
+
+		n := 0
+		err = rd.iterate(func(r *record) error {
+			n++
+			return nil
+		})
+		assert(err == nil, "iterate failed: %s", err)
+		assert(n == len(keys), "iterate: exp %d records, saw %d", len(keys), n)
+
+		sizes = append(sizes, rd.size)
+		rd.Close()
+	}
+
+	assert(sizes[1] < sizes[0]/2, "front coding didn't shrink the DB; %d vs %d", sizes[1], sizes[0])
+}
+
+func TestDedupValues(t *testing.T) {
+	assert := newAsserter(t)
+
+	key := []byte("0123456789abcdef")
+	opts := []WriterOptions{
+		{},
+		{DedupValues: true},
+		{DedupValues: true, PrefixCompress: true},
+		{DedupValues: true, PrefixCompress: true, Locality: true},
+		{DedupValues: true, PrefixCompress: true, Key: key},
+	}
+
+	// a handful of distinct values; and a few short ones that aren't
+	// worth deduplicating.
+	keys := make([][]byte, 2000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%06d", i))
+		vals[i] = []byte(fmt.Sprintf("a fairly long and very repetitive value %d", i%10))
+		if i%100 == 0 {
+			vals[i] = []byte("x")
+		}
+	}
+
+	var sizes []int64
+	for _, opt := range opts {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-val: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewEncryptedDBReader(fn, 10, opt.Key)
+		assert(err == nil, "read failed: %s", err)
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch; exp %s, saw %s", k, vals[i], v)
+		}
+
+		sizes = append(sizes, rd.size)
+		rd.Close()
+	}
+
+	assert(sizes[1] < sizes[0]/2, "dedup didn't shrink the DB; %d vs %d", sizes[1], sizes[0])
+}
+
+func TestCSVOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	csvdata := `exported by some tool
+# a comment
+id,name,email
+1,alice,alice@example.com
+2,bob,bob@example.com
+3,carol
+4,dave,dave@example.com
+`
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddCSVStreamWithOptions(strings.NewReader(csvdata), CSVOptions{
+		Comment:   '#',
+		SkipRows:  1,
+		KeyColumn: "xname",
+	})
+	assert(err != nil, "added CSV with a missing column")
+
+	n, err := wr.AddCSVStreamWithOptions(strings.NewReader(csvdata), CSVOptions{
+		Comment:   '#',
+		SkipRows:  1,
+		KeyColumn: "name",
+		ValColumn: "email",
+	})
+	assert(err == nil, "can't add CSV: %s", err)
+	assert(n == 3, "exp 3 records, saw %d", n)
+
+	// positional fields with a header row
+	n, err = wr.AddCSVStreamWithOptions(strings.NewReader("k,v\nfoo,bar\n"), CSVOptions{
+		Header: true,
+	})
+	assert(err == nil, "can't add CSV: %s", err)
+	assert(n == 1, "exp 1 record, saw %d", n)
+
+	n, err = wr.AddCSVStreamWithOptions(strings.NewReader("only a header\n"), CSVOptions{
+		Header: true,
+	})
+	assert(err == nil, "can't add empty CSV: %s", err)
+	assert(n == 0, "exp 0 records, saw %d", n)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	exp := map[string]string{
+		"alice": "alice@example.com",
+		"bob":   "bob@example.com",
+		"dave":  "dave@example.com",
+		"foo":   "bar",
+	}
+	for k, v := range exp {
+		x, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(x) == v, "key %s: value mismatch; exp %s, saw %s", k, v, x)
+	}
+
+	_, ok := rd.Lookup([]byte("k"))
+	assert(!ok, "header row added as a record")
+}
+
+func TestTextStreamFunc(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	// key=value with the key normalized to lower case
+	parse := func(line string) ([]byte, []byte, bool) {
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, nil, false
+		}
+		return []byte(strings.ToLower(line[:i])), []byte(line[i+1:]), true
+	}
+
+	text := "Alpha=one\r\nno delimiter here\nBETA= two \n=empty key\ngamma=three"
+	n, err := wr.AddTextStreamFunc(strings.NewReader(text), parse)
+	assert(err == nil, "can't add text: %s", err)
+	assert(n == 3, "exp 3 records, saw %d", n)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	exp := map[string]string{
+		"alpha": "one",
+		"beta":  " two ",
+		"gamma": "three",
+	}
+	for k, v := range exp {
+		x, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(x) == v, "key %s: value mismatch; exp '%s', saw '%s'", k, v, x)
+	}
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{PrefixCompress: true, DedupValues: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	const N = 4000
+	const P = 8
+
+	keys := make([][]byte, N)
+	vals := make([][]byte, N)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i%50))
+	}
+
+	// every producer adds an overlapping slice of keys
+	var wg sync.WaitGroup
+	errs := make(chan error, P)
+	for p := 0; p < P; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+
+			x := p * N / P
+			y := x + 2*N/P
+			if y > N {
+				y = N
+			}
+
+			for i := x; i < y; i++ {
+				if _, err := wr.AddKeyVals(keys[i:i+1], vals[i:i+1]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert(err == nil, "can't add key-val: %s", err)
+	}
+
+	assert(wr.TotalKeys() == N, "exp %d keys, saw %d", N, wr.TotalKeys())
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = wr.AddKeyVals(keys[:1], vals[:1])
+	assert(err == ErrFrozen, "added keys to a frozen db")
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: value mismatch; exp %s, saw %s", k, vals[i], v)
+	}
+}
+
+func TestKeyValReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{PrefixCompress: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4*65536)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("key-small")}, [][]byte{[]byte("small")})
+	assert(err == nil, "can't add key-val: %s", err)
+
+	n, err := wr.AddKeyValReader([]byte("key-big"), bytes.NewReader(big), int64(len(big)))
+	assert(err == nil, "can't add streamed value: %s", err)
+	assert(n == 1, "streamed value not added")
+
+	// a short stream leaves no trace
+	n, err = wr.AddKeyValReader([]byte("key-short"), bytes.NewReader(big[:100]), 200)
+	assert(err != nil, "added a short stream")
+	assert(n == 0, "short stream added")
+
+	n, err = wr.AddKeyValReader([]byte("key-big"), bytes.NewReader(big), int64(len(big)))
+	assert(err == nil && n == 0, "added duplicate key: %v", err)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("key-after")}, [][]byte{[]byte("after")})
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.TotalKeys() == 3, "exp 3 keys, saw %d", rd.TotalKeys())
+
+	v, err := rd.Find([]byte("key-big"))
+	assert(err == nil, "can't find streamed key: %s", err)
+	assert(bytes.Equal(v, big), "streamed value mismatch")
+
+	v, err = rd.Find([]byte("key-after"))
+	assert(err == nil, "can't find key: %s", err)
+	assert(string(v) == "after", "value mismatch; saw %s", v)
+
+	_, ok := rd.Lookup([]byte("key-short"))
+	assert(!ok, "found key of a short stream")
+
+	// no streaming into encrypted DBs
+	efn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	wr, err = NewEncryptedDBWriter(efn, []byte("0123456789abcdef"), false)
+	assert(err == nil, "can't create db: %s", err)
+	defer wr.Abort()
+
+	_, err = wr.AddKeyValReader([]byte("key"), bytes.NewReader(big), int64(len(big)))
+	assert(err != nil, "streamed a value into an encrypted db")
+}
+
+func TestWriteBuffer(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	// a large value grows the encoding buffer past what is kept
+	keys := make([][]byte, 5000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("value-%d", i))
+	}
+	vals[10] = bytes.Repeat([]byte("x"), 2*maxRecordBuf)
+
+	for _, opt := range []WriterOptions{{}, {LowMemory: true}, {SyncWrites: true}} {
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+
+		// records are durable as they are added with SyncWrites
+		if opt.SyncWrites {
+			st, err := os.Stat(wr.fntmp)
+			assert(err == nil, "can't stat temp file: %s", err)
+			assert(uint64(st.Size()) == wr.off, "exp %d bytes written, saw %d", wr.off, st.Size())
+		}
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch", k)
+		}
+		rd.Close()
+	}
+}
+
+func TestWriteOffsets(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := &DBWriter{}
+	for _, width := range []int{8, 4, 5} {
+		for _, n := range []int{0, 1, offsetBatch, 2*offsetBatch + 3} {
+			offs := make([]uint64, n)
+			for i := range offs {
+				offs[i] = rand64() >> (64 - 8*width)
+			}
+
+			var b bytes.Buffer
+			err := w.writeOffsets(&b, offs, width)
+			assert(err == nil, "%d: write failed: %s", n, err)
+			assert(b.Len() == n*width, "%d: exp %d bytes, saw %d", n, n*width, b.Len())
+
+			// decode the table like a reader
+			rd := &DBReader{}
+			if width == 8 {
+				x := b.Bytes()
+				rd.offsets = make([]uint64, n)
+				for i := range rd.offsets {
+					rd.offsets[i] = toLittleEndianUint64(binary.LittleEndian.Uint64(x[i*8:]))
+				}
+			} else {
+				rd.ctab, rd.cwidth = b.Bytes(), width
+			}
+
+			for i, o := range offs {
+				v := rd.entry(uint64(i))
+				assert(v == o, "%d/%d: offset %d: exp %#x, saw %#x", width, n, i, o, v)
+			}
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	fn2 := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+	defer os.Remove(fn2)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	k := func(s string) [][]byte { return [][]byte{[]byte(s)} }
+
+	_, err = wr.AddKeyVals(k("forever"), k("v0"))
+	assert(err == nil, "can't add key-val: %s", err)
+
+	_, err = wr.AddKeyValsWithExpiry(k("expired"), k("v1"), time.Now().Add(-time.Hour))
+	assert(err == nil, "can't add key-val: %s", err)
+
+	_, err = wr.AddKeyValsWithExpiry(k("later"), k("v2"), time.Now().Add(time.Hour))
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, s := range []string{"forever", "later"} {
+		_, ok := rd.Lookup([]byte(s))
+		assert(ok, "can't find key %s", s)
+	}
+
+	_, err = rd.Find([]byte("expired"))
+	assert(err == ErrNoKey, "found expired key: %v", err)
+	assert(!rd.Contains([]byte("expired")), "expired key in db")
+
+	rd.IgnoreExpiry(true)
+	v, ok := rd.Lookup([]byte("expired"))
+	assert(ok && string(v) == "v1", "can't find expired key when ignoring expiry")
+	rd.IgnoreExpiry(false)
+
+	// expired records are dropped by a rebuild; the others keep their expiry
+	err = Rebuild(fn, fn2, 2.0)
+	assert(err == nil, "rebuild failed: %s", err)
+
+	rd2, err := NewDBReader(fn2, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd2.Close()
+
+	rd2.IgnoreExpiry(true)
+	assert(rd2.TotalKeys() == 2, "exp 2 keys, saw %d", rd2.TotalKeys())
+	assert(!rd2.Contains([]byte("expired")), "expired key survived rebuild")
+
+	r, err := rd2.lookup([]byte("later"))
+	assert(err == nil, "can't find key: %s", err)
+	assert(r.expiry > 0, "expiry lost in rebuild")
+}
+
+func TestBuildStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{Locality: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	var kb, vb uint64
+	for _, s := range keyw {
+		v := strings.ToUpper(s) + "-value"
+		_, err = wr.AddKeyVals([][]byte{[]byte(s)}, [][]byte{[]byte(v)})
+		assert(err == nil, "can't add key-val: %s", err)
+		kb += uint64(len(s))
+		vb += uint64(len(v))
+	}
+
+	st := wr.Stats()
+	assert(st.Records == uint64(len(keyw)), "exp %d records, saw %d", len(keyw), st.Records)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	st = wr.Stats()
+	assert(st.Records == uint64(len(keyw)), "exp %d records, saw %d", len(keyw), st.Records)
+	assert(st.KeyBytes == kb, "exp %d key bytes, saw %d", kb, st.KeyBytes)
+	assert(st.ValBytes == vb, "exp %d value bytes, saw %d", vb, st.ValBytes)
+	assert(st.RecordBytes > kb+vb, "record bytes %d too small", st.RecordBytes)
+	assert(st.OffsetTblSize == 8*st.Records, "offset table size mismatch: %d", st.OffsetTblSize)
+	assert((64+st.RecordBytes+st.PadBytes)%uint64(os.Getpagesize()) == 0, "offset table not aligned")
+	assert(st.MPHLevels > 0 && st.MPHBits > 0 && st.MPHBitsPerKey > 0, "missing MPH stats")
+	assert(len(st.MPHConstruction.Levels) == st.MPHLevels, "exp %d MPH levels, saw %d", st.MPHLevels, len(st.MPHConstruction.Levels))
+	assert(st.MPHConstruction.Keys == st.Records, "exp %d MPH keys, saw %d", st.Records, st.MPHConstruction.Keys)
+	assert(len(st.String()) > 0, "empty stats")
+
+	fi, err := os.Stat(fn)
+	assert(err == nil, "can't stat %s: %s", fn, err)
+	assert(uint64(fi.Size()) == st.FileSize, "exp file size %d, saw %d", st.FileSize, fi.Size())
+}
+
+func TestInfo(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{PrefixCompress: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	for _, s := range keyw {
+		_, err = wr.AddKeyVals([][]byte{[]byte(s)}, [][]byte{[]byte(s)})
+		assert(err == nil, "can't add key-val: %s", err)
+	}
+
+	err = wr.SetMetadata([]byte("build 42"))
+	assert(err == nil, "can't set metadata: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	st := wr.Stats()
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	in := rd.Info()
+	assert(in.Name == fn, "exp name %s, saw %s", fn, in.Name)
+	assert(in.Version == FormatVersion, "exp version %d, saw %d", FormatVersion, in.Version)
+	assert(in.Keys == st.Records, "exp %d keys, saw %d", st.Records, in.Keys)
+	assert(in.Salt == rd.salt, "salt mismatch")
+	assert(uint64(in.Size) == st.FileSize, "exp size %d, saw %d", st.FileSize, in.Size)
+	assert(in.OffsetTbl == 64+st.RecordBytes+st.PadBytes, "offset table at %d", in.OffsetTbl)
+	assert(in.OffsetTblSize == st.OffsetTblSize, "exp offset table size %d, saw %d", st.OffsetTblSize, in.OffsetTblSize)
+	assert(in.ValueRegion == 0, "unexpected value region")
+	assert(in.MPHLevels == st.MPHLevels, "exp %d levels, saw %d", st.MPHLevels, in.MPHLevels)
+	assert(in.MPHBits == st.MPHBits, "exp %d MPH bits, saw %d", st.MPHBits, in.MPHBits)
+	assert(in.MPHBitsPerKey == st.MPHBitsPerKey, "bits/key mismatch")
+	assert(in.MPHSize == st.MPHSize, "exp MPH size %d, saw %d", st.MPHSize, in.MPHSize)
+	assert(string(in.Metadata) == "build 42", "metadata mismatch: %s", in.Metadata)
+	assert(in.Checksum == rd.csum, "checksum mismatch")
+	assert(in.BaseChecksum == nil, "unexpected base checksum")
+
+	exp := []string{"varlen", "chunked-checksum", "crc32c", "prefix-compressed"}
+	if !haveExtHash {
+		exp = append(exp, "stdlib-hash")
+	}
+	assert(strings.Join(in.Features, ",") == strings.Join(exp, ","), "exp features %v, saw %v", exp, in.Features)
+	assert(strings.Contains(in.String(), "prefix-compressed"), "features not described")
+}
+
+func TestFreezeAuto(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	assert(autoGamma(10, Gamma) == Gamma, "small key space: wrong gamma")
+	assert(autoGamma(largeKeys, Gamma) == largeGamma, "large key space: wrong gamma")
+	assert(autoGamma(largeKeys, 5.0) == 5.0, "large key space: gamma not preserved")
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.FreezeAuto()
+	assert(err == nil, "freeze failed: %s", err)
+
+	err = wr.FreezeAuto()
+	assert(err == ErrFrozen, "froze twice: %v", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch; saw %s", k, v)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	assert := newAsserter(t)
+
+	dn, err := ioutil.TempDir("", "bbhash")
+	assert(err == nil, "can't make temp dir: %s", err)
+	defer os.RemoveAll(dn)
+
+	fn := filepath.Join(dn, "mph.db")
+	txt := filepath.Join(dn, "input.txt")
+
+	data := "k1 v1\nk2 v22\n\nk1 again\nnovalue\nk3 value3\n"
+	err = ioutil.WriteFile(txt, []byte(data), 0600)
+	assert(err == nil, "can't write %s: %s", txt, err)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{DryRun: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddTextFile(txt, " ")
+	assert(err == nil, "can't add text: %s", err)
+	assert(n == 3, "exp 3 records, saw %d", n)
+
+	n, err = wr.AddCSVStream(strings.NewReader("k4,v4\nshort\nk2,dup\n"), ',', 0, 0, 1)
+	assert(err == nil, "can't add csv: %s", err)
+	assert(n == 1, "exp 1 record, saw %d", n)
+
+	n, err = wr.AddKeyValReader([]byte("k5"), strings.NewReader("value5"), 6)
+	assert(err == nil, "can't add stream: %s", err)
+	assert(n == 1, "stream key not added")
+
+	src := wr.Sources()
+	assert(len(src) == 2, "exp 2 sources, saw %d", len(src))
+
+	s := src[0]
+	assert(s.Name == txt, "wrong source name %s", s.Name)
+	assert(s.Records == 3 && s.Dups == 1 && s.Skipped == 1,
+		"text: wrong counts: %d records, %d dups, %d skipped", s.Records, s.Dups, s.Skipped)
+	assert(s.MaxKeyLen == 2 && s.MaxValLen == 7, "text: wrong max sizes %d, %d", s.MaxKeyLen, s.MaxValLen)
+
+	s = src[1]
+	assert(s.Name == "", "wrong stream name %s", s.Name)
+	assert(s.Records == 1 && s.Dups == 1 && s.Skipped == 1,
+		"csv: wrong counts: %d records, %d dups, %d skipped", s.Records, s.Dups, s.Skipped)
+
+	st := wr.Stats()
+	assert(st.Records == 5, "exp 5 records, saw %d", st.Records)
+	assert(st.RecordBytes > 0, "no record size estimate")
+
+	err = wr.Freeze(0)
+	assert(err == ErrDryRun, "dry run froze: %v", err)
+
+	wr.Abort()
+
+	ents, err := ioutil.ReadDir(dn)
+	assert(err == nil, "can't read %s: %s", dn, err)
+	assert(len(ents) == 1, "dry run wrote files: %d entries", len(ents))
+}
+
+func TestReproducible(t *testing.T) {
+	assert := newAsserter(t)
+
+	dn, err := ioutil.TempDir("", "bbhash")
+	assert(err == nil, "can't make temp dir: %s", err)
+	defer os.RemoveAll(dn)
+
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("https://example.com/path/%d", i))
+	}
+
+	opt := WriterOptions{
+		Reproducible:   true,
+		Seed:           42,
+		PrefixCompress: true,
+	}
+
+	// build a DB from 'keys' in the given order of indices
+	build := func(nm string, opt WriterOptions, order []int) []byte {
+		fn := filepath.Join(dn, nm)
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		for _, i := range order {
+			_, err = wr.AddKeyVals(keys[i:i+1], keys[i:i+1])
+			assert(err == nil, "can't add key-val: %s", err)
+		}
+
+		err = wr.SetMetadata([]byte("meta"))
+		assert(err == nil, "can't set metadata: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		b, err := ioutil.ReadFile(fn)
+		assert(err == nil, "can't read %s: %s", fn, err)
+		return b
+	}
+
+	fwd := make([]int, len(keys))
+	rev := make([]int, len(keys))
+	for i := range keys {
+		fwd[i] = i
+		rev[i] = len(keys) - 1 - i
+	}
+
+	a := build("a.db", opt, fwd)
+	b := build("b.db", opt, rev)
+	assert(bytes.Equal(a, b), "builds with the same seed differ")
+
+	// the temp file is elsewhere
+	topt := opt
+	topt.TmpDir = os.TempDir()
+	x := build("x.db", topt, fwd)
+	assert(bytes.Equal(a, x), "builds with and without TmpDir differ")
+
+	opt.Seed = 43
+	c := build("c.db", opt, fwd)
+	assert(!bytes.Equal(a, c), "builds with different seeds are identical")
+
+	rd, err := NewDBReader(filepath.Join(dn, "b.db"), 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch; saw %s", k, v)
+	}
+
+	opt.Key = []byte("0123456789abcdef")
+	_, err = NewDBWriterWithOptions(filepath.Join(dn, "d.db"), opt)
+	assert(err != nil, "created an encrypted reproducible DB")
+}
+
+func TestEmptyValues(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := [][]byte{[]byte("k0"), []byte("k1"), []byte("k2")}
+	vals := [][]byte{[]byte("v0"), []byte(""), nil}
+
+	for _, enc := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		var key []byte
+		if enc {
+			key = []byte("0123456789abcdef")
+		}
+
+		wr, err := NewDBWriterWithOptions(fn, WriterOptions{Key: key, DedupValues: true})
+		assert(err == nil, "can't create db: %s", err)
+
+		n, err := wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-val: %s", err)
+		assert(n == 3, "exp 3 records, saw %d", n)
+
+		n, err = wr.AddCSVStream(strings.NewReader("k3,\nk4,v4\n"), ',', 0, 0, 1)
+		assert(err == nil, "can't add csv: %s", err)
+		assert(n == 2, "exp 2 csv records, saw %d", n)
+
+		if !enc {
+			n, err = wr.AddKeyValReader([]byte("k5"), strings.NewReader(""), 0)
+			assert(err == nil, "can't add stream: %s", err)
+			assert(n == 1, "stream key not added")
+		}
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := newDBReader(fn, 10, key)
+		assert(err == nil, "read failed: %s", err)
+
+		exp := map[string]string{"k0": "v0", "k1": "", "k2": "", "k3": "", "k4": "v4"}
+		if !enc {
+			exp["k5"] = ""
+		}
+
+		for k, v := range exp {
+			x, err := rd.Find([]byte(k))
+			assert(err == nil, "enc %v: can't find key %s: %s", enc, k, err)
+			assert(string(x) == v, "enc %v: key %s: exp '%s', saw '%s'", enc, k, v, x)
+
+			_, ok := rd.Lookup([]byte(k))
+			assert(ok, "enc %v: can't lookup key %s", enc, k)
+		}
+		rd.Close()
+	}
+}
+
+func TestAppFlags(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	const tombstone byte = 0x81
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{Locality: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	half := len(keys) / 2
+	_, err = wr.AddKeyValsWithFlags(keys[:half], keys[:half], tombstone)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	_, err = wr.AddKeyVals(keys[half:], keys[half:])
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		exp := tombstone
+		if i >= half {
+			exp = 0
+		}
+
+		v, f, err := rd.FindWithFlags(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch; saw %s", k, v)
+		assert(f == exp, "key %s: exp flags %#x, saw %#x", k, exp, f)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	opt := WriterOptions{
+		MaxKeyLen:   8,
+		MaxValueLen: 8,
+		MaxRecords:  4,
+	}
+
+	wr, err := NewDBWriterWithOptions(fn, opt)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("a-very-long-key")}, [][]byte{[]byte("v")})
+	assert(errors.Is(err, ErrKeyTooLong), "long key: %v", err)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("k")}, [][]byte{[]byte("a-very-long-value")})
+	assert(errors.Is(err, ErrValueTooLong), "long value: %v", err)
+
+	_, err = wr.AddKeyValReader([]byte("k"), strings.NewReader("a-very-long-value"), 17)
+	assert(errors.Is(err, ErrValueTooLong), "long streamed value: %v", err)
+
+	// oversized and malformed lines are skipped by default
+	txt := "k1 v1\nthis-key-is-too-long v2\nk2 value-too-long\nnovalue\nk3 v3\n"
+	n, err := wr.AddTextStream(strings.NewReader(txt), " ")
+	assert(err == nil, "can't add text: %s", err)
+	assert(n == 2, "exp 2 records, saw %d", n)
+
+	src := wr.Sources()
+	assert(src[0].Skipped == 3, "exp 3 skipped lines, saw %d", src[0].Skipped)
+
+	keys := [][]byte{[]byte("k1"), []byte("k4"), []byte("k5"), []byte("k6")}
+	n, err = wr.AddKeyVals(keys, keys)
+	assert(errors.Is(err, ErrTooManyRecords), "too many records: %v", err)
+	assert(n == 2, "exp 2 records, saw %d", n)
+	wr.Abort()
+
+	// strict mode fails on the first bad line
+	opt.Strict = true
+	opt.MaxRecords = 0
+
+	for _, txt := range []string{"k1 v1\nnovalue\n", "k1 v1\nk2 value-too-long\n"} {
+		wr, err = NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddTextStream(strings.NewReader(txt), " ")
+		assert(err != nil, "strict: added bad text")
+		wr.Abort()
+	}
+
+	wr, err = NewDBWriterWithOptions(fn, opt)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddTextStream(strings.NewReader("k1 v1\n\nnovalue\n"), " ")
+	assert(errors.Is(err, ErrMalformedInput), "strict: malformed line: %v", err)
+	assert(strings.Contains(err.Error(), "line 3"), "strict: wrong line in %s", err)
+
+	_, err = wr.AddCSVStream(strings.NewReader("k2,v2\nshort\n"), ',', 0, 0, 1)
+	assert(errors.Is(err, ErrMalformedInput), "strict: short csv row: %v", err)
+
+	_, err = wr.AddCSVStream(strings.NewReader("k3,\"v3\n"), ',', 0, 0, 1)
+	assert(errors.Is(err, ErrMalformedInput), "strict: bad csv quoting: %v", err)
+	wr.Abort()
+}
+
+func TestSplitValues(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	_, err := NewDBWriterWithOptions(fn, WriterOptions{SplitValues: true, Key: []byte("0123456789abcdef")})
+	assert(err != nil, "created an encrypted split DB")
+
+	opt := WriterOptions{
+		SplitValues:    true,
+		PrefixCompress: true,
+		DedupValues:    true,
+	}
+
+	wr, err := NewDBWriterWithOptions(fn, opt)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 200)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("/some/common/path/%d", i))
+		vals[i] = []byte(fmt.Sprintf("value-%d", i%10))
+	}
+	vals[7] = nil
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	_, err = wr.AddKeyValReader([]byte("streamed"), strings.NewReader("streamed value"), 14)
+	assert(err == nil, "can't add stream: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	assert((rd.flags&flagSplit) > 0, "DB isn't split")
+	assert(rd.valoff > 64, "no value region")
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: exp '%s', saw '%s'", k, vals[i], v)
+	}
+
+	v, err := rd.Find([]byte("streamed"))
+	assert(err == nil, "can't find streamed key: %s", err)
+	assert(string(v) == "streamed value", "streamed value mismatch: %s", v)
+	rd.Close()
+
+	// the 10 distinct values are stored once
+	st := wr.Stats()
+	assert(st.RecordBytes < uint64(rd.valoff)-64+100, "values not deduplicated")
+
+	// corrupt the value region: values fail their checksum but keys are
+	// intact.
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	for i := rd.valoff; i < rd.valoff+8; i++ {
+		b[i] ^= 0xff
+	}
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// the corrupt value may be the streamed one
+	var bad int
+	for _, k := range append(keys, []byte("streamed")) {
+		assert(rd.Contains(k), "key %s not in db", k)
+		if _, err := rd.Find(k); err != nil {
+			bad++
+		}
+	}
+	assert(bad > 0, "corrupt value not detected")
+}
+
+func TestNamespaces(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	fn2 := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+	defer os.Remove(fn2)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := [][]byte{[]byte("alice"), []byte("bob")}
+	n, err := wr.AddKeyVals(keys, [][]byte{[]byte("a0"), []byte("b0")})
+	assert(err == nil && n == 2, "can't add key-vals: %s", err)
+
+	n, err = wr.AddKeyValsIn(1, keys, [][]byte{[]byte("a1"), []byte("b1")})
+	assert(err == nil && n == 2, "can't add key-vals to ns 1: %s", err)
+
+	n, err = wr.AddKeyValsIn(2, [][]byte{[]byte("carol"), []byte("carol")}, [][]byte{[]byte("c2"), []byte("dup")})
+	assert(err == nil && n == 1, "exp 1 record in ns 2, saw %d: %s", n, err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	check := func(rd *DBReader) {
+		exp := []struct {
+			ns  uint8
+			key string
+			val string
+		}{
+			{0, "alice", "a0"},
+			{0, "bob", "b0"},
+			{1, "alice", "a1"},
+			{1, "bob", "b1"},
+			{2, "carol", "c2"},
+		}
+
+		for _, e := range exp {
+			v, err := rd.FindIn(e.ns, []byte(e.key))
+			assert(err == nil, "ns %d: can't find key %s: %s", e.ns, e.key, err)
+			assert(string(v) == e.val, "ns %d: key %s: exp '%s', saw '%s'", e.ns, e.key, e.val, v)
+		}
+
+		v, err := rd.Find([]byte("alice"))
+		assert(err == nil && string(v) == "a0", "default ns lookup failed: %s", err)
+
+		_, err = rd.Find([]byte("carol"))
+		assert(err == ErrNoKey, "found key from ns 2 in default ns")
+		_, err = rd.FindIn(1, []byte("carol"))
+		assert(err == ErrNoKey, "found key from ns 2 in ns 1")
+		assert(!rd.Contains([]byte("carol")), "default ns contains key from ns 2")
+	}
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.TotalKeys() == 5, "exp 5 keys, saw %d", rd.TotalKeys())
+	check(rd)
+
+	// namespaces survive a merge
+	wr, err = NewDBWriter(fn2)
+	assert(err == nil, "can't create db: %s", err)
+	n, err = wr.AddAll(rd)
+	assert(err == nil && n == 5, "exp 5 merged records, saw %d: %s", n, err)
+	rd.Close()
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err = NewDBReader(fn2, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+	check(rd)
+}
+
+func TestExists(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	big := make([]byte, 65536)
+	keys := [][]byte{[]byte("small"), []byte("big")}
+	_, err = wr.AddKeyVals(keys, [][]byte{[]byte("v"), big})
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		ok, err := rd.Exists(k)
+		assert(err == nil, "exists %s: %s", k, err)
+		assert(ok, "key %s doesn't exist", k)
+	}
+
+	ok, err := rd.Exists([]byte("missing"))
+	assert(err == nil && !ok, "missing key exists: %s", err)
+
+	// key-only lookups don't populate the cache
+	assert(rd.cache.Len() == 0, "exp empty cache, saw %d", rd.cache.Len())
+
+	v, err := rd.Find([]byte("big"))
+	assert(err == nil && len(v) == len(big), "can't find big value: %s", err)
+
+	ok, err = rd.Exists([]byte("big"))
+	assert(err == nil && ok, "cached key doesn't exist: %s", err)
+}
+
+func TestIndex(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, fp := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, WriterOptions{Fingerprints: fp})
+		assert(err == nil, "can't create db: %s", err)
+
+		keys := make([][]byte, 1000)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		}
+
+		_, err = wr.AddKeyVals(keys, keys)
+		assert(err == nil, "can't add key-vals: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+		defer rd.Close()
+
+		// every key has a distinct slot
+		seen := make([]bool, rd.TotalKeys())
+		for _, k := range keys {
+			i, ok := rd.Index(k)
+			assert(ok, "fp %v: no index for key %s", fp, k)
+			assert(i < uint64(len(seen)), "fp %v: key %s: index %d out of range", fp, k, i)
+			assert(!seen[i], "fp %v: key %s: duplicate index %d", fp, k, i)
+			seen[i] = true
+
+			j, _ := rd.Index(k)
+			assert(i == j, "fp %v: key %s: index changed %d, %d", fp, k, i, j)
+		}
+
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("missing-%d", i))
+			_, ok := rd.Index(k)
+			assert(!ok, "fp %v: index for missing key %s", fp, k)
+		}
+	}
+}
+
+func TestFindInto(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, split := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, WriterOptions{SplitValues: split})
+		assert(err == nil, "can't create db: %s", err)
+
+		keys := make([][]byte, 100)
+		vals := make([][]byte, len(keys))
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key-%d", i))
+			vals[i] = bytes.Repeat([]byte{byte(i)}, i*10)
+		}
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+		defer rd.Close()
+
+		buf := make([]byte, 0, 4096)
+		for i, k := range keys {
+			v, err := rd.FindInto(k, buf)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch", k)
+			assert(len(v) == 0 || &v[0] == &buf[:1][0], "key %s: value not in dst", k)
+		}
+		assert(rd.cache.Len() == 0, "exp empty cache, saw %d", rd.cache.Len())
+
+		// a small buffer is grown
+		v, err := rd.FindInto(keys[99], make([]byte, 10))
+		assert(err == nil && bytes.Equal(v, vals[99]), "can't find key with small dst: %s", err)
+
+		// cached values are copied into dst
+		_, err = rd.Find(keys[50])
+		assert(err == nil, "can't find key: %s", err)
+		v, err = rd.FindInto(keys[50], buf)
+		assert(err == nil && bytes.Equal(v, vals[50]), "can't find cached key: %s", err)
+		assert(&v[0] == &buf[:1][0], "cached value not in dst")
+
+		// a cached value that doesn't fit is still a copy
+		v, err = rd.FindInto(keys[50], nil)
+		assert(err == nil && bytes.Equal(v, vals[50]), "can't find cached key: %s", err)
+		v[0] ^= 0xff
+		v, err = rd.Find(keys[50])
+		assert(err == nil && bytes.Equal(v, vals[50]), "cached value modified: %s", err)
+
+		// a nil dst doesn't cache the record
+		n := rd.cache.Len()
+		v, err = rd.FindInto(keys[60], nil)
+		assert(err == nil && bytes.Equal(v, vals[60]), "can't find key with nil dst: %s", err)
+		assert(rd.cache.Len() == n, "exp %d cached records, saw %d", n, rd.cache.Len())
+
+		_, err = rd.FindInto([]byte("missing"), buf)
+		assert(err == ErrNoKey, "missing key: exp ErrNoKey, saw %v", err)
+	}
+}
+
+func TestConcurrentFind(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	n := 1000
+	keys := make([][]byte, n)
+	vals := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("a somewhat longer value for key %d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < n*4; i += 8 {
+				j := i % n
+				v, err := rd.Find(keys[j])
+				if err == nil && !bytes.Equal(v, vals[j]) {
+					err = fmt.Errorf("key %s: exp '%s', saw '%s'", keys[j], vals[j], v)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert(false, "concurrent find: %s", err)
+	}
+}
+
+func TestMmapReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{PrefixCompress: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 200)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("/a/common/prefix/%d", i))
+		vals[i] = []byte(fmt.Sprintf("value %d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReaderMmap(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.fmap != nil, "file not mapped")
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: exp '%s', saw '%s'", k, vals[i], v)
+	}
+
+	_, err = rd.Find([]byte("missing"))
+	assert(err == ErrNoKey, "found missing key")
+	rd.Close()
+}
+
+func TestUnsafeFind(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, split := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		opt := WriterOptions{
+			PrefixCompress: true,
+			DedupValues:    true,
+			SplitValues:    split,
+		}
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		keys := make([][]byte, 200)
+		vals := make([][]byte, len(keys))
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("/a/common/prefix/%d", i))
+			vals[i] = []byte(fmt.Sprintf("value %d", i%20))
+		}
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReaderMmap(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+		assert(rd.fmap != nil, "file not mapped")
+
+		start := uintptr(unsafe.Pointer(&rd.fmap[0]))
+		end := start + uintptr(len(rd.fmap))
+		for i, k := range keys {
+			v, err := rd.UnsafeFind(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: exp '%s', saw '%s'", k, vals[i], v)
+
+			p := uintptr(unsafe.Pointer(&v[0]))
+			assert(p >= start && p < end, "key %s: value is not in the mapping", k)
+		}
+		assert(rd.cache.Len() == 0, "exp empty cache, saw %d", rd.cache.Len())
+
+		_, err = rd.UnsafeFind([]byte("missing"))
+		assert(err == ErrNoKey, "found missing key")
+		rd.Close()
+
+		// without a mapping, UnsafeFind is Find
+		rd, err = NewDBReader(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+
+		v, err := rd.UnsafeFind(keys[3])
+		assert(err == nil && bytes.Equal(v, vals[3]), "can't find key: %s", err)
+		assert(rd.cache.Len() == 1, "exp 1 cached record, saw %d", rd.cache.Len())
+		rd.Close()
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("value %d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.SetMetadata([]byte("meta"))
+	assert(err == nil, "can't set metadata: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	rd, err := NewDBReaderAt(bytes.NewReader(b), int64(len(b)), 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.mmap == nil, "offset table is mapped")
+	assert(string(rd.Metadata()) == "meta", "metadata mismatch: %s", rd.Metadata())
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: exp '%s', saw '%s'", k, vals[i], v)
+	}
+	rd.Close()
+
+	// a truncated image is rejected
+	_, err = NewDBReaderAt(bytes.NewReader(b), int64(len(b)-1), 10)
+	assert(err != nil, "opened truncated db")
+}
+
+func TestInMemoryReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{SplitValues: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("value %d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, verify := range []bool{false, true} {
+		rd, err := NewDBReaderInMemory(fn, 10, verify)
+		assert(err == nil, "read failed: %s", err)
+		assert(rd.verified == verify, "verified: exp %v", verify)
+
+		// the file isn't needed once loaded
+		if verify {
+			os.Remove(fn)
+		}
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: exp '%s', saw '%s'", k, vals[i], v)
+		}
+		rd.Close()
+	}
+}
+
+func TestInMemoryVerify(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("key")}, [][]byte{[]byte("a longer value")})
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// corrupt the last byte of the value
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	i := bytes.Index(b, []byte("a longer value"))
+	assert(i > 0, "can't find value")
+	b[i+13] ^= 0xff
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReaderInMemory(fn, 10, true)
+	assert(err != nil, "loaded corrupt db")
+
+	rd, err := NewDBReaderInMemory(fn, 10, false)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find([]byte("key"))
+	assert(err != nil && err != ErrNoKey, "corrupt record not detected")
+
+	st := rd.Stats()
+	assert(st.ChecksumFailures == 1, "exp 1 checksum failure, saw %d", st.ChecksumFailures)
+}
+
+func TestClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	// Close() discards an unfrozen DB
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("key")}, [][]byte{[]byte("val")})
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	tmp := wr.fntmp
+	err = wr.Close()
+	assert(err == nil, "close failed: %s", err)
+	assert(wr.Close() == nil, "second close failed")
+	_, err = os.Stat(tmp)
+	assert(os.IsNotExist(err), "temp file not removed")
+	_, err = os.Stat(fn)
+	assert(os.IsNotExist(err), "aborted db exists")
+
+	// and does nothing after Freeze()
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals([][]byte{[]byte("key")}, [][]byte{[]byte("val")})
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(wr.Close() == nil, "close after freeze failed")
+
+	for _, mmap := range []bool{false, true} {
+		var rd *DBReader
+		if mmap {
+			rd, err = NewDBReaderMmap(fn, 10)
+		} else {
+			rd, err = NewDBReader(fn, 10)
+		}
+		assert(err == nil, "read failed: %s", err)
+
+		_, err = rd.Find([]byte("key"))
+		assert(err == nil, "can't find key: %s", err)
+
+		err = rd.Close()
+		assert(err == nil, "close failed: %s", err)
+		assert(rd.Close() == nil, "second close failed")
+
+		_, err = rd.Find([]byte("key"))
+		assert(err == ErrClosed, "find: exp ErrClosed, saw %v", err)
+		_, err = rd.FindInto([]byte("key"), nil)
+		assert(err == ErrClosed, "find into: exp ErrClosed, saw %v", err)
+		_, err = rd.UnsafeFind([]byte("key"))
+		assert(err == ErrClosed, "unsafe find: exp ErrClosed, saw %v", err)
+		assert(!rd.Contains([]byte("key")), "closed db contains key")
+
+		_, errs := rd.FindMany([][]byte{[]byte("key")})
+		assert(errs[0] == ErrClosed, "find many: exp ErrClosed, saw %v", errs[0])
+
+		it := rd.Iter()
+		assert(!it.Next() && it.Err() == ErrClosed, "iter: exp ErrClosed, saw %v", it.Err())
+		assert(rd.VerifyAll() == ErrClosed, "verify of closed db")
+
+		info := rd.Info()
+		assert(info.MPHLevels == 0, "closed db has MPH levels")
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 20000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, mmap := range []bool{false, true} {
+		var rd *DBReader
+		if mmap {
+			rd, err = NewDBReaderMmap(fn, 0)
+		} else {
+			rd, err = NewDBReader(fn, 0)
+		}
+		assert(err == nil, "read failed: %s", err)
+
+		// lookups, batches, iterations and checks racing Close() either
+		// succeed or fail with ErrClosed
+		calls := []func(j int) error{
+			func(j int) error {
+				k := keys[j%len(keys)]
+				v, err := rd.Find(k)
+				if err == nil && !bytes.Equal(v, k) {
+					err = fmt.Errorf("key %s: value mismatch", k)
+				}
+				return err
+			},
+			func(j int) error {
+				_, errs := rd.FindMany(keys)
+				for _, err := range errs {
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			func(j int) error {
+				it := rd.Iter()
+				for it.Next() {
+					it.Index()
+				}
+				return it.Err()
+			},
+			func(j int) error {
+				return rd.VerifyAll()
+			},
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2*len(calls))
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; ; j++ {
+					err := calls[i%len(calls)](i*257 + j)
+					if err == ErrClosed {
+						return
+					}
+					if err != nil {
+						errs[i] = err
+						return
+					}
+				}
+			}(i)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		assert(rd.Close() == nil, "close failed")
+		wg.Wait()
+
+		for i, err := range errs {
+			assert(err == nil, "mmap %v: reader %d: %s", mmap, i, err)
+		}
+	}
+}
+
+func TestGetRecord(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	_, err = wr.AddKeyValsWithFlags([][]byte{[]byte("flagged")}, [][]byte{[]byte("v1")}, 0x42)
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddKeyValsWithExpiry([][]byte{[]byte("expiring")}, [][]byte{[]byte("v2")}, exp)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	r, err := rd.GetRecord([]byte("flagged"))
+	assert(err == nil, "can't get record: %s", err)
+	assert(string(r.Key) == "flagged" && string(r.Value) == "v1", "record mismatch: %+v", r)
+	assert(r.Flags == 0x42, "exp flags 0x42, saw %#x", r.Flags)
+	assert(r.Expiry.IsZero(), "record expires at %s", r.Expiry)
+	assert(r.Offset >= 64 && r.Checksum != 0, "bad offset %d or checksum %#x", r.Offset, r.Checksum)
+
+	r, err = rd.GetRecord([]byte("expiring"))
+	assert(err == nil, "can't get record: %s", err)
+	assert(string(r.Value) == "v2", "value mismatch: %s", r.Value)
+	assert(r.Expiry.Equal(exp), "exp expiry %s, saw %s", exp, r.Expiry)
+
+	_, err = rd.GetRecord([]byte("missing"))
+	assert(err == ErrNoKey, "missing key: exp ErrNoKey, saw %v", err)
+}
+
+func TestReaderOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddKeyValsWithExpiry([][]byte{[]byte("expired")}, [][]byte{[]byte("v")}, time.Unix(1, 0))
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	for _, mode := range []LoadMode{LoadFile, LoadMmap, LoadMemory} {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{
+			Mode:          mode,
+			Verify:        true,
+			CacheBytes:    50,
+			NegativeCache: 10,
+			Advice:        AdviceRandom,
+			IgnoreExpiry:  true,
+		})
+		assert(err == nil, "mode %d: read failed: %s", mode, err)
+
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "mode %d: can't find key %s: %s", mode, k, err)
+			assert(bytes.Equal(v, k), "mode %d: key %s: value mismatch", mode, k)
+		}
+
+		_, err = rd.Find([]byte("expired"))
+		assert(err == nil, "mode %d: expired record not returned: %s", mode, err)
+		assert(rd.cache.Len() <= 5, "mode %d: cache not bounded by bytes: %d", mode, rd.cache.Len())
+		assert(rd.neg != nil, "mode %d: no negative cache", mode)
+		assert(rd.verified == (mode == LoadMemory), "mode %d: verified is %v", mode, rd.verified)
+		assert((rd.fmap != nil) == (mode == LoadMmap), "mode %d: unexpected mapping", mode)
+		rd.Close()
+	}
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{Mode: LoadMode(10)})
+	assert(err != nil, "opened db with unknown load mode")
+
+	// corrupt the last byte of a value
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	i := bytes.Index(b, []byte("key-99key-99"))
+	assert(i > 0, "can't find value")
+	b[i+11] ^= 0xff
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{Verify: true})
+	assert(err != nil, "opened corrupt db with verify")
+
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{})
+	assert(err == nil, "read failed: %s", err)
+	rd.Close()
+}
+
+func TestFindString(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 1000)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		v, err := rd.FindString(string(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+
+		v, ok := rd.LookupString(string(k))
+		assert(ok && bytes.Equal(v, k), "can't lookup key %s", k)
+	}
+
+	_, err = rd.FindString("missing")
+	assert(err == ErrNoKey, "missing key: exp ErrNoKey, saw %v", err)
+	_, ok := rd.LookupString("missing")
+	assert(!ok, "found missing key")
+
+	// the key isn't copied
+	s, b := string(keys[10]), keys[10]
+	exp := testing.AllocsPerRun(100, func() { rd.Find(b) })
+	n := testing.AllocsPerRun(100, func() { rd.FindString(s) })
+	assert(n == exp, "exp %v allocs, saw %v", exp, n)
+}
+
+// a Logger that records its messages
+type testLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Printf(f string, v ...interface{}) {
+	l.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(f, v...))
+	l.Unlock()
+}
+
+// return true if a message contains 's'
+func (l *testLogger) has(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wl := &testLogger{}
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{LowMemory: true, Logger: wl})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddKeyVals(keys[:10], keys[:10])
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddTextStream(strings.NewReader("a 1\nnovalue\nb 2\n"), " ")
+	assert(err == nil, "can't add text: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	assert(wl.has("skipped 1 malformed"), "skipped lines not logged: %q", wl.msgs)
+	assert(wl.has("discarded 10 duplicate keys"), "duplicates not logged: %q", wl.msgs)
+	assert(wl.has("bbhash: salt"), "mph construction not logged: %q", wl.msgs)
+	assert(wl.has("102 records; mph"), "freeze not logged: %q", wl.msgs)
+
+	rl := &testLogger{}
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Verify: true, Logger: rl})
+	assert(err == nil, "read failed: %s", err)
+	rd.Close()
+
+	assert(rl.has("opened 102 keys"), "open not logged: %q", rl.msgs)
+	assert(rl.has("verified 102 records"), "verify not logged: %q", rl.msgs)
+}
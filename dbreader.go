@@ -9,149 +9,969 @@
 package bbhash
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"syscall"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
+	"crypto/ed25519"
 	"crypto/sha512"
 	"crypto/subtle"
-
-	"github.com/opencoff/golang-lru"
-	"github.com/opencoff/go-fasthash"
 )
 
 // DBReader represents the query interface for a previously constructed
 // constant database (built using NewDBWriter()). The only meaningful
 // operation on such a database is Lookup().
+//
+// A DBReader is safe for concurrent use by multiple goroutines: records are
+// read with ReadAt() and never through the shared file offset. An Iterator
+// is not; each goroutine needs its own.
 type DBReader struct {
+	codec
+
 	bb *BBHash
 
-	salt    uint64
-	saltkey []byte
+	cache recordCache
+
+	// decodes the values; see SetCodec()
+	vcodec Codec
 
-	cache *lru.ARCCache
+	// buffers of the records read into the cache; nil if they aren't
+	// pooled. See SetPool().
+	pool *bufPool
 
-	// memory mapped offset table
+	// normalizes the keys that are looked up; nil if the keys of the DB
+	// aren't normalized. See KeyNormalizer().
+	knorm    func([]byte) []byte
+	normName string
+
+	// hashes of keys known to be absent; nil if not enabled
+	neg *lruCache[struct{}]
+
+	// memory mapped offset table; if the offset table is encrypted, this
+	// is an in-memory copy of the decrypted table. A compact offset table
+	// is in 'ctab' instead; its entries are 'cwidth' bytes.
 	offsets []uint64
+	mmap    []byte
+	ctab    []byte
+	cwidth  int
 
 	nkeys uint64
 
+	// user metadata
+	meta []byte
+
+	// section of the checksum of the records; nil if the DB doesn't have
+	// it. See VerifyData().
+	dsum []byte
+
+	// strong checksum of this DB; and for a delta DB, the checksum of
+	// its base DB.
+	csum [32]byte
+	base []byte
+
+	// signature of a signed DB; nil otherwise
+	sig []byte
+
+	// file size - without the signature of a signed DB; and the file
+	// offset of the offset table
+	size   int64
+	offtbl uint64
+
+	// records are at offsets below 'limit': the file size or, in a
+	// compressed DB, the end of the uncompressed record region.
+	limit int64
+
+	// index of the blocks of a compressed DB; nil otherwise
+	blocks *blockIndex
+
+	// Bloom filter of the keys; nil if the DB doesn't have one
+	bloom *bloomFilter
+
+	// checksums of the segments of the records; nil if the DB doesn't
+	// have them. If 'vsegs' is true, segments are verified when they
+	// are first read.
+	segs  *segments
+	vsegs bool
+
+	// mask of the record offset in an entry of the offset table
+	offmask uint64
+
+	// if true, expired records are returned by lookups
+	noexpiry bool
+
+	// records are read from 'ra': the file or the mapping of the whole
+	// file in 'fmap'.
+	ra   io.ReaderAt
+	fmap []byte
+
+	// the metadata is read from 'mra' by VerifyMetadata()
+	mra io.ReaderAt
+
+	// the file opened for direct I/O in LoadDirect mode; nil otherwise
+	dfd *os.File
+
+	// alignment of the records; 0 if they aren't aligned
+	align uint64
+
+	// format version of the DB
+	version int
+
+	// the whole DB in memory - for UnsafeFind(); nil if the DB is read
+	// from a file.
+	mem *memReader
+
 	fd *os.File
 	fn string
+
+	// the DB this reader shares with others; see NewSharedDBReader()
+	shared *sharedDB
+
+	// set to 1 by Close()
+	closed uint32
+
+	// number of calls reading the DB; Close() waits for them to end
+	busy int32
+}
+
+// Reader is the lookup interface common to the readers of a single DB
+// (DBReader), a sharded DB (ShardedDBReader), a delta DB (DeltaReader), a
+// stack of DBs (MultiReader), a DB that is periodically replaced
+// (ReloadableReader) and a DB with runtime changes (OverlayDB).
+type Reader interface {
+	Find(key []byte) ([]byte, error)
+	Lookup(key []byte) ([]byte, bool)
+	Contains(key []byte) bool
+	Close() error
 }
 
+var (
+	_ Reader = &DBReader{}
+	_ Reader = &ShardedDBReader{}
+	_ Reader = &DeltaReader{}
+	_ Reader = &MultiReader{}
+	_ Reader = &ReloadableReader{}
+	_ Reader = &OverlayDB{}
+)
+
 // NewDBReader reads a previously construct database in file 'fn' and prepares
 // it for querying. Records are opportunistically cached after reading from disk.
 // We retain upto 'cache' number of records in memory (default 128).
 func NewDBReader(fn string, cache int) (rd *DBReader, err error) {
-	fd, err := os.Open(fn)
+	return newDBReader(fn, cache, nil)
+}
+
+// NewDBReaderMmap is like NewDBReader except the whole DB file is memory
+// mapped; records are decoded from the mapping without a system call per
+// lookup. If the file can't be mapped (e.g., it doesn't fit in the address
+// space), the records are read from the file as usual.
+func NewDBReaderMmap(fn string, cache int) (*DBReader, error) {
+	return newDBReaderMmap(fn, cache, nil)
+}
+
+func newDBReaderMmap(fn string, cache int, key []byte) (*DBReader, error) {
+	rd, err := newDBReader(fn, cache, key)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
-		if err != nil {
-			fd.Close()
+	rd.mapFile()
+	return rd, nil
+}
+
+// read the records from a mapping of the whole file - if it can be mapped
+func (rd *DBReader) mapFile() {
+	if b, err := mmapFile(rd.fd, rd.size); err == nil {
+		rd.fmap = b
+		rd.ra = rd.recordReader(bytes.NewReader(b))
+		if rd.blocks == nil {
+			rd.mem = &memReader{rd.ra, b}
 		}
-	}()
+	}
+}
 
-	// Number of records to cache
-	if cache <= 0 {
-		cache = 128
+// NewDBReaderInMemory is like NewDBReader except the whole DB file is read
+// into memory; lookups never touch the disk. If 'verify' is true, every
+// record is verified when the DB is loaded and the record checksums aren't
+// verified again by lookups. This is meant for small DBs.
+func NewDBReaderInMemory(fn string, cache int, verify bool) (*DBReader, error) {
+	return newDBReaderInMemory(fn, cache, nil, verify, checkStrong)
+}
+
+func newDBReaderInMemory(fn string, cache int, key []byte, verify bool, check openCheck) (*DBReader, error) {
+	fd, err := openLocked(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	b := make([]byte, st.Size())
+	if _, err = io.ReadFull(fd, b); err != nil {
+		return nil, fmt.Errorf("%s: can't read: %w", fn, err)
+	}
+
+	rd := &DBReader{
+		ra: bytes.NewReader(b),
+		fn: fn,
+	}
+
+	if err = rd.open(int64(len(b)), cache, key, check); err != nil {
+		return nil, err
+	}
+	if rd.blocks == nil {
+		rd.mem = &memReader{rd.ra, b}
+	}
+
+	if verify {
+		err = rd.iterate(func(r *record) error {
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		rd.verified = true
+		rd.ResetStats()
 	}
+	return rd, nil
+}
+
+// LoadMode selects how the records of a DB are read; see ReaderOptions.
+type LoadMode int
+
+const (
+	// Records are read from the file; see NewDBReader()
+	LoadFile LoadMode = iota
+
+	// The whole file is memory mapped; see NewDBReaderMmap()
+	LoadMmap
+
+	// The whole file is read into memory; see NewDBReaderInMemory()
+	LoadMemory
+
+	// Records are read from the file with direct I/O - bypassing the page
+	// cache - in whole blocks of 4096 bytes; the offset table and MPH are
+	// read as in LoadFile. Where direct I/O isn't supported (by the
+	// platform or the file system), records are read as in LoadFile. See
+	// WriterOptions.RecordAlign.
+	LoadDirect
+)
+
+// Advice tells the OS how the memory mapped parts of a DB will be accessed
+// (madvise(2)); it is ignored on platforms without madvise.
+type Advice int
+
+const (
+	AdviceNormal     Advice = iota // no special treatment
+	AdviceRandom                   // random access; no read ahead
+	AdviceSequential               // sequential access; aggressive read ahead
+	AdviceWillNeed                 // accessed soon; read ahead now
+)
+
+// ReaderOptions control how a DB is opened and queried by
+// NewDBReaderWithOptions(). The zero value opens a DB like NewDBReader().
+type ReaderOptions struct {
+	// Number of records to cache (default 128)
+	Cache int
+
+	// If positive, the cache is bounded by the size of the cached keys
+	// and values rather than by Cache; see DBReader.SetCacheBytes().
+	CacheBytes int64
+
+	// How the cache of Cache records evicts them; see
+	// DBReader.SetCachePolicy(). It is ignored if CacheBytes is set.
+	CachePolicy CachePolicy
+
+	// If not nil, the values returned by lookups are decoded by Codec;
+	// see DBReader.SetCodec().
+	Codec Codec
+
+	// Number of absent keys to cache; see DBReader.SetNegativeCache().
+	NegativeCache int
+
+	// If true, the records read into the cache are read into pooled
+	// buffers that are reused once the records are evicted; see
+	// DBReader.SetPool().
+	Pool bool
+
+	// Key of an encrypted DB; see NewEncryptedDBReader().
+	Key []byte
+
+	// How the records are read
+	Mode LoadMode
+
+	// If true, every record is verified when the DB is opened (see
+	// DBReader.VerifyAll()). In LoadMemory mode, lookups then don't
+	// verify the record checksums again.
+	Verify bool
+
+	// If true and the DB has segment checksums (see
+	// WriterOptions.SegmentSize), lookups verify each segment of the
+	// records the first time they read from it; a corrupt segment fails
+	// the lookups that read it with a SegmentError. The keys and values
+	// returned by UnsafeFind() are then copies.
+	VerifySegments bool
+
+	// If not nil, the DB must be signed with the private key of
+	// PublicKey (see WriterOptions.SigningKey); opening a DB that isn't
+	// fails with ErrBadSignature. Lookups then verify the segments of
+	// the records they read (see VerifySegments); so every key and value
+	// they return is covered by the signature. It can't be combined
+	// with FastOpen.
+	PublicKey ed25519.PublicKey
+
+	// If true, the strong checksum of the metadata - the file header,
+	// offset table and MPH - isn't verified when the DB is opened; so
+	// opening a large DB doesn't read all of its metadata. Lookups still
+	// verify the checksum of every record they read; a corrupt offset
+	// table or MPH makes them fail to find keys or return ErrCorrupt.
+	// DBReader.VerifyMetadata() runs the full check later - on demand or
+	// in a goroutine.
+	FastOpen bool
+
+	// If true, only the CRC32C of the metadata is verified when the DB is
+	// opened - not its strong checksum; the CRC is computed in hardware
+	// and detects accidental corruption of the metadata, not tampering.
+	// DBs built before the CRC was added are verified in full.
+	// DBReader.VerifyMetadata() runs the full check later. FastOpen takes
+	// precedence; it can't be combined with PublicKey.
+	QuickCheck bool
+
+	// Access pattern of the memory mapped offset table - and the whole
+	// file in LoadMmap mode; see DBReader.Advise().
+	Advice Advice
+
+	// If true, the memory mapped offset table is locked in memory; see
+	// DBReader.LockOffsets().
+	Mlock bool
+
+	// If not nil, lookup metrics are reported to Metrics; see
+	// DBReader.SetMetrics().
+	Metrics Metrics
+
+	// If true, lookups return expired records; see
+	// DBReader.IgnoreExpiry().
+	IgnoreExpiry bool
+
+	// If not nil, Logger receives the time taken to open and verify the
+	// DB and warnings about options that couldn't be applied.
+	Logger Logger
+}
+
+// NewDBReaderWithOptions is like NewDBReader except the DB is opened and
+// queried as described by 'opt'.
+func NewDBReaderWithOptions(fn string, opt ReaderOptions) (*DBReader, error) {
+	var rd *DBReader
+	var err error
 
-	rd = &DBReader{
-		saltkey: make([]byte, 16),
-		fd:      fd,
-		fn:      fn,
+	if opt.PublicKey != nil && (opt.FastOpen || opt.QuickCheck) {
+		return nil, fmt.Errorf("%s: signed DBs can't be opened without verifying them", fn)
 	}
 
-	var st os.FileInfo
-	var hdr *header
+	check := checkStrong
+	if opt.FastOpen {
+		check = checkNone
+	} else if opt.QuickCheck {
+		check = checkCRC
+	}
 
-	st, err = fd.Stat()
+	start := time.Now()
+	switch opt.Mode {
+	case LoadFile:
+		rd, err = openDBReader(fn, opt.Cache, opt.Key, check)
+	case LoadMmap:
+		rd, err = openDBReader(fn, opt.Cache, opt.Key, check)
+		if err == nil {
+			rd.mapFile()
+		}
+	case LoadMemory:
+		rd, err = newDBReaderInMemory(fn, opt.Cache, opt.Key, opt.Verify, check)
+	case LoadDirect:
+		rd, err = openDBReader(fn, opt.Cache, opt.Key, check)
+		if err == nil {
+			if e := rd.openDirect(); e != nil {
+				logf(opt.Logger, "%s: can't use direct I/O; reading it from the file: %s", fn, e)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown load mode %d", fn, opt.Mode)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("%s: can't stat: %s", fn, err)
+		return nil, err
 	}
 
-	if st.Size() < (64 + 32) {
-		return nil, fmt.Errorf("%s: file too small or corrupted", fn)
+	if opt.Mode == LoadMmap && rd.fmap == nil {
+		logf(opt.Logger, "%s: can't mmap the DB; reading it from the file", fn)
 	}
 
-	var hdrb [64]byte
+	if opt.FastOpen {
+		logf(opt.Logger, "%s: opened %d keys in %s (metadata not verified)", fn, rd.nkeys, time.Since(start))
+	} else if opt.QuickCheck && (rd.flags&flagCRC32C) > 0 {
+		logf(opt.Logger, "%s: opened %d keys in %s (metadata CRC verified)", fn, rd.nkeys, time.Since(start))
+	} else {
+		logf(opt.Logger, "%s: opened %d keys in %s", fn, rd.nkeys, time.Since(start))
+	}
+
+	if err = rd.setOptions(&opt); err != nil {
+		rd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+// apply the options of a newly opened DB
+func (rd *DBReader) setOptions(opt *ReaderOptions) error {
+	if opt.PublicKey != nil {
+		if err := rd.VerifySignature(opt.PublicKey); err != nil {
+			return err
+		}
+	}
 
-	_, err = io.ReadFull(fd, hdrb[:])
+	if opt.VerifySegments || opt.PublicKey != nil {
+		if rd.segs == nil {
+			logf(opt.Logger, "%s: DB has no segment checksums", rd.fn)
+		}
+		rd.vsegs = rd.segs != nil
+
+		// records aliased from memory aren't read through rd.ra
+		if rd.vsegs {
+			rd.mem = nil
+		}
+	}
+
+	if opt.Verify && opt.Mode != LoadMemory {
+		start := time.Now()
+		if err := rd.VerifyAll(); err != nil {
+			return err
+		}
+		rd.ResetStats()
+		logf(opt.Logger, "%s: verified %d records in %s", rd.fn, rd.nkeys, time.Since(start))
+	}
+
+	if opt.CacheBytes > 0 {
+		rd.SetCacheBytes(opt.CacheBytes)
+	} else if opt.CachePolicy != CacheARC {
+		if err := rd.SetCachePolicy(opt.CachePolicy, opt.Cache); err != nil {
+			return err
+		}
+	}
+	if opt.Codec != nil {
+		rd.SetCodec(opt.Codec)
+	}
+	if opt.Pool {
+		rd.SetPool(true)
+	}
+	if opt.NegativeCache > 0 {
+		if err := rd.SetNegativeCache(opt.NegativeCache); err != nil {
+			return err
+		}
+	}
+
+	if opt.Advice != AdviceNormal {
+		if err := rd.Advise(opt.Advice); err != nil {
+			return err
+		}
+	}
+	if opt.Mlock {
+		if err := rd.LockOffsets(); err != nil {
+			return err
+		}
+	}
+
+	if opt.Metrics != nil {
+		rd.SetMetrics(opt.Metrics)
+	}
+	rd.IgnoreExpiry(opt.IgnoreExpiry)
+	return nil
+}
+
+// NewEncryptedDBReader is like NewDBReader except it opens a DB constructed by
+// NewEncryptedDBWriter() using the same key 'key'.
+func NewEncryptedDBReader(fn string, cache int, key []byte) (*DBReader, error) {
+	return newDBReader(fn, cache, key)
+}
+
+// NewDBReaderAt is like NewDBReader except the DB is read from 'r' which
+// holds 'size' bytes; this serves DBs from sources other than files (e.g.,
+// embed.FS, zip archives or custom storage). The offset table is read into
+// memory rather than memory mapped. 'r' must be safe for concurrent use if
+// the DBReader is used concurrently; the caller closes 'r' (if needed) after
+// closing the DBReader.
+func NewDBReaderAt(r io.ReaderAt, size int64, cache int) (*DBReader, error) {
+	rd := &DBReader{
+		ra: r,
+		fn: "<reader>",
+	}
+
+	if err := rd.open(size, cache, nil, checkStrong); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+func newDBReader(fn string, cache int, key []byte) (*DBReader, error) {
+	return openDBReader(fn, cache, key, checkStrong)
+}
+
+// open the DB in file 'fn'; 'check' selects how its metadata is verified.
+func openDBReader(fn string, cache int, key []byte, check openCheck) (*DBReader, error) {
+	fd, err := openLocked(fn)
 	if err != nil {
-		return nil, fmt.Errorf("%s: can't read header: %s", fn, err)
+		return nil, err
 	}
 
-	hdr, err = rd.decodeHeader(hdrb[:], st.Size())
+	st, err := fd.Stat()
 	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	rd := &DBReader{
+		ra: fd,
+		fd: fd,
+		fn: fn,
+	}
+
+	if err = rd.open(st.Size(), cache, key, check); err != nil {
+		fd.Close()
 		return nil, err
 	}
+	return rd, nil
+}
 
-	err = rd.verifyChecksum(hdrb[:], hdr.offtbl, st.Size())
+// open the DB file 'fn' for reading with a shared lock; the lock fails with
+// ErrLocked if a writer holds it.
+func openLocked(fn string) (*os.File, error) {
+	fd, err := os.Open(fn)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = flock(fd, false); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return fd, nil
+}
+
+// how the metadata of a DB is verified when it is opened
+type openCheck int
+
+const (
+	checkStrong openCheck = iota // verify the strong checksum
+	checkNone                    // don't verify the metadata
+	checkCRC                     // verify the CRC32C; or the strong checksum if there is none
+)
+
+// read and verify the DB of 'sz' bytes from rd.ra and prepare it for
+// querying; the offset table is memory mapped if the DB is a file. 'check'
+// selects how the metadata is verified.
+func (rd *DBReader) open(sz int64, cache int, key []byte, check openCheck) error {
+	fn := rd.fn
+
+	// Number of records to cache
+	if cache <= 0 {
+		cache = 128
+	}
+
+	if sz < (64 + 32) {
+		return fmt.Errorf("%s: %w", fn, ErrTooSmall)
+	}
+
+	var hdrb [64]byte
+
+	_, err := rd.ra.ReadAt(hdrb[:], 0)
+	if err != nil {
+		return fmt.Errorf("%s: can't read header: %w", fn, err)
+	}
+
+	hdr, err := rd.decodeHeader(hdrb[:], sz)
+	if err != nil {
+		return err
+	}
+
+	// the signature of a signed DB follows the trailer; the rest of the
+	// DB ends before it.
+	if (hdr.flags & flagSigned) > 0 {
+		if sz < 64+32+ed25519.SignatureSize || hdr.offtbl >= uint64(sz-32-ed25519.SignatureSize) {
+			return fmt.Errorf("%s: %w", fn, ErrCorruptHeader)
+		}
+
+		sz -= ed25519.SignatureSize
+		rd.sig = make([]byte, ed25519.SignatureSize)
+		if _, err = rd.ra.ReadAt(rd.sig, sz); err != nil {
+			return fmt.Errorf("%s: can't read signature: %w", fn, err)
+		}
+	}
+
+	rd.mra = rd.ra
+	switch {
+	case check == checkNone:
+		_, err = rd.ra.ReadAt(rd.csum[:], sz-32)
+		if err != nil {
+			return fmt.Errorf("%s: can't read checksum: %w", fn, err)
+		}
+	case check == checkCRC && (hdr.flags&flagCRC32C) > 0:
+		rd.csum, err = rd.verifyCRC(rd.ra, hdrb[:], hdr, sz)
+		if err != nil {
+			return err
+		}
+	default:
+		rd.csum, err = rd.verifyChecksum(rd.ra, hdrb[:], hdr, sz)
+		if err != nil {
+			return err
+		}
+	}
+
 	// sanity check - even though we have verified the strong checksum
-	tblsz := hdr.nkeys * 8
-	if uint64(st.Size()) < (64 + 32 + tblsz) {
-		return nil, fmt.Errorf("%s: corrupt header", fn)
+	tblsz := offTableSize(hdr.flags, hdr.nkeys, hdr.offtbl)
+	if hdr.nkeys > uint64(sz)/8 || uint64(sz) < (64+32+tblsz) {
+		return fmt.Errorf("%s: %w", fn, ErrCorruptHeader)
 	}
 
-	rd.cache, err = lru.NewARC(cache)
+	rd.flags = hdr.flags
+	if (hdr.flags & flagEncrypted) > 0 {
+		if key == nil {
+			return fmt.Errorf("%s: %w", fn, ErrEncrypted)
+		}
+
+		var kcv uint64
+		rd.aead, kcv, err = newAEAD(key, hdr.salt)
+		if err != nil {
+			return err
+		}
+		if kcv != hdr.keychk {
+			return fmt.Errorf("%s: %w", fn, ErrBadKey)
+		}
+	}
+
+	rd.cache, err = newARCCache(cache)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Now, we are certain that the header, the offset-table and bbhash bits are
-	// all valid and uncorrupted.
+	// all valid and uncorrupted - unless 'check' skipped the checksum.
+
+	// mmap the offset table of a file. Sealed offset tables, those of
+	// DBs that aren't files and those that can't be mapped (e.g., on
+	// platforms without mmap) are read into memory.
+	if (hdr.flags & flagCompactOffsets) > 0 {
+		if err = rd.openCompact(hdr.offtbl, hdr.nkeys); err != nil {
+			return err
+		}
+	} else if (hdr.flags&flagEncOffsets) == 0 && rd.fd != nil {
+		rd.offsets, rd.mmap, err = mmapUint64(rd.fd, hdr.offtbl, hdr.nkeys)
+	}
+	if rd.mmap == nil && rd.ctab == nil {
+		rd.offsets, err = rd.readOffsets(hdr.offtbl, hdr.nkeys)
+		if err != nil {
+			return err
+		}
+	}
 
-	// mmap the offset table and return.
-	rd.offsets, err = mmapUint64(int(fd.Fd()), hdr.offtbl, int(hdr.nkeys), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	// The hash table starts after the offset table; its levels after the
+	// first are loaded on first use.
+	bbsz := sz - int64(hdr.offtbl+tblsz)
+	rd.bb, err = unmarshalLazyBBHash(rd.ra, int64(hdr.offtbl+tblsz), bbsz, hdr.nkeys)
 	if err != nil {
-		return nil, fmt.Errorf("%s: can't mmap offset table (off %d, sz %d): %s",
-			fn, hdr.offtbl, hdr.nkeys*8, err)
+		return fmt.Errorf("%s: can't unmarshal hash table: %w", fn, err)
 	}
 
-	// The hash table starts after the offset table.
-	fd.Seek(int64(hdr.offtbl)+int64(hdr.nkeys*8), 0)
-	rd.bb, err = UnmarshalBBHash(fd)
-	if err != nil {
-		return nil, fmt.Errorf("%s: can't unmarshal hash table: %s", fn, err)
+	// an unverified MPH must not map keys outside the offset table; the
+	// lazy levels are checked as they are loaded - and counted here
+	// unless the DB is opened without checks.
+	if lz := rd.bb.lazy; lz != nil {
+		if check != checkNone {
+			if err = lz.check(); err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+		}
+	} else if n := rd.bb.keys(); n != hdr.nkeys {
+		return fmt.Errorf("%s: %w: hash table has %d keys; exp %d", fn, ErrCorrupt, n, hdr.nkeys)
 	}
 
-	rd.salt = hdr.salt
+	if hdr.extoff > 0 {
+		if hdr.extoff < hdr.offtbl+tblsz || hdr.extoff >= uint64(sz-32) {
+			return fmt.Errorf("%s: %w", fn, ErrCorruptHeader)
+		}
+
+		var secs map[uint32][]byte
+
+		extsz := uint64(sz-32) - hdr.extoff
+		secs, err = readSections(io.NewSectionReader(rd.ra, int64(hdr.extoff), int64(extsz)), extsz)
+		if err != nil {
+			return fmt.Errorf("%s: can't read sections: %w", fn, err)
+		}
+
+		rd.meta = secs[secMeta]
+		rd.base = secs[secBase]
+
+		if b, ok := secs[secData]; ok {
+			if err = checkDataSum(b, hdr.offtbl); err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+			rd.dsum = b
+		}
+
+		if b, ok := secs[secNorm]; ok {
+			rd.normName = string(b)
+			rd.knorm, err = keyNormalizer(rd.normName)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+		}
+
+		if b, ok := secs[secBloom]; ok {
+			rd.bloom, err = unmarshalBloomFilter(b)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+		}
+
+		if b, ok := secs[secSegs]; ok {
+			rd.segs, err = newSegments(b, hdr.offtbl)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+			rd.segs.ra = rd.mra
+		}
+
+		if (hdr.flags & flagCompressed) > 0 {
+			rd.blocks, err = newBlockIndex(secs[secBlocks], hdr.offtbl)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fn, err)
+			}
+		}
+	}
+
+	rd.setSalt(hdr.salt)
+	rd.valoff = hdr.valoff
 	rd.nkeys = hdr.nkeys
+	rd.size = sz
+	rd.offtbl = hdr.offtbl
+	rd.align = hdr.align
+	rd.version = int(hdr.version)
+
+	rd.offmask = ^uint64(0)
+	if (hdr.flags & flagFingerprint) > 0 {
+		rd.offmask = fpOffMask
+	}
 
-	binary.BigEndian.PutUint64(rd.saltkey[:8], rd.salt)
-	binary.BigEndian.PutUint64(rd.saltkey[8:], ^rd.salt)
+	rd.limit = sz
+	if rd.blocks != nil {
+		rd.limit = int64(rd.blocks.end)
+	}
 
-	return rd, nil
+	// only the reads of records are counted
+	rd.ctr = &readerCounters{}
+	rd.ra = rd.recordReader(rd.ra)
+	return nil
+}
+
+// return the reader of records from the DB in 'ra': it counts the reads,
+// verifies the segments read (if enabled) and, in a compressed DB,
+// decompresses the records.
+func (rd *DBReader) recordReader(ra io.ReaderAt) io.ReaderAt {
+	ra = &countingReader{ra, rd.ctr}
+	if rd.segs != nil {
+		ra = &segmentReader{ra, rd}
+	}
+	if rd.blocks != nil {
+		ra = newBlockReader(ra, rd.blocks)
+	}
+	return ra
+}
+
+// read (and decrypt, if sealed) the offset table into memory. The offsets
+// are kept in the same (little-endian) representation as the mmap'd table.
+func (rd *DBReader) readOffsets(offtbl, nkeys uint64) ([]uint64, error) {
+	sealed := (rd.flags & flagEncOffsets) > 0
+
+	if nkeys > uint64(maxInt-gcmOverhead)/8 {
+		return nil, fmt.Errorf("%s: offset table of %d keys is too large for this platform", rd.fn, nkeys)
+	}
+
+	sz := nkeys * 8
+	if sealed {
+		sz += gcmOverhead
+	}
+
+	b := make([]byte, sz)
+	_, err := rd.ra.ReadAt(b, int64(offtbl))
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't read offset table: %w", rd.fn, err)
+	}
+
+	if sealed {
+		b, err = rd.aead.Open(b[:0], nonce(nonceOffTbl, offtbl), b, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't decrypt offset table: %w", rd.fn, ErrBadKey)
+		}
+	}
+
+	le := binary.LittleEndian
+	v := make([]uint64, nkeys)
+	for i := range v {
+		v[i] = toLittleEndianUint64(le.Uint64(b[i*8:]))
+	}
+	return v, nil
 }
 
 // TotalKeys returns the total number of distinct keys in the DB
 func (rd *DBReader) TotalKeys() int {
-	return len(rd.offsets)
+	return int(rd.nkeys)
+}
+
+// Version returns the format version of the DB; see FormatVersion.
+func (rd *DBReader) Version() int {
+	return rd.version
+}
+
+// Metadata returns the application defined metadata attached to the DB by
+// DBWriter.SetMetadata(); it returns nil if there is no metadata.
+func (rd *DBReader) Metadata() []byte {
+	return rd.meta
+}
+
+// Info describes the DB: its header, features, checksum, metadata and the
+// shape of its MPH.
+func (rd *DBReader) Info() DBInfo {
+	s := DBInfo{
+		Name:          rd.fn,
+		Version:       rd.version,
+		Salt:          rd.salt,
+		Keys:          rd.nkeys,
+		Size:          rd.size + int64(len(rd.sig)),
+		OffsetTbl:     rd.offtbl,
+		OffsetTblSize: offTableSize(rd.flags, rd.nkeys, rd.offtbl),
+		ValueRegion:   rd.valoff,
+		RecordAlign:   rd.align,
+		SegmentSize:   rd.segSize(),
+		Checksum:      rd.csum,
+		BaseChecksum:  rd.base,
+		Signature:     rd.sig,
+		Metadata:      rd.meta,
+	}
+
+	if rd.dsum != nil {
+		s.DataChecksum = rd.dsum[8:]
+	}
+
+	for _, f := range flagNames {
+		if (rd.flags & f.flag) > 0 {
+			s.Features = append(s.Features, f.name)
+		}
+	}
+
+	// the MPH isn't described once the DB is closed
+	if rd.isClosed() {
+		return s
+	}
+
+	s.MPHLevels = rd.bb.levels()
+	s.MPHSize = rd.bb.MarshalBinarySize()
+	for _, bits := range rd.bb.levelBits() {
+		s.MPHBits += bits
+	}
+	if s.Keys > 0 {
+		s.MPHBitsPerKey = float64(s.MPHBits) / float64(s.Keys)
+	}
+	return s
+}
+
+// return the size of the checksummed segments; 0 if there are none
+func (rd *DBReader) segSize() uint64 {
+	if rd.segs == nil {
+		return 0
+	}
+	return rd.segs.size
 }
 
-// Close closes the db
-func (rd *DBReader) Close() {
-	munmapUint64(int(rd.fd.Fd()), rd.offsets)
-	rd.fd.Close()
+// Close closes the db and returns the first error from unmapping or closing
+// the file. Close waits for the lookups (and the reads of iterations and
+// checks) in progress; calls after Close() fail with ErrClosed. Closing a
+// closed DB does nothing.
+func (rd *DBReader) Close() error {
+	if !atomic.CompareAndSwapUint32(&rd.closed, 0, 1) {
+		return nil
+	}
+
+	// the fields used by lookups are left alone; a lookup may still be
+	// reading them until it ends.
+	for atomic.LoadInt32(&rd.busy) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var err error
+	keep := func(e error) {
+		if err == nil && e != nil {
+			err = fmt.Errorf("%s: close: %w", rd.fn, e)
+		}
+	}
+
+	// the file and mappings of a shared DB belong to the DB
+	if s := rd.shared; s != nil {
+		rd.shared = nil
+		keep(s.release())
+	} else if rd.fd != nil {
+		keep(rd.fd.Close())
+	}
+
+	if rd.mmap != nil {
+		keep(munmap(rd.mmap))
+		rd.mmap = nil
+	}
+	if rd.fmap != nil {
+		keep(munmap(rd.fmap))
+		rd.fmap = nil
+	}
+	if rd.dfd != nil {
+		keep(rd.dfd.Close())
+		rd.dfd = nil
+	}
 	rd.cache.Purge()
-	rd.bb = nil
-	rd.fd = nil
-	rd.salt = 0
-	rd.saltkey = nil
-	rd.fn = ""
+	if rd.neg != nil {
+		rd.neg.Purge()
+	}
+	return err
 }
 
+// return true if the DB is closed
+func (rd *DBReader) isClosed() bool {
+	return atomic.LoadUint32(&rd.closed) != 0
+}
+
+// start reading the DB - its file, mappings or lazy MPH levels; return
+// false if the DB is closed. Close() waits for the read to end - see
+// leave(). Callbacks that may close the DB - e.g., those of iterations
+// and of VerifyAllProgress() - are made outside of the two.
+func (rd *DBReader) enter() bool {
+	atomic.AddInt32(&rd.busy, 1)
+	if rd.isClosed() {
+		atomic.AddInt32(&rd.busy, -1)
+		return false
+	}
+	return true
+}
+
+// end a read started by enter(); the last one pools the buffers of the
+// records evicted meanwhile.
+func (rd *DBReader) leave() {
+	if atomic.AddInt32(&rd.busy, -1) == 0 && rd.pool != nil {
+		rd.pool.drain()
+	}
+}
 
 // Lookup looks up 'key' in the table and returns the corresponding value.
 // If the key is not found, value is nil and returns false.
@@ -168,29 +988,345 @@ func (rd *DBReader) Lookup(key []byte) ([]byte, bool) {
 // It returns an error if the key is not found or the disk i/o failed or
 // the record checksum failed.
 func (rd *DBReader) Find(key []byte) ([]byte, error) {
-	h := fasthash.Hash64(rd.salt, key)
+	r, err := rd.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.val, nil
+}
+
+// FindString is like Find except the key is a string; the key is hashed
+// in place rather than copied into a new []byte.
+func (rd *DBReader) FindString(key string) ([]byte, error) {
+	return rd.Find(stringBytes(key))
+}
+
+// LookupString is like Lookup except the key is a string; see
+// FindString().
+func (rd *DBReader) LookupString(key string) ([]byte, bool) {
+	return rd.Lookup(stringBytes(key))
+}
+
+// FindInto is like Find except the value is read into 'dst' - which is
+// grown only if it is too small; the returned slice shares the storage of
+// 'dst' when it fits. Records read this way are not added to the cache;
+// cached records are still used. Reusing 'dst' across lookups avoids
+// allocating a buffer for every record read from disk:
+//
+//	var buf []byte
+//	for _, k := range keys {
+//		buf, err = rd.FindInto(k, buf[:0])
+//		...
+//	}
+func (rd *DBReader) FindInto(key, dst []byte) ([]byte, error) {
+	t0 := time.Now()
+	r, err := rd.findRecord(rd.ra, 0, rd.normKey(key), true, false, dst[:0:cap(dst)])
+	rd.ctr.lookups(1, time.Since(t0))
+	if err == errDeleted {
+		err = ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	if v, ok := rd.cache.Get(h); ok {
-		r := v.(*record)
+	// the value is in a new buffer if it doesn't fit in 'dst'; else it
+	// is in 'dst' - just not necessarily at the start.
+	if len(r.val) > cap(dst) {
 		return r.val, nil
 	}
 
+	dst = dst[:len(r.val)]
+	copy(dst, r.val)
+	return dst, nil
+}
+
+// UnsafeFind is like Find except the value of a record read from a memory
+// mapped or in-memory DB (see NewDBReaderMmap() and NewDBReaderInMemory())
+// is not copied: the returned slice aliases the DB itself. The caller must
+// not modify the value and must not use it after the DB is closed - doing
+// either may crash the program. The values of encrypted records, cached
+// records and of DBs read from files are copies; records aren't cached by
+// UnsafeFind().
+func (rd *DBReader) UnsafeFind(key []byte) ([]byte, error) {
+	if rd.mem == nil {
+		return rd.Find(key)
+	}
+
+	t0 := time.Now()
+	r, err := rd.findRecord(rd.mem, 0, rd.normKey(key), true, false, nil)
+	rd.ctr.lookups(1, time.Since(t0))
+	if err == errDeleted {
+		err = ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r.val, nil
+}
+
+// FindWithFlags is like Find except it also returns the application flags
+// of the record; see DBWriter.AddKeyValsWithFlags().
+func (rd *DBReader) FindWithFlags(key []byte) ([]byte, byte, error) {
+	r, err := rd.lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r.val, r.appflags, nil
+}
+
+// FindIn is like Find except it looks up 'key' in namespace 'ns'; see
+// DBWriter.AddKeyValsIn(). FindIn(0, key) is the same as Find(key).
+func (rd *DBReader) FindIn(ns uint8, key []byte) ([]byte, error) {
+	r, err := rd.find(ns, rd.normKey(key), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.val, nil
+}
+
+// Record is a record of the DB as it is stored; see GetRecord().
+type Record struct {
+	// the stored key and value
+	Key   []byte
+	Value []byte
+
+	// file offset of the record and its checksum; in a compressed DB,
+	// the offset is in the uncompressed record region.
+	Offset   uint64
+	Checksum uint64
+
+	// application defined flags; see DBWriter.AddKeyValsWithFlags()
+	Flags byte
+
+	// namespace of the record; see DBWriter.AddKeyValsIn()
+	Namespace uint8
+
+	// expiry time of the record; the zero time if it never expires
+	Expiry time.Time
+}
+
+// GetRecord is like Find except it returns the whole record: the stored key
+// and value, its offset, checksum and flags. The key is the one stored in
+// the DB - which need not be byte for byte the same as 'key' (e.g., if the
+// keys were normalized when the DB was built).
+func (rd *DBReader) GetRecord(key []byte) (*Record, error) {
+	r, err := rd.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.export(), nil
+}
+
+// return the exported form of 'r'
+func (r *record) export() *Record {
+	x := &Record{
+		Key:       r.key,
+		Value:     r.val,
+		Offset:    r.off,
+		Checksum:  r.csum,
+		Flags:     r.appflags,
+		Namespace: r.ns,
+	}
+	if r.expiry > 0 {
+		x.Expiry = time.Unix(int64(r.expiry), 0)
+	}
+	return x
+}
+
+// Contains returns true if 'key' is in the DB. Unlike Lookup(), the stored key
+// is compared with 'key' - so this is an exact membership test. This is the
+// natural way to query a key set built with NewKeySetWriter(). Like
+// Exists(), this doesn't read the value.
+func (rd *DBReader) Contains(key []byte) bool {
+	ok, _ := rd.Exists(key)
+	return ok
+}
+
+// Exists returns true if 'key' is in the DB; only the record header and
+// key are read from disk - the value is skipped (except in an encrypted DB).
+// Like Contains(), the stored key is compared with 'key'. It returns an
+// error if the disk i/o failed or the record is corrupt.
+func (rd *DBReader) Exists(key []byte) (bool, error) {
+	key = rd.normKey(key)
+	r, err := rd.find(0, key, false)
+	if err == ErrNoKey {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(r.key, key), nil
+}
+
+// Index returns the slot of 'key' in the minimal perfect hash of the DB -
+// in the interval [0, TotalKeys()); false if the key isn't in the DB. Every
+// key has a distinct slot that doesn't change for the life of the DB; so
+// an application can keep arrays of its own data (e.g., counters) in
+// parallel with the records. The key is verified like Contains(); only
+// the key of its record is read.
+func (rd *DBReader) Index(key []byte) (uint64, bool) {
+	key = rd.normKey(key)
+	r, err := rd.find(0, key, false)
+	if err != nil || !bytes.Equal(r.key, key) {
+		return 0, false
+	}
+
+	// the MPH index is 1 based; a cached record may need a level that
+	// isn't loaded yet.
+	if !rd.enter() {
+		return 0, false
+	}
+	i, err := rd.bb.find(r.hash)
+	rd.leave()
+	if err != nil || i == 0 {
+		return 0, false
+	}
+	return i - 1, true
+}
+
+// normalize 'key' and lookup its record in the cache or on disk
+func (rd *DBReader) lookup(key []byte) (*record, error) {
+	return rd.find(0, rd.normKey(key), true)
+}
+
+// lookup the record for 'key' in namespace 'ns' in the cache or on disk; if
+// 'wantVal' is false, the value of the record is not read and the record
+// is not cached.
+func (rd *DBReader) find(ns uint8, key []byte, wantVal bool) (*record, error) {
+	r, err := rd.findLayer(ns, key, wantVal)
+	if err == errDeleted {
+		err = ErrNoKey
+	}
+	return r, err
+}
+
+// lookup the record like find() - except the tombstone of a deleted key is
+// errDeleted; so a reader of layered DBs knows to stop.
+func (rd *DBReader) findLayer(ns uint8, key []byte, wantVal bool) (*record, error) {
+	t0 := time.Now()
+	r, err := rd.findRecord(rd.ra, ns, key, wantVal, true, nil)
+	rd.ctr.lookups(1, time.Since(t0))
+	return r, err
+}
+
+// return true if 'key' is in namespace 'ns' of the DB
+func (rd *DBReader) hasKey(ns uint8, key []byte) bool {
+	r, err := rd.find(ns, key, false)
+	return err == nil && bytes.Equal(r.key, key)
+}
+
+// lookup the record like findLayer() - reading it from 'ra' into 'dst'
+// when it is large enough. If 'cache' is true, the record is read from
+// rd.ra and cached; else the caller owns the record - a cached record is
+// copied into 'dst' (or a new buffer).
+func (rd *DBReader) findRecord(ra io.ReaderAt, ns uint8, key []byte, wantVal, cache bool, dst []byte) (*record, error) {
+	if !rd.enter() {
+		return nil, ErrClosed
+	}
+	defer rd.leave()
+
+	h := rd.keyHash(ns, key)
+
+	if r, ok := rd.cache.Get(h); ok {
+		rd.ctr.add(&rd.ctr.hits, MetricCacheHits, 1)
+		if r.deleted {
+			return nil, errDeleted
+		}
+		if rd.expired(r, time.Now()) {
+			return nil, ErrNoKey
+		}
+		if !cache {
+			x := *r
+			x.val = append(dst[:0], r.val...)
+			r = &x
+		}
+		return r, nil
+	}
+
+	rd.ctr.add(&rd.ctr.misses, MetricCacheMisses, 1)
+	if rd.neg != nil && rd.neg.Contains(h) {
+		rd.ctr.add(&rd.ctr.neghits, MetricNegativeHits, 1)
+		return nil, ErrNoKey
+	}
+
+	if rd.bloom != nil && !rd.bloom.has(h) {
+		rd.ctr.add(&rd.ctr.bloomrej, MetricBloomRejects, 1)
+		return nil, ErrNoKey
+	}
+
 	// Not in cache. So, go to disk and find it.
-	i := rd.bb.Find(h)
+	i, err := rd.bb.find(h)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rd.fn, err)
+	}
 	if i == 0 {
+		rd.absent(h)
 		return nil, ErrNoKey
 	}
 
 	//fmt.Printf("key %s => %#x => %d\n", string(key), h, i)
-	off := toLittleEndianUint64(rd.offsets[i-1])
-	r, err := rd.decodeRecord(off)
+	off, ok := rd.slotOffset(i, h)
+	if !ok {
+		rd.absent(h)
+		return nil, ErrNoKey
+	}
+
+	if !wantVal {
+		r, err := rd.decodeKey(off)
+		if err != nil {
+			return nil, err
+		}
+		if r.hash != h {
+			rd.absent(h)
+			return nil, ErrNoKey
+		}
+		if r.ns != ns || rd.expired(r, time.Now()) {
+			return nil, ErrNoKey
+		}
+		if r.deleted {
+			return nil, errDeleted
+		}
+		return r, nil
+	}
+
+	// a record read for the cache is read into a pooled buffer; it is
+	// reused once the record is evicted.
+	var bp *[]byte
+	if cache && rd.pool != nil && rd.cache.releases() {
+		bp = rd.pool.get()
+		dst = *bp
+	}
+
+	r, err := rd.decodeRecordFrom(ra, off, dst)
 	if err != nil {
+		if bp != nil {
+			rd.pool.put(bp)
+		}
 		return nil, err
 	}
+	if bp != nil {
+		rd.pool.keep(bp, r)
+	}
 
 	if r.hash != h {
+		r.discard()
+		rd.absent(h)
 		return nil, ErrNoKey
 	}
+	if r.ns != ns {
+		r.discard()
+		return nil, ErrNoKey
+	}
+	if err = rd.decodeValue(r); err != nil {
+		r.discard()
+		return nil, err
+	}
 
 	/*
 		// XXX Do we need this?
@@ -199,81 +1335,255 @@ func (rd *DBReader) Find(key []byte) ([]byte, error) {
 		}
 	*/
 
-	rd.cache.Add(h, r)
-	return r.val, nil
+	if cache {
+		rd.cache.Add(h, r)
+	}
+	if r.deleted {
+		return nil, errDeleted
+	}
+	if rd.expired(r, time.Now()) {
+		return nil, ErrNoKey
+	}
+	return r, nil
 }
 
-// Verify checksum of all metadata: offset table, bbhash bits and the file header.
-func (rd *DBReader) verifyChecksum(hdrb []byte, offtbl uint64, sz int64) error {
-	h := sha512.New512_256()
-	h.Write(hdrb[:])
+// Stats returns the lookup statistics of the DB since it was opened or
+// since the last call to ResetStats(). Only the reads of records are
+// counted - not those done while opening the DB.
+func (rd *DBReader) Stats() ReaderStats {
+	return rd.ctr.stats()
+}
 
-	// we now verify the offset table before decoding anything else or allocating
-	// any memory.
-	expsz := sz - int64(offtbl) - int64(32)
+// SetMetrics exports the lookup statistics of the DB to 'm' as they are
+// updated; see Metrics. This must be called before the DB is queried.
+func (rd *DBReader) SetMetrics(m Metrics) {
+	rd.ctr.m = m
+}
+
+// ResetStats resets the lookup statistics of the DB
+func (rd *DBReader) ResetStats() {
+	rd.ctr.reset()
+}
+
+// SetCacheBytes bounds the record cache by the total size of the cached
+// keys and values - 'max' bytes - rather than by the number of records; the
+// least recently used records are evicted first. Records larger than 'max'
+// aren't cached. This must be called before the DB is queried.
+func (rd *DBReader) SetCacheBytes(max int64) {
+	rd.cache = newByteCache(max)
+}
+
+// SetNegativeCache caches the hashes of upto 'n' keys that were found to be
+// absent from the DB; repeated lookups of such keys don't read the disk.
+// This is independent of the record cache. If 'n' is zero, absent keys
+// aren't cached (the default). This must be called before the DB is
+// queried.
+func (rd *DBReader) SetNegativeCache(n int) error {
+	if n <= 0 {
+		rd.neg = nil
+		return nil
+	}
+
+	c, err := newLRUCache[struct{}](n)
+	if err != nil {
+		return err
+	}
+	rd.neg = c
+	return nil
+}
+
+// remember that keys with hash 'h' are not in the DB
+func (rd *DBReader) absent(h uint64) {
+	if rd.neg != nil {
+		rd.neg.Add(h, struct{}{})
+	}
+}
+
+// IgnoreExpiry controls whether lookups return expired records; by default
+// expired records are treated as absent. See
+// DBWriter.AddKeyValsWithExpiry(). This must be called before the DB is
+// queried.
+func (rd *DBReader) IgnoreExpiry(ignore bool) {
+	rd.noexpiry = ignore
+}
 
-	rd.fd.Seek(int64(offtbl), 0)
+// return true if record 'r' has expired at time 'now'
+func (rd *DBReader) expired(r *record, now time.Time) bool {
+	return r.expiry > 0 && !rd.noexpiry && uint64(now.Unix()) >= r.expiry
+}
 
-	nw, err := io.CopyN(h, rd.fd, expsz)
+// return true if the DB has a record identical to 'x'
+func (rd *DBReader) hasRecord(x *record) bool {
+	r, err := rd.find(x.ns, x.key, true)
 	if err != nil {
-		return fmt.Errorf("%s: i/o error: %s", rd.fn, err)
+		return false
 	}
-	if nw != expsz {
-		return fmt.Errorf("%s: partial read while verifying checksum, exp %d, saw %d", rd.fn, expsz, nw)
+
+	return bytes.Equal(r.key, x.key) && bytes.Equal(r.val, x.val) &&
+		r.expiry == x.expiry && r.appflags == x.appflags
+}
+
+// call 'fp' for every record in the DB in offset table order; iteration
+// stops at the first error. Records visited this way are not cached.
+func (rd *DBReader) iterate(fp func(r *record) error) error {
+	for i := uint64(0); i < rd.nkeys; i++ {
+		// 'fp' may close the DB; it isn't called with the DB held
+		if !rd.enter() {
+			return ErrClosed
+		}
+		r, err := rd.decodeRecord(rd.offset(i))
+		rd.leave()
+		if err != nil {
+			return err
+		}
+
+		if err = fp(r); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// Verify checksum of all metadata: offset table, bbhash bits and the file
+// header; return the checksum.
+func (rd *DBReader) verifyChecksum(ra io.ReaderAt, hdrb []byte, hdr *header, sz int64) ([32]byte, error) {
 	var expsum [32]byte
+	var csum []byte
+
+	// we now verify the offset table before decoding anything else or allocating
+	// any memory.
+	offtbl := hdr.offtbl
+	expsz := sz - int64(offtbl) - int64(32)
+
+	if (hdr.flags & flagChunkSum) > 0 {
+		var err error
+
+		csum, err = chunkedChecksum(ra, hdrb, int64(offtbl), expsz)
+		if err != nil {
+			return expsum, fmt.Errorf("%s: i/o error: %w", rd.fn, err)
+		}
+	} else {
+		h := sha512.New512_256()
+		h.Write(hdrb[:])
+
+		nw, err := io.Copy(h, io.NewSectionReader(ra, int64(offtbl), expsz))
+		if err != nil {
+			return expsum, fmt.Errorf("%s: i/o error: %w", rd.fn, err)
+		}
+		if nw != expsz {
+			return expsum, fmt.Errorf("%s: partial read while verifying checksum, exp %d, saw %d: %w", rd.fn, expsz, nw, ErrTooSmall)
+		}
+		csum = h.Sum(nil)
+	}
 
 	// Read the trailer -- which is the expected checksum
-	rd.fd.Seek(sz-32, 0)
-	_, err = io.ReadFull(rd.fd, expsum[:])
+	_, err := ra.ReadAt(expsum[:], sz-32)
 	if err != nil {
-		return fmt.Errorf("%s: i/o error: %s", rd.fn, err)
+		return expsum, fmt.Errorf("%s: i/o error: %w", rd.fn, err)
 	}
 
-	csum := h.Sum(nil)
 	if subtle.ConstantTimeCompare(csum[:], expsum[:]) != 1 {
-		return fmt.Errorf("%s: checksum failure; exp %#x, saw %#x", rd.fn, expsum[:], csum[:])
+		return expsum, fmt.Errorf("%s: %w; exp %#x, saw %#x", rd.fn, ErrBadChecksum, expsum[:], csum[:])
 	}
 
-	rd.fd.Seek(int64(offtbl), 0)
-	return nil
+	return expsum, nil
 }
 
 // entry condition: b is 64 bytes long.
 func (rd *DBReader) decodeHeader(b []byte, sz int64) (*header, error) {
 	if string(b[:4]) != "BBHH" {
-		return nil, fmt.Errorf("%s: bad header", rd.fn)
+		return nil, fmt.Errorf("%s: %w (bad magic)", rd.fn, ErrCorruptHeader)
 	}
 
 	be := binary.BigEndian
 	h := &header{}
 	i := 8
 
+	h.flags = be.Uint32(b[4:8])
+	h.version = uint8(h.flags >> versionShift)
+	h.flags &= 1<<versionShift - 1
 	h.salt = be.Uint64(b[i : i+8])
 	i += 8
 	h.nkeys = be.Uint64(b[i : i+8])
 	i += 8
 	h.offtbl = be.Uint64(b[i : i+8])
+	i += 8
+	h.keychk = be.Uint64(b[i : i+8])
+	i += 8
+	h.extoff = be.Uint64(b[i : i+8])
+	i += 8
+	h.valoff = be.Uint64(b[i : i+8])
+	i += 8
+	h.align = be.Uint64(b[i : i+8])
 
 	if h.offtbl < 64 || h.offtbl >= uint64(sz-32) {
-		return nil, fmt.Errorf("%s: corrupt header", rd.fn)
+		return nil, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+	}
+
+	switch {
+	case h.version == 0:
+		h.version = 1
+	case h.version > FormatVersion:
+		return nil, fmt.Errorf("%s: unsupported format version %d", rd.fn, h.version)
+	case (h.flags & flagVarlen) == 0:
+		return nil, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+	}
+
+	if (h.flags & ^flagMask) > 0 {
+		return nil, fmt.Errorf("%s: unsupported feature flags %#x", rd.fn, h.flags)
+	}
+
+	if a := h.align; a != 0 && (a < minRecordAlign || a > maxRecordAlign || (a&(a-1)) != 0) {
+		return nil, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+	}
+
+	if (h.flags&flagStdHash) == 0 && !haveExtHash {
+		return nil, fmt.Errorf("%s: DB needs the siphash and fasthash hashes; not in a bbhash_stdlib build", rd.fn)
+	}
+
+	// the value region is between the records and the offset table
+	if (h.flags & flagSplit) > 0 {
+		if (h.flags&flagEncrypted) > 0 || (h.flags&flagVarlen) == 0 || h.valoff < 64 || h.valoff > h.offtbl {
+			return nil, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+		}
+	}
+
+	if (h.flags & flagCompressed) > 0 {
+		if (h.flags&(flagEncrypted|flagSplit)) > 0 || (h.flags&flagVarlen) == 0 || h.extoff == 0 {
+			return nil, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+		}
+	}
+
+	if (h.flags & flagCompactOffsets) > 0 {
+		if (h.flags&(flagEncOffsets|flagFingerprint|flagCompressed)) > 0 || compactWidth(h.offtbl) == 0 {
+			return nil, fmt.Errorf("%s: %w", rd.fn, ErrCorruptHeader)
+		}
 	}
 
 	return h, nil
 }
 
-// read the next full record at offset 'off' - by seeking to that offset.
-// calculate the record checksum, validate it and so on.
+// read the full record at offset 'off'; calculate the record checksum,
+// validate it and so on.
 func (rd *DBReader) decodeRecord(off uint64) (*record, error) {
-	_, err := rd.fd.Seek(int64(off), 0)
-	if err != nil {
-		return nil, err
+	return rd.decodeRecordFrom(rd.ra, off, nil)
+}
+
+// read the full record at offset 'off' from 'ra' into 'buf' if it is large
+// enough; the key and value of the returned record may alias 'buf'.
+func (rd *DBReader) decodeRecordFrom(ra io.ReaderAt, off uint64, buf []byte) (*record, error) {
+	if (rd.flags & flagVarlen) > 0 {
+		r, err := rd.decodeBuf(rd.recordCursor(ra), off, rd.limit, rflagPrefix|rflagValRef, true, buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rd.fn, err)
+		}
+		return r, nil
 	}
 
 	var hdr [2 + 4 + 8]byte
 
-	_, err = io.ReadFull(rd.fd, hdr[:])
+	_, err := rd.ra.ReadAt(hdr[:], int64(off))
 	if err != nil {
 		return nil, err
 	}
@@ -283,11 +1593,15 @@ func (rd *DBReader) decodeRecord(off uint64) (*record, error) {
 	vlen := int(be.Uint32(hdr[2:6]))
 
 	if klen <= 0 || vlen <= 0 || klen > 65535 {
-		return nil, fmt.Errorf("%s: key-len %d or value-len %d out of bounds", rd.fn, klen, vlen)
+		return nil, fmt.Errorf("%s: %w: key-len %d or value-len %d out of bounds", rd.fn, ErrCorruptRecord, klen, vlen)
+	}
+
+	if rd.aead != nil {
+		return rd.decodeSealedRecord(off, klen, vlen, be.Uint64(hdr[6:]))
 	}
 
-	buf := make([]byte, klen+vlen)
-	_, err = io.ReadFull(rd.fd, buf)
+	buf = sized(buf, uint64(klen+vlen))
+	_, err = rd.ra.ReadAt(buf, int64(off)+int64(len(hdr)))
 	if err != nil {
 		return nil, err
 	}
@@ -298,14 +1612,75 @@ func (rd *DBReader) decodeRecord(off uint64) (*record, error) {
 		csum: be.Uint64(hdr[6:]),
 	}
 
-	csum := x.checksum(rd.saltkey, off)
-	if csum != x.csum {
-		return nil, fmt.Errorf("%s: corrupted record at off %d (exp %#x, saw %#x)", rd.fn, off, x.csum, csum)
+	if !rd.verified {
+		csum := rd.csum64(off, x.key, x.val)
+		if csum != x.csum {
+			return nil, rd.badsum(fmt.Errorf("%s: %w", rd.fn, &ChecksumError{Offset: off, Exp: x.csum, Saw: csum}))
+		}
+	}
+
+	x.hash = rd.keyHash(0, x.key)
+	return x, nil
+}
+
+// read the record at offset 'off' without its value; see decodeAt().
+func (rd *DBReader) decodeKey(off uint64) (*record, error) {
+	if (rd.flags & flagVarlen) == 0 {
+		return rd.decodeRecord(off)
+	}
+
+	r, err := rd.decodeAt(rd.recordCursor(rd.ra), off, rd.limit, rflagPrefix|rflagValRef, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rd.fn, err)
+	}
+	return r, nil
+}
+
+// read the ciphertext of an encrypted record whose header has already been
+// read; verify the checksum and decrypt it.
+func (rd *DBReader) decodeSealedRecord(off uint64, klen, vlen int, csum uint64) (*record, error) {
+	buf := make([]byte, klen+vlen+rd.aead.Overhead())
+	_, err := rd.ra.ReadAt(buf, int64(off)+2+4+8)
+	if err != nil {
+		return nil, err
+	}
+
+	if c := rd.csum64(off, buf); c != csum {
+		return nil, rd.badsum(fmt.Errorf("%s: %w", rd.fn, &ChecksumError{Offset: off, Exp: csum, Saw: c}))
+	}
+
+	buf, err = rd.aead.Open(buf[:0], nonce(nonceRecord, off), buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't decrypt record at off %d: %w", rd.fn, off, err)
 	}
 
-	x.hash = fasthash.Hash64(rd.salt, x.key)
+	x := &record{
+		key:  buf[:klen],
+		val:  buf[klen:],
+		csum: csum,
+		off:  off,
+	}
+
+	x.hash = rd.keyHash(0, x.key)
 	return x, nil
 }
 
+// return the bytes of 's' without copying them; the bytes must not be
+// modified or retained beyond the lifetime of 's'. Lookups only hash and
+// compare their keys.
+func stringBytes(s string) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
 // ErrNoKey is returned when a key cannot be found in the DB
 var ErrNoKey = errors.New("No such key")
+
+// errDeleted is returned by findLayer() for the tombstone of a deleted key
+var errDeleted = errors.New("key is deleted")
+
+// ErrClosed is returned by lookups on a closed DB
+var ErrClosed = errors.New("DB is closed")
@@ -10,19 +10,24 @@ package bbhash
 
 import (
 	"bufio"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/sha512"
 	"encoding/binary"
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
-
-	"github.com/dchest/siphash"
-	"github.com/opencoff/go-fasthash"
+	"syscall"
+	"time"
 )
 
 // Most data is serialized as big-endian integers. The exceptions are:
@@ -39,78 +44,446 @@ import (
 // The DB meta-data is protected by strong checksum (SHA512-256) and each key/value
 // record is protected by a distinct siphash-2-4. Records can be added to the DB via
 // plain delimited text files or CSV files. Once all addition of key/val is complete,
-// the DB is written to disk via the Freeze() function.
+// the DB is written to disk via the Freeze() function. The Add functions are safe
+// for concurrent use by multiple goroutines.
 //
 // The DB has the following general structure:
 //   - 64 byte file header:
 //      * magic    [4]byte "BBHH"
-//      * flags    uint32  for now, all zeros
+//      * flags    uint32  feature flags (encryption etc.); the top byte is
+//                         the format version (zero in version 1 DBs)
 //      * salt     uint64  random salt for hash functions
 //      * nkeys    uint64  Number of keys in the DB
 //      * offtbl   uint64  file offset where the 'key/val' offsets start
+//      * keychk   uint64  key-check value for encrypted DBs
+//      * extoff   uint64  file offset of optional sections (user metadata etc.)
+//      * valoff   uint64  file offset of the value region in a split DB
+//      * align    uint64  alignment of the records; 0 if they aren't aligned
 //
 //   - Contiguous series of records; each record is a key/value pair:
-//      * keylen   uint16  length of the key
-//      * vallen   uint32  length of the value
-//      * cksum    uint64  Siphash checksum of key, value, offset
+//      * rflags   byte    per-record flags
+//      * keylen   uvarint length of the key
+//      * vallen   uvarint length of the value
+//      * cksum    uint64  Siphash checksum of record header, key, value, offset
 //      * key      []byte  keylen bytes of key
 //      * val      []byte  vallen bytes of value
 //
+//     A record may also have an expiry time and a byte of application
+//     defined flags in its header.
+//
+//     A front coded record (see record.go) also has the length of the key
+//     prefix it shares with an earlier anchor record and the distance to
+//     that record; it stores only the rest of the key.
+//
+//     DBs written before variable length records (header flag clear) use a
+//     fixed uint16 keylen and uint32 vallen with no rflags; such records are
+//     limited to 64KB keys and 4GB values.
+//
+//     In an encrypted DB, key and value are sealed together with AES-GCM
+//     (see crypto.go) and the checksum is over the ciphertext.
+//
+//     In a DB with aligned records, zeros pad the header and every record
+//     to the next multiple of the alignment.
+//
+//   - In a split DB, the values follow the records in a separate value
+//     region; each record header has the position and checksum of its
+//     value.
+//
+//   - In a compressed DB, the records are stored as compressed blocks;
+//     record offsets refer to the uncompressed records (see compress.go).
+//
 //   - Possibly a gap until the next PageSize boundary (4096 bytes)
 //   - Offset table: nkeys worth of file offsets. Entry 'i' is the perfect
 //     hash index for some key 'k' and offset[i] is the offset in the DB
-//     where the key and value can be found.
+//     where the key and value can be found. The offset table is
+//     optionally sealed with AES-GCM in an encrypted DB. The top 16 bits
+//     of each entry may hold a fingerprint of the key (see fingerprint.go).
 //   - Marshaled BBHash bytes (BBHash:MarshalBinary())
+//   - Optional tagged sections (see sections.go)
+//   - 4 bytes of CRC32C of the file header, offset-table, marshaled bbhash
+//     and the sections (see checksum.go)
 //   - 32 bytes of strong checksum (SHA512_256); this checksum is done over
-//     the file header, offset-table and marshaled bbhash.
+//     the file header, offset-table, marshaled bbhash and the sections -
+//     in chunks that can be verified concurrently (see checksum.go).
+//   - In a signed DB, the Ed25519 signature of the strong checksum (see
+//     sign.go).
 type DBWriter struct {
+	codec
+
 	fd *os.File
 
-	// to detect duplicates
-	keymap map[uint64]*record
+	// to detect duplicates; nil in low memory mode
+	keymap map[uint64]struct{}
 
-	// list of unique keys
+	// list of unique keys and the offset of their records: keys[i] is
+	// written at offs[i]. In low memory mode, these may have duplicates
+	// until Freeze().
 	keys []uint64
+	offs []uint64
+
+	// key check value for encrypted DBs
+	keychk uint64
 
-	// hash salt for hashing keys
-	salt uint64
+	// user supplied metadata
+	meta []byte
 
-	// siphash key: just binary encoded salt
-	saltkey []byte
+	// base DB when building a delta DB
+	base *DBReader
 
 	// running count of current offset within fd where we are writing
 	// records
 	off uint64
 
+	// records are written to fd through 'bw'; it is flushed before fd is
+	// read or written directly. 'buf' is the buffer that records are
+	// encoded into; the caller of addRecord() holds the lock.
+	bw  *bufio.Writer
+	buf []byte
+
+	// alignment of the offset table
+	pgsz uint64
+
+	// records start at multiples of 'align'; 0 if they aren't aligned
+	align uint64
+
+	// default gamma for Freeze()
+	gamma float64
+
+	// permissions of the DB file
+	perm os.FileMode
+
+	// temp dir and open flags for temp files
+	tmpdir string
+	oflags int
+
+	// lay out records in MPH order at Freeze; for encrypted DBs, faead is
+	// the AEAD for the final layout. If split is set, the values are laid
+	// out in a separate region.
+	locality bool
+	faead    cipher.AEAD
+	split    bool
+
+	// compress the record region at Freeze; 'blocks' is the index of the
+	// compressed blocks.
+	compress bool
+	blocks   []byte
+
+	// bits per key of the Bloom filter; zero if there is none
+	bloomBits int
+
+	// size of the checksummed segments of the records; zero if they
+	// aren't checksummed. 'segs' is the section of their checksums.
+	segsize uint64
+	segs    []byte
+
+	// running hash of the records written to the temp file; nil in a
+	// dry run. 'data' is the section of their checksum.
+	dsum digest
+	data []byte
+
+	// key that signs the DB; nil if it isn't signed
+	signer ed25519.PrivateKey
+
+	// front coding state; nil if keys aren't front coded
+	pfx *prefixer
+
+	// value deduplication state; nil if values aren't deduplicated
+	vdup *deduper
+
+	// strong checksum of the frozen DB
+	csum [32]byte
+
+	// serializes the addition of records; and Freeze()
+	mu sync.Mutex
+
+	// validate the input without writing any records
+	dryrun bool
+
+	// ingestion limits; zero means no limit
+	maxKeyLen  uint64
+	maxValLen  uint64
+	maxRecords uint64
+
+	// malformed or oversized text and CSV input is an error
+	strict bool
+
+	// normalizes the keys that are added; nil if they aren't normalized
+	knorm    func([]byte) []byte
+	normName string
+
+	// source of salts; seeded for reproducible builds. Temp file names
+	// don't draw from it - so the salts don't depend on them.
+	rng *rng
+
+	// metrics hook; nil if none
+	metrics Metrics
+
+	// logger; nil if none
+	log Logger
+
+	// build statistics
+	start    time.Time
+	keybytes uint64
+	valbytes uint64
+	stats    BuildStats
+	sources  []SourceStats
+
 	bb *BBHash
 
 	fntmp  string
 	fn     string
 	frozen bool
+
+	// lock file that keeps other writers from building the same DB; nil
+	// if it couldn't be created.
+	lock *os.File
+
+	// set by Close() and Abort()
+	closed bool
 }
 
 type header struct {
-	magic  [4]byte // file magic
-	resv00 uint32  // reserved - in future flags, algo choices etc.
+	magic   [4]byte // file magic
+	version uint8   // format version
+	flags   uint32  // feature flags
 
 	salt   uint64 // hash salt
 	nkeys  uint64 // number of keys in the system
 	offtbl uint64 // file location where offset-table starts
-
-	resv01 [4]uint64
+	keychk uint64 // key check value for encrypted DBs
+	extoff uint64 // file location of optional sections; 0 if none
+	valoff uint64 // file location of the value region in a split DB
+	align  uint64 // alignment of the records; 0 if they aren't aligned
 }
 
-type record struct {
-	hash uint64
+// FormatVersion is the version of the DB format written by DBWriter. DBs
+// written before the version was recorded in the header are version 1;
+// Migrate() upgrades them.
+//
+// Version 2 records the version in the header and always has variable
+// length records.
+const FormatVersion = 2
+
+// the format version is in the top byte of the header flags
+const versionShift = 24
+
+// Header flags
+const (
+	flagEncrypted      uint32 = 1 << 0  // records are encrypted
+	flagEncOffsets     uint32 = 1 << 1  // offset table is encrypted
+	flagVarlen         uint32 = 1 << 2  // records use variable length headers
+	flagKeysOnly       uint32 = 1 << 3  // records have keys but no values
+	flagPrefix         uint32 = 1 << 4  // records may have front coded keys
+	flagValRef         uint32 = 1 << 5  // records may have deduplicated values
+	flagExpiry         uint32 = 1 << 6  // records may have an expiry time
+	flagAppFlags       uint32 = 1 << 7  // records may have application flags
+	flagSplit          uint32 = 1 << 8  // values are in a separate region
+	flagNamespaces     uint32 = 1 << 9  // records may be in non-default namespaces
+	flagCompressed     uint32 = 1 << 10 // record region is compressed in blocks
+	flagFingerprint    uint32 = 1 << 11 // offset table entries have key fingerprints
+	flagStdHash        uint32 = 1 << 12 // keys and records are hashed with the standard library
+	flagXXH3           uint32 = 1 << 13 // keys are hashed with XXH3
+	flagCompactOffsets uint32 = 1 << 14 // offset table entries are less than 8 bytes
+	flagChunkSum       uint32 = 1 << 15 // metadata checksum is over hashes of chunks
+	flagSigned         uint32 = 1 << 16 // trailer is followed by a signature
+	flagTombstones     uint32 = 1 << 17 // delta DB has tombstones of deleted keys
+	flagCRC32C         uint32 = 1 << 18 // trailer is preceded by a CRC32C of the metadata
+
+	// all the flags we know about
+	flagMask = flagEncrypted | flagEncOffsets | flagVarlen | flagKeysOnly | flagPrefix | flagValRef | flagExpiry | flagAppFlags | flagSplit | flagNamespaces | flagCompressed | flagFingerprint | flagStdHash | flagXXH3 | flagCompactOffsets | flagChunkSum | flagSigned | flagTombstones | flagCRC32C
+)
 
-	key []byte
-	val []byte
+// size of the write buffer of the records; and the largest encoding buffer
+// the writer keeps between records
+const (
+	writeBufSize = 1 << 20
+	maxRecordBuf = 1 << 20
+)
 
-	// siphash of the key+val+offset+hash.
-	csum uint64
+// bounds of WriterOptions.RecordAlign
+const (
+	minRecordAlign = 512
+	maxRecordAlign = 1 << 20
+)
 
-	// offset where this record is written
-	off uint64
+// max size of a variable length record header: flags, klen, vlen, plen,
+// back, vback, expiry, app flags, namespace, vpos, vsum, csum
+const recHdrMax = 1 + 7*binary.MaxVarintLen64 + 2 + 8 + 8
+
+// WriterOptions control the construction of a DB by NewDBWriterWithOptions().
+// The zero value is a sensible default.
+type WriterOptions struct {
+	// Perm is the permission bits of the DB file; default 0600
+	Perm os.FileMode
+
+	// TmpDir is the directory for the temporary file used while building
+	// the DB; default is the directory of the DB file.
+	TmpDir string
+
+	// PageSize is the alignment of the offset table; it must be a power of
+	// 2 and at least 8. Default is the system page size.
+	PageSize int
+
+	// Gamma is the default gamma used by Freeze() when it is called with a
+	// gamma <= 1.0; default is the package constant 'Gamma'.
+	Gamma float64
+
+	// KeysOnly builds a key set; see NewKeySetWriter()
+	KeysOnly bool
+
+	// Key, if non-nil, encrypts the records; see NewEncryptedDBWriter()
+	Key []byte
+
+	// EncryptOffsets also encrypts the offset table when Key is set.
+	EncryptOffsets bool
+
+	// SyncWrites opens the DB file with O_SYNC and writes every record
+	// as it is added; every record write is durable when the Add
+	// functions return. This is slow.
+	SyncWrites bool
+
+	// LowMemory retains only the key hash and record offset of every
+	// record; this bounds the memory needed for very large DBs to 16
+	// bytes per record. Duplicate keys are detected only in Freeze();
+	// until then, the counts returned by the Add functions and
+	// TotalKeys() include duplicates.
+	LowMemory bool
+
+	// Locality rewrites the records at Freeze() so that they are laid
+	// out in the order of the offset table; this improves readahead
+	// when iterating or scanning the DB. It costs a second pass over
+	// the records.
+	Locality bool
+
+	// PrefixCompress front codes keys: a record whose key shares a long
+	// enough prefix with a recent "anchor" record stores only the rest
+	// of the key. This is effective when keys with common prefixes
+	// (URLs, file paths) are added in sorted order.
+	PrefixCompress bool
+
+	// DedupValues stores each distinct value once; records with the same
+	// value refer to an earlier record holding it. This is effective
+	// when there are few distinct values.
+	DedupValues bool
+
+	// SplitValues lays out the values in a separate region after the
+	// records at Freeze(); the records hold just the keys. Membership
+	// tests via DBReader.Contains() then don't read the values. This
+	// implies Locality and can't be combined with Key.
+	SplitValues bool
+
+	// Reproducible makes the build deterministic: the salts and temp
+	// file names are derived from Seed and the records are laid out in
+	// MPH order (see Locality). The same set of records built with the
+	// same options and Seed yields a byte-identical DB. When there are
+	// duplicate keys, the record added first still wins; so the order
+	// of adding them matters. It can't be combined with Key: encrypting
+	// different data under the same derived key and nonces is unsafe.
+	Reproducible bool
+	Seed         uint64
+
+	// MaxKeyLen, MaxValueLen and MaxRecords limit the size of keys, the
+	// size of values and the number of records in the DB; zero means no
+	// limit. Adding a record that exceeds a limit fails with
+	// ErrKeyTooLong, ErrValueTooLong or ErrTooManyRecords. In low memory
+	// mode, MaxRecords counts duplicates.
+	MaxKeyLen   int
+	MaxValueLen int
+	MaxRecords  uint64
+
+	// Strict makes the text and CSV Add functions fail with
+	// ErrMalformedInput on lines or rows that they can't parse; and with
+	// ErrKeyTooLong or ErrValueTooLong on records that exceed the size
+	// limits. By default, such lines are skipped and counted in
+	// SourceStats.Skipped.
+	Strict bool
+
+	// DryRun parses and validates the input without writing the DB: the
+	// records are checked for duplicates and sized but no file is
+	// created. Freeze() returns ErrDryRun; Stats() and Sources() describe
+	// what would have been built. LowMemory is ignored in a dry run.
+	DryRun bool
+
+	// Base, if non-nil, builds a delta DB on top of the DB opened by Base:
+	// records that are identical in Base are not added. The resulting DB
+	// is meant to be layered on top of Base via NewDeltaReader().
+	Base *DBReader
+
+	// Metrics, if non-nil, receives the number of records added and the
+	// build stats after Freeze(); see Metrics.
+	Metrics Metrics
+
+	// Compress compresses the record region in blocks of 64KB at
+	// Freeze(); readers decompress the blocks they need on demand (see
+	// compress.go). It can't be combined with Key or SplitValues.
+	Compress bool
+
+	// BloomBits adds a Bloom filter of 'BloomBits' bits per key to the
+	// DB at Freeze(); readers use it to reject most keys that aren't in
+	// the DB without reading a record. 10 bits per key reject ~99% of
+	// them. Zero means no filter.
+	BloomBits int
+
+	// Fingerprints stores a 16-bit fingerprint of each key in its entry
+	// of the offset table; readers use it to reject all but 1 in 65536
+	// keys that aren't in the DB without reading a record (see
+	// fingerprint.go). The record region must be smaller than 2^48 bytes.
+	Fingerprints bool
+
+	// CompactOffsets stores each entry of the offset table in just
+	// enough bytes for the record offsets - 4 bytes in DBs upto 4GB and 5
+	// bytes upto 1TB - instead of 8 (see offtable.go). The table is
+	// 40-50% smaller; lookups decode an entry instead of indexing a
+	// mapped []uint64. It can't be combined with EncryptOffsets,
+	// Fingerprints or Compress.
+	CompactOffsets bool
+
+	// StdlibHash hashes the keys and checksums the records with
+	// algorithms from the standard library - FNV-1a and a truncated
+	// HMAC-SHA256 - instead of fasthash and siphash; the choice is
+	// recorded in the DB header. Such a DB can be read by a program built
+	// with the 'bbhash_stdlib' tag, which has no third-party dependencies.
+	// Lookups are slower. It is always set in a 'bbhash_stdlib' build.
+	StdlibHash bool
+
+	// KeyHash selects the hash of the keys; the record checksums are
+	// unaffected. The choice is recorded in the DB header.
+	KeyHash KeyHash
+
+	// RecordAlign, if non-zero, pads every record with zeros so that the
+	// records start at multiples of RecordAlign bytes: a power of 2 from
+	// 512 to 1MB. With an alignment of 4096, records of up to 4096 bytes
+	// are read by a single block read in the LoadDirect mode of a
+	// reader. It can't be combined with Compress.
+	RecordAlign int
+
+	// SegmentSize, if non-zero, checksums the records in segments of
+	// SegmentSize bytes - a power of 2 from 4KB to 1GB; see
+	// DefaultSegmentSize. Readers can then verify only the segments they
+	// read (ReaderOptions.VerifySegments) and DBReader.VerifySegments()
+	// pinpoints the corrupt segments of a damaged DB.
+	SegmentSize int
+
+	// SigningKey, if non-nil, signs the DB: the strong checksum of the
+	// DB is signed with it at Freeze(). The records of a signed DB are
+	// always checksummed in segments (default DefaultSegmentSize); so
+	// the signature covers all of the DB. See ReaderOptions.PublicKey.
+	SigningKey ed25519.PrivateKey
+
+	// Logger, if non-nil, receives the progress of the MPH construction,
+	// the phase timings of Freeze() and warnings about skipped input.
+	Logger Logger
+
+	// KeyNormalizer, if non-nil, transforms every key added to the DB
+	// (e.g., lowercases it) before it is hashed and stored; it must be
+	// idempotent and safe for concurrent use. KeyNormalizerName names
+	// it in the DB; readers apply the normalizer registered under that
+	// name to the keys they look up (see RegisterKeyNormalizer()). If
+	// KeyNormalizer is nil, the registered normalizer named by
+	// KeyNormalizerName - a comma separated list such as "trim,lower" -
+	// is used. A delta DB normalizes keys like its Base.
+	KeyNormalizer     func([]byte) []byte
+	KeyNormalizerName string
 }
 
 // NewDBWriter prepares file 'fn' to hold a constant DB built using
@@ -118,53 +491,290 @@ type record struct {
 // and readers will open it using NewDBReader() to do constant time lookups
 // of key to value.
 func NewDBWriter(fn string) (*DBWriter, error) {
-	tmp := fmt.Sprintf("%s.tmp.%d", fn, rand64())
+	return NewDBWriterWithOptions(fn, WriterOptions{})
+}
 
-	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return nil, err
+// NewKeySetWriter prepares file 'fn' to hold a key set: a constant DB where
+// records only have keys and no values. Values given to any of the Add
+// functions are discarded; and for text files, a line without a delimiter is
+// taken to be a key. Readers use DBReader.Contains() to do constant time
+// membership tests on such a DB.
+func NewKeySetWriter(fn string) (*DBWriter, error) {
+	return NewDBWriterWithOptions(fn, WriterOptions{KeysOnly: true})
+}
+
+// NewEncryptedDBWriter is like NewDBWriter except the records are encrypted
+// with AES-256-GCM using a key derived from 'key' and the DB salt. If 'encOffsets'
+// is true, the offset table is also encrypted. The MPH itself is stored in
+// the clear. Such a DB can only be opened via NewEncryptedDBReader() with
+// the same key.
+func NewEncryptedDBWriter(fn string, key []byte, encOffsets bool) (*DBWriter, error) {
+	if key == nil {
+		return nil, ErrShortKey
+	}
+	return NewDBWriterWithOptions(fn, WriterOptions{Key: key, EncryptOffsets: encOffsets})
+}
+
+// NewDBWriterWithOptions is like NewDBWriter except the construction of
+// the DB is controlled by 'opt'.
+func NewDBWriterWithOptions(fn string, opt WriterOptions) (*DBWriter, error) {
+	if opt.Perm == 0 {
+		opt.Perm = 0600
+	}
+
+	if opt.PageSize == 0 {
+		opt.PageSize = os.Getpagesize()
+	}
+	if opt.PageSize < 8 || (opt.PageSize&(opt.PageSize-1)) != 0 {
+		return nil, fmt.Errorf("%s: page size %d is not a power of 2", fn, opt.PageSize)
+	}
+
+	if opt.Gamma <= 1.0 {
+		opt.Gamma = Gamma
+	}
+
+	if opt.MaxKeyLen < 0 || opt.MaxValueLen < 0 {
+		return nil, fmt.Errorf("%s: invalid key or value size limit", fn)
+	}
+
+	if opt.KeyHash != KeyHashDefault && opt.KeyHash != KeyHashXXH3 {
+		return nil, fmt.Errorf("%s: unknown key hash %s", fn, opt.KeyHash)
+	}
+
+	if opt.SplitValues {
+		if opt.Key != nil {
+			return nil, fmt.Errorf("%s: split DBs can't be encrypted", fn)
+		}
+		opt.Locality = true
+	}
+
+	if opt.BloomBits < 0 || opt.BloomBits > 64 {
+		return nil, fmt.Errorf("%s: invalid bloom filter size %d", fn, opt.BloomBits)
+	}
+
+	if opt.Compress && (opt.Key != nil || opt.SplitValues) {
+		return nil, fmt.Errorf("%s: compressed DBs can't be encrypted or split", fn)
+	}
+
+	if opt.CompactOffsets && ((opt.Key != nil && opt.EncryptOffsets) || opt.Fingerprints || opt.Compress) {
+		return nil, fmt.Errorf("%s: compact offset tables can't be encrypted, compressed or have fingerprints", fn)
+	}
+
+	if a := opt.RecordAlign; a != 0 {
+		if a < minRecordAlign || a > maxRecordAlign || (a&(a-1)) != 0 {
+			return nil, fmt.Errorf("%s: record alignment %d is not a power of 2 from 512 to 1MB", fn, a)
+		}
+		if opt.Compress {
+			return nil, fmt.Errorf("%s: compressed DBs can't have aligned records", fn)
+		}
+	}
+
+	if z := opt.SegmentSize; z != 0 {
+		if z < minSegmentSize || z > maxSegmentSize || (z&(z-1)) != 0 {
+			return nil, fmt.Errorf("%s: segment size %d is not a power of 2 from 4KB to 1GB", fn, z)
+		}
+	}
+
+	if opt.SigningKey != nil {
+		if len(opt.SigningKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s: invalid signing key of %d bytes", fn, len(opt.SigningKey))
+		}
+		if opt.SegmentSize == 0 {
+			opt.SegmentSize = DefaultSegmentSize
+		}
+	}
+
+	if opt.Reproducible {
+		if opt.Key != nil {
+			return nil, fmt.Errorf("%s: reproducible builds can't be encrypted", fn)
+		}
+		opt.Locality = true
+	}
+
+	if b := opt.Base; b != nil && opt.KeyNormalizer == nil && len(opt.KeyNormalizerName) == 0 {
+		opt.KeyNormalizerName = b.normName
+	}
+
+	knorm := opt.KeyNormalizer
+	if len(opt.KeyNormalizerName) > 0 {
+		if knorm == nil {
+			var err error
+			if knorm, err = keyNormalizer(opt.KeyNormalizerName); err != nil {
+				return nil, fmt.Errorf("%s: %w", fn, err)
+			}
+		}
+	} else if knorm != nil {
+		return nil, fmt.Errorf("%s: key normalizer needs a name", fn)
+	}
+
+	if b := opt.Base; b != nil && b.normName != opt.KeyNormalizerName {
+		return nil, fmt.Errorf("%s: key normalizer %q differs from %q of the base DB", fn, opt.KeyNormalizerName, b.normName)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if opt.SyncWrites {
+		flags |= os.O_SYNC
 	}
 
 	w := &DBWriter{
-		fd:      fd,
-		keymap:  make(map[uint64]*record),
-		keys:    make([]uint64, 0, 65536),
-		salt:    rand64(),
-		saltkey: make([]byte, 16),
-		off:     64,
-		fn:      fn,
-		fntmp:   tmp,
-	}
-
-	// Leave some space for a header; we will fill this in when we
-	// are done Freezing.
-	var z [64]byte
-	nw, err := fd.Write(z[:])
-	if err != nil {
-		return nil, w.error("can't write header: %s", err)
+		keys:     make([]uint64, 0, 65536),
+		offs:     make([]uint64, 0, 65536),
+		off:      64,
+		pgsz:     uint64(opt.PageSize),
+		align:    uint64(opt.RecordAlign),
+		gamma:    opt.Gamma,
+		perm:     opt.Perm,
+		tmpdir:   opt.TmpDir,
+		oflags:   flags,
+		locality: opt.Locality,
+		split:    opt.SplitValues,
+		compress: opt.Compress,
+		dryrun:   opt.DryRun,
+		rng:      newRng(opt.Reproducible, opt.Seed),
+		strict:   opt.Strict,
+		knorm:    knorm,
+		normName: opt.KeyNormalizerName,
+		metrics:  opt.Metrics,
+		log:      opt.Logger,
+		start:    time.Now(),
+		fn:       fn,
+
+		maxKeyLen:  uint64(opt.MaxKeyLen),
+		maxValLen:  uint64(opt.MaxValueLen),
+		maxRecords: opt.MaxRecords,
+		bloomBits:  opt.BloomBits,
+		segsize:    uint64(opt.SegmentSize),
+		signer:     opt.SigningKey,
+	}
+	w.off += w.padding(w.off)
+
+	// a dry run has nothing to write
+	if !w.dryrun {
+		if err := w.lockTarget(); err != nil {
+			return nil, err
+		}
+
+		fd, tmp, err := w.tmpFile()
+		if err != nil {
+			w.unlock()
+			return nil, err
+		}
+
+		w.fd = fd
+		w.fntmp = tmp
+		w.bw = bufio.NewWriterSize(fd, writeBufSize)
+		w.dsum = w.newDataSum()
+	}
+
+	w.flags = flagVarlen | flagChunkSum | flagCRC32C
+	w.setSalt(w.rng.next())
+
+	if !opt.LowMemory || w.dryrun {
+		w.keymap = make(map[uint64]struct{})
+	}
+
+	if opt.KeysOnly {
+		w.flags |= flagKeysOnly
+	}
+
+	if opt.Fingerprints {
+		w.flags |= flagFingerprint
+	}
+
+	if opt.CompactOffsets {
+		w.flags |= flagCompactOffsets
+	}
+
+	if opt.StdlibHash || !haveExtHash {
+		w.flags |= flagStdHash
+	}
+
+	if opt.KeyHash == KeyHashXXH3 {
+		w.flags |= flagXXH3
 	}
-	if nw != 64 {
-		return nil, w.error("can't write blank-header: %s", err)
+
+	if opt.PrefixCompress {
+		w.flags |= flagPrefix
+		w.pfx = &prefixer{}
+	}
+
+	if opt.DedupValues {
+		w.flags |= flagValRef
+		w.vdup = newDeduper()
+	}
+
+	if opt.Compress {
+		w.flags |= flagCompressed
+	}
+
+	if opt.SigningKey != nil {
+		w.flags |= flagSigned
 	}
 
-	binary.BigEndian.PutUint64(w.saltkey[:8], w.salt)
-	binary.BigEndian.PutUint64(w.saltkey[8:], ^w.salt)
+	w.base = opt.Base
+
+	if opt.Key != nil {
+		var err error
+
+		w.aead, w.keychk, err = newAEAD(opt.Key, w.salt)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+
+		w.flags |= flagEncrypted
+		if opt.EncryptOffsets {
+			w.flags |= flagEncOffsets
+		}
+
+		// The records are encrypted again when they're laid out at
+		// Freeze(); the temp file uses a throwaway key so that no nonce
+		// is ever reused under the final key.
+		if opt.Locality {
+			w.faead = w.aead
+			w.aead, _, err = newAEAD(opt.Key, rand64())
+			if err != nil {
+				w.Abort()
+				return nil, err
+			}
+		}
+	}
 
 	return w, nil
 }
 
+// SetMetadata attaches an application defined blob 'b' to the DB; this is
+// typically information such as a schema version, the source of the
+// data and so on. The metadata is covered by the strong checksum and
+// readers can retrieve it via DBReader.Metadata().
+func (w *DBWriter) SetMetadata(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.frozen {
+		return ErrFrozen
+	}
+
+	w.meta = make([]byte, len(b))
+	copy(w.meta, b)
+	return nil
+}
 
-// TotalKeys returns the total number of distinct keys in the DB
+// TotalKeys returns the total number of distinct keys in the DB. In low
+// memory mode, this includes duplicates until the DB is frozen.
 func (w *DBWriter) TotalKeys() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	return len(w.keys)
 }
 
 // AddKeyVals adds a series of key-value matched pairs to the db. If they are of
 // unequal length, only the smaller of the lengths are used. Records with duplicate
-// keys are discarded.
+// keys are discarded. Values may be empty.
 // Returns number of records added.
 func (w *DBWriter) AddKeyVals(keys [][]byte, vals [][]byte) (uint64, error) {
-	if w.frozen {
+	if w.isFrozen() {
 		return 0, ErrFrozen
 	}
 
@@ -191,141 +801,809 @@ func (w *DBWriter) AddKeyVals(keys [][]byte, vals [][]byte) (uint64, error) {
 	return z, nil
 }
 
-// AddTextFile adds contents from text file 'fn' where key and value are separated
-// by one of the characters in 'delim'. Duplicates, Empty lines or lines with no value
-// are skipped. This function just opens the file and calls AddTextStream()
+// AddKeyValsWithExpiry is like AddKeyVals except the records expire at
+// time 'expiry'; readers treat expired records as absent. A zero 'expiry'
+// means the records never expire.
 // Returns number of records added.
-func (w *DBWriter) AddTextFile(fn string, delim string) (uint64, error) {
-	if w.frozen {
+func (w *DBWriter) AddKeyValsWithExpiry(keys [][]byte, vals [][]byte, expiry time.Time) (uint64, error) {
+	if w.isFrozen() {
 		return 0, ErrFrozen
 	}
 
-	fd, err := os.Open(fn)
-	if err != nil {
-		return 0, err
+	var exp uint64
+	if !expiry.IsZero() {
+		if expiry.Unix() <= 0 {
+			return 0, fmt.Errorf("%s: invalid expiry time %s", w.fn, expiry)
+		}
+		exp = uint64(expiry.Unix())
 	}
 
-	if len(delim) == 0 {
-		delim = " \t"
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
 	}
 
-	defer fd.Close()
+	var z uint64
+	for i := 0; i < n; i++ {
+		r := &record{
+			key:    keys[i],
+			val:    vals[i],
+			expiry: exp,
+		}
+		ok, err := w.addRecord(r)
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
 
-	return w.AddTextStream(fd, delim)
+	return z, nil
 }
 
-// AddTextStream adds contents from text stream 'fd' where key and value are separated
-// by one of the characters in 'delim'. Duplicates, Empty lines or lines with no value
-// are skipped.
+// AddKeyValsWithFlags is like AddKeyVals except the records carry the
+// application defined flags 'flags'; the DB stores them as an opaque byte
+// covered by the record checksum. Readers retrieve them via
+// DBReader.FindWithFlags().
 // Returns number of records added.
-func (w *DBWriter) AddTextStream(fd io.Reader, delim string) (uint64, error) {
-	if w.frozen {
+func (w *DBWriter) AddKeyValsWithFlags(keys [][]byte, vals [][]byte, flags byte) (uint64, error) {
+	if w.isFrozen() {
 		return 0, ErrFrozen
 	}
 
-	rd := bufio.NewReader(fd)
-	sc := bufio.NewScanner(rd)
-	ch := make(chan *record, 10)
-
-	// do I/O asynchronously
-	go func(sc *bufio.Scanner, ch chan *record) {
-		for sc.Scan() {
-			s := strings.TrimSpace(sc.Text())
-			if len(s) == 0 {
-				continue
-			}
-			i := strings.IndexAny(s, delim)
-			if i < 0 {
-				continue
-			}
-
-			k := s[:i]
-			v := s[i:]
-
-			// ignore items that are too large
-			if len(k) > 65535 || len(v) >= 4294967295 {
-				continue
-			}
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
+	}
 
-			r := &record{
-				key: []byte(k),
-				val: []byte(v),
-			}
-			ch <- r
+	var z uint64
+	for i := 0; i < n; i++ {
+		r := &record{
+			key:      keys[i],
+			val:      vals[i],
+			appflags: flags,
 		}
+		ok, err := w.addRecord(r)
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
 
-		close(ch)
-	}(sc, ch)
-
-	return w.addFromChan(ch)
+	return z, nil
 }
 
-// AddCSVFile adds contents from CSV file 'fn'. If 'kwfield' and 'valfield' are
-// non-negative, they indicate the field# of the key and value respectively; the
-// default value for 'kwfield' & 'valfield' is 0 and 1 respectively.
-// If 'comma' is not 0, the default CSV delimiter is ','.
-// If 'comment' is not 0, then lines beginning with that rune are discarded.
-// Records where the 'kwfield' and 'valfield' can't be evaluated are discarded.
+// AddKeyValsIn is like AddKeyVals except the records are added to namespace
+// 'ns'. Each namespace is a separate key space: the same key can be in
+// several namespaces with different values. Namespace 0 is the default
+// namespace used by AddKeyVals() and the other Add functions. Readers look
+// up keys in a namespace via DBReader.FindIn().
 // Returns number of records added.
-func (w *DBWriter) AddCSVFile(fn string, comma, comment rune, kwfield, valfield int) (uint64, error) {
-	if w.frozen {
+func (w *DBWriter) AddKeyValsIn(ns uint8, keys [][]byte, vals [][]byte) (uint64, error) {
+	if w.isFrozen() {
 		return 0, ErrFrozen
 	}
 
-	fd, err := os.Open(fn)
-	if err != nil {
-		return 0, err
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
 	}
 
-	defer fd.Close()
+	var z uint64
+	for i := 0; i < n; i++ {
+		r := &record{
+			key: keys[i],
+			val: vals[i],
+			ns:  ns,
+		}
+		ok, err := w.addRecord(r)
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
 
-	return w.AddCSVStream(fd, comma, comment, kwfield, valfield)
+	return z, nil
 }
 
-// AddCSVStream adds contents from CSV file 'fn'. If 'kwfield' and 'valfield' are
-// non-negative, they indicate the field# of the key and value respectively; the
-// default value for 'kwfield' & 'valfield' is 0 and 1 respectively.
-// If 'comma' is not 0, the default CSV delimiter is ','.
-// If 'comment' is not 0, then lines beginning with that rune are discarded.
-// Records where the 'kwfield' and 'valfield' can't be evaluated are discarded.
+// AddKeys adds a series of keys with no values to the db. Records with duplicate
+// keys are discarded. In a DB that isn't a key set (see NewKeySetWriter()),
+// this is an error.
 // Returns number of records added.
-func (w *DBWriter) AddCSVStream(fd io.Reader, comma, comment rune, kwfield, valfield int) (uint64, error) {
-	if w.frozen {
+func (w *DBWriter) AddKeys(keys [][]byte) (uint64, error) {
+	if w.isFrozen() {
 		return 0, ErrFrozen
 	}
 
-	if kwfield < 0 {
-		kwfield = 0
-	}
-
-	if valfield < 0 {
-		valfield = 1
-	}
-
-	var max int = valfield
-	if kwfield > valfield {
-		max = kwfield
+	if (w.flags & flagKeysOnly) == 0 {
+		return 0, ErrNotKeySet
 	}
 
-	max += 1
-
+	var z uint64
+	for _, k := range keys {
+		r := &record{
+			key: k,
+		}
+		ok, err := w.addRecord(r)
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// DeleteKeys deletes 'keys' from the base of a delta DB (see
+// WriterOptions.Base): the delta holds a tombstone for each of them and
+// readers that layer the delta on top of other DBs (DeltaReader and
+// MultiReader) treat the keys as absent. Keys that aren't in the base
+// are skipped. It returns the number of keys deleted.
+func (w *DBWriter) DeleteKeys(keys [][]byte) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	if w.base == nil {
+		return 0, fmt.Errorf("%s: keys can only be deleted from the base of a delta DB", w.fn)
+	}
+
+	var z uint64
+	for _, k := range keys {
+		ok, err := w.addRecord(&record{key: k, deleted: true})
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// AddKeyValReader adds a record whose value is 'size' bytes read from 'val';
+// the value is copied to the DB without holding it in memory. A duplicate
+// key is discarded without reading 'val'. Values can't be streamed into an
+// encrypted DB. In a key set, 'val' is ignored. In a delta DB, the record
+// is always added.
+// Returns number of records added.
+func (w *DBWriter) AddKeyValReader(key []byte, val io.Reader, size int64) (uint64, error) {
+	if (w.flags & flagKeysOnly) > 0 {
+		return w.AddKeys([][]byte{key})
+	}
+
+	if w.aead != nil {
+		return 0, fmt.Errorf("%s: can't stream values into an encrypted DB", w.fn)
+	}
+
+	key = w.normKey(key)
+	if len(key) == 0 || size < 0 {
+		return 0, fmt.Errorf("%s: invalid key or value size %d", w.fn, size)
+	}
+
+	if err := w.checkSize(key, uint64(size)); err != nil {
+		return 0, err
+	}
+
+	r := &record{
+		key:  key,
+		hash: w.keyHash(0, key),
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.frozen {
+		return 0, ErrFrozen
+	}
+
+	if w.keymap != nil {
+		if _, ok := w.keymap[r.hash]; ok {
+			return 0, nil
+		}
+	}
+
+	if err := w.checkCount(); err != nil {
+		return 0, err
+	}
+
+	if w.dryrun {
+		if _, err := io.CopyN(ioutil.Discard, val, size); err != nil {
+			return 0, fmt.Errorf("%s: can't copy value: %w", w.fn, err)
+		}
+
+		var b [recHdrMax]byte
+
+		hdr := r.header(b[:], uint64(len(key)), uint64(size))
+		r.off = w.off
+		w.keymap[r.hash] = struct{}{}
+		w.keys = append(w.keys, r.hash)
+		w.offs = append(w.offs, r.off)
+		w.recordAdded()
+		w.off += uint64(len(hdr)+8+len(key)) + uint64(size)
+		w.off += w.padding(w.off)
+		w.keybytes += uint64(len(key))
+		w.valbytes += uint64(size)
+		return 1, nil
+	}
+
+	// the streamed record is written directly to the file
+	if err := w.bw.Flush(); err != nil {
+		return 0, err
+	}
+
+	// A streamed record is never front coded or used as an anchor; we
+	// can't undo a failed write to the prefixer.
+	var b [recHdrMax]byte
+
+	r.off = w.off
+	hdr := r.header(b[:], uint64(len(key)), uint64(size))
+	csumOff := int64(r.off) + int64(len(hdr))
+
+	h := w.newHash64()
+	h.Write(hdr)
+	h.Write(key)
+
+	buf := make([]byte, 0, len(hdr)+8+len(key))
+	buf = append(buf, hdr...)
+	buf = appendUint64(buf, 0)
+	buf = append(buf, key...)
+
+	// undo a partial record
+	undo := func(err error) (uint64, error) {
+		w.fd.Truncate(int64(w.off))
+		w.fd.Seek(int64(w.off), 0)
+		return 0, err
+	}
+
+	if _, err := w.fd.Write(buf); err != nil {
+		return undo(err)
+	}
+
+	if _, err := io.CopyN(io.MultiWriter(w.fd, h), val, size); err != nil {
+		return undo(fmt.Errorf("%s: can't copy value: %w", w.fn, err))
+	}
+
+	var z [8]byte
+	binary.BigEndian.PutUint64(z[:], r.off)
+	h.Write(z[:])
+
+	binary.BigEndian.PutUint64(z[:], h.Sum64())
+	if _, err := w.fd.WriteAt(z[:], csumOff); err != nil {
+		return undo(err)
+	}
+
+	end := w.off + uint64(len(buf)) + uint64(size)
+	pad := w.padding(end)
+	if pad > 0 {
+		if _, err := w.fd.Write(make([]byte, pad)); err != nil {
+			return undo(err)
+		}
+	}
+
+	// the checksum was patched in; so the record is hashed as written
+	if err := w.hashWritten(w.off, end+pad-w.off); err != nil {
+		return undo(err)
+	}
+
+	if w.keymap != nil {
+		w.keymap[r.hash] = struct{}{}
+	}
+	w.keys = append(w.keys, r.hash)
+	w.offs = append(w.offs, r.off)
+	w.recordAdded()
+	w.off = end + pad
+	w.keybytes += uint64(len(key))
+	w.valbytes += uint64(size)
+	return 1, nil
+}
+
+// AddDBFile adds all the records from a previously frozen DB in file 'fn';
+// this is useful to merge several DBs into one. Records with duplicate keys
+// are discarded - i.e., records already in the DB (or added from prior
+// files) take precedence.
+// Returns number of records added.
+func (w *DBWriter) AddDBFile(fn string) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	rd, err := NewDBReader(fn, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rd.Close()
+
+	return w.AddAll(rd)
+}
+
+// AddAll adds all the records from the DB opened by 'rd'. Records with
+// duplicate keys are discarded.
+// Returns number of records added.
+func (w *DBWriter) AddAll(rd *DBReader) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	// a key set has no values to offer
+	if (rd.flags&flagKeysOnly) > 0 && (w.flags&flagKeysOnly) == 0 {
+		return 0, fmt.Errorf("%s: %w", rd.fn, ErrNotKeySet)
+	}
+
+	now := time.Now()
+	src := SourceStats{Name: rd.fn}
+
+	var n uint64
+	err := rd.iterate(func(r *record) error {
+		// expired records and tombstones don't survive a merge
+		if rd.expired(r, now) || r.deleted {
+			return nil
+		}
+
+		nr := &record{key: r.key, val: r.val, expiry: r.expiry, appflags: r.appflags, ns: r.ns}
+		ok, err := w.addRecord(nr)
+		if err != nil {
+			return err
+		}
+		if ok {
+			n++
+		}
+		src.account(nr, ok)
+		return nil
+	})
+
+	w.addSource(&src)
+	return n, err
+}
+
+// Rebuild reads the DB in 'src' and writes a new DB with the same records
+// and metadata to 'dst' using gamma 'g'. The new DB uses the current
+// format and a new salt. 'src' and 'dst' may be the same file.
+func Rebuild(src, dst string, g float64) error {
+	rd, err := NewDBReader(src, 1)
+	if err != nil {
+		return err
+	}
+
+	defer rd.Close()
+
+	opt := WriterOptions{
+		Gamma:          g,
+		KeysOnly:       (rd.flags & flagKeysOnly) > 0,
+		PrefixCompress: (rd.flags & flagPrefix) > 0,
+		DedupValues:    (rd.flags & flagValRef) > 0,
+	}
+	return rebuild(rd, dst, opt)
+}
+
+// RebuildWithOptions is like Rebuild except the DB in 'src' is decrypted
+// with 'key' (nil if it isn't encrypted) and the new DB is written with
+// 'opt' - e.g., to pick a new key hash, checksum, key or gamma
+// (opt.Gamma). The options are used as given; except the new DB keeps
+// the key normalizer of 'src' - its keys are stored normalized - and its
+// permissions if opt.Perm is zero.
+func RebuildWithOptions(src, dst string, key []byte, opt WriterOptions) error {
+	rd, err := NewDBReaderWithOptions(src, ReaderOptions{Cache: 1, Key: key})
+	if err != nil {
+		return err
+	}
+
+	defer rd.Close()
+
+	if opt.KeyNormalizer != nil || len(opt.KeyNormalizerName) > 0 {
+		return fmt.Errorf("%s: a rebuilt DB keeps the key normalizer of %s", dst, src)
+	}
+	return rebuild(rd, dst, opt)
+}
+
+// write the records and metadata of 'rd' to a new DB 'dst' built with
+// 'opt'
+func rebuild(rd *DBReader, dst string, opt WriterOptions) error {
+	opt.KeyNormalizerName = rd.normName
+	if opt.Perm == 0 {
+		if st, err := rd.fd.Stat(); err == nil {
+			opt.Perm = st.Mode().Perm()
+		}
+	}
+
+	w, err := NewDBWriterWithOptions(dst, opt)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.AddAll(rd); err == nil {
+		if err = w.SetMetadata(rd.Metadata()); err == nil {
+			err = w.Freeze(0)
+		}
+	}
+
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return nil
+}
+
+// AddTextFile adds contents from text file 'fn' where key and value are separated
+// by one of the characters in 'delim'. Duplicates, Empty lines or lines with no value
+// are skipped. This function just opens the file and calls AddTextStream()
+// Returns number of records added.
+func (w *DBWriter) AddTextFile(fn string, delim string) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(delim) == 0 {
+		delim = " \t"
+	}
+
+	defer fd.Close()
+
+	keysOnly := (w.flags & flagKeysOnly) > 0
+	ch, ps := textRecords(fd, delimParser(delim, keysOnly), w.strict)
+	return w.addFromSource(fn, ch, ps)
+}
+
+// AddTextStream adds contents from text stream 'fd' where key and value are separated
+// by one of the characters in 'delim'. Duplicates, Empty lines or lines with no value
+// are skipped.
+// Returns number of records added.
+func (w *DBWriter) AddTextStream(fd io.Reader, delim string) (uint64, error) {
+	keysOnly := (w.flags & flagKeysOnly) > 0
+	return w.AddTextStreamFunc(fd, delimParser(delim, keysOnly))
+}
+
+// AddTextStreamFunc adds contents from text stream 'fd' where each line is
+// parsed into a key and value by 'parse'. The line given to 'parse' has no
+// trailing newline. Lines for which 'parse' returns false, lines that yield
+// an empty key and duplicates are skipped. The lines are read and parsed
+// asynchronously; 'parse' must not reuse the key and value it returns.
+// Returns number of records added.
+func (w *DBWriter) AddTextStreamFunc(fd io.Reader, parse func(line string) (key, val []byte, ok bool)) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	ch, ps := textRecords(fd, parse, w.strict)
+	return w.addFromSource("", ch, ps)
+}
+
+// return a parser for lines where key and value are separated by one of
+// the characters in 'delim'. In a key set, a line without a delimiter is a
+// key.
+func delimParser(delim string, keysOnly bool) func(line string) ([]byte, []byte, bool) {
+	return func(line string) ([]byte, []byte, bool) {
+		s := strings.TrimSpace(line)
+		if len(s) == 0 {
+			return nil, nil, false
+		}
+
+		i := strings.IndexAny(s, delim)
+		if i < 0 && keysOnly {
+			i = len(s)
+		}
+
+		if i < 0 {
+			return nil, nil, false
+		}
+
+		k := s[:i]
+		v := s[i:]
+		return []byte(k), []byte(v), true
+	}
+}
+
+// state of an asynchronous parser; it is safe to read once the parser's
+// chan is closed.
+type parseState struct {
+	// number of lines or rows that couldn't be parsed
+	skipped uint64
+
+	// read error, if any
+	err error
+}
+
+// parse the text stream 'fd' into records via 'parse' and send them on the
+// returned chan. Read errors and the number of lines that couldn't be
+// parsed are available via the returned parseState once the chan is
+// closed. If 'strict' is true, a line that can't be parsed is an error.
+func textRecords(fd io.Reader, parse func(line string) ([]byte, []byte, bool), strict bool) (chan *record, *parseState) {
+	rd := bufio.NewReader(fd)
+	ch := make(chan *record, 10)
+
+	// We don't use a bufio.Scanner here; it can't handle lines longer
+	// than 64KB.
+	ps := &parseState{}
+
+	// do I/O asynchronously
+	go func(rd *bufio.Reader, ch chan *record) {
+		var n int
+		for {
+			line, err := rd.ReadString('\n')
+			if len(line) > 0 {
+				n++
+				line = strings.TrimSuffix(line, "\n")
+				line = strings.TrimSuffix(line, "\r")
+
+				k, v, ok := parse(line)
+				if ok && len(k) > 0 {
+					r := &record{
+						key: k,
+						val: v,
+					}
+					ch <- r
+				} else if len(strings.TrimSpace(line)) > 0 {
+					if strict {
+						ps.err = fmt.Errorf("line %d: %w", n, ErrMalformedInput)
+						break
+					}
+					ps.skipped++
+				}
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					ps.err = err
+				}
+				break
+			}
+		}
+
+		close(ch)
+	}(rd, ch)
+
+	return ch, ps
+}
+
+// AddCSVFile adds contents from CSV file 'fn'. If 'kwfield' and 'valfield' are
+// non-negative, they indicate the field# of the key and value respectively; the
+// default value for 'kwfield' & 'valfield' is 0 and 1 respectively.
+// If 'comma' is not 0, the default CSV delimiter is ','.
+// If 'comment' is not 0, then lines beginning with that rune are discarded.
+// Records where the 'kwfield' and 'valfield' can't be evaluated are discarded.
+// Returns number of records added.
+func (w *DBWriter) AddCSVFile(fn string, comma, comment rune, kwfield, valfield int) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	return w.addCSVPositional(fn, fd, comma, comment, kwfield, valfield)
+}
+
+// AddCSVStream adds contents from CSV file 'fn'. If 'kwfield' and 'valfield' are
+// non-negative, they indicate the field# of the key and value respectively; the
+// default value for 'kwfield' & 'valfield' is 0 and 1 respectively.
+// If 'comma' is not 0, the default CSV delimiter is ','.
+// If 'comment' is not 0, then lines beginning with that rune are discarded.
+// Records where the 'kwfield' and 'valfield' can't be evaluated are discarded.
+// Returns number of records added.
+func (w *DBWriter) AddCSVStream(fd io.Reader, comma, comment rune, kwfield, valfield int) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	return w.addCSVPositional("", fd, comma, comment, kwfield, valfield)
+}
+
+// add the records of CSV stream 'fd' from source 'nm' with the key and
+// value in fields 'kwfield' and 'valfield'
+func (w *DBWriter) addCSVPositional(nm string, fd io.Reader, comma, comment rune, kwfield, valfield int) (uint64, error) {
+	if kwfield < 0 {
+		kwfield = 0
+	}
+
+	if valfield < 0 {
+		valfield = 1
+	}
+
+	opt := &CSVOptions{
+		Comma:   comma,
+		Comment: comment,
+	}
+
+	ch, ps, err := csvRecords(fd, opt, kwfield, valfield, w.strict)
+	if err != nil {
+		return 0, err
+	}
+	return w.addFromSource(nm, ch, ps)
+}
+
+// CSVOptions control the parsing of CSV input by AddCSVStreamWithOptions().
+// The zero value reads the key and value from the first two fields of every
+// row.
+type CSVOptions struct {
+	// Comma is the field delimiter; default ','
+	Comma rune
+
+	// Comment, if not 0, discards lines beginning with this rune
+	Comment rune
+
+	// SkipRows is the number of leading rows to discard; this is done
+	// before reading the header row.
+	SkipRows int
+
+	// Header treats the first row (after SkipRows) as a header naming
+	// the columns.
+	Header bool
+
+	// KeyColumn and ValColumn select the key and value by the name of
+	// their column in the header row; they imply Header. It is an error
+	// if the header doesn't have the named columns.
+	KeyColumn string
+	ValColumn string
+
+	// KeyField and ValField select the key and value by their field#
+	// when they aren't selected by name. If both are zero, the key and
+	// value are fields 0 and 1 respectively.
+	KeyField int
+	ValField int
+}
+
+// AddCSVFileWithOptions adds contents from CSV file 'fn' parsed as described
+// by 'opt'. Records where the key and value fields can't be evaluated are
+// discarded.
+// Returns number of records added.
+func (w *DBWriter) AddCSVFileWithOptions(fn string, opt CSVOptions) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
 
-	ch := make(chan *record, 10)
+	defer fd.Close()
+
+	return w.addCSV(fn, fd, opt)
+}
+
+// AddCSVStreamWithOptions adds contents from CSV stream 'fd' parsed as
+// described by 'opt'. Records where the key and value fields can't be
+// evaluated are discarded.
+// Returns number of records added.
+func (w *DBWriter) AddCSVStreamWithOptions(fd io.Reader, opt CSVOptions) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	return w.addCSV("", fd, opt)
+}
+
+// add the records of CSV stream 'fd' from source 'nm' parsed as described
+// by 'opt'
+func (w *DBWriter) addCSV(nm string, fd io.Reader, opt CSVOptions) (uint64, error) {
+	kwfield, valfield := opt.fields()
+	ch, ps, err := csvRecords(fd, &opt, kwfield, valfield, w.strict)
+	if err != nil {
+		return 0, err
+	}
+	return w.addFromSource(nm, ch, ps)
+}
+
+// return the key and value field# selected by position
+func (o *CSVOptions) fields() (int, int) {
+	if o.KeyField == 0 && o.ValField == 0 {
+		return 0, 1
+	}
+
+	kwfield, valfield := o.KeyField, o.ValField
+	if kwfield < 0 {
+		kwfield = 0
+	}
+	if valfield < 0 {
+		valfield = 1
+	}
+	return kwfield, valfield
+}
+
+// parse the CSV stream 'fd' into records and send them on the returned
+// chan. The key and value are in fields 'kwfield' and 'valfield' unless
+// 'opt' selects them by name. The leading rows and the header are
+// processed before we return. Malformed rows are skipped unless 'strict' is
+// true; read errors and the number of skipped rows are available via the
+// returned parseState once the chan is closed.
+func csvRecords(fd io.Reader, opt *CSVOptions, kwfield, valfield int, strict bool) (chan *record, *parseState, error) {
 	cr := csv.NewReader(fd)
-	cr.Comma = comma
-	cr.Comment = comment
+	if opt.Comma != 0 {
+		cr.Comma = opt.Comma
+	}
+	cr.Comment = opt.Comment
 	cr.FieldsPerRecord = -1
 	cr.TrimLeadingSpace = true
 	cr.ReuseRecord = true
 
+	ch := make(chan *record, 10)
+	ps := &parseState{}
+
+	// a stream that ends before the header has no records
+	for i := 0; i < opt.SkipRows; i++ {
+		if _, err := cr.Read(); err != nil {
+			return csvEOF(ch, ps, err)
+		}
+	}
+
+	if opt.Header || len(opt.KeyColumn) > 0 || len(opt.ValColumn) > 0 {
+		hdr, err := cr.Read()
+		if err != nil {
+			return csvEOF(ch, ps, err)
+		}
+
+		col := func(nm string, def int) (int, error) {
+			if len(nm) == 0 {
+				return def, nil
+			}
+			for i, h := range hdr {
+				if h == nm {
+					return i, nil
+				}
+			}
+			return 0, fmt.Errorf("CSV header has no column '%s'", nm)
+		}
+
+		if kwfield, err = col(opt.KeyColumn, kwfield); err != nil {
+			return nil, nil, err
+		}
+		if valfield, err = col(opt.ValColumn, valfield); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var max int = valfield
+	if kwfield > valfield {
+		max = kwfield
+	}
+
+	max += 1
+
 	go func(cr *csv.Reader, ch chan *record) {
+		var n int
 		for {
 			v, err := cr.Read()
+			n++
 			if err != nil {
+				// the reader can continue past a malformed row
+				if _, ok := err.(*csv.ParseError); ok {
+					if strict {
+						ps.err = fmt.Errorf("%s: %w", err, ErrMalformedInput)
+						break
+					}
+					ps.skipped++
+					continue
+				}
+				if err != io.EOF {
+					ps.err = err
+				}
 				break
 			}
 
 			if len(v) < max {
+				if strict {
+					ps.err = fmt.Errorf("record %d has %d fields: %w", n, len(v), ErrMalformedInput)
+					break
+				}
+				ps.skipped++
 				continue
 			}
 
@@ -335,124 +1613,680 @@ func (w *DBWriter) AddCSVStream(fd io.Reader, comma, comment rune, kwfield, valf
 			}
 			ch <- r
 		}
-		close(ch)
-	}(cr, ch)
+		close(ch)
+	}(cr, ch)
+
+	return ch, ps, nil
+}
+
+// handle error 'err' while reading the leading rows of a CSV stream; EOF
+// yields no records.
+func csvEOF(ch chan *record, ps *parseState, err error) (chan *record, *parseState, error) {
+	if err != io.EOF {
+		return nil, nil, err
+	}
+
+	close(ch)
+	return ch, ps, nil
+}
+
+// Freeze builds the minimal perfect hash, writes the DB and closes it.
+// For very large key spaces, a higher 'g' value is recommended (2.5~4.0); otherwise,
+// the Freeze() function will fail to generate an MPH. If 'g' is <= 1.0, the
+// gamma from the writer options is used.
+func (w *DBWriter) Freeze(g float64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.frozen {
+		return ErrFrozen
+	}
+
+	if w.dryrun {
+		return ErrDryRun
+	}
+
+	if g <= 1.0 {
+		g = w.gamma
+	}
+
+	// the records are read back from the file
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+	st := BuildStats{
+		Ingest:   t0.Sub(w.start),
+		KeyBytes: w.keybytes,
+		ValBytes: w.valbytes,
+	}
+
+	if w.keymap == nil {
+		n := len(w.keys)
+		w.dedup()
+		if d := n - len(w.keys); d > 0 {
+			logf(w.log, "%s: discarded %d duplicate keys", w.fn, d)
+		}
+	}
+
+	bb, err := newWithSalt(g, w.rng.next(), w.keys, w.log)
+	if err != nil {
+		logf(w.log, "%s: can't build MPH with gamma %4.2f: %s", w.fn, g, err)
+		return ErrMPHFail
+	}
+
+	t1 := time.Now()
+	st.MPH = t1.Sub(t0)
+
+	offset := make([]uint64, len(w.keys))
+	err = w.buildOffsets(bb, offset)
+	if err != nil {
+		return err
+	}
+
+	t2 := time.Now()
+	st.Offsets = t2.Sub(t1)
+
+	if w.locality {
+		err = w.relayout(bb, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	if (w.flags & flagFingerprint) > 0 {
+		if err = w.addFingerprints(bb, offset); err != nil {
+			return err
+		}
+	}
+
+	t3 := time.Now()
+	st.Layout = t3.Sub(t2)
+
+	// the records end at 'end'; in a compressed DB, that is the end of
+	// the compressed blocks.
+	end := w.off
+	if w.compress {
+		end, err = w.compressRecords()
+		if err != nil {
+			return err
+		}
+		if err = w.fd.Truncate(int64(end)); err != nil {
+			return err
+		}
+	}
+
+	if w.segsize > 0 {
+		w.segs, err = segmentSums(w.fd, w.segsize, end)
+		if err != nil {
+			return err
+		}
+	}
+	w.data = w.dataSection(end)
+
+	// We align the offset table to pagesize - so we can mmap it when we read it back.
+	pgsz_m1 := w.pgsz - 1
+	offtbl := end + pgsz_m1
+	offtbl &= ^pgsz_m1
+
+	// the width of the entries of a compact offset table depends on its
+	// offset
+	width := 8
+	if (w.flags & flagCompactOffsets) > 0 {
+		width = compactWidth(offtbl)
+		if width == 0 {
+			logf(w.log, "%s: DB is too large for a compact offset table", w.fn)
+			w.flags &^= flagCompactOffsets
+			width = 8
+		}
+	}
+
+	var ehdr [64]byte
+
+	// save info for building the file header.
+	hdr := &header{
+		magic:   [4]byte{'B', 'B', 'H', 'H'},
+		version: FormatVersion,
+		flags:   w.flags,
+		salt:    w.salt,
+		nkeys:   uint64(len(w.keys)),
+		offtbl:  offtbl,
+		keychk:  w.keychk,
+		valoff:  w.valoff,
+		align:   w.align,
+	}
+
+	// optional sections go right after the marshaled bbhash
+	secs := w.sections()
+	if len(secs) > 0 {
+		tblsz := offTableSize(w.flags, uint64(len(offset)), offtbl)
+		hdr.extoff = offtbl + tblsz + bb.MarshalBinarySize()
+	}
+	/*
+		hdr.magic[0] = 'B'
+		hdr.magic[1] = 'B'
+		hdr.magic[2] = 'H'
+		hdr.magic[3] = 'H'
+	*/
+
+	hdr.encode(ehdr[:])
+
+	w.fd.Seek(int64(offtbl), 0)
+
+	// We won't encode concurrently and write to disk for two reasons:
+	// 1. To make the I/O safe - we have to encode an entire worker's worth of offsets;
+	//    this costs additional memory.
+	// 2. There is no safe, portable way to do concurrent disk write without corrupting the
+	//    file.
+
+	// we calculate strong checksum for all data from this point on.
+	h := newDigest((w.flags&flagChunkSum) > 0, ehdr[:])
+	crc := crc32.New(crcTable)
+	crc.Write(ehdr[:])
+
+	// the metadata is written through a buffer; the offsets are encoded
+	// in batches.
+	bw := bufio.NewWriterSize(w.fd, writeBufSize)
+	tee := io.MultiWriter(bw, h, crc)
+	if (w.flags & flagEncOffsets) > 0 {
+		err = w.writeSealedOffsets(tee, offset, offtbl)
+	} else {
+		err = w.writeOffsets(tee, offset, width)
+	}
+	if err != nil {
+		return err
+	}
+
+	// We now encode the bbhash and write to disk.
+	err = bb.MarshalBinary(tee)
+	if err != nil {
+		return err
+	}
+
+	if len(secs) > 0 {
+		err = writeSections(tee, secs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the CRC is covered by the strong checksum
+	if _, err = io.MultiWriter(bw, h).Write(crc.Sum(nil)); err != nil {
+		return err
+	}
+
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	// Trailer is the checksum of the meta-data.
+	cksum := h.Sum(nil)
+	n, err := w.fd.Write(cksum[:])
+	if err != nil {
+		return err
+	}
+	if n != sha512.Size256 {
+		return fmt.Errorf("%s: partial write of checksum; exp %d saw %d", w.fntmp, sha512.Size256, n)
+	}
+	copy(w.csum[:], cksum)
+
+	if w.signer != nil {
+		sig := ed25519.Sign(w.signer, cksum)
+		if n, err = w.fd.Write(sig); err != nil {
+			return err
+		}
+		if n != len(sig) {
+			return fmt.Errorf("%s: partial write of signature; exp %d saw %d", w.fntmp, len(sig), n)
+		}
+	}
+
+	w.fd.Seek(0, 0)
+	n, err = w.fd.Write(ehdr[:])
+	if err != nil {
+		return err
+	}
+	if n != 64 {
+		return fmt.Errorf("%s: partial write of file header; exp %d saw %d", w.fntmp, 64, n)
+	}
+
+	// the fd can't be reused once we get here; a failure before the rename
+	// discards the temp file and releases the lock so that a later build of
+	// the same DB isn't locked out.
+	fail := func(err error) error {
+		os.Remove(w.fntmp)
+		w.unlock()
+		w.fd = nil
+		w.closed = true
+		return err
+	}
+
+	if err = w.fd.Sync(); err != nil {
+		w.fd.Close()
+		return fail(err)
+	}
+	if err = w.fd.Close(); err != nil {
+		return fail(err)
+	}
+
+	err = rename(w.fntmp, w.fn, w.perm)
+	if err != nil {
+		return fail(err)
+	}
+	w.frozen = true
+	w.unlock()
+
+	// make sure the rename itself is durable
+	err = syncDir(filepath.Dir(w.fn))
+	if err != nil {
+		return err
+	}
+
+	st.Write = time.Since(t3)
+	st.Records = uint64(len(w.keys))
+	st.RecordBytes = end - 64
+	st.PadBytes = offtbl - end
+	st.OffsetTblSize = offTableSize(w.flags, uint64(len(offset)), offtbl)
+
+	st.MPHLevels = len(bb.bits)
+	st.MPHConstruction = bb.ConstructionStats()
+	for _, bv := range bb.bits {
+		st.MPHBits += bv.Size()
+	}
+	if st.Records > 0 {
+		st.MPHBitsPerKey = float64(st.MPHBits) / float64(st.Records)
+	}
+	st.MPHSize = bb.MarshalBinarySize()
+
+	st.FileSize = offtbl + st.OffsetTblSize + st.MPHSize + crcSize + 32
+	if len(secs) > 0 {
+		st.FileSize += sectionsSize(secs)
+	}
+	if w.signer != nil {
+		st.FileSize += ed25519.SignatureSize
+	}
+
+	w.stats = st
+	if w.metrics != nil {
+		st.export(w.metrics)
+	}
+
+	logf(w.log, "%s: %d records; mph %s (%d levels), offsets %s, layout %s, write %s",
+		w.fn, st.Records, st.MPH, st.MPHLevels, st.Offsets, st.Layout, st.Write)
+	return nil
+}
+
+// FreezeAuto is like Freeze except the gamma is picked based on the number
+// of keys; if the MPH can't be built, the gamma is progressively increased
+// until it can.
+func (w *DBWriter) FreezeAuto() error {
+	g := autoGamma(w.TotalKeys(), w.gamma)
+	for {
+		err := w.Freeze(g)
+		if err != ErrMPHFail || g >= maxAutoGamma {
+			return err
+		}
+
+		logf(w.log, "%s: retrying with gamma %4.2f", w.fn, g+1.0)
+		g += 1.0
+	}
+}
+
+// The MPH construction can get into a pathological state for very large
+// key spaces; a larger gamma avoids it at the cost of a bigger MPH.
+const (
+	largeKeys    = 1000000
+	largeGamma   = 4.0
+	maxAutoGamma = 10.0
+)
+
+// pick a gamma for 'n' keys; 'g' is the default gamma
+func autoGamma(n int, g float64) float64 {
+	if n >= largeKeys && g < largeGamma {
+		return largeGamma
+	}
+	return g
+}
+
+// Stats returns statistics about the construction of the DB; they are
+// complete only after the DB is frozen.
+func (w *DBWriter) Stats() BuildStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.frozen {
+		return w.stats
+	}
+
+	return BuildStats{
+		Records:     uint64(len(w.keys)),
+		KeyBytes:    w.keybytes,
+		ValBytes:    w.valbytes,
+		RecordBytes: w.off - 64,
+		Ingest:      time.Since(w.start),
+	}
+}
+
+// Sources returns statistics about each input file or stream added via the
+// text, CSV or DB Add functions, in the order they were added.
+func (w *DBWriter) Sources() []SourceStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := make([]SourceStats, len(w.sources))
+	copy(s, w.sources)
+	return s
+}
+
+// record the statistics of source 's'
+func (w *DBWriter) addSource(s *SourceStats) {
+	w.mu.Lock()
+	w.sources = append(w.sources, *s)
+	w.mu.Unlock()
+}
+
+// rename 'src' to 'dst'; if they are on different filesystems, copy 'src'
+// to a temporary file next to 'dst' and rename that.
+func rename(src, dst string, perm os.FileMode) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	sfd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sfd.Close()
+
+	tmp := fmt.Sprintf("%s.tmp.%d", dst, rand64())
+	dfd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if err = flock(dfd, true); err == nil {
+		err = dfd.Chmod(perm)
+	}
+	if err == nil {
+		if _, err = io.Copy(dfd, sfd); err == nil {
+			err = dfd.Sync()
+		}
+	}
+	dfd.Close()
+
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
 
-	return w.addFromChan(ch)
+	os.Remove(src)
+	return nil
 }
 
-// Freeze builds the minimal perfect hash, writes the DB and closes it.
-// For very large key spaces, a higher 'g' value is recommended (2.5~4.0); otherwise,
-// the Freeze() function will fail to generate an MPH.
-func (w *DBWriter) Freeze(g float64) error {
-	if w.frozen {
-		return ErrFrozen
+// fsync the directory 'dn' so that recent renames in it are durable
+func syncDir(dn string) error {
+	// directories can't be synced on windows
+	if runtime.GOOS == "windows" {
+		return nil
 	}
 
-	bb, err := New(g, w.keys)
+	d, err := os.Open(dn)
 	if err != nil {
-		return ErrMPHFail
+		return err
 	}
 
-	offset := make([]uint64, len(w.keys))
-	err = w.buildOffsets(bb, offset)
+	err = d.Sync()
+	d.Close()
+	return err
+}
+
+// create a temp file for the DB and write a blank header to it. We fill in
+// the header when we are done Freezing.
+func (w *DBWriter) tmpFile() (*os.File, string, error) {
+	dir := filepath.Dir(w.fn)
+	if len(w.tmpdir) > 0 {
+		dir = w.tmpdir
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf("%s.tmp.%d", filepath.Base(w.fn), rand64()))
+
+	fd, err := os.OpenFile(tmp, w.oflags, w.perm)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	// We align the offset table to pagesize - so we can mmap it when we read it back.
-	pgsz := uint64(os.Getpagesize())
-	pgsz_m1 := pgsz - 1
-	offtbl := w.off + pgsz_m1
-	offtbl &= ^pgsz_m1
+	// readers can't open the temp file while it is being written
+	if err = flock(fd, true); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return nil, "", fmt.Errorf("%s: %w", tmp, err)
+	}
 
-	var ehdr [64]byte
+	// the umask may have clipped the permissions
+	if err = fd.Chmod(w.perm); err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return nil, "", fmt.Errorf("%s: can't set permissions: %w", tmp, err)
+	}
 
-	// save info for building the file header.
-	hdr := &header{
-		magic:  [4]byte{'B', 'B', 'H', 'H'},
-		salt:   w.salt,
-		nkeys:  uint64(len(w.keys)),
-		offtbl: offtbl,
+	// the first record may be aligned past the header
+	z := make([]byte, 64+w.padding(64))
+	nw, err := fd.Write(z)
+	if err == nil && nw != len(z) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return nil, "", fmt.Errorf("%s: can't write blank-header: %w", tmp, err)
 	}
-	/*
-		hdr.magic[0] = 'B'
-		hdr.magic[1] = 'B'
-		hdr.magic[2] = 'H'
-		hdr.magic[3] = 'H'
-	*/
 
-	hdr.encode(ehdr[:])
+	return fd, tmp, nil
+}
 
-	w.fd.Seek(int64(offtbl), 0)
+// take the lock file 'fn.lock' of the DB; it is held until the DB is frozen
+// or discarded. ErrLocked is returned if another writer holds it. If the
+// lock file can't be created, the DB is built without it.
+func (w *DBWriter) lockTarget() error {
+	fn := w.fn + ".lock"
+	for {
+		fd, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			logf(w.log, "%s: building without a lock: %s", w.fn, err)
+			return nil
+		}
 
-	// We won't encode concurrently and write to disk for two reasons:
-	// 1. To make the I/O safe - we have to encode an entire worker's worth of offsets;
-	//    this costs additional memory.
-	// 2. There is no safe, portable way to do concurrent disk write without corrupting the
-	//    file.
+		if err = flock(fd, true); err != nil {
+			fd.Close()
+			return fmt.Errorf("%s: %w", w.fn, err)
+		}
 
-	var z [8]byte
-	le := binary.LittleEndian
+		// the previous holder may have removed the lock file before we
+		// locked it; then, we hold a lock on a file no one else sees.
+		a, err := fd.Stat()
+		if err == nil {
+			var b os.FileInfo
+			if b, err = os.Stat(fn); err == nil && !os.SameFile(a, b) {
+				err = os.ErrNotExist
+			}
+		}
 
-	// we calculate strong checksum for all data from this point on.
-	h := sha512.New512_256()
-	h.Write(ehdr[:])
+		if !errors.Is(err, os.ErrNotExist) {
+			w.lock = fd
+			return nil
+		}
+		fd.Close()
+	}
+}
+
+// remove the lock file and release the lock
+func (w *DBWriter) unlock() {
+	if w.lock != nil {
+		os.Remove(w.lock.Name())
+		w.lock.Close()
+		w.lock = nil
+	}
+}
+
+// rewrite the records in the order of the offset table into a new temp
+// file; 'offset' is updated to point to the new location of each record.
+// In a split DB, the values are written to a separate value region that
+// follows the records.
+func (w *DBWriter) relayout(bb *BBHash, offset []uint64) error {
+	fd, tmp, err := w.tmpFile()
+	if err != nil {
+		return err
+	}
+
+	// the records are encoded afresh for their new offsets
+	dst := w.codec
+	if w.faead != nil {
+		dst.aead = w.faead
+	}
 
-	tee := io.MultiWriter(w.fd, h)
-	for _, o := range offset {
-		le.PutUint64(z[:], o)
+	var pfx *prefixer
+	var vdup *deduper
+	if w.pfx != nil {
+		pfx = &prefixer{}
+	}
+	if w.vdup != nil && !w.split {
+		vdup = newDeduper()
+	}
 
-		n, err := tee.Write(z[:])
+	// the value region is built in its own temp file and appended to the
+	// records; identical values share a position when deduplicating.
+	var vfd *os.File
+	var vw *bufio.Writer
+	var vals map[string]uint64
+	var vsize, dsize uint64
+	if w.split {
+		dst.flags |= flagSplit
+		vfd, err = os.OpenFile(tmp+".vals", os.O_RDWR|os.O_CREATE|os.O_TRUNC, w.perm)
 		if err != nil {
+			fd.Close()
+			os.Remove(tmp)
 			return err
 		}
-		if n != 8 {
-			return fmt.Errorf("%s: partial write of offsets; exp %d saw %d", w.fntmp, 8, n)
+		defer func() {
+			vfd.Close()
+			os.Remove(vfd.Name())
+		}()
+
+		vw = bufio.NewWriterSize(vfd, 1048576)
+		if w.vdup != nil {
+			vals = make(map[string]uint64)
 		}
 	}
 
-	// We now encode the bbhash and write to disk.
-	err = bb.MarshalBinary(tee)
-	if err != nil {
+	fail := func(err error) error {
+		fd.Close()
+		os.Remove(tmp)
 		return err
 	}
 
-	// Trailer is the checksum of the meta-data.
-	cksum := h.Sum(nil)
-	n, err := w.fd.Write(cksum[:])
-	if err != nil {
-		return err
-	}
-	if n != sha512.Size256 {
-		return fmt.Errorf("%s: partial write of checksum; exp %d saw %d", w.fntmp, sha512.Size256, n)
+	// the rewritten records are hashed as they are written
+	dsum := w.newDataSum()
+
+	bw := bufio.NewWriterSize(fd, 1048576)
+	tw := io.MultiWriter(bw, dsum)
+	buf := make([]byte, 0, 65536)
+	off := 64 + w.padding(64)
+	for i, o := range offset {
+		r, err := w.decode(w.fd, o, int64(w.off))
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", w.fntmp, err))
+		}
+
+		r.off = off
+		pack(pfx, vdup, r)
+
+		if w.split && len(r.val) > 0 {
+			pos, ok := vals[string(r.val)]
+			if !ok {
+				pos = vsize
+				if _, err = vw.Write(r.val); err != nil {
+					return fail(err)
+				}
+				vsize += uint64(len(r.val))
+
+				if vals != nil && dsize+uint64(len(r.val)) <= dedupMaxBytes {
+					vals[string(r.val)] = pos
+					dsize += uint64(len(r.val))
+				}
+			}
+			r.vpos = pos
+		}
+
+		b := dst.encode(buf[:0], r)
+		b = append(b, make([]byte, w.padding(off+uint64(len(b))))...)
+		if _, err = tw.Write(b); err != nil {
+			return fail(err)
+		}
+
+		offset[i] = off
+		off += uint64(len(b))
 	}
 
-	w.fd.Seek(0, 0)
-	n, err = w.fd.Write(ehdr[:])
-	if err != nil {
-		return err
+	if w.split {
+		if err = vw.Flush(); err == nil {
+			_, err = vfd.Seek(0, 0)
+		}
+		if err == nil {
+			_, err = io.Copy(tw, vfd)
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		dst.valoff = off
+		off += vsize
 	}
-	if n != 64 {
-		return fmt.Errorf("%s: partial write of file header; exp %d saw %d", w.fntmp, 64, n)
+
+	if err = bw.Flush(); err != nil {
+		return fail(err)
 	}
 
-	w.frozen = true
-	w.fd.Sync()
 	w.fd.Close()
+	os.Remove(w.fntmp)
 
-	err = os.Rename(w.fntmp, w.fn)
-	if err != nil {
-		return err
+	for j, k := range w.keys {
+		w.offs[j] = offset[bb.Find(k)-1]
 	}
 
+	w.fd = fd
+	w.fntmp = tmp
+	w.off = off
+	w.dsum = dsum
+	w.codec = dst
+	w.locality = false
+	w.split = false
 	return nil
 }
 
+// front code the key and deduplicate the value of record 'r' as
+// configured; r.off must be set.
+func pack(pfx *prefixer, vdup *deduper, r *record) {
+	anchor := false
+	if pfx != nil {
+		anchor = pfx.code(r)
+	}
+	if vdup != nil {
+		vdup.code(r, anchor)
+	}
+}
+
 // encode header 'h' into bytestream 'b'
 func (h *header) encode(b []byte) {
 	be := binary.BigEndian
 	copy(b[:4], h.magic[:])
+	be.PutUint32(b[4:8], h.flags|uint32(h.version)<<versionShift)
 
 	i := 8
 	be.PutUint64(b[i:i+8], h.salt)
@@ -460,12 +2294,132 @@ func (h *header) encode(b []byte) {
 	be.PutUint64(b[i:i+8], h.nkeys)
 	i += 8
 	be.PutUint64(b[i:i+8], h.offtbl)
+	i += 8
+	be.PutUint64(b[i:i+8], h.keychk)
+	i += 8
+	be.PutUint64(b[i:i+8], h.extoff)
+	i += 8
+	be.PutUint64(b[i:i+8], h.valoff)
+	i += 8
+	be.PutUint64(b[i:i+8], h.align)
+}
+
+// number of offsets encoded in a batch by writeOffsets()
+const offsetBatch = 65536
+
+// write the offset table to 'wr' in batches of little-endian offsets of
+// 'width' bytes
+func (w *DBWriter) writeOffsets(wr io.Writer, offset []uint64, width int) error {
+	le := binary.LittleEndian
+
+	n := len(offset)
+	if n > offsetBatch {
+		n = offsetBatch
+	}
+
+	b := make([]byte, n*width)
+	for len(offset) > 0 {
+		n = len(offset)
+		if n > offsetBatch {
+			n = offsetBatch
+		}
+
+		for i, o := range offset[:n] {
+			if width == 8 {
+				le.PutUint64(b[i*8:], o)
+			} else {
+				putOffset(b[i*width:], o, width)
+			}
+		}
+
+		m, err := wr.Write(b[:n*width])
+		if err != nil {
+			return err
+		}
+		if m != n*width {
+			return fmt.Errorf("%s: partial write of offsets; exp %d saw %d", w.fntmp, n*width, m)
+		}
+		offset = offset[n:]
+	}
+	return nil
+}
+
+// encrypt the offset table as one sealed blob and write it to 'w'
+func (w *DBWriter) writeSealedOffsets(wr io.Writer, offset []uint64, offtbl uint64) error {
+	le := binary.LittleEndian
+	b := make([]byte, len(offset)*8, len(offset)*8+w.aead.Overhead())
+	for i, o := range offset {
+		le.PutUint64(b[i*8:], o)
+	}
+
+	b = w.aead.Seal(b[:0], nonce(nonceOffTbl, offtbl), b, nil)
+	n, err := wr.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("%s: partial write of offsets; exp %d saw %d", w.fntmp, len(b), n)
+	}
+	return nil
 }
 
 // Abort stops the construction of the perfect hash db
 func (w *DBWriter) Abort() {
-	w.fd.Close()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.fd != nil {
+		w.fd.Close()
+		os.Remove(w.fntmp)
+	}
+	w.unlock()
+	w.closed = true
+}
+
+// Close discards the DB being built unless it is frozen - like Abort(); it
+// does nothing after Freeze() or if it was already called. Deferring Close()
+// right after creating the writer cleans up on every error path.
+func (w *DBWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.frozen || w.closed || w.fd == nil {
+		return nil
+	}
+
+	w.closed = true
+	err := w.fd.Close()
 	os.Remove(w.fntmp)
+	w.unlock()
+	return err
+}
+
+// return the optional sections to be written to the DB
+func (w *DBWriter) sections() []section {
+	var s []section
+
+	if len(w.meta) > 0 {
+		s = append(s, section{secMeta, w.meta})
+	}
+	if w.base != nil {
+		s = append(s, section{secBase, w.base.csum[:]})
+	}
+	if w.blocks != nil {
+		s = append(s, section{secBlocks, w.blocks})
+	}
+	if w.bloomBits > 0 {
+		s = append(s, section{secBloom, newBloomFilter(w.keys, w.bloomBits).marshal()})
+	}
+	if w.segs != nil {
+		s = append(s, section{secSegs, w.segs})
+	}
+	if len(w.normName) > 0 {
+		s = append(s, section{secNorm, []byte(w.normName)})
+	}
+	if w.data != nil {
+		s = append(s, section{secData, w.data})
+	}
+	return s
 }
 
 // build the offset mapping table: map of MPH index to a record offset.
@@ -475,24 +2429,75 @@ func (w *DBWriter) buildOffsets(bb *BBHash, offset []uint64) error {
 		return w.buildOffsetsConcurrent(bb, offset)
 	}
 
-	return w.buildOffsetSingle(bb, offset, w.keys)
+	return w.buildOffsetSingle(bb, offset, 0, len(w.keys))
 }
 
-// serialized/single-threaded construction of the offset table.
-func (w *DBWriter) buildOffsetSingle(bb *BBHash, offset, keys []uint64) error {
-	for _, k := range keys {
-		r := w.keymap[k]
+// serialized/single-threaded construction of the offset table for
+// keys[x:y].
+func (w *DBWriter) buildOffsetSingle(bb *BBHash, offset []uint64, x, y int) error {
+	for j := x; j < y; j++ {
+		k := w.keys[j]
 		i := bb.Find(k)
 		if i == 0 {
-			return fmt.Errorf("%s: key <%s> with hash %#x can't be mapped", w.fn, string(r.key), k)
+			var key []byte
+
+			// we don't keep the keys in memory; so fetch it from
+			// the file for the error message.
+			if r, err := w.decode(w.fd, w.offs[j], int64(w.off)); err == nil {
+				key = r.key
+			}
+			return fmt.Errorf("%s: key <%s> with hash %#x can't be mapped", w.fn, string(key), k)
 		}
 
-		offset[i-1] = r.off
+		offset[i-1] = w.offs[j]
 	}
 
 	return nil
 }
 
+// remove duplicate keys in low memory mode. The first record of a
+// duplicate key wins; the subsequent records are unreferenced garbage in
+// the file.
+func (w *DBWriter) dedup() {
+	sort.Sort(&hashOffsets{w.keys, w.offs})
+
+	n := 0
+	for i, k := range w.keys {
+		if i > 0 && k == w.keys[n-1] {
+			continue
+		}
+
+		w.keys[n] = k
+		w.offs[n] = w.offs[i]
+		n++
+	}
+
+	w.keys = w.keys[:n]
+	w.offs = w.offs[:n]
+}
+
+// sort key hashes and their offsets in tandem; ties are broken by the
+// offset so that the first record of a key sorts first.
+type hashOffsets struct {
+	k, o []uint64
+}
+
+func (h *hashOffsets) Len() int {
+	return len(h.k)
+}
+
+func (h *hashOffsets) Less(i, j int) bool {
+	if h.k[i] == h.k[j] {
+		return h.o[i] < h.o[j]
+	}
+	return h.k[i] < h.k[j]
+}
+
+func (h *hashOffsets) Swap(i, j int) {
+	h.k[i], h.k[j] = h.k[j], h.k[i]
+	h.o[i], h.o[j] = h.o[j], h.o[i]
+}
+
 // concurrent construction of the offset table.
 func (w *DBWriter) buildOffsetsConcurrent(bb *BBHash, offset []uint64) error {
 	ncpu := runtime.NumCPU()
@@ -518,14 +2523,13 @@ func (w *DBWriter) buildOffsetsConcurrent(bb *BBHash, offset []uint64) error {
 			y += r
 		}
 
-		// XXX keymap may have to be locked for concurrent reads?
-		go func(keys []uint64) {
-			err := w.buildOffsetSingle(bb, offset, keys)
+		go func(x, y int) {
+			err := w.buildOffsetSingle(bb, offset, x, y)
 			if err != nil {
 				errch <- err
 			}
 			wg.Done()
-		}(w.keys[x:y])
+		}(x, y)
 	}
 
 	// XXX What is the design pattern for returning errors from multiple workers?
@@ -533,13 +2537,18 @@ func (w *DBWriter) buildOffsetsConcurrent(bb *BBHash, offset []uint64) error {
 	return err
 }
 
-// read partial records from the chan, complete them and write them to disk.
-// Build up the internal tables as we go
-func (w *DBWriter) addFromChan(ch chan *record) (uint64, error) {
+// read partial records from the chan and add them via 'add'; the
+// caller's tables are built up as we go
+func addFromChan(ch chan *record, add func(r *record) (bool, error)) (uint64, error) {
 	var n uint64
 	for r := range ch {
-		ok, err := w.addRecord(r)
+		ok, err := add(r)
 		if err != nil {
+			// let the parser run to completion
+			go func() {
+				for range ch {
+				}
+			}()
 			return n, err
 		}
 		if ok {
@@ -550,33 +2559,158 @@ func (w *DBWriter) addFromChan(ch chan *record) (uint64, error) {
 	return n, nil
 }
 
+// read partial records of source 'nm' from the chan and add them; the
+// statistics of the source are recorded once the chan is drained.
+func (w *DBWriter) addFromSource(nm string, ch chan *record, ps *parseState) (uint64, error) {
+	src := SourceStats{Name: nm}
+	n, err := addFromChan(ch, func(r *record) (bool, error) {
+		ok, err := w.addRecord(r)
+		if err == nil {
+			src.account(r, ok)
+		} else if !w.strict && isSizeLimit(err) {
+			src.Skipped++
+			return false, nil
+		}
+		return ok, err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	// ps is safe to read once the channel is closed
+	src.Skipped += ps.skipped
+	w.addSource(&src)
+
+	if src.Skipped > 0 {
+		if len(nm) == 0 {
+			nm = "<stream>"
+		}
+		logf(w.log, "%s: skipped %d malformed or oversized lines in %s", w.fn, src.Skipped, nm)
+	}
+	return n, ps.err
+}
+
 // compute checksums and add a record to the file at the current offset.
+// This is safe for concurrent use.
 func (w *DBWriter) addRecord(r *record) (bool, error) {
-	buf := make([]byte, 0, 65536)
-	r.hash = fasthash.Hash64(w.salt, r.key)
-	if _, ok := w.keymap[r.hash]; ok {
+	if (w.flags & flagKeysOnly) > 0 {
+		r.val = nil
+	}
+
+	r.key = w.normKey(r.key)
+
+	if err := w.checkSize(r.key, uint64(len(r.val))); err != nil {
+		return false, err
+	}
+
+	// a delta DB only needs new or changed records - and the tombstones
+	// of keys in its base
+	if r.deleted {
+		if w.base == nil || !w.base.hasKey(r.ns, r.key) {
+			return false, nil
+		}
+	} else if w.base != nil && w.base.hasRecord(r) {
 		return false, nil
 	}
 
-	r.off = w.off
-	r.csum = r.checksum(w.saltkey, w.off)
+	r.hash = w.keyHash(r.ns, r.key)
 
-	b := r.encode(buf)
-	nw, err := w.fd.Write(b)
-	if err != nil {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.frozen {
+		return false, ErrFrozen
+	}
+
+	if w.keymap != nil {
+		if _, ok := w.keymap[r.hash]; ok {
+			return false, nil
+		}
+	}
+
+	if err := w.checkCount(); err != nil {
 		return false, err
 	}
 
-	if nw != len(b) {
-		return false, fmt.Errorf("%s: partial write; exp %d saw %d", w.fntmp, len(b), nw)
+	if r.expiry > 0 {
+		w.flags |= flagExpiry
+	}
+	if r.appflags != 0 {
+		w.flags |= flagAppFlags
+	}
+	if r.ns != 0 {
+		w.flags |= flagNamespaces
+	}
+	if r.deleted {
+		w.flags |= flagTombstones
+	}
+
+	r.off = w.off
+	pack(w.pfx, w.vdup, r)
+
+	b := w.encode(w.buf[:0], r)
+	b = append(b, make([]byte, w.padding(r.off+uint64(len(b))))...)
+	nw := len(b)
+	if !w.dryrun {
+		n, err := w.bw.Write(b)
+		if err != nil {
+			return false, err
+		}
+
+		if n != nw {
+			return false, fmt.Errorf("%s: partial write; exp %d saw %d", w.fntmp, nw, n)
+		}
+		w.dsum.Write(b)
+
+		// with SyncWrites, every record is durable when it is added
+		if (w.oflags & os.O_SYNC) != 0 {
+			if err = w.bw.Flush(); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	// keep the buffer for the next record - unless a large record grew it
+	if cap(b) <= maxRecordBuf {
+		w.buf = b[:0]
 	}
 
-	w.keymap[r.hash] = r
+	if w.keymap != nil {
+		w.keymap[r.hash] = struct{}{}
+	}
 	w.keys = append(w.keys, r.hash)
+	w.offs = append(w.offs, r.off)
+	w.recordAdded()
 	w.off += uint64(nw)
+	w.keybytes += uint64(len(r.key))
+	w.valbytes += uint64(len(r.val))
 	return true, nil
 }
 
+// return the number of zero bytes that pad a record ending at 'off' to the
+// record alignment
+func (w *DBWriter) padding(off uint64) uint64 {
+	if w.align == 0 {
+		return 0
+	}
+	return -off & (w.align - 1)
+}
+
+// count a record added to the DB; the caller holds the lock.
+func (w *DBWriter) recordAdded() {
+	if w.metrics != nil {
+		w.metrics.Counter(MetricRecordsAdded, 1)
+	}
+}
+
+// return true if the DB is frozen
+func (w *DBWriter) isFrozen() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.frozen
+}
+
 // cleanup intermediate work and return an error instance
 func (w *DBWriter) error(f string, v ...interface{}) error {
 	w.fd.Close()
@@ -585,48 +2719,62 @@ func (w *DBWriter) error(f string, v ...interface{}) error {
 	return fmt.Errorf(f, v...)
 }
 
-// Calculate a semi-strong checksum on the important fields of the record
-// at offset 'off'. In our implementation, we use siphash-24 (64-bit) as
-// the strong checksum; and we use the offset as one of the items being
-// protected.
-func (r *record) checksum(key []byte, off uint64) uint64 {
-	var b [8]byte
-
-	be := binary.BigEndian
-
-	h := siphash.New(key)
-	h.Write(r.key)
-	h.Write(r.val)
-
-	be.PutUint64(b[:], off)
-	h.Write(b[:])
-
-	return h.Sum64()
+// return an error if key 'key' or a value of 'vlen' bytes exceed the size
+// limits
+func (w *DBWriter) checkSize(key []byte, vlen uint64) error {
+	if w.maxKeyLen > 0 && uint64(len(key)) > w.maxKeyLen {
+		return fmt.Errorf("%s: key <%.64s> is %d bytes: %w", w.fn, key, len(key), ErrKeyTooLong)
+	}
+	if w.maxValLen > 0 && vlen > w.maxValLen {
+		return fmt.Errorf("%s: value of key <%.64s> is %d bytes: %w", w.fn, key, vlen, ErrValueTooLong)
+	}
+	return nil
 }
 
-// Provide a disk encoding of record r
-func (r *record) encode(buf []byte) []byte {
-	var b [2 + 4 + 8]byte
-
-	klen := len(r.key)
-	vlen := len(r.val)
-
-	be := binary.BigEndian
-
-	be.PutUint16(b[:2], uint16(klen))
-	be.PutUint32(b[2:6], uint32(vlen))
-	be.PutUint64(b[6:], r.csum)
+// return an error if the DB can't take another record; the caller must
+// hold the lock.
+func (w *DBWriter) checkCount() error {
+	if w.maxRecords > 0 && uint64(len(w.keys)) >= w.maxRecords {
+		return fmt.Errorf("%s: more than %d records: %w", w.fn, w.maxRecords, ErrTooManyRecords)
+	}
+	return nil
+}
 
-	buf = append(buf, b[:]...)
-	buf = append(buf, r.key...)
-	buf = append(buf, r.val...)
-	return buf
+// return true if 'err' is a size limit error; the text and CSV parsers
+// skip such records unless they are strict.
+func isSizeLimit(err error) bool {
+	return errors.Is(err, ErrKeyTooLong) || errors.Is(err, ErrValueTooLong)
 }
 
 // ErrMPHFail is returned when the gamma value provided to Freeze() is too small to
 // build a minimal perfect hash table.
 var ErrMPHFail = errors.New("failed to build MPH; gamma possibly small")
 
+// ErrNotKeySet is returned when adding keys without values to a DB that
+// isn't a key set.
+var ErrNotKeySet = errors.New("DB is not a key set")
+
 // ErrFrozen is returned when attempting to add new records to an already frozen DB
 // It is also returned when trying to freeze a DB that's already frozen.
 var ErrFrozen = errors.New("DB already frozen")
+
+// ErrKeyTooLong is returned when a key is longer than
+// WriterOptions.MaxKeyLen.
+var ErrKeyTooLong = errors.New("key too long")
+
+// ErrValueTooLong is returned when a value is longer than
+// WriterOptions.MaxValueLen.
+var ErrValueTooLong = errors.New("value too long")
+
+// ErrTooManyRecords is returned when adding a record would exceed
+// WriterOptions.MaxRecords.
+var ErrTooManyRecords = errors.New("too many records")
+
+// ErrMalformedInput is returned in strict mode when a line of text or a CSV
+// row can't be parsed; see WriterOptions.Strict.
+var ErrMalformedInput = errors.New("malformed input")
+
+// ErrDryRun is returned by Freeze() when the writer only validates its
+// input; see WriterOptions.DryRun.
+var ErrDryRun = errors.New("DB writer is a dry run")
+
@@ -0,0 +1,112 @@
+// delta.go -- layering a delta DB on top of a base DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// DeltaReader answers queries from a delta DB layered on top of its base DB.
+// A delta DB is built with WriterOptions.Base and holds only the records that
+// were added or changed relative to the base. Lookups consult the delta first
+// and fall back to the base.
+type DeltaReader struct {
+	base  *DBReader
+	delta *DBReader
+}
+
+// NewDeltaReader layers the delta DB 'delta' on top of 'base'. It is an error
+// if 'delta' wasn't built on top of 'base'. The DeltaReader owns both readers;
+// DeltaReader.Close() closes them.
+func NewDeltaReader(base, delta *DBReader) (*DeltaReader, error) {
+	if !bytes.Equal(delta.base, base.csum[:]) {
+		return nil, fmt.Errorf("%s: %w (base %s)", delta.fn, ErrNotDelta, base.fn)
+	}
+	if err := sameNormalizer(base, delta); err != nil {
+		return nil, err
+	}
+
+	d := &DeltaReader{
+		base:  base,
+		delta: delta,
+	}
+	return d, nil
+}
+
+// find the record for the normalized 'key' in the delta and then in the
+// base
+func (d *DeltaReader) find(key []byte, wantVal bool) (*record, error) {
+	r, err := d.delta.findLayer(0, key, wantVal)
+	if err == nil && bytes.Equal(r.key, key) {
+		return r, nil
+	}
+
+	// the delta deleted the key from the base
+	if err == errDeleted {
+		return nil, ErrNoKey
+	}
+
+	return d.base.find(0, key, wantVal)
+}
+
+// Find looks up 'key' in the delta and then in the base; it returns the
+// corresponding value. Keys deleted by the delta (see
+// DBWriter.DeleteKeys()) are not found.
+func (d *DeltaReader) Find(key []byte) ([]byte, error) {
+	r, err := d.find(d.delta.normKey(key), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.val, nil
+}
+
+// FindWithFlags is like Find except it also returns the application flags
+// of the record; see DBReader.FindWithFlags().
+func (d *DeltaReader) FindWithFlags(key []byte) ([]byte, byte, error) {
+	r, err := d.find(d.delta.normKey(key), true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r.val, r.appflags, nil
+}
+
+// Lookup looks up 'key' in the delta and then in the base. If the key is
+// not found, value is nil and returns false.
+func (d *DeltaReader) Lookup(key []byte) ([]byte, bool) {
+	v, err := d.Find(key)
+	if err != nil {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// Contains returns true if 'key' is in the delta or in the base - and
+// isn't deleted by the delta.
+func (d *DeltaReader) Contains(key []byte) bool {
+	key = d.delta.normKey(key)
+	r, err := d.find(key, false)
+	return err == nil && bytes.Equal(r.key, key)
+}
+
+// Close closes the delta and base DBs and returns the first error
+func (d *DeltaReader) Close() error {
+	err := d.delta.Close()
+	if e := d.base.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// ErrNotDelta is returned when a delta DB is layered on the wrong base DB.
+var ErrNotDelta = errors.New("delta DB doesn't match its base")
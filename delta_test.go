@@ -0,0 +1,154 @@
+// delta_test.go -- test suite for delta DBs
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	assert := newAsserter(t)
+
+	basefn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	deltafn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(basefn)
+	defer os.Remove(deltafn)
+
+	keys := make([][]byte, len(keyw))
+	for i, s := range keyw {
+		keys[i] = []byte(s)
+	}
+
+	wr, err := NewDBWriter(basefn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	base, err := NewDBReader(basefn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	// the delta has the same records; but one changed value and one new key
+	wr, err = NewDBWriterWithOptions(deltafn, WriterOptions{Base: base})
+	assert(err == nil, "can't create delta db: %s", err)
+
+	vals := make([][]byte, len(keys))
+	copy(vals, keys)
+	vals[0] = []byte("changed")
+
+	n, err := wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-val: %s", err)
+	assert(n == 1, "delta has unchanged records; exp 1, saw %d", n)
+
+	n, err = wr.AddKeyVals([][]byte{[]byte("newkey")}, [][]byte{[]byte("newval")})
+	assert(err == nil, "can't add key-val: %s", err)
+	assert(n == 1, "new key not added")
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	delta, err := NewDBReader(deltafn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	_, err = NewDeltaReader(delta, base)
+	assert(err != nil, "layered base on delta")
+
+	d, err := NewDeltaReader(base, delta)
+	assert(err == nil, "can't layer delta: %s", err)
+	defer d.Close()
+
+	for i, k := range keys {
+		v, err := d.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(v) == string(vals[i]), "key %s: exp %s, saw %s", k, vals[i], v)
+	}
+
+	v, ok := d.Lookup([]byte("newkey"))
+	assert(ok && string(v) == "newval", "new key: exp newval, saw %s", v)
+	assert(!d.Contains([]byte("nokey")), "found non-existent key")
+}
+
+func TestDeltaDelete(t *testing.T) {
+	assert := newAsserter(t)
+
+	basefn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	deltafn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(basefn)
+	defer os.Remove(deltafn)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(basefn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.DeleteKeys(keys[:1])
+	assert(err != nil, "deleted keys from a DB without a base")
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	base, err := NewDBReader(basefn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	// delete the first 10 keys and a key that isn't in the base
+	wr, err = NewDBWriterWithOptions(deltafn, WriterOptions{Base: base})
+	assert(err == nil, "can't create delta db: %s", err)
+	n, err := wr.DeleteKeys(append(keys[:10:10], []byte("nokey")))
+	assert(err == nil, "can't delete keys: %s", err)
+	assert(n == 10, "deleted keys: exp 10, saw %d", n)
+	_, err = wr.AddKeyVals([][]byte{[]byte("newkey")}, [][]byte{[]byte("newval")})
+	assert(err == nil, "can't add key-val: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	delta, err := NewDBReader(deltafn, 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(delta.Info().Features[len(delta.Info().Features)-1] == "tombstones", "features %v", delta.Info().Features)
+
+	// the delta alone doesn't have the deleted keys either
+	_, err = delta.Find(keys[0])
+	assert(err == ErrNoKey, "found deleted key in delta: %v", err)
+	err = delta.VerifyAll()
+	assert(err == nil, "verify failed: %s", err)
+
+	d, err := NewDeltaReader(base, delta)
+	assert(err == nil, "can't layer delta: %s", err)
+
+	for i, k := range keys {
+		v, err := d.Find(k)
+		if i < 10 {
+			assert(err == ErrNoKey, "found deleted key %s: %v", k, err)
+			assert(!d.Contains(k), "contains deleted key %s", k)
+			continue
+		}
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(v) == string(k), "key %s: exp %s, saw %s", k, k, v)
+	}
+	assert(d.Contains([]byte("newkey")), "new key not found")
+
+	// a multi reader hides the deleted keys too
+	m, err := NewMultiReader(delta, base)
+	assert(err == nil, "can't layer dbs: %s", err)
+	defer m.Close()
+
+	for i, k := range keys {
+		_, err := m.Find(k)
+		assert((err == ErrNoKey) == (i < 10), "key %s: %v", k, err)
+	}
+
+	var nk int
+	err = m.Keys(func(k []byte) bool {
+		nk++
+		return true
+	})
+	assert(err == nil, "iter failed: %s", err)
+	assert(nk == len(keys)-10+1, "iter: exp %d keys, saw %d", len(keys)-10+1, nk)
+}
@@ -0,0 +1,134 @@
+// direct.go -- reading records with direct I/O
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// Direct I/O bypasses the page cache: reads must be at file offsets and
+// of sizes that are multiples of the block size of the device, into
+// memory aligned to it. We use 4096 byte blocks; they are aligned for
+// devices with 512 and 4096 byte blocks.
+const directBlock = 4096
+
+// reads of upto this size use pooled buffers
+const directPoolSize = 16 * directBlock
+
+var directPool = sync.Pool{
+	New: func() interface{} {
+		b := alignedBuf(directPoolSize)
+		return &b
+	},
+}
+
+// directReader reads from a file opened for direct I/O; reads at any
+// offset and of any size are widened to whole blocks.
+type directReader struct {
+	fd *os.File
+}
+
+func (d *directReader) ReadAt(p []byte, off int64) (int, error) {
+	start := off &^ (directBlock - 1)
+	end := (off + int64(len(p)) + directBlock - 1) &^ (directBlock - 1)
+	sz := int(end - start)
+
+	var b []byte
+	if sz <= directPoolSize {
+		bp := directPool.Get().(*[]byte)
+		defer directPool.Put(bp)
+		b = (*bp)[:sz]
+	} else {
+		b = alignedBuf(sz)
+	}
+
+	// the read is short at the end of the file
+	n, err := d.fd.ReadAt(b, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return copyBlock(p, b[:n], int(off-start))
+}
+
+// directCursor reads a single record from a directReader: the blocks read
+// for the record header are reused for the rest of the record. It isn't
+// safe for concurrent use.
+type directCursor struct {
+	ra  io.ReaderAt
+	off int64
+	b   []byte
+}
+
+func (c *directCursor) ReadAt(p []byte, off int64) (int, error) {
+	if c.b != nil && off >= c.off && off+int64(len(p)) <= c.off+int64(len(c.b)) {
+		return copy(p, c.b[off-c.off:]), nil
+	}
+
+	start := off &^ (directBlock - 1)
+	end := (off + int64(len(p)) + directBlock - 1) &^ (directBlock - 1)
+	b := make([]byte, end-start)
+
+	n, err := c.ra.ReadAt(b, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	c.off, c.b = start, b[:n]
+	return copyBlock(p, c.b, int(off-start))
+}
+
+// copy the bytes from 'skip' onwards of the blocks in 'b' to 'p'; it is
+// io.EOF if 'b' ends before 'p' is filled.
+func copyBlock(p, b []byte, skip int) (int, error) {
+	if skip >= len(b) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b[skip:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// return a buffer of 'n' bytes aligned to directBlock
+func alignedBuf(n int) []byte {
+	b := make([]byte, n+directBlock)
+	a := int(uintptr(unsafe.Pointer(&b[0])) & (directBlock - 1))
+	if a > 0 {
+		a = directBlock - a
+	}
+	return b[a : a+n : a+n]
+}
+
+// read the records of the DB with direct I/O; the file is opened again
+// for it.
+func (rd *DBReader) openDirect() error {
+	fd, err := openDirect(rd.fn)
+	if err != nil {
+		return err
+	}
+
+	rd.dfd = fd
+	rd.ra = rd.recordReader(&directReader{fd})
+	return nil
+}
+
+// return the reader of a single record from 'ra'; with direct I/O, the
+// blocks read for the record header are reused for the rest of the record.
+// The records of a compressed DB are read from decompressed blocks.
+func (rd *DBReader) recordCursor(ra io.ReaderAt) io.ReaderAt {
+	if rd.dfd != nil && rd.blocks == nil && ra == rd.ra {
+		return &directCursor{ra: ra}
+	}
+	return ra
+}
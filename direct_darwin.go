@@ -0,0 +1,33 @@
+// direct_darwin.go -- direct I/O with F_NOCACHE
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin
+// +build darwin
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// open 'fn' for reading with the data caching of the file turned off
+func openDirect(fn string) (*os.File, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), syscall.F_NOCACHE, 1)
+	if e != 0 {
+		fd.Close()
+		return nil, fmt.Errorf("%s: can't disable caching: %w", fn, e)
+	}
+	return fd, nil
+}
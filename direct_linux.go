@@ -0,0 +1,23 @@
+// direct_linux.go -- direct I/O with O_DIRECT
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package bbhash
+
+import (
+	"os"
+	"syscall"
+)
+
+// open 'fn' for reading with direct I/O; it fails on file systems that
+// don't support O_DIRECT (e.g., tmpfs).
+func openDirect(fn string) (*os.File, error) {
+	return os.OpenFile(fn, os.O_RDONLY|syscall.O_DIRECT, 0)
+}
@@ -0,0 +1,22 @@
+// direct_other.go -- platforms without direct I/O
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package bbhash
+
+import (
+	"errors"
+	"os"
+)
+
+// direct I/O isn't supported on this platform
+func openDirect(fn string) (*os.File, error) {
+	return nil, errors.New("direct I/O is not supported")
+}
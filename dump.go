@@ -0,0 +1,176 @@
+// dump.go -- write the records of a constant DB as text
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Format is a textual format of the records written by DBReader.DumpTo()
+type Format int
+
+const (
+	// CSV with a header row naming the columns "key" and "value"; fields
+	// are quoted as needed (RFC 4180). It can be read back with
+	// DBWriter.AddCSVStreamWithOptions() and CSVOptions.Header.
+	FormatCSV Format = iota
+
+	// A key and value per line separated by a tab; tabs, newlines,
+	// carriage returns and backslashes in the key or value are escaped
+	// as \t, \n, \r and \\.
+	FormatTSV
+
+	// A JSON object per line: {"key": .., "value": ..}. Keys and values
+	// that aren't valid UTF-8 are base64 encoded in "key64" and "value64"
+	// instead. Records in a non-default namespace also have "ns".
+	FormatJSONL
+)
+
+// String returns the name of the format
+func (f Format) String() string {
+	switch f {
+	case FormatCSV:
+		return "csv"
+	case FormatTSV:
+		return "tsv"
+	case FormatJSONL:
+		return "jsonl"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// DumpTo writes every record of the DB to 'w' in the format 'f' - in the
+// order of Iter(). The records of a key set have just the key.
+func (rd *DBReader) DumpTo(w io.Writer, f Format) error {
+	keysOnly := (rd.flags & flagKeysOnly) > 0
+
+	var put func(it *Iterator) error
+
+	bw := bufio.NewWriter(w)
+	flush := bw.Flush
+	switch f {
+	case FormatCSV:
+		cw := csv.NewWriter(bw)
+		row := []string{"key", "value"}
+		if keysOnly {
+			row = row[:1]
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+
+		put = func(it *Iterator) error {
+			row[0] = string(it.Key())
+			if !keysOnly {
+				row[1] = string(it.Value())
+			}
+			return cw.Write(row)
+		}
+
+		// the CSV writer must be flushed before bw
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+
+	case FormatTSV:
+		put = func(it *Iterator) error {
+			bw.WriteString(tsvEscape(it.Key()))
+			if !keysOnly {
+				bw.WriteByte('\t')
+				bw.WriteString(tsvEscape(it.Value()))
+			}
+			return bw.WriteByte('\n')
+		}
+
+	case FormatJSONL:
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		put = func(it *Iterator) error {
+			m := make(map[string]interface{}, 3)
+			jsonField(m, "key", it.Key())
+			if !keysOnly {
+				jsonField(m, "value", it.Value())
+			}
+			if ns := it.Namespace(); ns != 0 {
+				m["ns"] = ns
+			}
+			return enc.Encode(m)
+		}
+
+	default:
+		return fmt.Errorf("%s: unknown dump format %d", rd.fn, f)
+	}
+
+	it := rd.Iter()
+	for it.Next() {
+		if err := put(it); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// set the JSON field 'nm' to 'b' - or 'nm64' to its base64 encoding if it
+// isn't valid UTF-8.
+func jsonField(m map[string]interface{}, nm string, b []byte) {
+	if utf8.Valid(b) {
+		m[nm] = string(b)
+	} else {
+		m[nm+"64"] = base64.StdEncoding.EncodeToString(b)
+	}
+}
+
+// escape tabs, newlines, carriage returns and backslashes in 'b'
+func tsvEscape(b []byte) string {
+	var s []byte
+	for i, c := range b {
+		var e byte
+		switch c {
+		case '\t':
+			e = 't'
+		case '\n':
+			e = 'n'
+		case '\r':
+			e = 'r'
+		case '\\':
+			e = '\\'
+		default:
+			if s != nil {
+				s = append(s, c)
+			}
+			continue
+		}
+
+		if s == nil {
+			s = make([]byte, i, len(b)+8)
+			copy(s, b[:i])
+		}
+		s = append(s, '\\', e)
+	}
+
+	if s == nil {
+		return string(b)
+	}
+	return string(s)
+}
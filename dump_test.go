@@ -0,0 +1,102 @@
+// dump_test.go -- test suite for dumping a DB as text
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDumpTo(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	kv := map[string]string{
+		"plain":     "value",
+		"comma,key": "quoted \"value\"",
+		"tab\tkey":  "multi\nline\\value",
+		"binary":    "\xff\xfe\x00",
+		"unicode-é": "☃",
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	for k, v := range kv {
+		_, err = wr.AddKeyVals([][]byte{[]byte(k)}, [][]byte{[]byte(v)})
+		assert(err == nil, "can't add key-val: %s", err)
+	}
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// CSV round trips through the CSV importer
+	var b bytes.Buffer
+	err = rd.DumpTo(&b, FormatCSV)
+	assert(err == nil, "csv dump failed: %s", err)
+	assert(strings.HasPrefix(b.String(), "key,value\n"), "no csv header")
+
+	fn2 := fn + ".csv.db"
+	defer os.Remove(fn2)
+	wr, err = NewDBWriter(fn2)
+	assert(err == nil, "can't create db: %s", err)
+	n, err := wr.AddCSVStreamWithOptions(&b, CSVOptions{Header: true})
+	assert(err == nil, "can't add csv: %s", err)
+	assert(n == uint64(len(kv)), "exp %d csv records, saw %d", len(kv), n)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd2, err := NewDBReader(fn2, 10)
+	assert(err == nil, "read failed: %s", err)
+	for k, v := range kv {
+		x, err := rd2.Find([]byte(k))
+		assert(err == nil && string(x) == v, "csv key %q: exp %q, saw %q: %s", k, v, x, err)
+	}
+	rd2.Close()
+
+	// TSV escapes the delimiters
+	b.Reset()
+	err = rd.DumpTo(&b, FormatTSV)
+	assert(err == nil, "tsv dump failed: %s", err)
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	assert(len(lines) == len(kv), "exp %d tsv lines, saw %d", len(kv), len(lines))
+	for _, s := range lines {
+		assert(strings.Count(s, "\t") == 1, "bad tsv line %q", s)
+	}
+	assert(strings.Contains(b.String(), "tab\\tkey\tmulti\\nline\\\\value\n"), "tsv not escaped")
+
+	// JSONL
+	b.Reset()
+	err = rd.DumpTo(&b, FormatJSONL)
+	assert(err == nil, "jsonl dump failed: %s", err)
+
+	dec := json.NewDecoder(&b)
+	for i := 0; i < len(kv); i++ {
+		var m map[string]string
+		err = dec.Decode(&m)
+		assert(err == nil, "can't decode jsonl: %s", err)
+
+		k, v := m["key"], m["value"]
+		if x, ok := m["value64"]; ok {
+			y, err := base64.StdEncoding.DecodeString(x)
+			assert(err == nil, "bad base64: %s", err)
+			v = string(y)
+		}
+		assert(kv[k] == v, "jsonl key %q: exp %q, saw %q", k, kv[k], v)
+	}
+
+	err = rd.DumpTo(&b, Format(42))
+	assert(err != nil, "dumped an unknown format")
+}
@@ -1,6 +1,7 @@
 // endian_be_test.go -- test suite for endian-convertors:
 // Run this on Big-endian machines!
 
+//go:build ppc64 || mips || mips64
 // +build ppc64 mips mips64
 
 package bbhash
@@ -10,6 +10,7 @@
 // warranty; it is provided "as is". No claim  is made to its
 // suitability for any purpose.
 
+//go:build 386 || amd64 || arm || arm64 || ppc64le || mipsle || mips64le
 // +build 386 amd64 arm arm64 ppc64le mipsle mips64le
 
 package bbhash
@@ -1,6 +1,7 @@
 // endian_le_test.go -- test suite for endian-convertors:
 // Run this on Little-endian machines!
 
+//go:build 386 || amd64 || arm || arm64 || ppc64le || mipsle || mips64le
 // +build 386 amd64 arm arm64 ppc64le mipsle mips64le
 
 package bbhash
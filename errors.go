@@ -0,0 +1,112 @@
+// errors.go -- errors that describe a corrupt DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the readers and writers wrap one of the exported
+// errors of this package - or the underlying I/O error - with the name of
+// the DB and other context; use errors.Is() and errors.As() to tell them
+// apart. A DB that fails an integrity check yields an error that matches
+// ErrCorrupt; a more specific error (e.g., ErrBadChecksum) is matched too
+// where one applies. Absent keys are ErrNoKey, lookups on a closed DB
+// are ErrClosed and DBs that are being written are ErrLocked.
+
+// ErrCorrupt is matched by every error that describes a corrupt DB
+var ErrCorrupt = errors.New("corrupt DB")
+
+// ErrTooSmall is returned when a file is too small to be a DB
+var ErrTooSmall error = &corruptError{"file too small"}
+
+// ErrCorruptHeader is returned when the file header of a DB is invalid
+var ErrCorruptHeader error = &corruptError{"corrupt header"}
+
+// ErrBadChecksum is returned when the checksum of the DB metadata or of a
+// record doesn't match its contents; see ChecksumError.
+var ErrBadChecksum error = &corruptError{"checksum mismatch"}
+
+// ErrCorruptRecord is returned when a record can't be decoded
+var ErrCorruptRecord error = &corruptError{"corrupt record"}
+
+// ErrBadSignature is returned when a DB isn't signed by the expected key;
+// see ReaderOptions.PublicKey.
+var ErrBadSignature = errors.New("bad signature")
+
+// ErrLocked is returned when a DB is opened while it is being written or
+// when another writer is building the same DB. The locks are advisory
+// (flock(2)) and only taken on platforms that support them.
+var ErrLocked = errors.New("DB is locked by another writer")
+
+// a specific kind of corruption; it matches ErrCorrupt
+type corruptError struct {
+	s string
+}
+
+func (e *corruptError) Error() string {
+	return e.s
+}
+
+func (e *corruptError) Is(err error) bool {
+	return err == ErrCorrupt
+}
+
+// ChecksumError describes a record whose checksum doesn't match its
+// contents; it matches ErrBadChecksum and ErrCorrupt.
+type ChecksumError struct {
+	// File offset of the record
+	Offset uint64
+
+	// Expected and computed checksums
+	Exp, Saw uint64
+
+	// Value is true if the separately checksummed value of a record
+	// failed (see WriterOptions.SplitValues)
+	Value bool
+}
+
+// Error returns a description of the checksum mismatch
+func (e *ChecksumError) Error() string {
+	what := "record"
+	if e.Value {
+		what = "value of record"
+	}
+	return fmt.Sprintf("%s of %s at off %d (exp %#x, saw %#x)", ErrBadChecksum, what, e.Offset, e.Exp, e.Saw)
+}
+
+// Unwrap returns ErrBadChecksum
+func (e *ChecksumError) Unwrap() error {
+	return ErrBadChecksum
+}
+
+// SegmentError describes segments of the records of a DB whose checksums
+// don't match their contents (see WriterOptions.SegmentSize); it matches
+// ErrBadChecksum and ErrCorrupt.
+type SegmentError struct {
+	// Size of the segments
+	Size uint64
+
+	// File offsets of the corrupt segments
+	Offsets []uint64
+}
+
+// Error returns a description of the corrupt segments
+func (e *SegmentError) Error() string {
+	if len(e.Offsets) == 1 {
+		return fmt.Sprintf("%s of segment of %d bytes at off %d", ErrBadChecksum, e.Size, e.Offsets[0])
+	}
+	return fmt.Sprintf("%s of %d segments of %d bytes at offsets %v", ErrBadChecksum, len(e.Offsets), e.Size, e.Offsets)
+}
+
+// Unwrap returns ErrBadChecksum
+func (e *SegmentError) Unwrap() error {
+	return ErrBadChecksum
+}
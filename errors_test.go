@@ -0,0 +1,94 @@
+// errors_test.go -- test suite for the errors of a corrupt DB
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	_, err := NewDBReader(fn, 10)
+	assert(errors.Is(err, os.ErrNotExist), "missing db: %v", err)
+	assert(!errors.Is(err, ErrCorrupt), "missing db is corrupt: %v", err)
+
+	err = ioutil.WriteFile(fn, []byte("BBHH"), 0600)
+	assert(err == nil, "can't write db: %s", err)
+	_, err = NewDBReader(fn, 10)
+	assert(errors.Is(err, ErrTooSmall), "short db: %v", err)
+	assert(errors.Is(err, ErrCorrupt), "short db isn't corrupt: %v", err)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	good, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	rd.Close()
+
+	_, err = rd.Find(keys[0])
+	assert(errors.Is(err, ErrClosed), "closed db: %v", err)
+
+	corrupt := func(i int) {
+		b := append([]byte(nil), good...)
+		b[i] ^= 0xff
+		err := ioutil.WriteFile(fn, b, 0600)
+		assert(err == nil, "can't write db: %s", err)
+	}
+
+	// bad magic
+	corrupt(0)
+	_, err = NewDBReader(fn, 10)
+	assert(errors.Is(err, ErrCorruptHeader), "bad magic: %v", err)
+	assert(errors.Is(err, ErrCorrupt), "bad magic isn't corrupt: %v", err)
+
+	// bad global checksum
+	corrupt(len(good) - 1)
+	_, err = NewDBReader(fn, 10)
+	assert(errors.Is(err, ErrBadChecksum), "bad checksum: %v", err)
+	assert(errors.Is(err, ErrCorrupt), "bad checksum isn't corrupt: %v", err)
+
+	var ce *ChecksumError
+	assert(!errors.As(err, &ce), "global checksum has a record offset: %v", err)
+
+	// bad record checksum
+	i := bytes.Index(good, []byte("key-99key-99"))
+	assert(i > 0, "can't find value")
+	corrupt(i + 11)
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find([]byte("key-99"))
+	assert(errors.Is(err, ErrBadChecksum), "bad record: %v", err)
+	assert(errors.Is(err, ErrCorrupt), "bad record isn't corrupt: %v", err)
+	assert(!errors.Is(err, ErrNoKey), "bad record is absent: %v", err)
+	assert(errors.As(err, &ce), "bad record: not a checksum error: %v", err)
+	assert(ce.Offset >= 64 && ce.Offset < uint64(i), "bad record: offset %d", ce.Offset)
+	assert(ce.Exp != ce.Saw, "bad record: checksums match")
+
+	_, err = rd.Find([]byte("key-100"))
+	assert(err == ErrNoKey, "absent key: %v", err)
+}
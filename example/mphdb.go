@@ -10,17 +10,29 @@
 // One can construct the on-disk MPH DB using a variety of input:
 //   - white space delimited text file: first field is key, second field is value
 //   - Comma Separated text file (CSV): first field is key, second field is value
+//   - JSON lines: an object per line with "key" and "value" (see
+//     DBReader.DumpTo())
+//
+// The delimiters of text files, the key and value columns of CSV files and
+// the format of the input are selected by command line flags; otherwise the
+// format is inferred from the file extension.
+//
+// "mphdb serve DB" serves lookups from a constant DB over HTTP (see serve.go).
 //
 // Sometimes, bbhash gets into a pathological state while constructing MPH out of very
-// large data sets. This can be alleviated by using a larger "gamma". mphdb tries to
-// bump the gamma to "4.0" whenever we have more than 1M keys.
+// large data sets. This can be alleviated by using a larger "gamma". Unless a gamma
+// is given, mphdb lets DBWriter.FreezeAuto() pick one.
 
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"strings"
+	"time"
 
 	B "github.com/opencoff/go-bbhash"
 
@@ -35,12 +47,37 @@ type value struct {
 
 var Gamma float64	// bbhash 'gamma' factor
 var Verify bool		// if set, verify a previously constructed DB
+var DryRun bool		// if set, only validate the input
+var Delim string	// key/value delimiters of text input
+var CSVKey int		// field# of the key in CSV input
+var CSVVal int		// field# of the value in CSV input
+var JSONL bool		// if set, all input is JSON lines
+var KeysOnly bool	// if set, build a key set
+var Verbose bool	// if set, log the progress of the build
+var XXH3 bool		// if set, hash the keys with XXH3
+var Align int		// if non-zero, alignment of the records
+var Segments bool	// if set, checksum the records in segments
 
 func main() {
-	usage := fmt.Sprintf("%s [options] OUTPUT [INPUT ...]", os.Args[0])
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
 
-	flag.Float64VarP(&Gamma, "gamma", "g", 2.0, "Bitfield expansion factor `g`")
-	flag.BoolVarP(&Verify, "verify", "V", false, "Verify a constant DB")
+	usage := fmt.Sprintf("%s [options] OUTPUT [INPUT ...]\n       %s serve [options] DB", os.Args[0], os.Args[0])
+
+	flag.Float64VarP(&Gamma, "gamma", "g", 0, "Bitfield expansion factor `g` (default: automatic)")
+	flag.BoolVarP(&Verify, "verify", "V", false, "Verify every record of a constant DB")
+	flag.BoolVarP(&DryRun, "dry-run", "n", false, "Validate the input without writing the DB")
+	flag.StringVarP(&Delim, "delim", "d", " \t", "Separate the key and value of text input by any of the chars in `s`")
+	flag.IntVarP(&CSVKey, "csv-key", "", 0, "Use CSV field# `n` as the key")
+	flag.IntVarP(&CSVVal, "csv-val", "", 1, "Use CSV field# `n` as the value")
+	flag.BoolVarP(&JSONL, "jsonl", "j", false, "Treat all input as JSON lines")
+	flag.BoolVarP(&KeysOnly, "keys-only", "k", false, "Build a key set; values in the input are ignored")
+	flag.BoolVarP(&Verbose, "verbose", "v", false, "Show the progress of the build")
+	flag.BoolVarP(&XXH3, "xxh3", "", false, "Hash the keys with XXH3")
+	flag.IntVarP(&Align, "align", "", 0, "Align the records to multiples of `n` bytes (512 to 1MB)")
+	flag.BoolVarP(&Segments, "segments", "", false, "Checksum the records in segments of 16MB")
 	flag.Usage = func() {
 		fmt.Printf("mphdb - create constant DB from txt or CSV files using MPH\nUsage: %s\n", usage)
 		flag.PrintDefaults()
@@ -57,17 +94,30 @@ func main() {
 	args = args[1:]
 
 	if Verify {
-		db, err := B.NewDBReader(fn, 1000)
-		if err != nil {
-			die("Can't read %s: %s", fn, err)
-		}
-
-		fmt.Printf("%s: %d records\n", fn, db.TotalKeys())
-		db.Close()
+		verify(fn)
 		return
 	}
 
-	db, err := B.NewDBWriter(fn)
+	if len(Delim) == 0 {
+		die("delimiter can't be empty")
+	}
+
+	opt := B.WriterOptions{
+		DryRun:      DryRun,
+		KeysOnly:    KeysOnly,
+		RecordAlign: Align,
+	}
+	if XXH3 {
+		opt.KeyHash = B.KeyHashXXH3
+	}
+	if Segments {
+		opt.SegmentSize = B.DefaultSegmentSize
+	}
+	if Verbose {
+		opt.Logger = log.New(os.Stderr, "mphdb: ", log.Ltime|log.Lmicroseconds)
+	}
+
+	db, err := B.NewDBWriterWithOptions(fn, opt)
 	if err != nil {
 		die("can't create MPH DB: %s", err)
 	}
@@ -76,11 +126,14 @@ func main() {
 	if len(args) > 0 {
 		for _, f := range args {
 			switch {
+			case JSONL || strings.HasSuffix(f, ".jsonl"):
+				n, err = addJSONLFile(db, f)
+
 			case strings.HasSuffix(f, ".txt"):
-				n, err = db.AddTextFile(f, " \t")
+				n, err = db.AddTextFile(f, Delim)
 
 			case strings.HasSuffix(f, ".csv"):
-				n, err = db.AddCSVFile(f, ',', '#', 0, 1)
+				n, err = db.AddCSVFile(f, ',', '#', CSVKey, CSVVal)
 
 			default:
 				warn("Don't know how to add %s", f)
@@ -95,7 +148,11 @@ func main() {
 			fmt.Printf("+ %s: %d records\n", f, n)
 		}
 	} else {
-		n, err = db.AddTextStream(os.Stdin, " \t")
+		if JSONL {
+			n, err = db.AddTextStreamFunc(os.Stdin, parseJSONL)
+		} else {
+			n, err = db.AddTextStream(os.Stdin, Delim)
+		}
 		if err != nil {
 			db.Abort()
 			die("can't add STDIN: %s", err)
@@ -104,19 +161,114 @@ func main() {
 		fmt.Printf("+ <STDIN>: %d records\n", n)
 	}
 
-	g := Gamma
-	if db.TotalKeys() >= 1000000 {
-		if g < 3.5 {
-			warn("Bumping Gamma to 4.0 to guarantee creation of MPH ..\n")
-			g = 4.0
+	if DryRun {
+		for _, s := range db.Sources() {
+			fmt.Printf("%s\n", s.String())
 		}
+
+		st := db.Stats()
+		fmt.Printf("%s: %s", fn, st.String())
+		db.Abort()
+		return
 	}
 
-	err = db.Freeze(g)
+	if Gamma > 1.0 {
+		err = db.Freeze(Gamma)
+	} else {
+		err = db.FreezeAuto()
+	}
 	if err != nil {
 		db.Abort()
 		die("can't write db %s: %s", fn, err)
 	}
+
+	st := db.Stats()
+	fmt.Printf("%s: %s", fn, st.String())
+}
+
+// add the JSON lines in file 'fn' to 'db'
+func addJSONLFile(db *B.DBWriter, fn string) (uint64, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	return db.AddTextStreamFunc(fd, parseJSONL)
+}
+
+// a line of JSON lines input; keys and values that aren't valid UTF-8
+// are base64 encoded in "key64" and "value64" - as written by
+// DBReader.DumpTo().
+type jsonRecord struct {
+	Key     *string `json:"key"`
+	Key64   *string `json:"key64"`
+	Value   *string `json:"value"`
+	Value64 *string `json:"value64"`
+}
+
+// parse a line of JSON lines input; blank lines and lines without a key
+// are skipped.
+func parseJSONL(line string) ([]byte, []byte, bool) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil, false
+	}
+
+	var j jsonRecord
+	if err := json.Unmarshal([]byte(line), &j); err != nil {
+		return nil, nil, false
+	}
+
+	key, ok := jsonField(j.Key, j.Key64)
+	if !ok || len(key) == 0 {
+		return nil, nil, false
+	}
+
+	val, ok := jsonField(j.Value, j.Value64)
+	if !ok && !KeysOnly {
+		return nil, nil, false
+	}
+	return key, val, true
+}
+
+// return the value of a JSON field 's' or its base64 encoding 's64'
+func jsonField(s, s64 *string) ([]byte, bool) {
+	switch {
+	case s != nil:
+		return []byte(*s), true
+	case s64 != nil:
+		b, err := base64.StdEncoding.DecodeString(*s64)
+		return b, err == nil
+	}
+	return nil, false
+}
+
+// verify every part of the DB in 'fn': opening it verifies the strong
+// checksum of the header, offset table and MPH; VerifyAll() verifies the
+// checksum of every record and that every offset table entry maps back to
+// its slot of the MPH.
+func verify(fn string) {
+	start := time.Now()
+
+	db, err := B.NewDBReader(fn, 1)
+	if err != nil {
+		die("CORRUPT: %s", err)
+	}
+	defer db.Close()
+
+	info := db.Info()
+	fmt.Printf("%s: global checksum OK\n", fn)
+
+	err = db.VerifyAll()
+	if err != nil {
+		db.Close()
+		die("CORRUPT: %s", err)
+	}
+
+	fmt.Printf("%s: %d records OK\n", fn, info.Keys)
+	fmt.Printf("%s", info.String())
+	fmt.Printf("verified in %s\n", time.Since(start))
 }
 
 // die with error
@@ -0,0 +1,130 @@
+// serve.go -- serve lookups from a constant DB over HTTP
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	B "github.com/opencoff/go-bbhash"
+
+	flag "github.com/opencoff/pflag"
+)
+
+// max size of the body of a batch request
+const maxBatchBody = 16 * 1024 * 1024
+
+// serve the DB named in 'args' as a read-only key-value service:
+//   - GET /KEY returns the value of KEY or 404 if it isn't in the DB
+//   - POST /_batch with a JSON array of keys returns a JSON object that
+//     maps the keys found in the DB to their values.
+func serve(args []string) {
+	var listen string
+	var cache int
+
+	usage := fmt.Sprintf("%s serve [options] DB", os.Args[0])
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVarP(&listen, "listen", "l", ":8080", "Listen for HTTP requests on `addr`")
+	fs.IntVarP(&cache, "cache", "c", 10000, "Cache upto `n` records in memory")
+	fs.Usage = func() {
+		fmt.Printf("mphdb serve - serve lookups from a constant DB over HTTP\nUsage: %s\n", usage)
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 1 {
+		die("No DB file name!\nUsage: %s\n", usage)
+	}
+
+	fn := args[0]
+	db, err := B.NewDBReader(fn, cache)
+	if err != nil {
+		die("can't read %s: %s", fn, err)
+	}
+	defer db.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_batch", func(w http.ResponseWriter, r *http.Request) {
+		batchHandler(db, w, r)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		findHandler(db, w, r)
+	})
+
+	fmt.Printf("%s: serving %d records on %s\n", fn, db.TotalKeys(), listen)
+	if err = http.ListenAndServe(listen, mux); err != nil {
+		db.Close()
+		die("can't serve %s: %s", fn, err)
+	}
+}
+
+// GET /KEY
+func findHandler(db *B.DBReader, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if len(key) == 0 {
+		http.Error(w, "no key", http.StatusBadRequest)
+		return
+	}
+
+	val, err := db.FindString(key)
+	switch {
+	case err == B.ErrNoKey:
+		http.Error(w, "no such key", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(val)
+	}
+}
+
+// POST /_batch
+func batchHandler(db *B.DBReader, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBatchBody)).Decode(&keys); err != nil {
+		http.Error(w, fmt.Sprintf("malformed batch: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	bkeys := make([][]byte, len(keys))
+	for i, k := range keys {
+		bkeys[i] = []byte(k)
+	}
+
+	vals, errs := db.FindMany(bkeys)
+	res := make(map[string]string, len(keys))
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			res[keys[i]] = string(vals[i])
+		case err != B.ErrNoKey:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
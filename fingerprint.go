@@ -0,0 +1,60 @@
+// fingerprint.go -- key fingerprints in the offset table
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+)
+
+// In a DB built with WriterOptions.Fingerprints, the top 16 bits of each
+// entry of the offset table hold a fingerprint of the hash of the key of
+// its record; the record offset is in the low 48 bits. A reader compares
+// the fingerprint of a key with the one in its MPH slot before reading the
+// record: all but 1 in 65536 keys that aren't in the DB are rejected
+// without touching the record region.
+const (
+	fpShift = 48
+
+	// record offsets in a DB with fingerprints are below 2^48
+	fpOffMask uint64 = 1<<fpShift - 1
+)
+
+// return the fingerprint of the key hash 'h'
+func fingerprint(h uint64) uint64 {
+	return h >> fpShift
+}
+
+// add the fingerprints of the keys to the offset table
+func (w *DBWriter) addFingerprints(bb *BBHash, offset []uint64) error {
+	if w.off > fpOffMask {
+		return fmt.Errorf("%s: DB too large for fingerprints", w.fn)
+	}
+
+	for _, k := range w.keys {
+		i := bb.Find(k)
+		offset[i-1] |= fingerprint(k) << fpShift
+	}
+	return nil
+}
+
+// return the record offset in entry 'i' of the offset table
+func (rd *DBReader) offset(i uint64) uint64 {
+	return rd.entry(i) & rd.offmask
+}
+
+// return the record offset in MPH slot 'i' (1 based) for the key hash 'h';
+// false if the fingerprint in the slot rules the key out.
+func (rd *DBReader) slotOffset(i, h uint64) (uint64, bool) {
+	e := rd.entry(i - 1)
+	if (rd.flags&flagFingerprint) > 0 && e>>fpShift != fingerprint(h) {
+		rd.ctr.add(&rd.ctr.fprej, MetricFingerprintRejects, 1)
+		return 0, false
+	}
+	return e & rd.offmask, true
+}
@@ -0,0 +1,80 @@
+// fingerprint_test.go -- test suite for key fingerprints in the offset table
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestFingerprints(t *testing.T) {
+	assert := newAsserter(t)
+
+	opts := []WriterOptions{
+		{Fingerprints: true},
+		{Fingerprints: true, Locality: true},
+		{Fingerprints: true, Compress: true},
+		{Fingerprints: true, Key: []byte("0123456789abcdef"), EncryptOffsets: true},
+	}
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	for n, opt := range opts {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "%d: can't create db: %s", n, err)
+
+		_, err = wr.AddKeyVals(keys, keys)
+		assert(err == nil, "%d: can't add key-vals: %s", n, err)
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "%d: freeze failed: %s", n, err)
+
+		rd, err := NewEncryptedDBReader(fn, 10, opt.Key)
+		assert(err == nil, "%d: read failed: %s", n, err)
+
+		info := rd.Info()
+		j := len(info.Features) - 1
+		if !haveExtHash {
+			j--
+		}
+		assert(info.Features[j] == "fingerprints", "%d: features %v", n, info.Features)
+
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%d: can't find key %s: %s", n, k, err)
+			assert(bytes.Equal(v, k), "%d: key %s: value mismatch", n, k)
+		}
+
+		rd.ResetStats()
+		for i := 0; i < 10000; i++ {
+			_, err = rd.Find([]byte(fmt.Sprintf("missing-%d", i)))
+			assert(err == ErrNoKey, "%d: missing key: exp ErrNoKey, saw %v", n, err)
+		}
+
+		st := rd.Stats()
+		assert(st.Reads < 10, "%d: too many reads for missing keys: %d", n, st.Reads)
+		assert(st.FingerprintRejects > 0, "%d: no fingerprint rejects", n)
+
+		_, errs := rd.FindMany([][]byte{[]byte("missing"), keys[1]})
+		assert(errs[0] == ErrNoKey && errs[1] == nil, "%d: find many: %v", n, errs)
+
+		err = rd.VerifyAll()
+		assert(err == nil, "%d: verify failed: %s", n, err)
+
+		var m int
+		err = rd.Range(func(k, v []byte) bool {
+			m++
+			return true
+		})
+		assert(err == nil && m == len(keys), "%d: iterated over %d records: %v", n, m, err)
+		rd.Close()
+	}
+}
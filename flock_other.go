@@ -0,0 +1,21 @@
+// flock_other.go -- platforms without advisory file locks
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package bbhash
+
+import (
+	"os"
+)
+
+// files are never locked on this platform
+func flock(fd *os.File, excl bool) error {
+	return nil
+}
@@ -0,0 +1,107 @@
+// flock_test.go -- test suite for the advisory locks of writers and readers
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package bbhash
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestLocking(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = os.Stat(fn + ".lock")
+	assert(err == nil, "no lock file: %s", err)
+
+	// a concurrent build of the same DB
+	_, err = NewDBWriter(fn)
+	assert(errors.Is(err, ErrLocked), "second writer: %v", err)
+
+	// a dry run doesn't write anything
+	dry, err := NewDBWriterWithOptions(fn, WriterOptions{DryRun: true})
+	assert(err == nil, "dry run: %s", err)
+	dry.Abort()
+
+	// the temp file is being written
+	_, err = NewDBReader(wr.fntmp, 10)
+	assert(errors.Is(err, ErrLocked), "reader of temp file: %v", err)
+	_, err = NewDBReaderInMemory(wr.fntmp, 10, false)
+	assert(errors.Is(err, ErrLocked), "in-memory reader of temp file: %v", err)
+
+	wr.Abort()
+	_, err = os.Stat(fn + ".lock")
+	assert(os.IsNotExist(err), "lock file not removed: %v", err)
+
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't create db after abort: %s", err)
+
+	keys := [][]byte{[]byte("alice"), []byte("bob")}
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = os.Stat(fn + ".lock")
+	assert(os.IsNotExist(err), "lock file not removed: %v", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// readers don't keep a new version from being built
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't rebuild db: %s", err)
+	wr.Close()
+
+	rd2, err := NewDBReader(fn, 10)
+	assert(err == nil, "second reader failed: %s", err)
+	rd2.Close()
+}
+
+func TestFreezeFailUnlocks(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.RemoveAll(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := [][]byte{[]byte("alice"), []byte("bob")}
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	// a non-empty directory in place of the DB makes the rename fail
+	err = os.MkdirAll(fn+"/x", 0700)
+	assert(err == nil, "mkdir: %s", err)
+
+	tmp := wr.fntmp
+	err = wr.Freeze(2.0)
+	assert(err != nil, "freeze over a directory succeeded")
+	assert(!wr.isFrozen(), "failed freeze marked frozen")
+	assert(wr.Close() == nil, "close after failed freeze")
+
+	_, err = os.Stat(tmp)
+	assert(os.IsNotExist(err), "temp file not removed: %v", err)
+	_, err = os.Stat(fn + ".lock")
+	assert(os.IsNotExist(err), "lock file not removed: %v", err)
+
+	os.RemoveAll(fn)
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't create db after failed freeze: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+}
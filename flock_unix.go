@@ -0,0 +1,42 @@
+// flock_unix.go -- advisory file locks for unix like systems
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package bbhash
+
+import (
+	"os"
+	"syscall"
+)
+
+// take an exclusive or shared advisory lock on 'fd' without waiting; it is
+// released when 'fd' is closed. ErrLocked is returned if a conflicting lock
+// is held. Filesystems without locks are silently ignored.
+func flock(fd *os.File, excl bool) error {
+	how := syscall.LOCK_SH
+	if excl {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err := syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return ErrLocked
+		case syscall.ENOLCK, syscall.EOPNOTSUPP, syscall.EINVAL:
+			return nil
+		}
+		return err
+	}
+}
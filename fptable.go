@@ -0,0 +1,230 @@
+// fptable.go -- the fingerprinted MPH index of MPHMap and StaticSet
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// an MPH of salted key hashes and the fingerprint of the hash in each slot;
+// it is the index of MPHMap and StaticSet.
+type fpTable struct {
+	bb   *BBHash
+	salt uint64
+	fps  []uint32
+
+	// keys are hashed with the standard library hash; always true in a
+	// bbhash_stdlib build.
+	std bool
+}
+
+// bit in the encoded tag that marks an index of standard library hashes
+const fpTableStdHash uint32 = 1 << 31
+
+// Number of salts tried before giving up on building an index whose keys
+// have distinct hashes
+const fpTableTries = 8
+
+// build the index of 'n' keys whose salted hashes are hash(salt, i); eq(i, j)
+// returns true if keys 'i' and 'j' are equal. Return the index of the first
+// of each distinct key and its slot in the MPH.
+func (t *fpTable) build(n int, hash func(salt uint64, i int) uint64, eq func(i, j int) bool) ([]int, []uint64, error) {
+	hs := make([]uint64, n)
+	idx := make([]int, n)
+	for try := 0; try < fpTableTries; try++ {
+		t.salt = rand64()
+		for i := range hs {
+			hs[i] = hash(t.salt, i)
+		}
+
+		// distinct keys with the same hash need a new salt
+		uniq, ok := uniqHashes(hs, idx, eq)
+		if !ok {
+			continue
+		}
+
+		bb, fps, slots, err := buildFingerprints(hs, uniq)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		t.bb = bb
+		t.fps = fps
+		return uniq, slots, nil
+	}
+	return nil, nil, fmt.Errorf("bbhash: can't hash %d keys without collisions", n)
+}
+
+// return the index of the first of each distinct key, given the hashes
+// 'hs' of the keys; eq(i, j) returns true if keys 'i' and 'j' are equal.
+// 'idx' is scratch space for len(hs) indices. Returns false if distinct
+// keys have the same hash.
+func uniqHashes(hs []uint64, idx []int, eq func(i, j int) bool) ([]int, bool) {
+	for i := range idx {
+		idx[i] = i
+	}
+
+	// order the keys by hash - and the order they were given in
+	sort.Slice(idx, func(a, b int) bool {
+		x, y := idx[a], idx[b]
+		if hs[x] == hs[y] {
+			return x < y
+		}
+		return hs[x] < hs[y]
+	})
+
+	uniq := make([]int, 0, len(idx))
+	for _, i := range idx {
+		if n := len(uniq); n > 0 {
+			j := uniq[n-1]
+			if hs[i] == hs[j] {
+				if !eq(i, j) {
+					return nil, false
+				}
+				continue
+			}
+		}
+		uniq = append(uniq, i)
+	}
+	return uniq, true
+}
+
+// build the MPH of the distinct hashes hs[i] for each i in 'uniq'; return
+// it, the fingerprint of the hash in each slot of the MPH and the slot of
+// each i in 'uniq'. The MPH is nil if there are no hashes.
+func buildFingerprints(hs []uint64, uniq []int) (*BBHash, []uint32, []uint64, error) {
+	n := len(uniq)
+	fps := make([]uint32, n)
+	slots := make([]uint64, n)
+	if n == 0 {
+		return nil, fps, slots, nil
+	}
+
+	keys := make([]uint64, n)
+	for j, i := range uniq {
+		keys[j] = hs[i]
+	}
+
+	bb, err := newWithSalt(Gamma, rand64(), keys, nil)
+	if err != nil {
+		return nil, nil, nil, ErrMPHFail
+	}
+
+	for j, h := range keys {
+		s := bb.Find(h) - 1
+		fps[s] = uint32(h >> 32)
+		slots[j] = s
+	}
+	return bb, fps, slots, nil
+}
+
+// return the slot of the key whose salted hash is 'h' and true if it is
+// in the index
+func (t *fpTable) find(h uint64) (uint64, bool) {
+	if t.bb == nil {
+		return 0, false
+	}
+
+	i := t.bb.Find(h)
+	if i == 0 || t.fps[i-1] != uint32(h>>32) {
+		return 0, false
+	}
+	return i - 1, true
+}
+
+// encode the index as described in MPHMap.MarshalBinary(); 'magic' and
+// 'tag' identify the type of its user.
+func (t *fpTable) marshal(w io.Writer, magic string, tag uint32) error {
+	n := len(t.fps)
+	b := make([]byte, 24, 24+4*n)
+
+	le := binary.LittleEndian
+	copy(b[:4], magic)
+	if t.std {
+		tag |= fpTableStdHash
+	}
+	le.PutUint32(b[4:8], tag)
+	le.PutUint64(b[8:16], t.salt)
+	le.PutUint64(b[16:24], uint64(n))
+
+	var z [4]byte
+	for _, fp := range t.fps {
+		le.PutUint32(z[:], fp)
+		b = append(b, z[:]...)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+
+	if n > 0 {
+		return t.bb.MarshalBinary(w)
+	}
+	return nil
+}
+
+// return the size of the encoded index
+func (t *fpTable) marshalSize() uint64 {
+	n := uint64(24 + 4*len(t.fps))
+	if t.bb != nil {
+		n += t.bb.MarshalBinarySize()
+	}
+	return n
+}
+
+// decode an index encoded by marshal() from 'r'; return its tag. 'what'
+// names the type of its user in errors.
+func (t *fpTable) unmarshal(r io.Reader, magic, what string) (uint32, error) {
+	var b [24]byte
+
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+
+	if string(b[:4]) != magic {
+		return 0, fmt.Errorf("bbhash: %w: bad %s magic", ErrCorrupt, what)
+	}
+
+	le := binary.LittleEndian
+	tag := le.Uint32(b[4:8])
+	t.std = (tag & fpTableStdHash) > 0
+	if !t.std && !haveExtHash {
+		return 0, fmt.Errorf("bbhash: %s needs the fasthash hash; not in a bbhash_stdlib build", what)
+	}
+
+	t.salt = le.Uint64(b[8:16])
+
+	// sanity check before allocating the fingerprints
+	n := le.Uint64(b[16:24])
+	if n > (1 << 40) {
+		return 0, fmt.Errorf("bbhash: %w: %s of %d keys", ErrCorrupt, what, n)
+	}
+
+	fb := make([]byte, 4*n)
+	if _, err := io.ReadFull(r, fb); err != nil {
+		return 0, err
+	}
+
+	t.fps = make([]uint32, n)
+	for i := range t.fps {
+		t.fps[i] = le.Uint32(fb[4*i:])
+	}
+
+	if n > 0 {
+		bb, err := UnmarshalBBHash(r)
+		if err != nil {
+			return 0, err
+		}
+		t.bb = bb
+	}
+	return tag &^ fpTableStdHash, nil
+}
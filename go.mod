@@ -1,10 +1,10 @@
 module github.com/opencoff/go-bbhash
 
-go 1.12
+go 1.20
 
 require (
 	github.com/dchest/siphash v1.2.1
 	github.com/opencoff/go-fasthash v0.0.0-20180406145558-aed761496075
 	github.com/opencoff/golang-lru v0.6.0
-	github.com/opencoff/pflag v0.2.0 // indirect
+	github.com/opencoff/pflag v0.2.0
 )
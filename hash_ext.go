@@ -0,0 +1,29 @@
+// hash_ext.go -- third-party key hash and record checksum
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !bbhash_stdlib
+
+package bbhash
+
+import (
+	"github.com/dchest/siphash"
+	"github.com/opencoff/go-fasthash"
+)
+
+// this build can read and write DBs hashed with fasthash and siphash
+const haveExtHash = true
+
+// fasthash of 'b' salted with 'salt'
+func extHash64(salt uint64, b []byte) uint64 {
+	return fasthash.Hash64(salt, b)
+}
+
+// siphash-2-4 keyed with 'key'
+func newExtHash64(key []byte) hash64 {
+	return siphash.New(key)
+}
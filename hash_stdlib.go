@@ -0,0 +1,24 @@
+// hash_stdlib.go -- no third-party hashes in a bbhash_stdlib build
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build bbhash_stdlib
+
+package bbhash
+
+// This build only has the standard library hashes: writers always set
+// 'flagStdHash' and readers refuse DBs without it. So, the functions
+// below are never called.
+const haveExtHash = false
+
+func extHash64(salt uint64, b []byte) uint64 {
+	panic("bbhash: fasthash is not in a bbhash_stdlib build")
+}
+
+func newExtHash64(key []byte) hash64 {
+	panic("bbhash: siphash is not in a bbhash_stdlib build")
+}
@@ -0,0 +1,354 @@
+// iter.go -- iterate over the records of a constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Number of records an iterator in index order reads ahead
+const iterReadahead = 1024
+
+// Iterator walks the records of a DB in the order they are stored in the
+// file - shard by shard in a sharded DB and DB by DB in a MultiReader; or
+// in the order of their index in the perfect hash (see
+// DBReader.IterIndex()). Each record's checksum is verified as it is
+// read. Expired records are
+// skipped unless the reader ignores expiry (see DBReader.IgnoreExpiry()).
+// An Iterator is not safe for concurrent use.
+//
+//	it := rd.Iter()
+//	for it.Next() {
+//		k, v := it.Key(), it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	rd  *DBReader
+	now time.Time
+
+	// DBs yet to be visited after rd (e.g., the other shards of a
+	// sharded DB)
+	rest []*DBReader
+
+	// record offsets in ascending order; or in index order
+	offs []uint64
+
+	// visit the records in index order; the records read ahead of the
+	// iteration are in 'ahead'.
+	index bool
+	ahead []readahead
+
+	// don't read the values
+	keysOnly bool
+
+	// if true, records whose keys are in the DBs visited earlier
+	// ('shadow') are skipped; see MultiReader.Iter().
+	merge  bool
+	shadow []*DBReader
+
+	r   *record
+	err error
+}
+
+// a record read ahead of the iteration
+type readahead struct {
+	r   *record
+	err error
+}
+
+// Iter returns an iterator over all the records of the DB - in every
+// namespace. Records visited this way are not cached.
+func (rd *DBReader) Iter() *Iterator {
+	return newIterator([]*DBReader{rd})
+}
+
+// IterIndex returns an iterator over all the records of the DB in the
+// order of their index in the perfect hash - i.e., in the order of the
+// offset table; Iterator.Index() is the index of each record. The records
+// are read ahead of the iteration in batches of 1024 - concurrently and
+// in the order of their offsets; so a full scan runs at the bandwidth of
+// the disk even though the records are not visited in file order.
+// Records visited this way are not cached.
+func (rd *DBReader) IterIndex() *Iterator {
+	it := &Iterator{
+		now:   time.Now(),
+		rest:  []*DBReader{rd},
+		index: true,
+	}
+
+	it.nextDB()
+	return it
+}
+
+// return an iterator over the records of the DBs in 'rds' - one after the
+// other.
+func newIterator(rds []*DBReader) *Iterator {
+	it := &Iterator{
+		now:  time.Now(),
+		rest: rds,
+	}
+
+	it.nextDB()
+	return it
+}
+
+// start visiting the records of the next DB; return false if there are no
+// more DBs.
+func (it *Iterator) nextDB() bool {
+	if len(it.rest) == 0 {
+		return false
+	}
+
+	if it.merge && it.rd != nil {
+		it.shadow = append(it.shadow, it.rd)
+	}
+
+	rd := it.rest[0]
+	it.rest = it.rest[1:]
+	it.rd = rd
+	if !rd.enter() {
+		it.err = ErrClosed
+		return false
+	}
+
+	offs := make([]uint64, rd.nkeys)
+	for i := range offs {
+		offs[i] = rd.offset(uint64(i))
+	}
+	rd.leave()
+
+	if !it.index {
+		sort.Slice(offs, func(i, j int) bool {
+			return offs[i] < offs[j]
+		})
+	}
+
+	it.offs = offs
+	return true
+}
+
+// Next advances the iterator to the next record and returns true if there
+// is one. It returns false at the end of the DB or if a record can't be
+// read; Err() tells them apart. Once the DB is closed, Next returns false
+// and Err() returns ErrClosed.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		if len(it.offs) == 0 && len(it.ahead) == 0 {
+			if !it.nextDB() {
+				break
+			}
+			continue
+		}
+
+		// the DB can't be closed while a record is read
+		rd := it.rd
+		if !rd.enter() {
+			it.err = ErrClosed
+			break
+		}
+		r, err := it.visit()
+		rd.leave()
+
+		if err != nil {
+			it.err = err
+			break
+		}
+		if r != nil {
+			it.r = r
+			return true
+		}
+	}
+
+	it.r = nil
+	return false
+}
+
+// read the next record of the current DB; return nil if it is expired,
+// deleted or hidden.
+func (it *Iterator) visit() (*record, error) {
+	var r *record
+	var err error
+
+	if it.index {
+		if len(it.ahead) == 0 {
+			it.readAhead()
+		}
+		r, err = it.ahead[0].r, it.ahead[0].err
+		it.ahead = it.ahead[1:]
+	} else {
+		r, err = it.read(it.offs[0])
+		it.offs = it.offs[1:]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.deleted || it.rd.expired(r, it.now) {
+		return nil, nil
+	}
+
+	hidden, err := it.hidden(r)
+	if err != nil || hidden {
+		return nil, err
+	}
+
+	if !it.keysOnly {
+		if err = it.rd.decodeValue(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// read the record at offset 'off'
+func (it *Iterator) read(off uint64) (*record, error) {
+	if it.keysOnly {
+		return it.rd.decodeKey(off)
+	}
+	return it.rd.decodeRecord(off)
+}
+
+// read the next batch of records in index order - concurrently, in the
+// order of their offsets.
+func (it *Iterator) readAhead() {
+	n := len(it.offs)
+	if n > iterReadahead {
+		n = iterReadahead
+	}
+
+	todo := make([]batchRead, n)
+	for i, off := range it.offs[:n] {
+		todo[i] = batchRead{i: i, off: off}
+	}
+	it.offs = it.offs[n:]
+
+	sort.Slice(todo, func(i, j int) bool {
+		return todo[i].off < todo[j].off
+	})
+
+	ahead := make([]readahead, n)
+	readPool(todo, runtime.NumCPU(), func(x batchRead) {
+		r, err := it.read(x.off)
+		ahead[x.i] = readahead{r, err}
+	})
+	it.ahead = ahead
+}
+
+// return true if the key of 'r' is in - or deleted by - a DB that hides
+// it
+func (it *Iterator) hidden(r *record) (bool, error) {
+	for _, rd := range it.shadow {
+		x, err := rd.findLayer(r.ns, r.key, false)
+		if err == errDeleted || (err == nil && bytes.Equal(x.key, r.key)) {
+			return true, nil
+		}
+		if err != nil && err != ErrNoKey {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Key returns the key of the current record.
+func (it *Iterator) Key() []byte {
+	if it.r == nil {
+		return nil
+	}
+	return it.r.key
+}
+
+// Value returns the value of the current record.
+func (it *Iterator) Value() []byte {
+	if it.r == nil {
+		return nil
+	}
+	return it.r.val
+}
+
+// Index returns the index of the current record in the perfect hash of
+// its DB; see DBReader.Index(). If the level of the MPH that has the index
+// can't be read, it returns 0 and the error stops the iteration.
+func (it *Iterator) Index() uint64 {
+	if it.r == nil {
+		return 0
+	}
+
+	rd := it.rd
+	if !rd.enter() {
+		if it.err == nil {
+			it.err = ErrClosed
+		}
+		return 0
+	}
+	i, err := rd.bb.find(it.r.hash)
+	rd.leave()
+	if err != nil {
+		if it.err == nil {
+			it.err = err
+		}
+		return 0
+	}
+	return i - 1
+}
+
+// Namespace returns the namespace of the current record; see
+// DBWriter.AddKeyValsIn().
+func (it *Iterator) Namespace() uint8 {
+	if it.r == nil {
+		return 0
+	}
+	return it.r.ns
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Range calls 'fp' for every record of the DB in the order of Iter();
+// iteration stops when 'fp' returns false.
+func (rd *DBReader) Range(fp func(key, val []byte) bool) error {
+	return rangeIter(rd.Iter(), fp)
+}
+
+// call 'fp' for every record of 'it' until it returns false
+func rangeIter(it *Iterator, fp func(key, val []byte) bool) error {
+	for it.Next() {
+		if !fp(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// Keys calls 'fp' for the key of every record of the DB in the order of
+// Iter(); iteration stops when 'fp' returns false. The values are skipped
+// rather than read; as a result, the record checksums are only verified in
+// an encrypted DB (where the values are always read) and in a DB built with
+// WriterOptions.SplitValues.
+func (rd *DBReader) Keys(fp func(key []byte) bool) error {
+	return keysIter(rd.Iter(), fp)
+}
+
+// call 'fp' for the key of every record of 'it' until it returns false
+func keysIter(it *Iterator, fp func(key []byte) bool) error {
+	it.keysOnly = true
+	for it.Next() {
+		if !fp(it.Key()) {
+			break
+		}
+	}
+	return it.Err()
+}
@@ -0,0 +1,176 @@
+// iter_test.go -- test suite for the DB iterator
+
+package bbhash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	exp := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		v := fmt.Sprintf("val-%d", i)
+		exp[k] = v
+
+		_, err = wr.AddKeyVals([][]byte{[]byte(k)}, [][]byte{[]byte(v)})
+		assert(err == nil, "can't add key-val: %s", err)
+	}
+
+	_, err = wr.AddKeyValsIn(3, [][]byte{[]byte("key-0")}, [][]byte{[]byte("ns-val")})
+	assert(err == nil, "can't add key-val to ns 3: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	seen := make(map[string]bool)
+	it := rd.Iter()
+	for it.Next() {
+		k, v := string(it.Key()), string(it.Value())
+		if it.Namespace() == 3 {
+			assert(k == "key-0" && v == "ns-val", "ns 3: wrong record %s=%s", k, v)
+			continue
+		}
+
+		assert(it.Namespace() == 0, "key %s: unexpected ns %d", k, it.Namespace())
+		assert(exp[k] == v, "key %s: exp '%s', saw '%s'", k, exp[k], v)
+		assert(!seen[k], "key %s seen twice", k)
+		seen[k] = true
+	}
+	assert(it.Err() == nil, "iteration failed: %s", it.Err())
+	assert(len(seen) == len(exp), "exp %d records, saw %d", len(exp), len(seen))
+
+	var n int
+	err = rd.Range(func(k, v []byte) bool {
+		n++
+		return n < 10
+	})
+	assert(err == nil, "range failed: %s", err)
+	assert(n == 10, "range didn't stop; saw %d records", n)
+	rd.Close()
+
+	// a corrupt record stops the iteration with an error
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	b[100] ^= 0xff
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	it = rd.Iter()
+	for it.Next() {
+	}
+	assert(it.Err() != nil, "corrupt record not detected")
+}
+
+func TestKeys(t *testing.T) {
+	assert := newAsserter(t)
+
+	for _, opt := range []WriterOptions{
+		{},
+		{PrefixCompress: true, DedupValues: true},
+		{SplitValues: true},
+		{Key: []byte("0123456789abcdef")},
+	} {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		exp := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("/some/key/%d", i)
+			exp[k] = true
+
+			_, err = wr.AddKeyVals([][]byte{[]byte(k)}, [][]byte{[]byte(fmt.Sprintf("val-%d", i%7))})
+			assert(err == nil, "can't add key-val: %s", err)
+		}
+
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := newDBReader(fn, 10, opt.Key)
+		assert(err == nil, "read failed: %s", err)
+
+		seen := make(map[string]bool)
+		err = rd.Keys(func(k []byte) bool {
+			seen[string(k)] = true
+			return true
+		})
+		assert(err == nil, "keys failed: %s", err)
+		assert(len(seen) == len(exp), "exp %d keys, saw %d", len(exp), len(seen))
+		for k := range exp {
+			assert(seen[k], "key %s missing", k)
+		}
+		rd.Close()
+	}
+}
+
+func TestIterIndex(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	// more than one batch of read ahead
+	n := 3*iterReadahead + 10
+	exp := make(map[string]string)
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		v := fmt.Sprintf("val-%d", i)
+		exp[k] = v
+
+		_, err = wr.AddKeyVals([][]byte{[]byte(k)}, [][]byte{[]byte(v)})
+		assert(err == nil, "can't add key-val: %s", err)
+	}
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	var i uint64
+	it := rd.IterIndex()
+	for it.Next() {
+		k := string(it.Key())
+		assert(it.Index() == i, "key %s: exp index %d, saw %d", k, i, it.Index())
+		assert(string(it.Value()) == exp[k], "key %s: exp %s, saw %s", k, exp[k], it.Value())
+
+		j, ok := rd.Index(it.Key())
+		assert(ok && j == i, "key %s: index %d, saw %d", k, i, j)
+		i++
+	}
+	assert(it.Err() == nil, "iter failed: %s", it.Err())
+	assert(i == uint64(n), "exp %d records, saw %d", n, i)
+
+	// the index of records visited in file order
+	it = rd.Iter()
+	for it.Next() {
+		j, _ := rd.Index(it.Key())
+		assert(it.Index() == j, "key %s: exp index %d, saw %d", it.Key(), j, it.Index())
+	}
+	assert(it.Err() == nil, "iter failed: %s", it.Err())
+}
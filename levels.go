@@ -0,0 +1,228 @@
+// levels.go -- levels of the MPH of a DB loaded on first use
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// A DBReader reads level 0 of the MPH - which has the slots of most of the
+// keys (about 2/3 of them with the default gamma) - when it opens the DB.
+// The deeper levels are read from the DB the first time a lookup reaches
+// them; so opening a DB with a large MPH of many levels allocates and
+// reads much less of it. A lazy level is verified as it is loaded: the
+// keys of the levels up to it must not exceed the keys of the DB - and the
+// keys of all the levels must match them. Unless the DB is opened with
+// FastOpen, the keys of all the levels are also counted when it is opened -
+// without keeping the levels.
+
+// lazyLevels are the levels of a BBHash after bits[]; they are loaded on
+// first use.
+type lazyLevels struct {
+	ra io.ReaderAt
+
+	// file offset and number of words of each level
+	off   []int64
+	words []uint64
+
+	// number of keys of the MPH; and of the levels in bits[]
+	nkeys uint64
+	base  uint64
+
+	// levels are loaded in order with the lock held
+	sync.Mutex
+	lv []atomic.Pointer[lazyLevel]
+}
+
+// a loaded level
+type lazyLevel struct {
+	bv *bitVector
+
+	// rank of the first bit of the level and of the next level
+	rank uint64
+	next uint64
+}
+
+// unmarshal the BBHash of 'nkeys' keys marshaled in the 'sz' bytes at 'off'
+// of 'ra'; only level 0 is read, the rest are loaded from 'ra' on first use.
+// An MPH with fingerprints is read in full.
+func unmarshalLazyBBHash(ra io.ReaderAt, off, sz int64, nkeys uint64) (*BBHash, error) {
+	var b [32]byte
+
+	if sz < int64(len(b)) {
+		return nil, fmt.Errorf("bbhash: %w: truncated header", ErrCorrupt)
+	}
+	if _, err := ra.ReadAt(b[:], off); err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	if (le.Uint64(b[24:]) & bbFingerprints) > 0 {
+		return UnmarshalBBHash(io.NewSectionReader(ra, off, sz))
+	}
+
+	nlvl, err := decodeBBHeader(b[:])
+	if err != nil {
+		return nil, err
+	}
+
+	bv, err := unmarshalbitVector(io.NewSectionReader(ra, off+32, sz-32))
+	if err != nil {
+		return nil, err
+	}
+
+	bb := &BBHash{
+		bits: []*bitVector{bv},
+		salt: le.Uint64(b[16:24]),
+	}
+	bb.preComputeRank()
+	if nlvl == 1 {
+		return bb, nil
+	}
+
+	lz := &lazyLevels{
+		ra:    ra,
+		nkeys: nkeys,
+		base:  bv.ComputeRank(),
+	}
+	if lz.base > nkeys {
+		return nil, fmt.Errorf("bbhash: %w: level 0 has %d keys; exp at most %d", ErrCorrupt, lz.base, nkeys)
+	}
+
+	// only the length of each level is read
+	var x [8]byte
+
+	end := off + sz
+	pos := off + 32 + int64(bv.MarshalBinarySize())
+	for i := uint64(1); i < nlvl; i++ {
+		if pos+8 > end {
+			return nil, fmt.Errorf("bbhash: %w: level %d is truncated", ErrCorrupt, i)
+		}
+		if _, err = ra.ReadAt(x[:], pos); err != nil {
+			return nil, err
+		}
+
+		n := le.Uint64(x[:])
+		if n == 0 || n > (1<<32) || n > uint64(end-pos-8)/8 {
+			return nil, fmt.Errorf("bbhash: %w: level %d: bitvect length %d is invalid", ErrCorrupt, i, n)
+		}
+
+		lz.off = append(lz.off, pos+8)
+		lz.words = append(lz.words, n)
+		pos += 8 + 8*int64(n)
+	}
+
+	lz.lv = make([]atomic.Pointer[lazyLevel], len(lz.off))
+	bb.lazy = lz
+	return bb, nil
+}
+
+// return the 1 based rank of key 'k' in the lazy levels - the first of
+// which is level 'lvl0' of the MPH; or 0 if it isn't in any of them.
+func (lz *lazyLevels) find(k, salt uint64, lvl0 int) (uint64, error) {
+	for i := range lz.lv {
+		l, err := lz.level(i)
+		if err != nil {
+			return 0, err
+		}
+
+		j := hash(k, salt, uint(lvl0+i)) % l.bv.Size()
+		if l.bv.IsSet(j) {
+			return 1 + l.rank + l.bv.Rank(j), nil
+		}
+	}
+	return 0, nil
+}
+
+// return lazy level 'i'; it is loaded if it hasn't been.
+func (lz *lazyLevels) level(i int) (*lazyLevel, error) {
+	if l := lz.lv[i].Load(); l != nil {
+		return l, nil
+	}
+
+	lz.Lock()
+	defer lz.Unlock()
+	return lz.load(i)
+}
+
+// load lazy level 'i' and the levels before it; called with the lock
+// held. An error isn't remembered; the next use tries again.
+func (lz *lazyLevels) load(i int) (*lazyLevel, error) {
+	if l := lz.lv[i].Load(); l != nil {
+		return l, nil
+	}
+
+	rank := lz.base
+	if i > 0 {
+		p, err := lz.load(i - 1)
+		if err != nil {
+			return nil, err
+		}
+		rank = p.next
+	}
+
+	bv, err := lz.read(i)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lazyLevel{
+		bv:   bv,
+		rank: rank,
+		next: rank + bv.ComputeRank(),
+	}
+
+	// an unverified MPH must not map keys outside the offset table
+	if l.next > lz.nkeys || (i == len(lz.lv)-1 && l.next != lz.nkeys) {
+		return nil, fmt.Errorf("bbhash: %w: levels up to %d have %d keys; exp %d", ErrCorrupt, i+1, l.next, lz.nkeys)
+	}
+
+	lz.lv[i].Store(l)
+	return l, nil
+}
+
+// read the bitvector of lazy level 'i'
+func (lz *lazyLevels) read(i int) (*bitVector, error) {
+	b := make([]byte, 8*lz.words[i])
+	if _, err := io.ReadFull(io.NewSectionReader(lz.ra, lz.off[i], int64(len(b))), b); err != nil {
+		return nil, fmt.Errorf("bbhash: level %d: %w", i+1, err)
+	}
+
+	bv := &bitVector{
+		v: make([]uint64, lz.words[i]),
+	}
+
+	le := binary.LittleEndian
+	for j := range bv.v {
+		bv.v[j] = le.Uint64(b[j*8:])
+	}
+	return bv, nil
+}
+
+// count the keys of every lazy level without keeping it; they must match
+// the keys of the MPH.
+func (lz *lazyLevels) check() error {
+	n := lz.base
+	for i := range lz.off {
+		bv, err := lz.read(i)
+		if err != nil {
+			return err
+		}
+		n += bv.ComputeRank()
+	}
+
+	if n != lz.nkeys {
+		return fmt.Errorf("bbhash: %w: levels have %d keys; exp %d", ErrCorrupt, n, lz.nkeys)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// levels_test.go -- test suite for MPH levels loaded on first use
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLazyLevels(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	st := wr.Stats()
+	assert(st.MPHLevels > 1, "exp more than 1 level, saw %d", st.MPHLevels)
+
+	var lastoff int64
+	for _, m := range []LoadMode{LoadFile, LoadMmap, LoadMemory} {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m})
+		assert(err == nil, "%d: read failed: %s", m, err)
+
+		lz := rd.bb.lazy
+		assert(lz != nil, "%d: no lazy levels", m)
+		assert(len(rd.bb.bits) == 1, "%d: exp 1 level loaded, saw %d", m, len(rd.bb.bits))
+		for i := range lz.lv {
+			assert(lz.lv[i].Load() == nil, "%d: level %d loaded at open", m, i+1)
+		}
+
+		in := rd.Info()
+		assert(in.MPHLevels == st.MPHLevels, "%d: exp %d levels, saw %d", m, st.MPHLevels, in.MPHLevels)
+		assert(in.MPHBits == st.MPHBits, "%d: exp %d MPH bits, saw %d", m, st.MPHBits, in.MPHBits)
+		assert(in.MPHSize == st.MPHSize, "%d: exp MPH size %d, saw %d", m, st.MPHSize, in.MPHSize)
+
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%d: can't find key %s: %s", m, k, err)
+			assert(bytes.Equal(v, k), "%d: key %s: value mismatch", m, k)
+		}
+
+		// every level has the slot of some key
+		for i := range lz.lv {
+			assert(lz.lv[i].Load() != nil, "%d: level %d not loaded", m, i+1)
+		}
+
+		var b bytes.Buffer
+		err = rd.bb.MarshalBinary(&b)
+		assert(err == nil, "%d: marshal failed: %s", m, err)
+		assert(uint64(b.Len()) == st.MPHSize, "%d: exp marshaled size %d, saw %d", m, st.MPHSize, b.Len())
+
+		assert(lz.check() == nil, "%d: level check failed", m)
+		lastoff = lz.off[len(lz.off)-1]
+		rd.Close()
+	}
+
+	// corrupt the last level; the DB opens without verifying it and the
+	// lookups that reach it fail.
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	b[lastoff] ^= 0x1
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReader(fn, 0)
+	assert(errors.Is(err, ErrCorrupt), "opened corrupt db: %v", err)
+
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{FastOpen: true})
+	assert(err == nil, "fast open failed: %s", err)
+	defer rd.Close()
+
+	err = rd.bb.lazy.check()
+	assert(errors.Is(err, ErrCorrupt), "level check: exp ErrCorrupt, saw %v", err)
+
+	nerr := 0
+	for _, k := range keys {
+		_, ok := rd.Index(k)
+		v, err := rd.Find(k)
+		if err != nil {
+			assert(errors.Is(err, ErrCorrupt), "key %s: exp ErrCorrupt, saw %v", k, err)
+			assert(!ok, "key %s: index of a corrupt level", k)
+			nerr++
+			continue
+		}
+		assert(ok, "key %s: no index", k)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+	assert(nerr > 0, "corrupt level not detected")
+}
@@ -0,0 +1,23 @@
+// logger.go -- optional logging of progress and warnings
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+// Logger receives progress messages, phase timings and warnings from the
+// construction of the MPH, DBWriter and DBReader; *log.Logger satisfies
+// it. See WriterOptions.Logger and ReaderOptions.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// log a message to 'l' - if it isn't nil
+func logf(l Logger, f string, v ...interface{}) {
+	if l != nil {
+		l.Printf(f, v...)
+	}
+}
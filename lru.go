@@ -0,0 +1,121 @@
+// lru.go -- a small LRU cache keyed by 64-bit hashes
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// lruCache holds upto 'max' values indexed by a 64-bit hash and evicts the
+// least recently used value when it is full. It is safe for concurrent use.
+type lruCache[V any] struct {
+	sync.Mutex
+
+	max int
+	ll  *list.List
+	m   map[uint64]*list.Element
+
+	// called with each value evicted to make room; may be nil
+	evict func(V)
+}
+
+// an entry in the lruCache list
+type lruEntry[V any] struct {
+	h uint64
+	v V
+}
+
+func newLRUCache[V any](max int) (*lruCache[V], error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("bbhash: invalid cache size %d", max)
+	}
+
+	c := &lruCache[V]{
+		max: max,
+		ll:  list.New(),
+		m:   make(map[uint64]*list.Element),
+	}
+	return c, nil
+}
+
+func (c *lruCache[V]) Get(h uint64) (V, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.m[h]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry[V]).v, true
+	}
+
+	var zero V
+	return zero, false
+}
+
+// Contains returns true if 'h' is in the cache; it doesn't update its
+// recency.
+func (c *lruCache[V]) Contains(h uint64) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.m[h]
+	return ok
+}
+
+func (c *lruCache[V]) Add(h uint64, v V) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.m[h]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry[V]).v = v
+		return
+	}
+
+	c.m[h] = c.ll.PushFront(&lruEntry[V]{h, v})
+	if c.ll.Len() > c.max {
+		e := c.ll.Back()
+		x := e.Value.(*lruEntry[V])
+		c.ll.Remove(e)
+		delete(c.m, x.h)
+		if c.evict != nil {
+			c.evict(x.v)
+		}
+	}
+}
+
+func (c *lruCache[V]) releases() bool { return c.evict != nil }
+
+func (c *lruCache[V]) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ll.Len()
+}
+
+// Keys returns the hashes in the cache; the least recently used first
+func (c *lruCache[V]) Keys() []uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	k := make([]uint64, 0, c.ll.Len())
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		k = append(k, e.Value.(*lruEntry[V]).h)
+	}
+	return k
+}
+
+func (c *lruCache[V]) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ll.Init()
+	c.m = make(map[uint64]*list.Element)
+}
@@ -0,0 +1,33 @@
+// madvise_linux.go -- access pattern hints for mapped regions
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package bbhash
+
+import (
+	"syscall"
+)
+
+// tell the kernel how the mapped region 'b' will be accessed
+func madvise(b []byte, a Advice) error {
+	var x int
+
+	switch a {
+	case AdviceRandom:
+		x = syscall.MADV_RANDOM
+	case AdviceSequential:
+		x = syscall.MADV_SEQUENTIAL
+	case AdviceWillNeed:
+		x = syscall.MADV_WILLNEED
+	default:
+		x = syscall.MADV_NORMAL
+	}
+	return syscall.Madvise(b, x)
+}
@@ -0,0 +1,17 @@
+// madvise_other.go -- platforms without madvise
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package bbhash
+
+// access pattern hints are ignored
+func madvise(b []byte, a Advice) error {
+	return nil
+}
@@ -26,10 +26,11 @@ func (bb *BBHash) MarshalBinary(w io.Writer) error {
 	//   o version
 	//   o n-bitvectors
 	//   o salt
-	//   o resv
+	//   o flags: bbFingerprints if the fingerprints follow the bitvectors
 	//
 	// Body:
 	//   o <n> bitvectors laid out consecutively
+	//   o optional fingerprints: a little-endian uint32 per key
 
 	var b bytes.Buffer
 	var x [8]byte
@@ -39,13 +40,17 @@ func (bb *BBHash) MarshalBinary(w io.Writer) error {
 	le.PutUint64(x[:], 1) // version 1
 	b.Write(x[:])
 
-	le.PutUint64(x[:], uint64(len(bb.bits)))
+	le.PutUint64(x[:], uint64(bb.levels()))
 	b.Write(x[:])
 
 	le.PutUint64(x[:], bb.salt)
 	b.Write(x[:])
 
-	le.PutUint64(x[:], 0) // reserved byte
+	var flags uint64
+	if bb.fps != nil {
+		flags |= bbFingerprints
+	}
+	le.PutUint64(x[:], flags)
 	b.Write(x[:])
 
 	n, err := w.Write(b.Bytes())
@@ -64,20 +69,44 @@ func (bb *BBHash) MarshalBinary(w io.Writer) error {
 		}
 	}
 
+	if bb.lazy != nil {
+		for i := range bb.lazy.off {
+			l, err := bb.lazy.level(i)
+			if err != nil {
+				return err
+			}
+			if err = l.bv.MarshalBinary(w); err != nil {
+				return err
+			}
+		}
+	}
+
 	// We don't store the rank vector; we can re-compute it when we unmarshal
 	// the bitvectors.
 
+	if bb.fps != nil {
+		fb := make([]byte, 4*len(bb.fps))
+		for i, fp := range bb.fps {
+			le.PutUint32(fb[i*4:], fp)
+		}
+		if _, err = w.Write(fb); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// flag in the marshaled header of a BBHash with fingerprints
+const bbFingerprints uint64 = 1
+
 // MarshalBinarySize returns the size of the marshaled bbhash (in bytes)
 func (bb *BBHash) MarshalBinarySize() uint64 {
 	var z uint64 = 4 * 8 // header
 
-	for _, bv := range bb.bits {
-		z += bv.MarshalBinarySize()
+	for _, bits := range bb.levelBits() {
+		z += 8 * (1 + bits/64)
 	}
-	return z
+	return z + 4*uint64(len(bb.fps))
 }
 
 // UnmarshalBBHash reads a previously marshalled binary stream from 'r' and recreates
@@ -90,18 +119,12 @@ func UnmarshalBBHash(r io.Reader) (*BBHash, error) {
 		return nil, err
 	}
 
-	le := binary.LittleEndian
-
-	v := le.Uint64(b[:8])
-	if v != 1 {
-		return nil, fmt.Errorf("bbhash: no support to un-marshal version %d", v)
-	}
-
-	v = le.Uint64(b[8:16])
-	if v == 0 || v > uint64(MaxLevel) {
-		return nil, fmt.Errorf("bbhash: invalid levels %d (max %d)", v, MaxLevel)
+	v, err := decodeBBHeader(b[:])
+	if err != nil {
+		return nil, err
 	}
 
+	le := binary.LittleEndian
 	bb := &BBHash{
 		bits: make([]*bitVector, v),
 		salt: le.Uint64(b[16:24]),
@@ -117,9 +140,38 @@ func UnmarshalBBHash(r io.Reader) (*BBHash, error) {
 	}
 
 	bb.preComputeRank()
+
+	if (le.Uint64(b[24:]) & bbFingerprints) > 0 {
+		fb := make([]byte, 4*bb.keys())
+		if _, err = io.ReadFull(r, fb); err != nil {
+			return nil, err
+		}
+
+		bb.fps = make([]uint32, len(fb)/4)
+		for i := range bb.fps {
+			bb.fps[i] = le.Uint32(fb[i*4:])
+		}
+	}
 	return bb, nil
 }
 
+// validate the 32 byte header 'b' of a marshaled BBHash; return the number
+// of levels.
+func decodeBBHeader(b []byte) (uint64, error) {
+	le := binary.LittleEndian
+
+	v := le.Uint64(b[:8])
+	if v != 1 {
+		return 0, fmt.Errorf("bbhash: no support to un-marshal version %d", v)
+	}
+
+	v = le.Uint64(b[8:16])
+	if v == 0 || v > uint64(MaxLevel) {
+		return 0, fmt.Errorf("bbhash: invalid levels %d (max %d)", v, MaxLevel)
+	}
+	return v, nil
+}
+
 func errShortWrite(n int) error {
 	return fmt.Errorf("bbhash: incomplete write; exp 8, saw %d", n)
 }
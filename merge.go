@@ -0,0 +1,229 @@
+// merge.go -- construct a BBHash from sorted key files
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A key file is a sequence of big-endian uint64 keys in ascending order
+// without duplicates - e.g., a shard of keys written by a sharded exporter.
+// NewFromSortedFiles() merges the files as it reads them: a key that is in
+// several files is seen once, and only the smallest key of each file is in
+// memory. Level 0 of the MPH hashes all the keys; so the files are merged
+// once to count the keys and twice more for the two passes of level 0.
+//
+// What remains in memory for 'n' keys and gamma 'g': the two bitvectors of
+// level 0 - the MPH level and its collisions - of g*n bits each; and the
+// keys that collide at level 0 - about 2/5 of them with the default gamma
+// - at 8 bytes each for the later levels. The list of colliding keys grows
+// as they are found; so it may briefly take twice that. Each merge also
+// holds a batch of mergeBatch keys and a read buffer per file.
+
+// number of merged keys passed to each pass of level 0 at a time
+const mergeBatch = 64 * 1024
+
+// NewFromSortedFiles is like New except the keys are read from the sorted
+// key files 'fns' (see above) instead of memory; a key may be in several
+// files. It returns an error matching ErrMalformedInput if a file isn't a
+// sequence of ascending uint64 keys.
+func NewFromSortedFiles(g float64, fns ...string) (*BBHash, error) {
+	return newFromSortedFiles(g, rand64(), fns, nil)
+}
+
+// like NewFromSortedFiles() except the hash functions use salt 'salt' and
+// the progress is logged to 'log'; the MPH is the same as that of
+// newWithSalt() with the merged keys.
+func newFromSortedFiles(g float64, salt uint64, fns []string, log Logger) (*BBHash, error) {
+	if g <= 1.0 {
+		g = 2.0
+	}
+	bb := &BBHash{
+		salt: salt,
+		g:    g,
+	}
+
+	n, err := mergeKeyFiles(fns, func([]uint64) {})
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("bbhash: no keys in %d key files", len(fns))
+	}
+
+	// the keys of level 0 are never in memory; the redo list grows with
+	// the collisions.
+	s := bb.newState(int(n), 0)
+	s.log = log
+	logf(log, "bbhash: salt %#x, gamma %4.2f, %d keys in %d files, %d bits", salt, g, n, len(fns), s.A.Size())
+
+	t0 := time.Now()
+	m, err := mergeKeyFiles(fns, func(keys []uint64) {
+		preprocess(s, keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t1 := time.Now()
+	s.A.Reset()
+	z, err := mergeKeyFiles(fns, func(keys []uint64) {
+		assign(s, keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m != n || z != n {
+		return nil, fmt.Errorf("bbhash: key files changed during construction; exp %d keys, saw %d and %d", n, m, z)
+	}
+	s.levelDone(int(n), t0, t1, false)
+
+	keys, _ := s.nextLevel()
+	switch {
+	case keys == nil:
+		s.finish()
+	case len(keys) > MinParallelKeys:
+		err = s.concurrent(keys)
+	default:
+		err = s.singleThread(keys)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return bb, nil
+}
+
+// merge the key files 'fns' and call 'fp' with batches of the unique keys
+// in ascending order; 'fp' must not retain the batch. Returns the number of
+// unique keys.
+func mergeKeyFiles(fns []string, fp func(keys []uint64)) (uint64, error) {
+	files := make([]*keyFile, 0, len(fns))
+	defer func() {
+		for _, kf := range files {
+			kf.fd.Close()
+		}
+	}()
+
+	h := make(keyHeap, 0, len(fns))
+	for _, fn := range fns {
+		fd, err := os.Open(fn)
+		if err != nil {
+			return 0, err
+		}
+
+		kf := &keyFile{
+			fn: fn,
+			fd: fd,
+			rd: bufio.NewReader(fd),
+		}
+		files = append(files, kf)
+
+		ok, err := kf.next()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			h = append(h, kf)
+		}
+	}
+	heap.Init(&h)
+
+	var n, last uint64
+
+	buf := make([]uint64, 0, mergeBatch)
+	for len(h) > 0 {
+		kf := h[0]
+		if k := kf.key; n == 0 || k != last {
+			buf = append(buf, k)
+			last = k
+			n++
+			if len(buf) == cap(buf) {
+				fp(buf)
+				buf = buf[:0]
+			}
+		}
+
+		ok, err := kf.next()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+
+	if len(buf) > 0 {
+		fp(buf)
+	}
+	return n, nil
+}
+
+// keyFile is a key file being merged
+type keyFile struct {
+	fn string
+	fd *os.File
+	rd *bufio.Reader
+
+	// current key and the number of keys read
+	key uint64
+	n   uint64
+}
+
+// read the next key of the file; return false at the end of the file.
+func (kf *keyFile) next() (bool, error) {
+	var b [8]byte
+
+	_, err := io.ReadFull(kf.rd, b[:])
+	switch err {
+	case nil:
+	case io.EOF:
+		return false, nil
+	case io.ErrUnexpectedEOF:
+		return false, fmt.Errorf("bbhash: %s: truncated key %d: %w", kf.fn, kf.n, ErrMalformedInput)
+	default:
+		return false, fmt.Errorf("bbhash: %s: %w", kf.fn, err)
+	}
+
+	k := binary.BigEndian.Uint64(b[:])
+	if kf.n > 0 && k <= kf.key {
+		return false, fmt.Errorf("bbhash: %s: key %d (%#x) isn't above the previous key (%#x): %w", kf.fn, kf.n, k, kf.key, ErrMalformedInput)
+	}
+
+	kf.key = k
+	kf.n++
+	return true, nil
+}
+
+// keyHeap orders the key files being merged by their current key
+type keyHeap []*keyFile
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(*keyFile))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	kf := old[n-1]
+	*h = old[:n-1]
+	return kf
+}
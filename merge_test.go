@@ -0,0 +1,106 @@
+// merge_test.go -- test suite for BBHash construction from sorted key files
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestSortedFiles(t *testing.T) {
+	assert := newAsserter(t)
+
+	// three shards of ascending keys; every third key is in two of them
+	keys := make([]uint64, MinParallelKeys)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	shards := make([][]uint64, 3)
+	for i, k := range keys {
+		shards[i%3] = append(shards[i%3], k)
+		if i%3 == 0 {
+			shards[(i+1)%3] = append(shards[(i+1)%3], k)
+		}
+	}
+
+	var fns []string
+	defer func() {
+		for _, fn := range fns {
+			os.Remove(fn)
+		}
+	}()
+
+	for _, s := range shards {
+		fn := fmt.Sprintf("%s/keys%d.bin", os.TempDir(), rand64())
+		fns = append(fns, fn)
+		err := os.WriteFile(fn, keyFileBytes(s), 0600)
+		assert(err == nil, "can't write key file: %s", err)
+	}
+
+	salt := rand64()
+	bb, err := newFromSortedFiles(2.0, salt, fns, nil)
+	assert(err == nil, "construction failed: %s", err)
+
+	st := bb.ConstructionStats()
+	assert(st.Keys == uint64(len(keys)), "exp %d keys, saw %d", len(keys), st.Keys)
+	assert(len(st.Levels) == len(bb.bits), "exp %d levels, saw %d", len(bb.bits), len(st.Levels))
+
+	// the MPH of the merged keys is that of the keys in memory
+	ref, err := newWithSalt(2.0, salt, keys, nil)
+	assert(err == nil, "construction failed: %s", err)
+
+	seen := make(map[uint64]bool)
+	for _, k := range keys {
+		i := bb.Find(k)
+		assert(i > 0 && i <= uint64(len(keys)), "key %#x: index %d out of range", k, i)
+		assert(!seen[i], "key %#x: duplicate index %d", k, i)
+		assert(i == ref.Find(k), "key %#x: exp index %d, saw %d", k, ref.Find(k), i)
+		seen[i] = true
+	}
+
+	var b1, b2 bytes.Buffer
+	assert(bb.MarshalBinary(&b1) == nil, "marshal failed")
+	assert(ref.MarshalBinary(&b2) == nil, "marshal failed")
+	assert(bytes.Equal(b1.Bytes(), b2.Bytes()), "marshaled MPHs differ")
+
+	bb, err = NewFromSortedFiles(2.0, fns...)
+	assert(err == nil, "construction failed: %s", err)
+	assert(bb.ConstructionStats().Keys == uint64(len(keys)), "exp %d keys", len(keys))
+
+	// keys out of order
+	err = os.WriteFile(fns[0], keyFileBytes([]uint64{1, 3, 2}), 0600)
+	assert(err == nil, "can't write key file: %s", err)
+	_, err = NewFromSortedFiles(2.0, fns...)
+	assert(errors.Is(err, ErrMalformedInput), "unsorted keys: %v", err)
+
+	// duplicate keys in a file
+	err = os.WriteFile(fns[0], keyFileBytes([]uint64{1, 2, 2}), 0600)
+	assert(err == nil, "can't write key file: %s", err)
+	_, err = NewFromSortedFiles(2.0, fns...)
+	assert(errors.Is(err, ErrMalformedInput), "duplicate keys: %v", err)
+
+	// truncated key
+	err = os.WriteFile(fns[0], keyFileBytes([]uint64{1, 2})[:13], 0600)
+	assert(err == nil, "can't write key file: %s", err)
+	_, err = NewFromSortedFiles(2.0, fns...)
+	assert(errors.Is(err, ErrMalformedInput), "truncated key: %v", err)
+
+	_, err = NewFromSortedFiles(2.0)
+	assert(err != nil, "no key files: no error")
+}
+
+// return the key file of 'keys'
+func keyFileBytes(keys []uint64) []byte {
+	b := make([]byte, 8*len(keys))
+	for i, k := range keys {
+		binary.BigEndian.PutUint64(b[i*8:], k)
+	}
+	return b
+}
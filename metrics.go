@@ -0,0 +1,68 @@
+// metrics.go -- hooks to export metrics of DB construction and lookups
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"time"
+)
+
+// Metrics receives the metrics of a DBReader (see DBReader.SetMetrics())
+// and a DBWriter (see WriterOptions.Metrics); the names are the Metric
+// constants below. Counters are monotonically increasing; gauges are set
+// to a new value. Implementations must be safe for concurrent use and
+// cheap - they are called in the lookup path. The prometheus sub-module
+// has an implementation for Prometheus.
+type Metrics interface {
+	Counter(name string, delta float64)
+	Gauge(name string, val float64)
+}
+
+// Metrics of a DBReader; all of them are counters.
+const (
+	MetricLookups            = "bbhash_lookups_total"
+	MetricLookupSeconds      = "bbhash_lookup_seconds_total"
+	MetricCacheHits          = "bbhash_cache_hits_total"
+	MetricCacheMisses        = "bbhash_cache_misses_total"
+	MetricNegativeHits       = "bbhash_negative_cache_hits_total"
+	MetricBloomRejects       = "bbhash_bloom_rejects_total"
+	MetricFingerprintRejects = "bbhash_fingerprint_rejects_total"
+	MetricReads              = "bbhash_reads_total"
+	MetricBytesRead          = "bbhash_read_bytes_total"
+	MetricChecksumFailures   = "bbhash_checksum_failures_total"
+)
+
+// Metrics of a DBWriter: MetricRecordsAdded is a counter; the rest are
+// gauges set by Freeze().
+const (
+	MetricRecordsAdded   = "bbhash_build_records_added_total"
+	MetricBuildRecords   = "bbhash_build_records"
+	MetricBuildFileSize  = "bbhash_build_file_bytes"
+	MetricBuildMPHLevels = "bbhash_build_mph_levels"
+	MetricBuildIngest    = "bbhash_build_ingest_seconds"
+	MetricBuildMPH       = "bbhash_build_mph_seconds"
+	MetricBuildOffsets   = "bbhash_build_offsets_seconds"
+	MetricBuildLayout    = "bbhash_build_layout_seconds"
+	MetricBuildWrite     = "bbhash_build_write_seconds"
+)
+
+// export the stats of a frozen DB to 'm'
+func (s *BuildStats) export(m Metrics) {
+	g := func(name string, d time.Duration) {
+		m.Gauge(name, d.Seconds())
+	}
+
+	m.Gauge(MetricBuildRecords, float64(s.Records))
+	m.Gauge(MetricBuildFileSize, float64(s.FileSize))
+	m.Gauge(MetricBuildMPHLevels, float64(s.MPHLevels))
+	g(MetricBuildIngest, s.Ingest)
+	g(MetricBuildMPH, s.MPH)
+	g(MetricBuildOffsets, s.Offsets)
+	g(MetricBuildLayout, s.Layout)
+	g(MetricBuildWrite, s.Write)
+}
@@ -0,0 +1,72 @@
+// metrics_test.go -- test suite for the metrics hooks
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Metrics that remember the latest values
+type testMetrics struct {
+	sync.Mutex
+	v map[string]float64
+}
+
+func (m *testMetrics) Counter(name string, delta float64) {
+	m.Lock()
+	m.v[name] += delta
+	m.Unlock()
+}
+
+func (m *testMetrics) Gauge(name string, val float64) {
+	m.Lock()
+	m.v[name] = val
+	m.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wm := &testMetrics{v: make(map[string]float64)}
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{Metrics: wm})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := [][]byte{[]byte("k1"), []byte("k2"), []byte("k3"), []byte("k1")}
+	vals := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3"), []byte("dup")}
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	assert(wm.v[MetricRecordsAdded] == 3, "exp 3 records added, saw %v", wm.v[MetricRecordsAdded])
+	assert(wm.v[MetricBuildRecords] == 3, "exp 3 records, saw %v", wm.v[MetricBuildRecords])
+	st := wr.Stats()
+	assert(wm.v[MetricBuildFileSize] == float64(st.FileSize), "file size mismatch")
+	assert(wm.v[MetricBuildMPHLevels] > 0, "no MPH levels")
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	rm := &testMetrics{v: make(map[string]float64)}
+	rd.SetMetrics(rm)
+
+	for _, k := range keys {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+
+	rs := rd.Stats()
+	assert(rm.v[MetricLookups] == 4, "exp 4 lookups, saw %v", rm.v[MetricLookups])
+	assert(rm.v[MetricCacheHits] == 1 && rm.v[MetricCacheMisses] == 3, "wrong cache metrics")
+	assert(rm.v[MetricReads] == float64(rs.Reads), "exp %d reads, saw %v", rs.Reads, rm.v[MetricReads])
+	assert(rm.v[MetricBytesRead] == float64(rs.BytesRead), "bytes read mismatch")
+	assert(rm.v[MetricLookupSeconds] > 0, "no lookup time")
+}
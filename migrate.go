@@ -0,0 +1,129 @@
+// migrate.go -- upgrade a DB to the current format
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// MigrateOptions control the upgrade of a DB by MigrateWithOptions(). The
+// zero value keeps the features of the DB.
+type MigrateOptions struct {
+	// Key of an encrypted DB; the migrated DB is encrypted with it too.
+	Key []byte
+
+	// KeyHash and StdlibHash select the key hash and record checksums
+	// of the migrated DB (see WriterOptions); the DB keeps its own if
+	// they are the zero value.
+	KeyHash    KeyHash
+	StdlibHash bool
+
+	// Gamma of the MPH of the migrated DB; default Gamma
+	Gamma float64
+
+	// SigningKey, if non-nil, signs the migrated DB; see
+	// WriterOptions.SigningKey. A signed DB can't be re-signed without
+	// it; the migrated DB is then unsigned.
+	SigningKey ed25519.PrivateKey
+
+	// Logger, if non-nil, receives the progress of the migration.
+	Logger Logger
+}
+
+// Migrate upgrades the DB in 'src' to the current format (FormatVersion)
+// and writes it to 'dst'; 'src' and 'dst' may be the same file. It is
+// MigrateWithOptions() with the zero MigrateOptions.
+func Migrate(src, dst string) error {
+	return MigrateWithOptions(src, dst, MigrateOptions{})
+}
+
+// MigrateWithOptions is like Migrate except 'opt' can pick new hash
+// functions for the migrated DB. The records are read from 'src' and
+// written afresh with a new salt: the migrated DB has the same keys,
+// values, metadata and features (key set, front coding, deduplicated or
+// split values, fingerprints, Bloom filter, compression, encryption,
+// record alignment and segment checksums) as 'src'. Expired records aren't migrated. A delta DB
+// can't be migrated; it must be rebuilt on top of its migrated base.
+func MigrateWithOptions(src, dst string, opt MigrateOptions) error {
+	rd, err := NewDBReaderWithOptions(src, ReaderOptions{Cache: 1, Key: opt.Key})
+	if err != nil {
+		return err
+	}
+
+	defer rd.Close()
+
+	if rd.base != nil {
+		return fmt.Errorf("%s: can't migrate a delta DB", src)
+	}
+
+	wo := WriterOptions{
+		Key:            opt.Key,
+		EncryptOffsets: (rd.flags & flagEncOffsets) > 0,
+		KeysOnly:       (rd.flags & flagKeysOnly) > 0,
+		PrefixCompress: (rd.flags & flagPrefix) > 0,
+		DedupValues:    (rd.flags & flagValRef) > 0,
+		SplitValues:    (rd.flags & flagSplit) > 0,
+		Compress:       (rd.flags & flagCompressed) > 0,
+		Fingerprints:   (rd.flags & flagFingerprint) > 0,
+		CompactOffsets: (rd.flags & flagCompactOffsets) > 0,
+		StdlibHash:     opt.StdlibHash || (rd.flags&flagStdHash) > 0,
+		KeyHash:        opt.KeyHash,
+		RecordAlign:    int(rd.align),
+		SegmentSize:    int(rd.segSize()),
+		Gamma:          opt.Gamma,
+		SigningKey:     opt.SigningKey,
+		Logger:         opt.Logger,
+
+		KeyNormalizerName: rd.normName,
+	}
+
+	if wo.KeyHash == KeyHashDefault && (rd.flags&flagXXH3) > 0 {
+		wo.KeyHash = KeyHashXXH3
+	}
+
+	// keep the size of the Bloom filter
+	if b := rd.bloom; b != nil && rd.nkeys > 0 {
+		bits := uint64(len(b.v)) * 64 / rd.nkeys
+		if bits < 1 {
+			bits = 1
+		}
+		if bits > 64 {
+			bits = 64
+		}
+		wo.BloomBits = int(bits)
+	}
+
+	if st, err := rd.fd.Stat(); err == nil {
+		wo.Perm = st.Mode().Perm()
+	}
+
+	if rd.sig != nil && opt.SigningKey == nil {
+		logf(opt.Logger, "%s: no signing key; the migrated DB isn't signed", src)
+	}
+
+	w, err := NewDBWriterWithOptions(dst, wo)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.AddAll(rd); err == nil {
+		if err = w.SetMetadata(rd.Metadata()); err == nil {
+			err = w.Freeze(0)
+		}
+	}
+
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	logf(opt.Logger, "%s: migrated version %d DB to version %d in %s", src, rd.version, FormatVersion, dst)
+	return nil
+}
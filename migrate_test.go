@@ -0,0 +1,119 @@
+// migrate_test.go -- test suite for format versions and migration
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// set the format version in the header of the DB in 'fn' to 'v' and fix up
+// its checksum; version 1 DBs have no version in the header.
+func setVersion(t *testing.T, fn string, v uint8) {
+	assert := newAsserter(t)
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	if v == 1 {
+		v = 0
+	}
+	b[4] = v
+
+	fixChecksum(b)
+
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+}
+
+// recompute the checksum in the trailer of the DB in 'b'
+func fixChecksum(b []byte) {
+	flags := binary.BigEndian.Uint32(b[4:8])
+	offtbl := binary.BigEndian.Uint64(b[24:32])
+	h := newDigest((flags&flagChunkSum) > 0, b[:64])
+	h.Write(b[offtbl : len(b)-32])
+	copy(b[len(b)-32:], h.Sum(nil))
+}
+
+func TestMigrate(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("/a/common/prefix/%d", i))
+		vals[i] = []byte(fmt.Sprintf("value %d", i%50))
+	}
+
+	key := []byte("0123456789abcdef")
+	for _, tc := range []struct {
+		wo WriterOptions
+		mo MigrateOptions
+	}{
+		{WriterOptions{PrefixCompress: true, DedupValues: true, BloomBits: 10, Fingerprints: true, KeyHash: KeyHashXXH3}, MigrateOptions{}},
+		{WriterOptions{SplitValues: true, RecordAlign: 512}, MigrateOptions{KeyHash: KeyHashXXH3}},
+		{WriterOptions{Key: key, EncryptOffsets: true}, MigrateOptions{Key: key, StdlibHash: true}},
+	} {
+		wr, err := NewDBWriterWithOptions(fn, tc.wo)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+		err = wr.SetMetadata([]byte("schema 7"))
+		assert(err == nil, "can't set metadata: %s", err)
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		setVersion(t, fn, 1)
+
+		rd, err := NewEncryptedDBReader(fn, 10, tc.wo.Key)
+		assert(err == nil, "read failed: %s", err)
+		assert(rd.Version() == 1, "exp version 1, saw %d", rd.Version())
+		assert(rd.Info().Version == 1, "exp info version 1, saw %d", rd.Info().Version)
+		flags, salt := rd.flags, rd.salt
+		rd.Close()
+
+		err = MigrateWithOptions(fn, fn, tc.mo)
+		assert(err == nil, "migrate failed: %s", err)
+
+		rd, err = NewEncryptedDBReader(fn, 10, tc.wo.Key)
+		assert(err == nil, "read of migrated db failed: %s", err)
+		assert(rd.Version() == FormatVersion, "exp version %d, saw %d", FormatVersion, rd.Version())
+		assert(rd.salt != salt, "salt wasn't changed")
+		assert(string(rd.Metadata()) == "schema 7", "metadata mismatch: %q", rd.Metadata())
+		assert(rd.align == uint64(tc.wo.RecordAlign), "exp alignment %d, saw %d", tc.wo.RecordAlign, rd.align)
+
+		exp := flags
+		if tc.mo.StdlibHash {
+			exp |= flagStdHash
+		}
+		if tc.mo.KeyHash == KeyHashXXH3 {
+			exp |= flagXXH3
+		}
+		assert(rd.flags == exp, "exp flags %#x, saw %#x", exp, rd.flags)
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch", k)
+		}
+
+		err = rd.VerifyAll()
+		assert(err == nil, "verify failed: %s", err)
+		rd.Close()
+	}
+
+	err := Migrate(fn, fn)
+	assert(err != nil, "migrated an encrypted db without its key")
+
+	setVersion(t, fn, FormatVersion+1)
+	_, err = NewDBReader(fn, 10)
+	assert(err != nil, "opened a db with a future format version")
+}
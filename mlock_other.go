@@ -0,0 +1,22 @@
+// mlock_other.go -- platforms without mlock
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package bbhash
+
+import (
+	"errors"
+)
+
+var errNoMlock = errors.New("mlock is not supported on this platform")
+
+func mlock(b []byte) error {
+	return errNoMlock
+}
@@ -0,0 +1,21 @@
+// mlock_unix.go -- lock mapped regions in memory
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build darwin || linux
+// +build darwin linux
+
+package bbhash
+
+import (
+	"syscall"
+)
+
+// lock the mapped region 'b' in memory; it is unlocked when it is unmapped.
+func mlock(b []byte) error {
+	return syscall.Mlock(b)
+}
@@ -9,44 +9,75 @@
 package bbhash
 
 import (
-	"reflect"
-	"syscall"
+	"errors"
+	"fmt"
+	"math"
+	"os"
 	"unsafe"
 )
 
-// map 'n' uint64s at offset 'off'
-func mmapUint64(fd int, off uint64, n int, prot, flags int) ([]uint64, error) {
-	sz := n * 8
+// The platform specific parts are in mmap_unix.go, mmap_windows.go and
+// mmap_other.go:
+//   - mmapRegion() maps 'sz' bytes at offset 'off' of a file read-only;
+//     'off' must be a multiple of mmapAlign().
+//   - munmap() unmaps a region mapped by mmapRegion().
+//
+// Callers fall back to reading the file when mapping fails; on platforms
+// without mmap, mmapRegion() always fails with errNoMmap.
 
-	// XXX Will this grow the file if needed?
-	ba, err := syscall.Mmap(fd, int64(off), sz, prot, flags)
-	if err != nil {
-		return nil, err
-	}
+// max size of a slice; this is bounded by the address space (e.g., 2GB on
+// 32-bit platforms).
+const maxInt = int(^uint(0) >> 1)
 
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&ba))
-	var v []uint64
+var errNoMmap = errors.New("mmap is not supported on this platform")
 
-	// XXX Will addr get garbage collected? It shouldn't!
-	sh := (*reflect.SliceHeader)(unsafe.Pointer(&v))
-	sh.Data = bh.Data
-	sh.Len = n
-	sh.Cap = n
+// map 'n' uint64s at offset 'off'; 'off' need not be page aligned. The
+// offset may be beyond 4GB even on 32-bit platforms; but the mapping must
+// fit in the address space. Returns the uint64 slice and the underlying
+// mapping; the latter must be passed to munmap() when the caller is done.
+func mmapUint64(fd *os.File, off uint64, n uint64) ([]uint64, []byte, error) {
+	align := mmapAlign()
+	start := off &^ (align - 1)
+	adj := off - start
 
-	return v, nil
-}
+	if n == 0 || start > math.MaxInt64 || n > uint64(maxInt)/8 || n*8 > uint64(maxInt)-adj {
+		return nil, nil, fmt.Errorf("can't map %d uint64s at off %d", n, off)
+	}
+
+	ba, err := mmapRegion(fd, int64(start), int(n*8+adj))
+	if err != nil {
+		return nil, nil, err
+	}
 
+	// the mapping isn't managed by the GC; it stays valid until it is
+	// unmapped.
+	v := unsafe.Slice((*uint64)(unsafe.Pointer(&ba[adj])), int(n))
+	return v, ba, nil
+}
 
-// unmap a previously mapped u64 array
-func munmapUint64(fd int, v []uint64) error {
-	var a []byte
+// map 'sz' bytes at offset 'off' like mmapUint64(); returns the bytes and
+// the underlying mapping.
+func mmapBytes(fd *os.File, off uint64, sz uint64) ([]byte, []byte, error) {
+	align := mmapAlign()
+	start := off &^ (align - 1)
+	adj := off - start
 
-	vh := (*reflect.SliceHeader)(unsafe.Pointer(&v))
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&a))
+	if sz == 0 || start > math.MaxInt64 || sz > uint64(maxInt)-adj {
+		return nil, nil, fmt.Errorf("can't map %d bytes at off %d", sz, off)
+	}
 
-	bh.Data = vh.Data
-	bh.Len = vh.Len * 8
-	bh.Cap = bh.Len
+	ba, err := mmapRegion(fd, int64(start), int(sz+adj))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ba[adj : adj+sz : adj+sz], ba, nil
+}
 
-	return syscall.Munmap(a)
+// map the first 'sz' bytes of the file read-only; it is an error if they
+// don't fit in the address space.
+func mmapFile(fd *os.File, sz int64) ([]byte, error) {
+	if sz <= 0 || int64(int(sz)) != sz {
+		return nil, fmt.Errorf("can't map %d bytes", sz)
+	}
+	return mmapRegion(fd, 0, int(sz))
 }
@@ -0,0 +1,29 @@
+// mmap_other.go -- platforms without mmap
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package bbhash
+
+import (
+	"os"
+)
+
+func mmapAlign() uint64 {
+	return uint64(os.Getpagesize())
+}
+
+// the offset table and records are read from the file instead
+func mmapRegion(fd *os.File, off int64, sz int) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func munmap(b []byte) error {
+	return errNoMmap
+}
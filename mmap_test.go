@@ -0,0 +1,105 @@
+// mmap_test.go -- test suite for the mmap helpers
+
+package bbhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMmapUint64(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mmap%d.dat", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	// an unaligned table of uint64s past the first mapping boundary
+	const off = 70001
+	const n = 1000
+
+	b := make([]byte, off+n*8)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(b[off+i*8:], uint64(i*i))
+	}
+
+	err := ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write %s: %s", fn, err)
+
+	fd, err := os.Open(fn)
+	assert(err == nil, "can't open %s: %s", fn, err)
+	defer fd.Close()
+
+	v, m, err := mmapUint64(fd, off, n)
+	assert(err == nil, "can't map: %s", err)
+	assert(len(v) == n && cap(v) == n, "exp %d uint64s, saw %d", n, len(v))
+	for i := range v {
+		x := toLittleEndianUint64(v[i])
+		assert(x == uint64(i*i), "%d: exp %d, saw %d", i, i*i, x)
+	}
+
+	err = munmap(m)
+	assert(err == nil, "can't unmap: %s", err)
+
+	_, _, err = mmapUint64(fd, off, 0)
+	assert(err != nil, "mapped 0 uint64s")
+
+	_, _, err = mmapUint64(fd, off, uint64(maxInt)/8)
+	assert(err != nil, "mapped more than the address space")
+
+	_, _, err = mmapUint64(fd, 1<<63, 1)
+	assert(err != nil, "mapped at a negative offset")
+
+	f, err := mmapFile(fd, int64(len(b)))
+	assert(err == nil, "can't map file: %s", err)
+	assert(len(f) == len(b), "exp %d bytes, saw %d", len(b), len(f))
+	munmap(f)
+}
+
+func TestAdvise(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{
+		Mode:   LoadMmap,
+		Advice: AdviceWillNeed,
+	})
+	assert(err == nil, "read failed: %s", err)
+
+	for _, a := range []Advice{AdviceRandom, AdviceSequential, AdviceNormal} {
+		err = rd.Advise(a)
+		assert(err == nil, "advise %d failed: %s", a, err)
+	}
+
+	// locking may be disallowed by the locked memory limit
+	if err = rd.LockOffsets(); err != nil && rd.mmap != nil {
+		t.Logf("can't lock offset table: %s", err)
+	}
+
+	for _, k := range keys {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+
+	rd.Close()
+	assert(rd.Advise(AdviceRandom) == ErrClosed, "advised closed db")
+	assert(rd.LockOffsets() == ErrClosed, "locked closed db")
+}
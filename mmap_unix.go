@@ -0,0 +1,32 @@
+// mmap_unix.go -- mmap for unix like systems
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package bbhash
+
+import (
+	"os"
+	"syscall"
+)
+
+// mappings start at page boundaries
+func mmapAlign() uint64 {
+	return uint64(os.Getpagesize())
+}
+
+// map 'sz' bytes at offset 'off' of 'fd' read-only
+func mmapRegion(fd *os.File, off int64, sz int) ([]byte, error) {
+	return syscall.Mmap(int(fd.Fd()), off, sz, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmap a previously mapped region
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
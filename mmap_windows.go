@@ -0,0 +1,50 @@
+// mmap_windows.go -- mmap for windows
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build windows
+// +build windows
+
+package bbhash
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// views of a file mapping start at multiples of the allocation
+// granularity - which is 64KB on all versions of windows.
+func mmapAlign() uint64 {
+	return 65536
+}
+
+// map 'sz' bytes at offset 'off' of 'fd' read-only
+func mmapRegion(fd *os.File, off int64, sz int) ([]byte, error) {
+	h, err := syscall.CreateFileMapping(syscall.Handle(fd.Fd()), nil, syscall.PAGE_READONLY, 0, 0, nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+
+	// the view holds a reference to the mapping
+	defer syscall.CloseHandle(h)
+
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, uint32(off>>32), uint32(off), uintptr(sz))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+
+	// 'addr' is outside the Go heap; convert it without tripping vet
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	return unsafe.Slice((*byte)(p), sz), nil
+}
+
+// unmap a previously mapped region
+func munmap(b []byte) error {
+	addr := uintptr(unsafe.Pointer(&b[0]))
+	return os.NewSyscallError("UnmapViewOfFile", syscall.UnmapViewOfFile(addr))
+}
@@ -0,0 +1,183 @@
+// mphmap.go -- a read-only in-memory map built on BBHash
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+// MPHKey is the set of key types of an MPHMap: strings and integers
+type MPHKey interface {
+	~string | ~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// MPHMap is a read-only map from keys to values: it is built once from a
+// map or a list of pairs and answers lookups from a minimal perfect hash of
+// the keys and a dense slice of values. The keys themselves aren't stored;
+// a 32-bit fingerprint of each key rejects all but 1 in 2^32 lookups of
+// keys that aren't in the map. Lookups don't allocate. An MPHMap is safe
+// for concurrent use.
+type MPHMap[K MPHKey, V any] struct {
+	fpTable
+	kind reflect.Kind
+
+	// value of the key in each slot of the MPH
+	vals []V
+}
+
+// NewMPHMap returns a read-only copy of 'm'
+func NewMPHMap[K MPHKey, V any](m map[K]V) (*MPHMap[K, V], error) {
+	keys := make([]K, 0, len(m))
+	vals := make([]V, 0, len(m))
+	for k, v := range m {
+		keys = append(keys, k)
+		vals = append(vals, v)
+	}
+	return newMPHMap(keys, vals)
+}
+
+// NewMPHMapFromPairs returns a read-only map of 'keys[i]' to 'vals[i]'; if
+// a key is repeated, its first value wins.
+func NewMPHMapFromPairs[K MPHKey, V any](keys []K, vals []V) (*MPHMap[K, V], error) {
+	if len(keys) != len(vals) {
+		return nil, fmt.Errorf("bbhash: %d keys and %d values", len(keys), len(vals))
+	}
+	return newMPHMap(keys, vals)
+}
+
+func newMPHMap[K MPHKey, V any](keys []K, vals []V) (*MPHMap[K, V], error) {
+	kind := reflect.TypeOf((*K)(nil)).Elem().Kind()
+
+	m := &MPHMap[K, V]{
+		kind: kind,
+	}
+	m.std = !haveExtHash
+
+	hash := func(salt uint64, i int) uint64 {
+		return hashKey(kind, m.std, salt, keys[i])
+	}
+	eq := func(i, j int) bool {
+		return keys[i] == keys[j]
+	}
+
+	uniq, slots, err := m.build(len(keys), hash, eq)
+	if err != nil {
+		return nil, err
+	}
+
+	m.vals = make([]V, len(uniq))
+	for j, i := range uniq {
+		m.vals[slots[j]] = vals[i]
+	}
+	return m, nil
+}
+
+// Len returns the number of keys in the map
+func (m *MPHMap[K, V]) Len() int {
+	return len(m.vals)
+}
+
+// Get returns the value of key 'k' and true if it is in the map; the zero
+// value and false otherwise.
+func (m *MPHMap[K, V]) Get(k K) (V, bool) {
+	i, ok := m.find(hashKey(m.kind, m.std, m.salt, k))
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return m.vals[i], true
+}
+
+// return the hash of key 'k' of kind 'kind' salted with 'salt'; integers
+// hash the same regardless of their size. 'std' selects the standard
+// library hash for strings.
+func hashKey[K MPHKey](kind reflect.Kind, std bool, salt uint64, k K) uint64 {
+	p := unsafe.Pointer(&k)
+
+	var v uint64
+	switch kind {
+	case reflect.String:
+		return hashBytes(std, salt, stringBytes(*(*string)(p)))
+	case reflect.Int:
+		v = uint64(*(*int)(p))
+	case reflect.Int8:
+		v = uint64(*(*int8)(p))
+	case reflect.Int16:
+		v = uint64(*(*int16)(p))
+	case reflect.Int32:
+		v = uint64(*(*int32)(p))
+	case reflect.Int64:
+		v = uint64(*(*int64)(p))
+	case reflect.Uint:
+		v = uint64(*(*uint)(p))
+	case reflect.Uint8:
+		v = uint64(*(*uint8)(p))
+	case reflect.Uint16:
+		v = uint64(*(*uint16)(p))
+	case reflect.Uint32:
+		v = uint64(*(*uint32)(p))
+	case reflect.Uint64:
+		v = *(*uint64)(p)
+	case reflect.Uintptr:
+		v = uint64(*(*uintptr)(p))
+	}
+	return hash(v, salt, 0)
+}
+
+// MarshalBinary encodes the map into a binary form suitable for durable
+// storage; UnmarshalMPHMap() reconstructs it. The values are encoded with
+// encoding/gob; so they must be types that gob can encode.
+//
+// The encoding is little-endian:
+//   - magic  "MPHM"
+//   - kind   uint32 the reflect.Kind of the keys; the top bit is set if
+//     the keys are hashed with the standard library hash (in a
+//     bbhash_stdlib build)
+//   - salt   uint64
+//   - n      uint64 number of keys
+//   - fps    []uint32 fingerprints in MPH order
+//   - the marshaled BBHash (if n > 0)
+//   - the gob encoding of the values in MPH order
+func (m *MPHMap[K, V]) MarshalBinary(w io.Writer) error {
+	if err := m.marshal(w, "MPHM", uint32(m.kind)); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(m.vals)
+}
+
+// UnmarshalMPHMap reads a map marshaled by MPHMap.MarshalBinary() from 'r';
+// the key and value types must be those of the marshaled map.
+func UnmarshalMPHMap[K MPHKey, V any](r io.Reader) (*MPHMap[K, V], error) {
+	m := &MPHMap[K, V]{
+		kind: reflect.TypeOf((*K)(nil)).Elem().Kind(),
+	}
+
+	tag, err := m.unmarshal(r, "MPHM", "MPHMap")
+	if err != nil {
+		return nil, err
+	}
+
+	if k := reflect.Kind(tag); k != m.kind {
+		return nil, fmt.Errorf("bbhash: MPHMap keys are %s; exp %s", k, m.kind)
+	}
+
+	if err := gob.NewDecoder(r).Decode(&m.vals); err != nil {
+		return nil, fmt.Errorf("bbhash: can't decode MPHMap values: %w", err)
+	}
+
+	if n := len(m.fps); len(m.vals) != n {
+		return nil, fmt.Errorf("bbhash: %w: MPHMap has %d values; exp %d", ErrCorrupt, len(m.vals), n)
+	}
+	return m, nil
+}
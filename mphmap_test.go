@@ -0,0 +1,93 @@
+// mphmap_test.go -- test suite for MPHMap
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+type hostname string
+
+func TestMPHMap(t *testing.T) {
+	assert := newAsserter(t)
+
+	m := make(map[hostname]int)
+	for i := 0; i < 1000; i++ {
+		m[hostname(fmt.Sprintf("host-%d.example.com", i))] = i
+	}
+
+	mm, err := NewMPHMap(m)
+	assert(err == nil, "can't build map: %s", err)
+	assert(mm.Len() == len(m), "len mismatch: exp %d, saw %d", len(m), mm.Len())
+
+	for k, v := range m {
+		x, ok := mm.Get(k)
+		assert(ok, "can't find %s", k)
+		assert(x == v, "%s: exp %d, saw %d", k, v, x)
+	}
+
+	_, ok := mm.Get("nonexistent.example.com")
+	assert(!ok, "found absent key")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		mm.Get("host-10.example.com")
+	})
+	assert(allocs == 0, "Get allocates: %v", allocs)
+
+	var b bytes.Buffer
+	err = mm.MarshalBinary(&b)
+	assert(err == nil, "can't marshal: %s", err)
+
+	_, err = UnmarshalMPHMap[int, int](bytes.NewReader(b.Bytes()))
+	assert(err != nil, "unmarshaled string keys as ints")
+
+	um, err := UnmarshalMPHMap[hostname, int](&b)
+	assert(err == nil, "can't unmarshal: %s", err)
+	assert(um.Len() == len(m), "unmarshaled len mismatch: exp %d, saw %d", len(m), um.Len())
+	for k, v := range m {
+		x, ok := um.Get(k)
+		assert(ok && x == v, "unmarshaled %s: exp %d, saw %d", k, v, x)
+	}
+}
+
+func TestMPHMapPairs(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := []int16{-3, 7, 0, -3, 1000, 7}
+	vals := []string{"a", "b", "c", "d", "e", "f"}
+
+	_, err := NewMPHMapFromPairs(keys, vals[:2])
+	assert(err != nil, "built map with mismatched pairs")
+
+	mm, err := NewMPHMapFromPairs(keys, vals)
+	assert(err == nil, "can't build map: %s", err)
+	assert(mm.Len() == 4, "len mismatch: exp 4, saw %d", mm.Len())
+
+	exp := map[int16]string{-3: "a", 7: "b", 0: "c", 1000: "e"}
+	for k, v := range exp {
+		x, ok := mm.Get(k)
+		assert(ok && x == v, "key %d: exp %s, saw %s", k, v, x)
+	}
+
+	_, ok := mm.Get(-4)
+	assert(!ok, "found absent key")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		mm.Get(1000)
+	})
+	assert(allocs == 0, "Get allocates: %v", allocs)
+
+	empty, err := NewMPHMap(map[uint64][]byte{})
+	assert(err == nil, "can't build empty map: %s", err)
+	_, ok = empty.Get(1)
+	assert(!ok, "found key in empty map")
+
+	var b bytes.Buffer
+	err = empty.MarshalBinary(&b)
+	assert(err == nil, "can't marshal empty map: %s", err)
+	empty, err = UnmarshalMPHMap[uint64, []byte](&b)
+	assert(err == nil, "can't unmarshal empty map: %s", err)
+	assert(empty.Len() == 0, "empty map has %d keys", empty.Len())
+}
@@ -0,0 +1,173 @@
+// multi.go -- layering several DBs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+)
+
+// MultiReader answers queries from a stack of DBs - e.g., a base DB and
+// the DBs of the daily changes on top of it. Lookups consult the DBs front
+// to back; the first DB that has a key - or deleted it - answers for it.
+// Unlike a DeltaReader, the DBs are independent: any DB can be layered on
+// any other. So new records can be published as a small DB without
+// rebuilding the others. A MultiReader is safe for concurrent use.
+type MultiReader struct {
+	dbs []*DBReader
+}
+
+// NewMultiReader layers the DBs in 'dbs': dbs[0] is on top. The MultiReader
+// owns the DBs; MultiReader.Close() closes them.
+func NewMultiReader(dbs ...*DBReader) (*MultiReader, error) {
+	if len(dbs) == 0 {
+		return nil, errors.New("multi reader needs at least one DB")
+	}
+	if err := sameNormalizer(dbs...); err != nil {
+		return nil, err
+	}
+
+	m := &MultiReader{
+		dbs: append([]*DBReader{}, dbs...),
+	}
+	return m, nil
+}
+
+// find the record for 'key' in namespace 'ns' in the first DB that has it;
+// a DB that deleted the key (see DBWriter.DeleteKeys()) hides it.
+func (m *MultiReader) find(ns uint8, key []byte, wantVal bool) (*record, error) {
+	key = m.dbs[0].normKey(key)
+	for _, rd := range m.dbs {
+		r, err := rd.findLayer(ns, key, wantVal)
+		if err == nil && bytes.Equal(r.key, key) {
+			return r, nil
+		}
+		if err == errDeleted {
+			return nil, ErrNoKey
+		}
+		if err != nil && err != ErrNoKey {
+			return nil, err
+		}
+	}
+	return nil, ErrNoKey
+}
+
+// Find looks up 'key' in the DBs front to back; it returns the value of
+// the first DB that has it.
+func (m *MultiReader) Find(key []byte) ([]byte, error) {
+	r, err := m.find(0, key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.val, nil
+}
+
+// FindWithFlags is like Find except it also returns the application flags
+// of the record; see DBReader.FindWithFlags().
+func (m *MultiReader) FindWithFlags(key []byte) ([]byte, byte, error) {
+	r, err := m.find(0, key, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r.val, r.appflags, nil
+}
+
+// FindIn is like Find except 'key' is looked up in namespace 'ns'; see
+// DBReader.FindIn().
+func (m *MultiReader) FindIn(ns uint8, key []byte) ([]byte, error) {
+	r, err := m.find(ns, key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.val, nil
+}
+
+// GetRecord is like Find except it returns the full record; see
+// DBReader.GetRecord().
+func (m *MultiReader) GetRecord(key []byte) (*Record, error) {
+	r, err := m.find(0, key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.export(), nil
+}
+
+// Lookup looks up 'key' like Find. If the key is not found, value is nil
+// and returns false.
+func (m *MultiReader) Lookup(key []byte) ([]byte, bool) {
+	v, err := m.Find(key)
+	if err != nil {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// Contains returns true if 'key' is in any of the DBs
+func (m *MultiReader) Contains(key []byte) bool {
+	ok, _ := m.Exists(key)
+	return ok
+}
+
+// Exists is like Contains except it returns the error of a DB that can't
+// be read; see DBReader.Exists().
+func (m *MultiReader) Exists(key []byte) (bool, error) {
+	_, err := m.find(0, key, false)
+	if err == ErrNoKey {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Iter returns an iterator over the records of all the DBs - DB by DB,
+// front to back. A record is skipped if its key is in a DB above it; so
+// every key is visited once with the value that Find() returns.
+func (m *MultiReader) Iter() *Iterator {
+	it := newIterator(m.dbs)
+	it.merge = true
+	return it
+}
+
+// Range calls 'fp' for every record in the order of Iter(); iteration
+// stops when 'fp' returns false.
+func (m *MultiReader) Range(fp func(key, val []byte) bool) error {
+	return rangeIter(m.Iter(), fp)
+}
+
+// Keys calls 'fp' for every key in the order of Iter(); iteration stops
+// when 'fp' returns false. See DBReader.Keys().
+func (m *MultiReader) Keys(fp func(key []byte) bool) error {
+	return keysIter(m.Iter(), fp)
+}
+
+// IgnoreExpiry controls whether lookups return expired records; see
+// DBReader.IgnoreExpiry().
+func (m *MultiReader) IgnoreExpiry(ignore bool) {
+	for _, rd := range m.dbs {
+		rd.IgnoreExpiry(ignore)
+	}
+}
+
+// Close closes all the DBs and returns the first error
+func (m *MultiReader) Close() error {
+	var err error
+	for _, rd := range m.dbs {
+		if e := rd.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
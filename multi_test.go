@@ -0,0 +1,101 @@
+// multi_test.go -- test suite for layered DBs
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMultiReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	_, err := NewMultiReader()
+	assert(err != nil, "created an empty multi reader")
+
+	// layers of keys [lo, hi) with values "name-i"
+	layers := []struct {
+		name   string
+		lo, hi int
+	}{
+		{"d2", 90, 100},
+		{"d1", 50, 150},
+		{"base", 0, 100},
+	}
+
+	var dbs []*DBReader
+	for _, l := range layers {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriter(fn)
+		assert(err == nil, "can't create db: %s", err)
+		for i := l.lo; i < l.hi; i++ {
+			k := []byte(fmt.Sprintf("key-%d", i))
+			v := []byte(fmt.Sprintf("%s-%d", l.name, i))
+			_, err = wr.AddKeyVals([][]byte{k}, [][]byte{v})
+			assert(err == nil, "can't add key-val: %s", err)
+		}
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+		dbs = append(dbs, rd)
+	}
+
+	m, err := NewMultiReader(dbs...)
+	assert(err == nil, "can't create multi reader: %s", err)
+	defer m.Close()
+
+	// return the expected value of key 'i'
+	expect := func(i int) string {
+		for _, l := range layers {
+			if i >= l.lo && i < l.hi {
+				return fmt.Sprintf("%s-%d", l.name, i)
+			}
+		}
+		return ""
+	}
+
+	for i := 0; i < 160; i++ {
+		k := []byte(fmt.Sprintf("key-%d", i))
+		exp := expect(i)
+
+		v, err := m.Find(k)
+		if exp == "" {
+			assert(err == ErrNoKey, "key %s: found %s", k, v)
+			assert(!m.Contains(k), "key %s: contains", k)
+			continue
+		}
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(v) == exp, "key %s: exp %s, saw %s", k, exp, v)
+		assert(m.Contains(k), "key %s: not contained", k)
+
+		r, err := m.GetRecord(k)
+		assert(err == nil, "can't get record %s: %s", k, err)
+		assert(string(r.Value) == exp, "key %s: record value %s", k, r.Value)
+	}
+
+	seen := make(map[string]bool)
+	err = m.Range(func(k, v []byte) bool {
+		assert(!seen[string(k)], "key %s: visited twice", k)
+		seen[string(k)] = true
+
+		var i int
+		fmt.Sscanf(string(k), "key-%d", &i)
+		assert(string(v) == expect(i), "key %s: exp %s, saw %s", k, expect(i), v)
+		return true
+	})
+	assert(err == nil, "range failed: %s", err)
+	assert(len(seen) == 150, "visited %d keys; exp 150", len(seen))
+
+	n := 0
+	err = m.Keys(func(k []byte) bool {
+		n++
+		return true
+	})
+	assert(err == nil, "keys failed: %s", err)
+	assert(n == 150, "visited %d keys; exp 150", n)
+}
@@ -0,0 +1,123 @@
+// normalize.go -- normalization of keys before they are hashed
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A key normalizer transforms every key added to a DB - e.g., lowercases or
+// trims it - before it is hashed and stored (see
+// WriterOptions.KeyNormalizer). Its name is recorded in the DB; readers
+// look the name up in the registry of normalizers and apply the same
+// transform to the keys they look up. So the lookups of "Foo " and "foo"
+// find the record of "foo" in a DB built with "lower,trim".
+//
+// A normalizer must be idempotent - normalizing a normalized key returns
+// it unchanged - and safe for concurrent use; it must not modify its
+// argument.
+
+// ErrKeyNormalizer is returned when a DB names a key normalizer that isn't
+// registered; see RegisterKeyNormalizer().
+var ErrKeyNormalizer = errors.New("unknown key normalizer")
+
+var keyNorms = struct {
+	sync.RWMutex
+	m map[string]func([]byte) []byte
+}{
+	m: map[string]func([]byte) []byte{
+		"lower": bytes.ToLower,
+		"trim":  bytes.TrimSpace,
+	},
+}
+
+// RegisterKeyNormalizer makes the key normalizer 'fn' available by 'name'
+// to writers (WriterOptions.KeyNormalizerName) and to readers of DBs built
+// with it. "lower" (Unicode lower case) and "trim" (strip leading and
+// trailing white space) are built in. It panics if 'name' is empty, has a
+// comma or is already registered. A program that reads a DB built with a
+// normalizer of its own must register it before opening the DB.
+func RegisterKeyNormalizer(name string, fn func([]byte) []byte) {
+	if len(name) == 0 || strings.Contains(name, ",") || fn == nil {
+		panic(fmt.Sprintf("bbhash: invalid key normalizer %q", name))
+	}
+
+	keyNorms.Lock()
+	defer keyNorms.Unlock()
+
+	if _, ok := keyNorms.m[name]; ok {
+		panic(fmt.Sprintf("bbhash: key normalizer %q is already registered", name))
+	}
+	keyNorms.m[name] = fn
+}
+
+// return the normalizer named by 'name': a comma separated list of
+// registered normalizers that are applied in order.
+func keyNormalizer(name string) (func([]byte) []byte, error) {
+	keyNorms.RLock()
+	defer keyNorms.RUnlock()
+
+	var fns []func([]byte) []byte
+	for _, nm := range strings.Split(name, ",") {
+		fn, ok := keyNorms.m[nm]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrKeyNormalizer, nm)
+		}
+		fns = append(fns, fn)
+	}
+
+	if len(fns) == 1 {
+		return fns[0], nil
+	}
+
+	norm := func(key []byte) []byte {
+		for _, fn := range fns {
+			key = fn(key)
+		}
+		return key
+	}
+	return norm, nil
+}
+
+// KeyNormalizer returns the name of the key normalizer of the DB; or the
+// empty string if its keys aren't normalized.
+func (rd *DBReader) KeyNormalizer() string {
+	return rd.normName
+}
+
+// return the normalized form of 'key'
+func (rd *DBReader) normKey(key []byte) []byte {
+	if rd.knorm == nil {
+		return key
+	}
+	return rd.knorm(key)
+}
+
+// return the normalized form of 'key'
+func (w *DBWriter) normKey(key []byte) []byte {
+	if w.knorm == nil {
+		return key
+	}
+	return w.knorm(key)
+}
+
+// return an error if the DBs in 'dbs' don't normalize keys the same way;
+// layered DBs normalize a key once - with the normalizer of the first.
+func sameNormalizer(dbs ...*DBReader) error {
+	for _, rd := range dbs[1:] {
+		if rd.normName != dbs[0].normName {
+			return fmt.Errorf("%s: key normalizer %q differs from %q of %s", rd.fn, rd.normName, dbs[0].normName, dbs[0].fn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// normalize_test.go -- test suite for key normalizers
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func init() {
+	RegisterKeyNormalizer("test-dehyphen", func(k []byte) []byte {
+		return bytes.ReplaceAll(k, []byte("-"), nil)
+	})
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{KeyNormalizerName: "trim,lower,test-dehyphen"})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := [][]byte{[]byte(" Foo"), []byte("BAR-1 "), []byte("foo"), []byte("baz")}
+	vals := [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")}
+	n, err := wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+	assert(n == 3, "exp 3 records, saw %d", n)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.KeyNormalizer() == "trim,lower,test-dehyphen", "normalizer: saw %q", rd.KeyNormalizer())
+
+	exp := map[string]string{
+		"FOO":    "1",
+		"foo  ":  "1",
+		"bar1":   "2",
+		"Bar-1":  "2",
+		" BAZ\t": "4",
+	}
+	for k, v := range exp {
+		x, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find %q: %s", k, err)
+		assert(string(x) == v, "%q: exp %q, saw %q", k, v, x)
+		assert(rd.Contains([]byte(k)), "%q: not contained", k)
+		_, ok := rd.Index([]byte(k))
+		assert(ok, "%q: no index", k)
+	}
+
+	r, err := rd.GetRecord([]byte("-BAR-1-"))
+	assert(err == nil, "can't get record: %s", err)
+	assert(string(r.Key) == "bar1", "stored key: saw %q", r.Key)
+
+	vs, errs := rd.FindMany([][]byte{[]byte("Foo"), []byte("BAZ"), []byte("nope")})
+	assert(errs[0] == nil && string(vs[0]) == "1", "batch: foo: %v %q", errs[0], vs[0])
+	assert(errs[1] == nil && string(vs[1]) == "4", "batch: baz: %v %q", errs[1], vs[1])
+	assert(errs[2] == ErrNoKey, "batch: absent key: %v", errs[2])
+
+	// changes on top of the DB are normalized too
+	o := NewOverlayDB(rd)
+	o.Set([]byte("NEW"), []byte("5"))
+	o.Delete([]byte(" BAZ"))
+	v, err := o.Find([]byte("new "))
+	assert(err == nil && string(v) == "5", "overlay: new: %v %q", err, v)
+	assert(!o.Contains([]byte("baz")), "overlay: deleted key found")
+
+	// a normalizer must be named
+	_, err = NewDBWriterWithOptions(fn+".x", WriterOptions{KeyNormalizer: bytes.ToUpper})
+	assert(err != nil, "unnamed normalizer: no error")
+
+	_, err = NewDBWriterWithOptions(fn+".x", WriterOptions{KeyNormalizerName: "no-such"})
+	assert(errors.Is(err, ErrKeyNormalizer), "unknown normalizer: %v", err)
+}
+
+func TestKeyNormalizerUnregistered(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	opt := WriterOptions{
+		KeyNormalizer:     bytes.ToUpper,
+		KeyNormalizerName: "test-upper",
+	}
+	wr, err := NewDBWriterWithOptions(fn, opt)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals([][]byte{[]byte("abc")}, [][]byte{[]byte("1")})
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// readers can't look up keys without the normalizer
+	_, err = NewDBReader(fn, 10)
+	assert(errors.Is(err, ErrKeyNormalizer), "unregistered normalizer: %v", err)
+}
+
+func TestKeyNormalizerSharded(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer func() {
+		os.Remove(fn)
+		for i := 0; i < 4; i++ {
+			os.Remove(shardName(fn, i))
+		}
+	}()
+
+	wr, err := NewShardedDBWriter(fn, 4, WriterOptions{KeyNormalizerName: "lower"})
+	assert(err == nil, "can't create db: %s", err)
+
+	var keys, vals [][]byte
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("Key-%d", i)))
+		vals = append(vals, []byte(fmt.Sprintf("%d", i)))
+	}
+	keys = append(keys, []byte("KEY-0"))
+	vals = append(vals, []byte("dup"))
+
+	n, err := wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+	assert(n == 100, "exp 100 records, saw %d", n)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewShardedDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("KEY-%d", i)
+		v, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find %s: %s", k, err)
+		assert(string(v) == fmt.Sprintf("%d", i), "%s: saw %q", k, v)
+	}
+}
@@ -0,0 +1,95 @@
+// offtable.go -- compact encoding of the offset table
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// In a DB built with WriterOptions.CompactOffsets, each entry of the
+// offset table is a little-endian offset of just enough bytes for the
+// largest offset - which is below the start of the offset table: 4 bytes
+// in DBs upto 4GB, 5 bytes upto 1TB and so on. The width isn't stored; the
+// reader derives it from the file offset of the table. The entries aren't
+// aligned; the table is mapped (or read) as bytes and each lookup decodes
+// one entry.
+
+// return the width of the entries of a compact offset table at 'offtbl';
+// zero if the offsets are too large for a compact table.
+func compactWidth(offtbl uint64) int {
+	w := (bits.Len64(offtbl-1) + 7) / 8
+	if w < 4 {
+		w = 4
+	}
+	if w > 7 {
+		return 0
+	}
+	return w
+}
+
+// return the size of the offset table of 'nkeys' entries at 'offtbl' in a
+// DB with the header flags 'flags'
+func offTableSize(flags uint32, nkeys, offtbl uint64) uint64 {
+	if (flags & flagCompactOffsets) > 0 {
+		return nkeys * uint64(compactWidth(offtbl))
+	}
+
+	n := nkeys * 8
+	if (flags & flagEncOffsets) > 0 {
+		n += gcmOverhead
+	}
+	return n
+}
+
+// encode 'o' as 'width' little-endian bytes into 'b'
+func putOffset(b []byte, o uint64, width int) {
+	for j := 0; j < width; j++ {
+		b[j] = byte(o >> (8 * j))
+	}
+}
+
+// return entry 'i' of the offset table
+func (rd *DBReader) entry(i uint64) uint64 {
+	if rd.ctab == nil {
+		return toLittleEndianUint64(rd.offsets[i])
+	}
+
+	w := uint64(rd.cwidth)
+	b := rd.ctab[i*w : i*w+w]
+
+	var o uint64
+	for j := len(b) - 1; j >= 0; j-- {
+		o = o<<8 | uint64(b[j])
+	}
+	return o
+}
+
+// map (or read) the compact offset table of 'nkeys' entries at 'offtbl'
+func (rd *DBReader) openCompact(offtbl, nkeys uint64) error {
+	rd.cwidth = compactWidth(offtbl)
+	sz := nkeys * uint64(rd.cwidth)
+	if sz > uint64(maxInt) {
+		return fmt.Errorf("%s: offset table of %d keys is too large for this platform", rd.fn, nkeys)
+	}
+
+	if rd.fd != nil && nkeys > 0 {
+		if b, m, err := mmapBytes(rd.fd, offtbl, sz); err == nil {
+			rd.ctab, rd.mmap = b, m
+			return nil
+		}
+	}
+
+	b := make([]byte, sz)
+	if _, err := rd.ra.ReadAt(b, int64(offtbl)); err != nil {
+		return fmt.Errorf("%s: can't read offset table: %w", rd.fn, err)
+	}
+	rd.ctab = b
+	return nil
+}
@@ -0,0 +1,98 @@
+// offtable_test.go -- test suite for compact offset tables
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestCompactWidth(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		offtbl uint64
+		width  int
+	}{
+		{4096, 4},
+		{1 << 32, 4},
+		{1<<32 + 4096, 5},
+		{1 << 40, 5},
+		{1<<40 + 4096, 6},
+		{1 << 56, 7},
+		{1<<56 + 4096, 0},
+	}
+
+	for _, tc := range tests {
+		w := compactWidth(tc.offtbl)
+		assert(w == tc.width, "%#x: exp width %d, saw %d", tc.offtbl, tc.width, w)
+	}
+}
+
+func TestCompactOffsets(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	for _, opt := range []WriterOptions{
+		{CompactOffsets: true, Fingerprints: true},
+		{CompactOffsets: true, Compress: true},
+		{CompactOffsets: true, Key: []byte("0123456789abcdef"), EncryptOffsets: true},
+	} {
+		_, err := NewDBWriterWithOptions(fn, opt)
+		assert(err != nil, "created a compact offset table with %+v", opt)
+	}
+
+	keys := make([][]byte, 2000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	var sizes []uint64
+	for _, opt := range []WriterOptions{
+		{},
+		{CompactOffsets: true},
+		{CompactOffsets: true, Key: []byte("0123456789abcdef")},
+		{CompactOffsets: true, SplitValues: true, BloomBits: 8},
+	} {
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, keys)
+		assert(err == nil, "can't add key-vals: %s", err)
+		err = wr.SetMetadata([]byte("meta"))
+		assert(err == nil, "can't set metadata: %s", err)
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		st := wr.Stats()
+		sizes = append(sizes, st.OffsetTblSize)
+
+		for _, m := range []LoadMode{LoadFile, LoadMmap, LoadMemory} {
+			rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, Key: opt.Key})
+			assert(err == nil, "read failed: %s", err)
+
+			assert((rd.ctab != nil) == opt.CompactOffsets, "compact table mismatch")
+			assert(rd.Info().OffsetTblSize == st.OffsetTblSize, "exp table size %d, saw %d", st.OffsetTblSize, rd.Info().OffsetTblSize)
+			assert(string(rd.Metadata()) == "meta", "metadata mismatch")
+
+			for _, k := range keys {
+				v, err := rd.Find(k)
+				assert(err == nil, "can't find key %s: %s", k, err)
+				assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+			}
+
+			_, err = rd.Find([]byte("absent"))
+			assert(err == ErrNoKey, "found absent key: %v", err)
+
+			err = rd.VerifyAll()
+			assert(err == nil, "verify failed: %s", err)
+			rd.Close()
+		}
+	}
+
+	assert(sizes[1] == sizes[0]/2, "exp compact table of %d bytes, saw %d", sizes[0]/2, sizes[1])
+}
@@ -0,0 +1,169 @@
+// overlay.go -- runtime changes on top of a DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"sort"
+	"sync"
+)
+
+// OverlayDB answers queries from a DB and an in-memory set of changes made
+// after it was built: keys that were added or overridden with Set() and
+// keys that were deleted with Delete(). It is a stopgap for a DB that is
+// mostly static but needs a few runtime patches; the changes can be
+// written to a delta DB with Flush() and folded into the next build. An
+// OverlayDB is safe for concurrent use.
+type OverlayDB struct {
+	rd *DBReader
+
+	mu sync.RWMutex
+	m  map[string]*overlayRec
+}
+
+// a change in an OverlayDB
+type overlayRec struct {
+	val     []byte
+	deleted bool
+}
+
+// NewOverlayDB returns an OverlayDB with no changes on top of 'rd'. The
+// OverlayDB owns 'rd'; OverlayDB.Close() closes it.
+func NewOverlayDB(rd *DBReader) *OverlayDB {
+	o := &OverlayDB{
+		rd: rd,
+		m:  make(map[string]*overlayRec),
+	}
+	return o
+}
+
+// Set adds 'key' with value 'val' - or overrides its value in the DB. The
+// key and value are copied; the key is normalized like the keys of the DB
+// (see WriterOptions.KeyNormalizer).
+func (o *OverlayDB) Set(key, val []byte) {
+	v := append([]byte{}, val...)
+	k := string(o.rd.normKey(key))
+
+	o.mu.Lock()
+	o.m[k] = &overlayRec{val: v}
+	o.mu.Unlock()
+}
+
+// Delete deletes 'key'; it is absent even if it is in the DB.
+func (o *OverlayDB) Delete(key []byte) {
+	k := string(o.rd.normKey(key))
+
+	o.mu.Lock()
+	o.m[k] = &overlayRec{deleted: true}
+	o.mu.Unlock()
+}
+
+// Find looks up 'key' in the changes and then in the DB; it returns the
+// corresponding value. The returned slice must not be modified.
+func (o *OverlayDB) Find(key []byte) ([]byte, error) {
+	key = o.rd.normKey(key)
+
+	o.mu.RLock()
+	x, ok := o.m[string(key)]
+	o.mu.RUnlock()
+
+	if ok {
+		if x.deleted {
+			return nil, ErrNoKey
+		}
+		return x.val, nil
+	}
+
+	return o.rd.Find(key)
+}
+
+// Lookup looks up 'key' like Find. If the key is not found, value is nil
+// and returns false.
+func (o *OverlayDB) Lookup(key []byte) ([]byte, bool) {
+	v, err := o.Find(key)
+	if err != nil {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// Contains returns true if 'key' was set or is in the DB - and isn't
+// deleted.
+func (o *OverlayDB) Contains(key []byte) bool {
+	key = o.rd.normKey(key)
+
+	o.mu.RLock()
+	x, ok := o.m[string(key)]
+	o.mu.RUnlock()
+
+	if ok {
+		return !x.deleted
+	}
+	return o.rd.Contains(key)
+}
+
+// Len returns the number of changes - keys set or deleted - on top of the DB
+func (o *OverlayDB) Len() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return len(o.m)
+}
+
+// Flush writes the changes to the delta DB 'fn' of the DB (see
+// WriterOptions.Base); 'opt.Base' is ignored. Set keys are written as
+// records unless the DB has the same record; deleted keys are written as
+// tombstones unless the DB doesn't have them (see DBWriter.DeleteKeys()).
+// The changes are kept: a DeltaReader of the DB and the delta DB answers
+// queries like the OverlayDB, and a later Flush() writes all the changes
+// again.
+func (o *OverlayDB) Flush(fn string, opt WriterOptions) error {
+	var keys, vals, dels [][]byte
+
+	o.mu.RLock()
+	names := make([]string, 0, len(o.m))
+	for k := range o.m {
+		names = append(names, k)
+	}
+
+	// the records are written in a stable order
+	sort.Strings(names)
+	for _, k := range names {
+		if x := o.m[k]; x.deleted {
+			dels = append(dels, []byte(k))
+		} else {
+			keys = append(keys, []byte(k))
+			vals = append(vals, x.val)
+		}
+	}
+	o.mu.RUnlock()
+
+	opt.Base = o.rd
+	w, err := NewDBWriterWithOptions(fn, opt)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.AddKeyVals(keys, vals); err == nil {
+		if _, err = w.DeleteKeys(dels); err == nil {
+			err = w.Freeze(0)
+		}
+	}
+
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return nil
+}
+
+// Close closes the DB; the changes are discarded.
+func (o *OverlayDB) Close() error {
+	return o.rd.Close()
+}
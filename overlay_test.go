@@ -0,0 +1,89 @@
+// overlay_test.go -- test suite for OverlayDB
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestOverlayDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	basefn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	deltafn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(basefn)
+	defer os.Remove(deltafn)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewDBWriter(basefn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(basefn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	o := NewOverlayDB(rd)
+	o.Set(keys[0], []byte("changed"))
+	o.Set(keys[1], keys[1])
+	o.Set([]byte("newkey"), []byte("newval"))
+	o.Delete(keys[2])
+	o.Set([]byte("gone"), []byte("gone"))
+	o.Delete([]byte("gone"))
+	assert(o.Len() == 5, "changes: exp 5, saw %d", o.Len())
+
+	// expected value of each key; nil if it is deleted
+	exp := make(map[string][]byte)
+	for _, k := range keys {
+		exp[string(k)] = k
+	}
+	exp[string(keys[0])] = []byte("changed")
+	exp["newkey"] = []byte("newval")
+	exp[string(keys[2])] = nil
+	exp["gone"] = nil
+
+	check := func(name string, r Reader) {
+		for k, v := range exp {
+			x, ok := r.Lookup([]byte(k))
+			if v == nil {
+				assert(!ok, "%s: found deleted key %s", name, k)
+				assert(!r.Contains([]byte(k)), "%s: contains deleted key %s", name, k)
+				continue
+			}
+			assert(ok, "%s: can't find key %s", name, k)
+			assert(string(x) == string(v), "%s: key %s: exp %s, saw %s", name, k, v, x)
+		}
+	}
+
+	check("overlay", o)
+
+	err = o.Flush(deltafn, WriterOptions{})
+	assert(err == nil, "flush failed: %s", err)
+	assert(o.Len() == 5, "flush dropped changes: %d", o.Len())
+	check("overlay", o)
+
+	// the base with the delta answers like the overlay
+	base, err := NewDBReader(basefn, 10)
+	assert(err == nil, "read failed: %s", err)
+	delta, err := NewDBReader(deltafn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	// unchanged and absent keys aren't in the delta
+	assert(delta.TotalKeys() == 3, "delta records: exp 3, saw %d", delta.TotalKeys())
+
+	d, err := NewDeltaReader(base, delta)
+	assert(err == nil, "can't layer delta: %s", err)
+	defer d.Close()
+	check("delta", d)
+
+	err = o.Close()
+	assert(err == nil, "close failed: %s", err)
+}
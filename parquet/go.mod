@@ -0,0 +1,25 @@
+module github.com/opencoff/go-bbhash/parquet
+
+go 1.21
+
+require (
+	github.com/opencoff/go-bbhash v0.0.0
+	github.com/parquet-go/parquet-go v0.23.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/dchest/siphash v1.2.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/opencoff/go-fasthash v0.0.0-20180406145558-aed761496075 // indirect
+	github.com/opencoff/golang-lru v0.6.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/segmentio/encoding v0.4.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
+
+replace github.com/opencoff/go-bbhash => ../
@@ -0,0 +1,212 @@
+// parquet.go -- add records from Parquet files to a constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package parquet adds records from Parquet files to a bbhash.DBWriter. It is
+// a separate module so that users of bbhash don't inherit the Parquet
+// dependency.
+package parquet
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	bbhash "github.com/opencoff/go-bbhash"
+	pq "github.com/parquet-go/parquet-go"
+)
+
+// number of rows read and added to the DB at a time
+const batchSize = 1024
+
+// AddFile adds the records of Parquet file 'fn' to the DB being built by
+// 'w'; the key and value are the columns named 'keyCol' and 'valCol'. Nested
+// columns are named by their dotted path (eg "a.b.c"). If 'valCol' is empty,
+// only keys are added and 'w' must be a key set. Rows with a null key are
+// skipped; a null value is an empty value. Records with duplicate keys are
+// discarded.
+// Returns number of records added.
+func AddFile(w *bbhash.DBWriter, fn string, keyCol, valCol string) (uint64, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := AddReader(w, fd, st.Size(), keyCol, valCol)
+	if err != nil {
+		return n, fmt.Errorf("%s: %w", fn, err)
+	}
+	return n, nil
+}
+
+// AddReader is like AddFile except the Parquet data is read from 'r' which
+// holds 'size' bytes.
+// Returns number of records added.
+func AddReader(w *bbhash.DBWriter, r io.ReaderAt, size int64, keyCol, valCol string) (uint64, error) {
+	f, err := pq.OpenFile(r, size)
+	if err != nil {
+		return 0, err
+	}
+
+	kidx, err := column(f, keyCol)
+	if err != nil {
+		return 0, err
+	}
+
+	vidx := -1
+	if len(valCol) > 0 {
+		if vidx, err = column(f, valCol); err != nil {
+			return 0, err
+		}
+	}
+
+	b := &batch{
+		w:     w,
+		noval: vidx < 0,
+		keys:  make([][]byte, 0, batchSize),
+		vals:  make([][]byte, 0, batchSize),
+	}
+
+	rows := make([]pq.Row, batchSize)
+	for _, rg := range f.RowGroups() {
+		rr := rg.Rows()
+		for {
+			m, err := rr.ReadRows(rows)
+			for _, row := range rows[:m] {
+				k, ok := rowValue(row, kidx)
+				if !ok || len(k) == 0 {
+					continue
+				}
+
+				var v []byte
+				if vidx >= 0 {
+					v, _ = rowValue(row, vidx)
+				}
+
+				if err := b.add(k, v); err != nil {
+					rr.Close()
+					return b.n, err
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rr.Close()
+				return b.n, err
+			}
+		}
+		rr.Close()
+	}
+
+	err = b.flush()
+	return b.n, err
+}
+
+// return the column index of column 'nm' in 'f'
+func column(f *pq.File, nm string) (int, error) {
+	leaf, ok := f.Schema().Lookup(strings.Split(nm, ".")...)
+	if !ok {
+		return 0, fmt.Errorf("no column '%s'", nm)
+	}
+	return leaf.ColumnIndex, nil
+}
+
+// return the first non-null value of column 'col' in 'row' as bytes
+func rowValue(row pq.Row, col int) ([]byte, bool) {
+	for _, v := range row {
+		if v.Column() != col {
+			continue
+		}
+		if v.IsNull() {
+			return nil, false
+		}
+		return valueBytes(v), true
+	}
+	return nil, false
+}
+
+// return the bytes of value 'v'; byte arrays are used as is and other
+// types are formatted as text. The row buffers are reused; so we copy.
+func valueBytes(v pq.Value) []byte {
+	switch v.Kind() {
+	case pq.ByteArray, pq.FixedLenByteArray:
+		b := v.ByteArray()
+		z := make([]byte, len(b))
+		copy(z, b)
+		return z
+
+	case pq.Boolean:
+		return strconv.AppendBool(nil, v.Boolean())
+
+	case pq.Int32:
+		return strconv.AppendInt(nil, int64(v.Int32()), 10)
+
+	case pq.Int64:
+		return strconv.AppendInt(nil, v.Int64(), 10)
+
+	case pq.Float:
+		return strconv.AppendFloat(nil, float64(v.Float()), 'g', -1, 32)
+
+	case pq.Double:
+		return strconv.AppendFloat(nil, v.Double(), 'g', -1, 64)
+
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// a batch of records waiting to be added to the DB
+type batch struct {
+	w     *bbhash.DBWriter
+	noval bool
+	keys  [][]byte
+	vals  [][]byte
+
+	// number of records added
+	n uint64
+}
+
+// add a record to the batch; a full batch is added to the DB
+func (b *batch) add(k, v []byte) error {
+	b.keys = append(b.keys, k)
+	b.vals = append(b.vals, v)
+	if len(b.keys) < batchSize {
+		return nil
+	}
+	return b.flush()
+}
+
+// add the pending records to the DB
+func (b *batch) flush() error {
+	if len(b.keys) == 0 {
+		return nil
+	}
+
+	var n uint64
+	var err error
+	if b.noval {
+		n, err = b.w.AddKeys(b.keys)
+	} else {
+		n, err = b.w.AddKeyVals(b.keys, b.vals)
+	}
+
+	b.n += n
+	b.keys = b.keys[:0]
+	b.vals = b.vals[:0]
+	return err
+}
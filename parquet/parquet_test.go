@@ -0,0 +1,100 @@
+// parquet_test.go -- test suite for the Parquet importer
+
+package parquet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	bbhash "github.com/opencoff/go-bbhash"
+	pq "github.com/parquet-go/parquet-go"
+)
+
+type row struct {
+	Name  string  `parquet:"name"`
+	ID    int64   `parquet:"id"`
+	Email *string `parquet:"email,optional"`
+}
+
+func TestAddFile(t *testing.T) {
+	assert := newAsserter(t)
+
+	dn := t.TempDir()
+	src := filepath.Join(dn, "input.parquet")
+	fn := filepath.Join(dn, "mph.db")
+
+	fd, err := os.Create(src)
+	assert(err == nil, "can't create %s: %s", src, err)
+
+	pw := pq.NewWriter(fd)
+	for i := 0; i < 3000; i++ {
+		r := &row{
+			Name: fmt.Sprintf("user-%d", i),
+			ID:   int64(i),
+		}
+		if i%2 == 0 {
+			e := fmt.Sprintf("user-%d@example.com", i)
+			r.Email = &e
+		}
+		err = pw.Write(r)
+		assert(err == nil, "can't write row %d: %s", i, err)
+	}
+
+	err = pw.Close()
+	assert(err == nil, "can't close writer: %s", err)
+	fd.Close()
+
+	wr, err := bbhash.NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = AddFile(wr, src, "name", "nonexistent")
+	assert(err != nil, "added a non-existent column")
+
+	n, err := AddFile(wr, src, "name", "id")
+	assert(err == nil, "can't add %s: %s", src, err)
+	assert(n == 3000, "exp 3000 records, saw %d", n)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := bbhash.NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("user-%d", i)
+		v, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(v) == fmt.Sprintf("%d", i), "key %s: value mismatch; saw %s", k, v)
+	}
+
+	// null keys are skipped
+	ks := filepath.Join(dn, "keys.db")
+	kw, err := bbhash.NewKeySetWriter(ks)
+	assert(err == nil, "can't create key set: %s", err)
+
+	n, err = AddFile(kw, src, "email", "")
+	assert(err == nil, "can't add %s: %s", src, err)
+	assert(n == 1500, "exp 1500 keys, saw %d", n)
+	kw.Abort()
+}
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
@@ -0,0 +1,189 @@
+// pool.go -- pooled buffers of the records read into the cache
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A lookup that misses the cache reads its record into a new buffer; the
+// buffer is garbage once the record is evicted from the cache. A service
+// that looks up many more keys than it caches allocates a buffer for most
+// lookups. A reader with a pool reads such records into pooled buffers
+// instead; the buffer of a record goes back to the pool when the record is
+// evicted. Each buffer is owned by one record - nothing else is pinned by
+// a value the caller keeps.
+//
+// An evicted buffer is "retired" until no lookup of the reader is in
+// flight - a lookup may have found the record just before it was evicted.
+// Only then is it reused. The ARC cache doesn't report the records it
+// evicts; its records aren't read into pooled buffers.
+
+const (
+	// smallest pooled buffer; the buffers are a power of 2 in size
+	poolMin = 256
+
+	// records larger than this aren't pooled
+	poolMax = 64 * 1024
+
+	// number of buffer sizes
+	poolSizes = 9
+
+	// most evicted buffers held until the reader is idle; the rest are
+	// left to the GC.
+	poolRetired = 1024
+)
+
+// bufPool holds the buffers of the records read by a DBReader
+type bufPool struct {
+	sizes [poolSizes]sync.Pool
+
+	// size index of the last record read into the pool; the size of a
+	// record is known only after it is read. Most DBs have records of
+	// similar sizes.
+	hint int32
+
+	// busy count of the reader; see DBReader.enter()
+	busy *int32
+
+	mu      sync.Mutex
+	retired []*[]byte
+	nret    int32
+}
+
+func newBufPool(busy *int32) *bufPool {
+	return &bufPool{busy: busy}
+}
+
+// return a buffer of the size of the last record read into the pool
+func (p *bufPool) get() *[]byte {
+	i := atomic.LoadInt32(&p.hint)
+	if bp, ok := p.sizes[i].Get().(*[]byte); ok {
+		return bp
+	}
+
+	b := make([]byte, poolMin<<i)
+	return &b
+}
+
+// return 'bp' to the pool
+func (p *bufPool) put(bp *[]byte) {
+	if i := poolSize(cap(*bp)); i >= 0 {
+		p.sizes[i].Put(bp)
+	}
+}
+
+// give record 'r' the buffer 'bp' it was read into; if the record isn't in
+// it (e.g., it is too large or is encrypted), the buffer is returned to
+// the pool and the next records are read into larger buffers.
+func (p *bufPool) keep(bp *[]byte, r *record) {
+	if inBuf(*bp, r.key) || inBuf(*bp, r.val) {
+		r.pool, r.pbuf = p, bp
+		return
+	}
+
+	p.put(bp)
+	if i := poolSize(len(r.key) + len(r.val)); i > int(atomic.LoadInt32(&p.hint)) {
+		atomic.StoreInt32(&p.hint, int32(i))
+	}
+}
+
+// retire the buffer of an evicted record; it is reused once the reader is
+// idle.
+func (p *bufPool) retire(bp *[]byte) {
+	p.mu.Lock()
+	if len(p.retired) < poolRetired {
+		p.retired = append(p.retired, bp)
+		atomic.StoreInt32(&p.nret, int32(len(p.retired)))
+	}
+	p.mu.Unlock()
+}
+
+// pool the retired buffers if no lookup is in flight. The buffers were
+// retired after their records were evicted; so a lookup that starts later
+// can't find them.
+func (p *bufPool) drain() {
+	if atomic.LoadInt32(&p.nret) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if atomic.LoadInt32(p.busy) != 0 {
+		return
+	}
+	for i, bp := range p.retired {
+		p.put(bp)
+		p.retired[i] = nil
+	}
+	p.retired = p.retired[:0]
+	atomic.StoreInt32(&p.nret, 0)
+}
+
+// index of the pooled buffer size for 'n' bytes; -1 if 'n' is too large
+func poolSize(n int) int {
+	if n > poolMax {
+		return -1
+	}
+	if n <= poolMin {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - bits.Len(poolMin-1)
+}
+
+// return true if 'b' is within the storage of 'buf'
+func inBuf(buf, b []byte) bool {
+	if cap(buf) == 0 || cap(b) == 0 {
+		return false
+	}
+
+	s := uintptr(unsafe.Pointer(unsafe.SliceData(buf)))
+	x := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	return x >= s && x < s+uintptr(cap(buf))
+}
+
+// return the pooled buffer of an evicted record 'r'; it's a no-op if the
+// record isn't in a pooled buffer.
+func (r *record) release() {
+	if r.pool != nil {
+		r.pool.retire(r.pbuf)
+	}
+}
+
+// return the pooled buffer of a record that was read but isn't cached; the
+// record must not be used after.
+func (r *record) discard() {
+	if r.pool != nil {
+		r.pool.put(r.pbuf)
+		r.pool, r.pbuf = nil, nil
+	}
+}
+
+// SetPool controls whether the records read into the cache are read into
+// pooled buffers that are reused when the records are evicted - which
+// cuts the allocations of lookups that miss the cache. Pooling is off by
+// default. The value returned by Find() and the like is in the buffer of
+// its cached record; with pooling, it is valid only until the record is
+// evicted - which the next lookup may do. So it suits a reader used by one
+// goroutine that is done with each value before its next lookup; e.g.,
+// each goroutine with its own reader from NewSharedDBReader(). The values
+// returned by FindMany(), FindInto() and UnsafeFind() aren't affected.
+// Records aren't pooled with the ARC cache; it doesn't report evictions.
+// This must be called before the DB is queried.
+func (rd *DBReader) SetPool(on bool) {
+	if on {
+		rd.pool = newBufPool(&rd.busy)
+	} else {
+		rd.pool = nil
+	}
+}
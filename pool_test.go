@@ -0,0 +1,208 @@
+// pool_test.go -- test suite for the pooled record buffers
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// make a DB of 'n' keys with values of 'vsize' bytes; every 100th value
+// is too large to be pooled.
+func makePoolDB(fn string, n, vsize int) ([][]byte, [][]byte, error) {
+	keys := make([][]byte, n)
+	vals := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		z := vsize
+		if i%100 == 0 {
+			z = poolMax + 1
+		}
+		vals[i] = bytes.Repeat([]byte{byte(i)}, z)
+	}
+
+	wr, err := NewDBWriter(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = wr.AddKeyVals(keys, vals); err != nil {
+		wr.Abort()
+		return nil, nil, err
+	}
+	return keys, vals, wr.Freeze(2.0)
+}
+
+func TestPool(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys, vals, err := makePoolDB(fn, 2000, 100)
+	assert(err == nil, "can't create db: %s", err)
+
+	opts := []ReaderOptions{
+		{Cache: 100, CachePolicy: CacheLRU, Pool: true},
+		{Cache: 100, CachePolicy: CacheShardedLRU, Pool: true},
+		{Cache: 100, CachePolicy: CacheClock, Pool: true},
+		{CacheBytes: 100 * 1024, Pool: true},
+	}
+
+	for _, opt := range opts {
+		rd, err := NewDBReaderWithOptions(fn, opt)
+		assert(err == nil, "read failed: %s", err)
+
+		// each value is valid until the next lookup
+		for n := 0; n < 3; n++ {
+			for i, k := range keys {
+				v, err := rd.Find(k)
+				assert(err == nil, "%s: can't find key %s: %s", opt.CachePolicy, k, err)
+				assert(bytes.Equal(v, vals[i]), "%s: key %s: value mismatch", opt.CachePolicy, k)
+			}
+		}
+		assert(len(rd.pool.retired) == 0, "%s: %d buffers not pooled", opt.CachePolicy, len(rd.pool.retired))
+
+		var pooled int
+		for _, h := range rd.cache.Keys() {
+			r, _ := rd.cache.Get(h)
+			if r.pool != nil {
+				pooled++
+			}
+			if len(r.val) > poolMax {
+				assert(r.pool == nil, "%s: large record pooled", opt.CachePolicy)
+			}
+		}
+		assert(pooled > 0, "%s: no pooled records", opt.CachePolicy)
+
+		// the values of a batch larger than the cache stay valid
+		got, errs := rd.FindMany(keys)
+		for i := range keys {
+			assert(errs[i] == nil, "%s: batch: can't find key %s: %s", opt.CachePolicy, keys[i], errs[i])
+		}
+		for _, k := range keys[:500] {
+			_, err = rd.Find(k)
+			assert(err == nil, "%s: can't find key %s: %s", opt.CachePolicy, k, err)
+		}
+		for i := range keys {
+			assert(bytes.Equal(got[i], vals[i]), "%s: batch: key %s: value mismatch", opt.CachePolicy, keys[i])
+		}
+		rd.Close()
+	}
+
+	// a buffer isn't reused while a lookup may still read its record
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Cache: 10, CachePolicy: CacheLRU, Pool: true})
+	assert(err == nil, "read failed: %s", err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var buf []byte
+			for i := g; i < len(keys)*2; i += 8 {
+				j := i % len(keys)
+				if _, err := rd.Find(keys[(j+g)%len(keys)]); err != nil {
+					errs <- err
+					return
+				}
+				v, err := rd.FindInto(keys[j], buf)
+				if err == nil && !bytes.Equal(v, vals[j]) {
+					err = fmt.Errorf("key %s: value mismatch", keys[j])
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				buf = v
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert(false, "concurrent find: %s", err)
+	}
+	rd.Close()
+
+	// the ARC cache doesn't report evictions; a bbhash_stdlib build has
+	// an LRU cache instead.
+	rd, err = NewDBReaderWithOptions(fn, ReaderOptions{Cache: 100, Pool: true})
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys[:200] {
+		v, err := rd.Find(k)
+		assert(err == nil && bytes.Equal(v, vals[i]), "arc: can't find key %s: %v", k, err)
+	}
+	for _, h := range rd.cache.Keys() {
+		r, _ := rd.cache.Get(h)
+		assert(r.pool == nil || rd.cache.releases(), "arc: record pooled")
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		n   int
+		exp int
+	}{
+		{0, 0},
+		{1, 0},
+		{poolMin, 0},
+		{poolMin + 1, 1},
+		{2 * poolMin, 1},
+		{poolMax, poolSizes - 1},
+		{poolMax + 1, -1},
+	}
+
+	for _, tc := range tests {
+		i := poolSize(tc.n)
+		assert(i == tc.exp, "size %d: exp %d, saw %d", tc.n, tc.exp, i)
+		if i >= 0 {
+			assert(poolMin<<i >= tc.n, "size %d: buffer of %d", tc.n, poolMin<<i)
+		}
+	}
+}
+
+func BenchmarkPool(b *testing.B) {
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	// 16x more keys than records cached; so most lookups miss
+	keys, _, err := makePoolDB(fn, 16*1024, 200)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Cache: 1024, CachePolicy: CacheLRU, Pool: pool})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer rd.Close()
+
+			var m0, m1 runtime.MemStats
+			runtime.ReadMemStats(&m0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := (uint64(i) * 0x9e3779b97f4a7c15) % uint64(len(keys))
+				if _, err := rd.Find(keys[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			runtime.ReadMemStats(&m1)
+			b.ReportMetric(float64(m1.NumGC-m0.NumGC), "GCs")
+		})
+	}
+}
@@ -0,0 +1,24 @@
+module github.com/opencoff/go-bbhash/prometheus
+
+go 1.20
+
+require (
+	github.com/opencoff/go-bbhash v0.0.0
+	github.com/prometheus/client_golang v1.19.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dchest/siphash v1.2.1 // indirect
+	github.com/opencoff/go-fasthash v0.0.0-20180406145558-aed761496075 // indirect
+	github.com/opencoff/golang-lru v0.6.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
+
+replace github.com/opencoff/go-bbhash => ../
@@ -0,0 +1,141 @@
+// prometheus.go -- export DB metrics to Prometheus
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package prometheus exports the metrics of go-bbhash DB readers and
+// writers to Prometheus; see bbhash.Metrics. It is a separate module so
+// that users of the core library don't inherit the Prometheus client:
+//
+//	m := prometheus.New(nil, prom.Labels{"db": "users"})
+//	rd.SetMetrics(m)
+package prometheus
+
+import (
+	"errors"
+	"sync"
+
+	bbhash "github.com/opencoff/go-bbhash"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements bbhash.Metrics by registering a Prometheus counter or
+// gauge for each metric on first use. It is safe for concurrent use.
+type Metrics struct {
+	reg    prom.Registerer
+	labels prom.Labels
+
+	mu       sync.RWMutex
+	counters map[string]prom.Counter
+	gauges   map[string]prom.Gauge
+}
+
+var _ bbhash.Metrics = &Metrics{}
+
+// New returns Metrics that registers its collectors with 'reg' (the
+// default registerer if nil); 'labels' are attached to every metric - e.g.,
+// to tell apart several DBs in one process.
+func New(reg prom.Registerer, labels prom.Labels) *Metrics {
+	if reg == nil {
+		reg = prom.DefaultRegisterer
+	}
+
+	return &Metrics{
+		reg:      reg,
+		labels:   labels,
+		counters: make(map[string]prom.Counter),
+		gauges:   make(map[string]prom.Gauge),
+	}
+}
+
+// Counter adds 'delta' to the counter 'name'
+func (m *Metrics) Counter(name string, delta float64) {
+	m.mu.RLock()
+	c, ok := m.counters[name]
+	m.mu.RUnlock()
+
+	if !ok {
+		m.mu.Lock()
+		if c, ok = m.counters[name]; !ok {
+			c = prom.NewCounter(prom.CounterOpts{
+				Name:        name,
+				Help:        help(name),
+				ConstLabels: m.labels,
+			})
+			c = m.register(c).(prom.Counter)
+			m.counters[name] = c
+		}
+		m.mu.Unlock()
+	}
+
+	c.Add(delta)
+}
+
+// Gauge sets the gauge 'name' to 'val'
+func (m *Metrics) Gauge(name string, val float64) {
+	m.mu.RLock()
+	g, ok := m.gauges[name]
+	m.mu.RUnlock()
+
+	if !ok {
+		m.mu.Lock()
+		if g, ok = m.gauges[name]; !ok {
+			g = prom.NewGauge(prom.GaugeOpts{
+				Name:        name,
+				Help:        help(name),
+				ConstLabels: m.labels,
+			})
+			g = m.register(g).(prom.Gauge)
+			m.gauges[name] = g
+		}
+		m.mu.Unlock()
+	}
+
+	g.Set(val)
+}
+
+// register 'c' and return the collector to use: 'c' or the identical one
+// registered earlier. A collector that can't be registered still works;
+// it just isn't exported.
+func (m *Metrics) register(c prom.Collector) prom.Collector {
+	err := m.reg.Register(c)
+
+	var are prom.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		return are.ExistingCollector
+	}
+	return c
+}
+
+// help text of the metrics we know about
+var helps = map[string]string{
+	bbhash.MetricLookups:            "Number of keys looked up",
+	bbhash.MetricLookupSeconds:      "Total time spent in lookups",
+	bbhash.MetricCacheHits:          "Number of lookups answered by the record cache",
+	bbhash.MetricCacheMisses:        "Number of lookups not in the record cache",
+	bbhash.MetricNegativeHits:       "Number of lookups answered by the negative cache",
+	bbhash.MetricBloomRejects:       "Number of lookups rejected by the Bloom filter",
+	bbhash.MetricFingerprintRejects: "Number of lookups rejected by the key fingerprints",
+	bbhash.MetricReads:              "Number of reads of the DB",
+	bbhash.MetricBytesRead:          "Number of bytes read from the DB",
+	bbhash.MetricChecksumFailures:   "Number of records that failed their checksum",
+	bbhash.MetricRecordsAdded:       "Number of records added to the DB being built",
+	bbhash.MetricBuildRecords:       "Number of records in the last DB built",
+	bbhash.MetricBuildFileSize:      "Size of the last DB built",
+	bbhash.MetricBuildMPHLevels:     "Number of MPH levels of the last DB built",
+	bbhash.MetricBuildIngest:        "Time spent adding records to the last DB built",
+	bbhash.MetricBuildMPH:           "Time spent building the MPH of the last DB built",
+	bbhash.MetricBuildOffsets:       "Time spent building the offset table of the last DB built",
+	bbhash.MetricBuildLayout:        "Time spent laying out the records of the last DB built",
+	bbhash.MetricBuildWrite:         "Time spent writing the last DB built",
+}
+
+func help(name string) string {
+	if h, ok := helps[name]; ok {
+		return h
+	}
+	return "go-bbhash metric " + name
+}
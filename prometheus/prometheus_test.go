@@ -0,0 +1,75 @@
+// prometheus_test.go -- test suite for the Prometheus exporter
+
+package prometheus
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	bbhash "github.com/opencoff/go-bbhash"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := filepath.Join(t.TempDir(), "mph.db")
+	reg := prom.NewRegistry()
+
+	wm := New(reg, prom.Labels{"db": "test"})
+	wr, err := bbhash.NewDBWriterWithOptions(fn, bbhash.WriterOptions{Metrics: wm})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := [][]byte{[]byte("k1"), []byte("k2"), []byte("k3")}
+	vals := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3")}
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	v := testutil.ToFloat64(wm.counters[bbhash.MetricRecordsAdded])
+	assert(v == 3, "exp 3 records added, saw %v", v)
+	v = testutil.ToFloat64(wm.gauges[bbhash.MetricBuildRecords])
+	assert(v == 3, "exp 3 records, saw %v", v)
+
+	rd, err := bbhash.NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// a second Metrics on the same registry shares the collectors
+	rm := New(reg, prom.Labels{"db": "test"})
+	rd.SetMetrics(rm)
+	for _, k := range keys {
+		_, err = rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+	}
+
+	v = testutil.ToFloat64(rm.counters[bbhash.MetricLookups])
+	assert(v == 3, "exp 3 lookups, saw %v", v)
+
+	rm2 := New(reg, prom.Labels{"db": "test"})
+	rm2.Counter(bbhash.MetricLookups, 1)
+	v = testutil.ToFloat64(rm.counters[bbhash.MetricLookups])
+	assert(v == 4, "collectors not shared: exp 4 lookups, saw %v", v)
+}
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
@@ -0,0 +1,706 @@
+// record.go -- encoding and decoding of DB records
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type record struct {
+	hash uint64
+
+	key []byte
+	val []byte
+
+	// siphash of the key+val+offset+hash.
+	csum uint64
+
+	// offset where this record is written
+	off uint64
+
+	// for a front coded record: length of the prefix shared with the
+	// anchor record at offset 'anchor'.
+	plen   int
+	anchor uint64
+
+	// for a record with a deduplicated value: offset of the record
+	// holding the value.
+	vref uint64
+
+	// expiry time of the record in seconds since the unix epoch; zero
+	// if the record never expires.
+	expiry uint64
+
+	// application defined flags; opaque to us
+	appflags byte
+
+	// namespace of the record; zero is the default namespace
+	ns uint8
+
+	// in a split DB: position of the value in the value region
+	vpos uint64
+
+	// the key is deleted from the base of a delta DB; see
+	// DBWriter.DeleteKeys().
+	deleted bool
+
+	// the pooled buffer holding the key and value; it goes back to
+	// 'pool' when the record is evicted from the cache. See bufPool.
+	pool *bufPool
+	pbuf *[]byte
+}
+
+// Per-record flags
+const (
+	rflagPrefix  byte = 1 << 0 // key is front coded against an anchor record
+	rflagValRef  byte = 1 << 1 // value is held by an earlier record
+	rflagExpiry  byte = 1 << 2 // record has an expiry time
+	rflagApp     byte = 1 << 3 // record has application flags
+	rflagNS      byte = 1 << 4 // record is in a non-default namespace
+	rflagDeleted byte = 1 << 5 // record is a tombstone of a deleted key
+)
+
+// codec holds the per-DB state needed to encode and decode records; it is
+// shared by DBWriter and DBReader.
+type codec struct {
+	// hash salt for hashing keys
+	salt uint64
+
+	// siphash key: just binary encoded salt
+	saltkey []byte
+
+	// header flags
+	flags uint32
+
+	// AEAD for encrypted DBs; nil otherwise
+	aead cipher.AEAD
+
+	// file offset of the value region in a split DB
+	valoff uint64
+
+	// all the records were verified when the DB was loaded into memory;
+	// their checksums aren't verified again.
+	verified bool
+
+	// reader statistics; nil in a writer
+	ctr *readerCounters
+}
+
+// initialize the codec for salt 'salt'
+func (c *codec) setSalt(salt uint64) {
+	c.salt = salt
+	c.saltkey = make([]byte, 16)
+
+	binary.BigEndian.PutUint64(c.saltkey[:8], salt)
+	binary.BigEndian.PutUint64(c.saltkey[8:], ^salt)
+}
+
+// return the checksum of 'v' at offset 'off' - or 'exp' if the records
+// were verified up front.
+func (c *codec) verify(exp, off uint64, v ...[]byte) uint64 {
+	if c.verified {
+		return exp
+	}
+	return c.csum64(off, v...)
+}
+
+// count a record checksum failure and return the error 'err'
+func (c *codec) badsum(err error) error {
+	if c.ctr != nil {
+		c.ctr.add(&c.ctr.badsum, MetricChecksumFailures, 1)
+	}
+	return err
+}
+
+// per-record flags permitted by the header flags
+func (c *codec) rflagMask() byte {
+	var m byte
+
+	if (c.flags & flagPrefix) > 0 {
+		m |= rflagPrefix
+	}
+	if (c.flags & flagValRef) > 0 {
+		m |= rflagValRef
+	}
+	if (c.flags & flagExpiry) > 0 {
+		m |= rflagExpiry
+	}
+	if (c.flags & flagAppFlags) > 0 {
+		m |= rflagApp
+	}
+	if (c.flags & flagNamespaces) > 0 {
+		m |= rflagNS
+	}
+	if (c.flags & flagTombstones) > 0 {
+		m |= rflagDeleted
+	}
+	return m
+}
+
+// Provide a disk encoding of record r at offset r.off. In an encrypted DB
+// the key and value are sealed together; in that case the checksum is
+// calculated over the ciphertext.
+// The record header is variable length and covered by the checksum:
+//   - rflags: 1 byte of per-record flags
+//   - klen:   uvarint key length
+//   - vlen:   uvarint value length
+//   - plen:   uvarint shared prefix length (only for front coded records)
+//   - back:   uvarint distance to the anchor record (only for front coded records)
+//   - vback:  uvarint distance to the record holding a deduplicated value
+//   - expiry: uvarint expiry time in seconds since the unix epoch (only for
+//     records that expire)
+//   - app:    1 byte of non-zero application flags (only for records that
+//     have them)
+//   - ns:     1 byte of non-zero namespace id (only for records outside the
+//     default namespace)
+//   - vpos:   uvarint position of the value in the value region (only in a
+//     split DB, for non-empty values)
+//   - vsum:   8 byte checksum of the value (along with vpos)
+//   - csum:   8 byte checksum
+//
+// The tombstone of a key deleted from the base of a delta DB is a record
+// with the flag rflagDeleted and no value.
+//
+// A front coded record stores only the key bytes after the prefix it
+// shares with its anchor. A record with a deduplicated value stores no
+// value (vlen is zero) and refers to an earlier record that has the same
+// value. In either case, the checksum is over the full key and value. In an
+// encrypted DB, the header of a record with any per-record flags is
+// authenticated as additional data.
+//
+// In a split DB, the value is stored in a separate value region and the
+// checksum is over the header and key; the value has its own checksum in
+// the header. The caller writes the value at r.vpos in the value region.
+//
+// Anchors never refer to other records; and the records holding values
+// are never deduplicated themselves. This bounds the number of reads
+// needed to decode a record.
+func (c *codec) encode(buf []byte, r *record) []byte {
+	var b [recHdrMax]byte
+
+	key := r.key
+	if r.plen > 0 {
+		key = r.key[r.plen:]
+	}
+
+	val := r.val
+	if r.vref > 0 {
+		val = nil
+	}
+
+	hdr := r.header(b[:], uint64(len(key)), uint64(len(val)))
+
+	// split DBs are never encrypted
+	if (c.flags&flagSplit) > 0 && len(val) > 0 {
+		hdr = appendUvarint(hdr, r.vpos)
+		hdr = appendUint64(hdr, c.csum64(r.vpos, val))
+		r.csum = c.csum64(r.off, hdr, r.key)
+
+		buf = append(buf, hdr...)
+		buf = appendUint64(buf, r.csum)
+		return append(buf, key...)
+	}
+
+	if c.aead != nil {
+		var ad []byte
+		if hdr[0] != 0 {
+			ad = hdr
+		}
+
+		pt := make([]byte, 0, len(key)+len(val)+c.aead.Overhead())
+		pt = append(pt, key...)
+		pt = append(pt, val...)
+
+		ct := c.aead.Seal(pt[:0], nonce(nonceRecord, r.off), pt, ad)
+		r.csum = c.csum64(r.off, hdr, ct)
+
+		buf = append(buf, hdr...)
+		buf = appendUint64(buf, r.csum)
+		return append(buf, ct...)
+	}
+
+	r.csum = c.csum64(r.off, hdr, r.key, r.val)
+
+	buf = append(buf, hdr...)
+	buf = appendUint64(buf, r.csum)
+	buf = append(buf, key...)
+	return append(buf, val...)
+}
+
+// encode the header of record 'r' into 'b' - except the checksum; 'klen'
+// and 'vlen' are the lengths of the stored key and value.
+func (r *record) header(b []byte, klen, vlen uint64) []byte {
+	b[0] = 0
+	if r.plen > 0 {
+		b[0] |= rflagPrefix
+	}
+	if r.vref > 0 {
+		b[0] |= rflagValRef
+	}
+	if r.expiry > 0 {
+		b[0] |= rflagExpiry
+	}
+	if r.appflags != 0 {
+		b[0] |= rflagApp
+	}
+	if r.ns != 0 {
+		b[0] |= rflagNS
+	}
+	if r.deleted {
+		b[0] |= rflagDeleted
+	}
+
+	n := 1
+	n += binary.PutUvarint(b[n:], klen)
+	n += binary.PutUvarint(b[n:], vlen)
+	if r.plen > 0 {
+		n += binary.PutUvarint(b[n:], uint64(r.plen))
+		n += binary.PutUvarint(b[n:], r.off-r.anchor)
+	}
+	if r.vref > 0 {
+		n += binary.PutUvarint(b[n:], r.off-r.vref)
+	}
+	if r.expiry > 0 {
+		n += binary.PutUvarint(b[n:], r.expiry)
+	}
+	if r.appflags != 0 {
+		b[n] = r.appflags
+		n++
+	}
+	if r.ns != 0 {
+		b[n] = r.ns
+		n++
+	}
+	return b[:n]
+}
+
+// read and validate a variable length record at offset 'off' in 'fd';
+// the file is 'size' bytes long.
+func (c *codec) decode(fd io.ReaderAt, off uint64, size int64) (*record, error) {
+	return c.decodeAt(fd, off, size, rflagPrefix|rflagValRef, true)
+}
+
+// decode the record at 'off'; 'allow' is the set of per-record flags that
+// refer to other records that the record may have. The value is read only
+// if 'wantVal' is true; since the checksum of a record covers its value, a
+// record decoded without its value is verified only in a split DB (where
+// the key has its own checksum). The value of an encrypted record is always
+// read; it is needed to authenticate the record.
+func (c *codec) decodeAt(fd io.ReaderAt, off uint64, size int64, allow byte, wantVal bool) (*record, error) {
+	return c.decodeBuf(fd, off, size, allow, wantVal, nil)
+}
+
+// decode the record at 'off' like decodeAt() - but read it into 'scratch'
+// if it is large enough. The key and value of the returned record may
+// alias 'scratch'.
+func (c *codec) decodeBuf(fd io.ReaderAt, off uint64, size int64, allow byte, wantVal bool, scratch []byte) (*record, error) {
+	if off >= uint64(size) {
+		return nil, fmt.Errorf("%w: offset %d out of bounds", ErrCorruptRecord, off)
+	}
+
+	// The header is variable length; we read the max header size and
+	// use the remainder as the start of the key. A short read is ok as
+	// long as we got a full header.
+	var hb [recHdrMax]byte
+
+	n, err := fd.ReadAt(hb[:], int64(off))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	b := hb[:n]
+	allow |= rflagExpiry | rflagApp | rflagNS | rflagDeleted
+	if len(b) < 1 || (b[0] & ^(allow&c.rflagMask())) != 0 {
+		return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+	}
+
+	rflags := b[0]
+
+	klen, i := binary.Uvarint(b[1:])
+	if i <= 0 {
+		return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+	}
+	j := 1 + i
+
+	vlen, i := binary.Uvarint(b[j:])
+	if i <= 0 {
+		return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+	}
+	j += i
+
+	var plen, back, vback uint64
+	if (rflags & rflagPrefix) > 0 {
+		plen, i = binary.Uvarint(b[j:])
+		if i <= 0 {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		j += i
+
+		back, i = binary.Uvarint(b[j:])
+		if i <= 0 || plen == 0 || back == 0 || back > off {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		j += i
+	}
+
+	valref := (rflags & rflagValRef) > 0
+	if valref {
+		vback, i = binary.Uvarint(b[j:])
+		if i <= 0 || vback == 0 || vback > off {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		j += i
+	}
+
+	var expiry uint64
+	if (rflags & rflagExpiry) > 0 {
+		expiry, i = binary.Uvarint(b[j:])
+		if i <= 0 || expiry == 0 {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		j += i
+	}
+
+	var appflags byte
+	if (rflags & rflagApp) > 0 {
+		if len(b) <= j || b[j] == 0 {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		appflags = b[j]
+		j++
+	}
+
+	var ns uint8
+	if (rflags & rflagNS) > 0 {
+		if len(b) <= j || b[j] == 0 {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		ns = b[j]
+		j++
+	}
+
+	split := (c.flags&flagSplit) > 0 && vlen > 0
+
+	var vpos, vsum uint64
+	if split {
+		vpos, i = binary.Uvarint(b[j:])
+		if i <= 0 || len(b) < j+i+8 {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		j += i
+		vsum = binary.BigEndian.Uint64(b[j : j+8])
+		j += 8
+	}
+
+	if len(b) < j+8 {
+		return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+	}
+
+	hdr := b[:j]
+	csum := binary.BigEndian.Uint64(b[j : j+8])
+	j += 8
+
+	// records in key sets and records with deduplicated values have no
+	// stored value; other values may be empty. The record must fit in
+	// the file; in a split DB, so must the value.
+	avail := uint64(size) - off - uint64(j)
+	novals := (c.flags&flagKeysOnly) > 0 || valref || (rflags&rflagDeleted) > 0
+
+	inline := vlen
+	if split {
+		inline = 0
+		if c.valoff == 0 || c.valoff > uint64(size) || vpos > uint64(size)-c.valoff || vlen > uint64(size)-c.valoff-vpos {
+			return nil, fmt.Errorf("%w: value-len %d at %d out of bounds", ErrCorruptRecord, vlen, vpos)
+		}
+	}
+	if klen == 0 || (novals && vlen > 0) || klen > avail || inline > avail-klen {
+		return nil, fmt.Errorf("%w: key-len %d or value-len %d out of bounds", ErrCorruptRecord, klen, vlen)
+	}
+
+	// without the value, only the key needs to be read
+	keyonly := !wantVal && c.aead == nil && !split
+
+	bodylen := klen + inline
+	if keyonly {
+		bodylen = klen
+	}
+	if c.aead != nil {
+		bodylen += uint64(c.aead.Overhead())
+	}
+	if bodylen > avail {
+		return nil, fmt.Errorf("%w: key-len %d or value-len %d out of bounds", ErrCorruptRecord, klen, vlen)
+	}
+	if bodylen > uint64(maxInt) || vlen > uint64(maxInt) {
+		return nil, fmt.Errorf("record at off %d is too large for this platform", off)
+	}
+
+	mr, alias := fd.(*memReader)
+	alias = alias && c.aead == nil
+
+	var buf []byte
+	if alias {
+		// the record is never modified in place unless it is encrypted
+		x := off + uint64(j)
+		buf = mr.b[x : x+bodylen : x+bodylen]
+	} else {
+		buf = sized(scratch, bodylen)
+		m := copy(buf, b[j:])
+		if m < len(buf) {
+			_, err = fd.ReadAt(buf[m:], int64(off)+int64(j+m))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.aead != nil {
+		if x := c.csum64(off, hdr, buf); x != csum {
+			return nil, c.badsum(&ChecksumError{Offset: off, Exp: csum, Saw: x})
+		}
+
+		var ad []byte
+		if rflags != 0 {
+			ad = hdr
+		}
+
+		buf, err = c.aead.Open(buf[:0], nonce(nonceRecord, off), buf, ad)
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt record at off %d: %w", off, err)
+		}
+	}
+
+	key := buf[:klen]
+	val := buf[klen:]
+	if plen > 0 {
+		a, err := c.decodeAt(fd, off-back, size, 0, false)
+		if err != nil {
+			return nil, fmt.Errorf("anchor of record at off %d: %w", off, err)
+		}
+		if plen > uint64(len(a.key)) {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+
+		key = make([]byte, 0, plen+klen)
+		key = append(key, a.key[:plen]...)
+		key = append(key, buf[:klen]...)
+	}
+
+	if valref && wantVal {
+		v, err := c.decodeAt(fd, off-vback, size, rflagPrefix, true)
+		if err != nil {
+			return nil, fmt.Errorf("value of record at off %d: %w", off, err)
+		}
+		if len(v.val) == 0 {
+			return nil, fmt.Errorf("%w header at off %d", ErrCorruptRecord, off)
+		}
+		val = v.val
+	}
+
+	if split {
+		if x := c.verify(csum, off, hdr, key); x != csum {
+			return nil, c.badsum(&ChecksumError{Offset: off, Exp: csum, Saw: x})
+		}
+
+		val = nil
+		if wantVal {
+			if alias {
+				x := c.valoff + vpos
+				val = mr.b[x : x+vlen : x+vlen]
+			} else {
+				val = sized(buf[len(buf):cap(buf)], vlen)
+				if _, err = fd.ReadAt(val, int64(c.valoff+vpos)); err != nil {
+					return nil, err
+				}
+			}
+			if x := c.verify(vsum, vpos, val); x != vsum {
+				return nil, c.badsum(&ChecksumError{Offset: off, Exp: vsum, Saw: x, Value: true})
+			}
+		}
+	} else if c.aead == nil && !keyonly {
+		if x := c.verify(csum, off, hdr, key, val); x != csum {
+			return nil, c.badsum(&ChecksumError{Offset: off, Exp: csum, Saw: x})
+		}
+	}
+
+	x := &record{
+		key:      key,
+		val:      val,
+		csum:     csum,
+		off:      off,
+		expiry:   expiry,
+		appflags: appflags,
+		ns:       ns,
+		deleted:  (rflags & rflagDeleted) > 0,
+	}
+
+	x.hash = c.keyHash(ns, x.key)
+	return x, nil
+}
+
+// memReader reads a DB that is entirely in memory - memory mapped or read
+// into memory. The keys and values of unencrypted records decoded from it
+// alias 'b' rather than being copied.
+type memReader struct {
+	io.ReaderAt
+	b []byte
+}
+
+// return the first 'n' bytes of 'b' - or a new slice if 'b' is too small
+func sized(b []byte, n uint64) []byte {
+	if uint64(cap(b)) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// Front coding state of a writer: the most recent anchor record. Every
+// anchor is followed by at most 'prefixBlock' front coded records.
+type prefixer struct {
+	key []byte
+	off uint64
+	n   int
+}
+
+const (
+	prefixBlock = 64
+	prefixMin   = 4
+)
+
+// front code record 'r' against the current anchor; if it doesn't share a
+// long enough prefix, 'r' becomes the new anchor. r.off must be set.
+// Returns true if 'r' is the new anchor.
+func (p *prefixer) code(r *record) bool {
+	r.plen = 0
+	if p.key != nil && p.n < prefixBlock {
+		n := 0
+		for n < len(p.key) && n < len(r.key)-1 && p.key[n] == r.key[n] {
+			n++
+		}
+
+		if n >= prefixMin {
+			r.plen = n
+			r.anchor = p.off
+			p.n++
+			return false
+		}
+	}
+
+	p.key = append(p.key[:0], r.key...)
+	p.off = r.off
+	p.n = 0
+	return true
+}
+
+// Value deduplication state of a writer: the offset of the most recent
+// record holding each distinct value. We track at most 'dedupMaxBytes'
+// worth of distinct values.
+type deduper struct {
+	vals map[string]uint64
+	size int
+}
+
+const dedupMaxBytes = 16 * 1048576
+
+func newDeduper() *deduper {
+	return &deduper{
+		vals: make(map[string]uint64),
+	}
+}
+
+// refer record 'r' to an earlier record with the same value if that saves
+// space; otherwise, 'r' holds its value and may be referred to by later
+// records. An anchor for front coding must hold its own value. r.off must
+// be set.
+func (d *deduper) code(r *record, anchor bool) {
+	r.vref = 0
+	if len(r.val) == 0 {
+		return
+	}
+
+	o, ok := d.vals[string(r.val)]
+	if ok && !anchor && uvarintLen(r.off-o) < len(r.val) {
+		r.vref = o
+		return
+	}
+
+	if !ok {
+		if d.size+len(r.val) > dedupMaxBytes {
+			return
+		}
+		d.size += len(r.val)
+	}
+
+	// a closer record makes for shorter references
+	d.vals[string(r.val)] = r.off
+}
+
+// return the length of the uvarint encoding of 'v'
+func uvarintLen(v uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], v)
+}
+
+// hash of 'key' in namespace 'ns'; each namespace is a distinct key space.
+// Keys in the default namespace hash as they always have.
+func (c *codec) keyHash(ns uint8, key []byte) uint64 {
+	salt := c.salt
+	if ns != 0 {
+		salt ^= mix(uint64(ns))
+	}
+
+	if (c.flags & flagXXH3) > 0 {
+		return xxh3Hash64(salt, key)
+	}
+	return hashBytes((c.flags&flagStdHash) > 0, salt, key)
+}
+
+// return a new keyed hash for the record checksums of the DB
+func (c *codec) newHash64() hash64 {
+	if (c.flags & flagStdHash) > 0 {
+		return newStdHash64(c.saltkey)
+	}
+	return newExtHash64(c.saltkey)
+}
+
+// Calculate a semi-strong checksum of the byte slices in 'v' followed by the
+// offset 'off'; we use the offset as one of the items being protected. The
+// checksum is siphash-2-4 (64-bit) - or a truncated HMAC-SHA256 in a DB
+// built with WriterOptions.StdlibHash.
+func (c *codec) csum64(off uint64, v ...[]byte) uint64 {
+	var b [8]byte
+
+	h := c.newHash64()
+	for _, x := range v {
+		h.Write(x)
+	}
+
+	binary.BigEndian.PutUint64(b[:], off)
+	h.Write(b[:])
+
+	return h.Sum64()
+}
+
+// append a big-endian encoding of 'v' to 'b'
+func appendUint64(b []byte, v uint64) []byte {
+	var x [8]byte
+
+	binary.BigEndian.PutUint64(x[:], v)
+	return append(b, x[:]...)
+}
+
+// append 'v' as a uvarint to 'b'
+func appendUvarint(b []byte, v uint64) []byte {
+	var x [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(x[:], v)
+	return append(b, x[:n]...)
+}
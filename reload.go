@@ -0,0 +1,277 @@
+// reload.go -- a DB reader that follows atomic replacements of its file
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default interval at which a ReloadableReader checks its file
+const defaultReloadInterval = 10 * time.Second
+
+// ReloadOptions control how a ReloadableReader opens and reloads its DB.
+type ReloadOptions struct {
+	// Number of records to cache in each DBReader; see NewDBReader()
+	Cache int
+
+	// Key of an encrypted DB; see NewEncryptedDBReader()
+	Key []byte
+
+	// Interval at which the file is checked for a replacement; if zero,
+	// it defaults to 10 seconds. If negative, the file is only checked
+	// when Reload() is called.
+	Interval time.Duration
+
+	// If not nil, OnReload is called after every attempt to open a
+	// replaced file: with the new DBReader if it succeeded, or the error
+	// if it failed. The previous DB continues to be used if the new one
+	// can't be opened.
+	OnReload func(rd *DBReader, err error)
+}
+
+// ReloadableReader answers queries from the DB in a file that is
+// periodically replaced - e.g., by building a new DB with DBWriter and
+// renaming it over the old one. When the file is replaced, the new DB is
+// opened and swapped in atomically; lookups that are in flight complete on
+// the old DB, which is closed once they are done. A ReloadableReader is
+// safe for concurrent use.
+type ReloadableReader struct {
+	fn  string
+	opt ReloadOptions
+
+	mu  sync.RWMutex
+	cur *reloadHandle
+
+	// identity of the last file that failed to open
+	bad os.FileInfo
+
+	// serializes reloads
+	rmu sync.Mutex
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// a reference counted DBReader; the reader is closed when the last
+// reference is released. The current reader holds one reference.
+type reloadHandle struct {
+	// first for 64-bit alignment of atomic ops on 32-bit platforms
+	refs int64
+
+	rd *DBReader
+	fi os.FileInfo
+}
+
+// NewReloadableReader opens the DB in file 'fn' and starts watching the
+// file for replacements.
+func NewReloadableReader(fn string, opt ReloadOptions) (*ReloadableReader, error) {
+	if opt.Interval == 0 {
+		opt.Interval = defaultReloadInterval
+	}
+
+	h, err := openHandle(fn, &opt)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReloadableReader{
+		fn:   fn,
+		opt:  opt,
+		cur:  h,
+		done: make(chan struct{}),
+	}
+
+	if opt.Interval > 0 {
+		r.wg.Add(1)
+		go r.watch()
+	}
+	return r, nil
+}
+
+// open the DB in 'fn' and identify it by the file that was opened - not
+// the name; the name may be replaced while it is opened.
+func openHandle(fn string, opt *ReloadOptions) (*reloadHandle, error) {
+	rd, err := newDBReader(fn, opt.Cache, opt.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := rd.fd.Stat()
+	if err != nil {
+		rd.Close()
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	h := &reloadHandle{
+		refs: 1,
+		rd:   rd,
+		fi:   fi,
+	}
+	return h, nil
+}
+
+// Find looks up 'key' in the current DB; see DBReader.Find().
+func (r *ReloadableReader) Find(key []byte) ([]byte, error) {
+	var val []byte
+
+	err := r.With(func(rd *DBReader) error {
+		var err error
+		val, err = rd.Find(key)
+		return err
+	})
+	return val, err
+}
+
+// Lookup looks up 'key' in the current DB; see DBReader.Lookup().
+func (r *ReloadableReader) Lookup(key []byte) ([]byte, bool) {
+	v, err := r.Find(key)
+	if err != nil {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// Contains returns true if 'key' is in the current DB.
+func (r *ReloadableReader) Contains(key []byte) bool {
+	var ok bool
+
+	r.With(func(rd *DBReader) error {
+		ok = rd.Contains(key)
+		return nil
+	})
+	return ok
+}
+
+// With calls 'fp' with the current DB and returns its error; the DB isn't
+// closed until 'fp' returns - even if it is replaced meanwhile. 'fp' must
+// not retain 'rd' (or slices that alias it, see DBReader.UnsafeFind())
+// after it returns.
+func (r *ReloadableReader) With(fp func(rd *DBReader) error) error {
+	h := r.acquire()
+	if h == nil {
+		return fmt.Errorf("%s: %w", r.fn, ErrClosed)
+	}
+	defer h.release()
+
+	return fp(h.rd)
+}
+
+// Reload checks if the file was replaced and if so, opens the new DB and
+// swaps it in. It returns true if the DB was replaced.
+func (r *ReloadableReader) Reload() (bool, error) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	fi, err := os.Stat(r.fn)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	cur := r.cur
+	r.mu.RUnlock()
+
+	if cur == nil || sameFile(fi, cur.fi) || (r.bad != nil && sameFile(fi, r.bad)) {
+		return false, nil
+	}
+
+	h, err := openHandle(r.fn, &r.opt)
+	if err != nil {
+		r.bad = fi
+		if r.opt.OnReload != nil {
+			r.opt.OnReload(nil, err)
+		}
+		return false, err
+	}
+
+	r.mu.Lock()
+	old := r.cur
+	r.cur = h
+	r.mu.Unlock()
+
+	r.bad = nil
+	old.release()
+
+	if r.opt.OnReload != nil {
+		r.opt.OnReload(h.rd, nil)
+	}
+	return true, nil
+}
+
+// Close stops watching the file and closes the current DB once the
+// lookups in flight are done. Lookups after Close() fail. The error is from
+// closing the DB - if there are no lookups in flight.
+func (r *ReloadableReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	r.mu.Lock()
+	h := r.cur
+	r.cur = nil
+	r.mu.Unlock()
+
+	if h == nil {
+		return nil
+	}
+	return h.release()
+}
+
+// check the file for replacements every opt.Interval
+func (r *ReloadableReader) watch() {
+	defer r.wg.Done()
+
+	t := time.NewTicker(r.opt.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+			r.Reload()
+		}
+	}
+}
+
+// return the current DB with a reference held on it; nil if the reader
+// is closed.
+func (r *ReloadableReader) acquire() *reloadHandle {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	h := r.cur
+	if h != nil {
+		atomic.AddInt64(&h.refs, 1)
+	}
+	return h
+}
+
+// drop a reference; the last one closes the DB
+func (h *reloadHandle) release() error {
+	if atomic.AddInt64(&h.refs, -1) == 0 {
+		return h.rd.Close()
+	}
+	return nil
+}
+
+// return true if 'a' and 'b' describe the same version of a file
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,122 @@
+// reload_test.go -- test suite for ReloadableReader
+
+package bbhash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// build a DB in 'fn' by writing a temp file and renaming it over 'fn'
+func buildVersion(t *testing.T, fn string, ver int) {
+	assert := newAsserter(t)
+
+	tmp := fmt.Sprintf("%s.%d.tmp", fn, ver)
+	wr, err := NewDBWriter(tmp)
+	assert(err == nil, "can't create db: %s", err)
+
+	for _, s := range keyw {
+		_, err = wr.AddKeyVals([][]byte{[]byte(s)}, [][]byte{[]byte(fmt.Sprintf("%s-%d", s, ver))})
+		assert(err == nil, "can't add key-val: %s", err)
+	}
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	err = os.Rename(tmp, fn)
+	assert(err == nil, "can't rename %s: %s", tmp, err)
+}
+
+func TestReloadableReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	buildVersion(t, fn, 1)
+
+	var reloads int
+	opt := ReloadOptions{
+		Interval: -1,
+		OnReload: func(rd *DBReader, err error) {
+			assert(err == nil && rd != nil, "reload failed: %s", err)
+			reloads++
+		},
+	}
+
+	r, err := NewReloadableReader(fn, opt)
+	assert(err == nil, "can't open reloadable db: %s", err)
+
+	key := []byte(keyw[0])
+	v, err := r.Find(key)
+	assert(err == nil && string(v) == keyw[0]+"-1", "exp version 1, saw %s: %s", v, err)
+
+	ok, err := r.Reload()
+	assert(err == nil && !ok, "reloaded an unchanged file: %s", err)
+
+	// a lookup in flight keeps using the old DB across a reload
+	err = r.With(func(rd *DBReader) error {
+		buildVersion(t, fn, 2)
+
+		ok, err := r.Reload()
+		assert(err == nil && ok, "didn't reload: %s", err)
+
+		v, err := rd.Find([]byte(keyw[1]))
+		assert(err == nil && string(v) == keyw[1]+"-1", "exp old version, saw %s: %s", v, err)
+		return nil
+	})
+	assert(err == nil, "with: %s", err)
+	assert(reloads == 1, "exp 1 reload, saw %d", reloads)
+
+	v, err = r.Find(key)
+	assert(err == nil && string(v) == keyw[0]+"-2", "exp version 2, saw %s: %s", v, err)
+
+	// a corrupt replacement is ignored
+	err = ioutil.WriteFile(fn+".bad", []byte("not a db"), 0600)
+	assert(err == nil, "can't write file: %s", err)
+	err = os.Rename(fn+".bad", fn)
+	assert(err == nil, "can't rename: %s", err)
+
+	r.opt.OnReload = nil
+	ok, err = r.Reload()
+	assert(err != nil && !ok, "reloaded a corrupt file")
+	ok, err = r.Reload()
+	assert(err == nil && !ok, "retried a corrupt file: %s", err)
+
+	v, err = r.Find(key)
+	assert(err == nil && string(v) == keyw[0]+"-2", "exp version 2, saw %s: %s", v, err)
+
+	r.Close()
+	_, err = r.Find(key)
+	assert(err != nil, "lookup after close succeeded")
+}
+
+func TestReloadPolling(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	buildVersion(t, fn, 1)
+
+	r, err := NewReloadableReader(fn, ReloadOptions{Interval: 10 * time.Millisecond})
+	assert(err == nil, "can't open reloadable db: %s", err)
+	defer r.Close()
+
+	buildVersion(t, fn, 2)
+
+	key := []byte(keyw[0])
+	var v []byte
+	for i := 0; i < 200; i++ {
+		v, err = r.Find(key)
+		assert(err == nil, "can't find key: %s", err)
+		if string(v) == keyw[0]+"-2" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(string(v) == keyw[0]+"-2", "DB wasn't reloaded")
+}
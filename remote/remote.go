@@ -0,0 +1,211 @@
+// remote.go -- read a constant DB over HTTP range requests
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package remote provides an io.ReaderAt that fetches byte ranges of a file
+// over HTTP(S) - e.g., a constant DB in S3 or other object storage (via a
+// presigned URL). Fetched blocks are cached; so the offset table and BBHash
+// are fetched once when the DB is opened and records are fetched on demand:
+//
+//	r, err := remote.New(url, remote.Options{})
+//	...
+//	rd, err := bbhash.NewDBReaderAt(r, r.Size(), 1000)
+package remote
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/opencoff/golang-lru"
+)
+
+// Default block size and number of cached blocks
+const (
+	BlockSize   int = 65536
+	CacheBlocks int = 1024
+)
+
+// Options control the fetching and caching of blocks by New(). The zero
+// value is a sensible default.
+type Options struct {
+	// Client makes the HTTP requests; http.DefaultClient if nil
+	Client *http.Client
+
+	// Header is added to every request (e.g., for authorization)
+	Header http.Header
+
+	// BlockSize is the unit of fetching and caching; reads are rounded
+	// to blocks. BlockSize if zero.
+	BlockSize int
+
+	// CacheBlocks is the number of blocks cached in memory; CacheBlocks
+	// if zero.
+	CacheBlocks int
+}
+
+// ReaderAt reads a remote file via HTTP range requests. It is safe for
+// concurrent use.
+type ReaderAt struct {
+	url    string
+	client *http.Client
+	header http.Header
+	blksz  int64
+	size   int64
+
+	// cached blocks indexed by block number
+	cache lru.Cache
+}
+
+// New prepares to read the file at 'url'; the server must support range
+// requests. Only GET requests are made; so presigned URLs work.
+func New(url string, opt Options) (*ReaderAt, error) {
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+	if opt.BlockSize <= 0 {
+		opt.BlockSize = BlockSize
+	}
+	if opt.CacheBlocks <= 0 {
+		opt.CacheBlocks = CacheBlocks
+	}
+
+	cache, err := lru.NewSimple(opt.CacheBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReaderAt{
+		url:    url,
+		client: opt.Client,
+		header: opt.Header,
+		blksz:  int64(opt.BlockSize),
+		cache:  cache,
+	}
+
+	// the size of the file is in the Content-Range of any range request;
+	// we fetch the first block and cache it.
+	b, err := r.fetch(0, r.blksz)
+	if err != nil {
+		return nil, err
+	}
+	n := r.blksz
+	if n > r.size {
+		n = r.size
+	}
+	if int64(len(b)) != n {
+		return nil, fmt.Errorf("%s: short read of block 0; exp %d, saw %d", url, n, len(b))
+	}
+
+	cache.Add(int64(0), b)
+	return r, nil
+}
+
+// Size returns the size of the remote file
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes at offset 'off' of the remote file; it
+// implements io.ReaderAt.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%s: negative offset %d", r.url, off)
+	}
+
+	var n int
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+
+		b, err := r.block(off / r.blksz)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(p[n:], b[off%r.blksz:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// return block 'i' from the cache or the server
+func (r *ReaderAt) block(i int64) ([]byte, error) {
+	if v, ok := r.cache.Get(i); ok {
+		return v.([]byte), nil
+	}
+
+	off := i * r.blksz
+	n := r.blksz
+	if off+n > r.size {
+		n = r.size - off
+	}
+
+	b, err := r.fetch(off, n)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != n {
+		return nil, fmt.Errorf("%s: short read of block %d; exp %d, saw %d", r.url, i, n, len(b))
+	}
+
+	r.cache.Add(i, b)
+	return b, nil
+}
+
+// fetch at most 'n' bytes at offset 'off'; the first fetch learns the size
+// of the file.
+func (r *ReaderAt) fetch(off, n int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%s: range request failed: %s", r.url, resp.Status)
+	}
+
+	if r.size == 0 {
+		r.size, err = contentSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", r.url, err)
+		}
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, n))
+}
+
+// parse the complete length from 'bytes first-last/size'
+func contentSize(s string) (int64, error) {
+	i := strings.LastIndexByte(s, '/')
+	if !strings.HasPrefix(s, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("bad content range '%s'", s)
+	}
+
+	z, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || z <= 0 {
+		return 0, fmt.Errorf("bad content range '%s'", s)
+	}
+	return z, nil
+}
@@ -0,0 +1,104 @@
+// remote_test.go -- test suite for the HTTP range reader
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bbhash "github.com/opencoff/go-bbhash"
+)
+
+func TestRemoteDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := filepath.Join(t.TempDir(), "mph.db")
+
+	wr, err := bbhash.NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("value %d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	img, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	var reqs int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&reqs, 1)
+		http.ServeContent(w, r, "db", time.Time{}, bytes.NewReader(img))
+	}))
+	defer srv.Close()
+
+	r, err := New(srv.URL, Options{BlockSize: 4096})
+	assert(err == nil, "can't open remote db: %s", err)
+	assert(r.Size() == int64(len(img)), "exp size %d, saw %d", len(img), r.Size())
+
+	rd, err := bbhash.NewDBReaderAt(r, r.Size(), 10)
+	assert(err == nil, "can't open db: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: exp '%s', saw '%s'", k, vals[i], v)
+	}
+
+	// every block is fetched once
+	nblk := (int64(len(img)) + 4095) / 4096
+	n := atomic.LoadInt64(&reqs)
+	assert(n <= nblk, "exp at most %d requests, saw %d", nblk, n)
+
+	// a read spanning blocks and the end of the file
+	b := make([]byte, 5000)
+	m, err := r.ReadAt(b, int64(len(img))-4500)
+	assert(m == 4500 && err != nil, "bad read at the end: %d bytes, %v", m, err)
+	assert(bytes.Equal(b[:m], img[len(img)-4500:]), "data mismatch at the end")
+}
+
+func TestNoRanges(t *testing.T) {
+	assert := newAsserter(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("no ranges here"))
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, Options{})
+	assert(err != nil, "opened a server without range support")
+}
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
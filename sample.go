@@ -0,0 +1,72 @@
+// sample.go -- random samples of the records of a DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Sample returns 'n' distinct records of the DB picked uniformly at random -
+// e.g., to spot check the data of a production DB or to build test
+// fixtures from it. If the DB has fewer than 'n' records, all of them are
+// returned. Expired records are sampled too; the records are returned in
+// the order of the offset table and are not cached.
+func (rd *DBReader) Sample(n int) ([]Record, error) {
+	if !rd.enter() {
+		return nil, ErrClosed
+	}
+	defer rd.leave()
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	idx := sampleIndex(rd.nkeys, uint64(n))
+	recs := make([]Record, 0, len(idx))
+	for _, i := range idx {
+		r, err := rd.decodeRecord(rd.offset(i))
+		if err != nil {
+			return nil, err
+		}
+		if err = rd.decodeValue(r); err != nil {
+			return nil, err
+		}
+		recs = append(recs, *r.export())
+	}
+	return recs, nil
+}
+
+// return 'n' distinct random integers in [0, max) in ascending order -
+// using Floyd's algorithm.
+func sampleIndex(max, n uint64) []uint64 {
+	if n >= max {
+		idx := make([]uint64, max)
+		for i := range idx {
+			idx[i] = uint64(i)
+		}
+		return idx
+	}
+
+	seen := make(map[uint64]bool, n)
+	idx := make([]uint64, 0, n)
+	for j := max - n; j < max; j++ {
+		t := uint64(rand.Int63n(int64(j + 1)))
+		if seen[t] {
+			t = j
+		}
+		seen[t] = true
+		idx = append(idx, t)
+	}
+
+	sort.Slice(idx, func(i, j int) bool {
+		return idx[i] < idx[j]
+	})
+	return idx
+}
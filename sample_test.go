@@ -0,0 +1,72 @@
+// sample_test.go -- test suite for random samples of records
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	recs, err := rd.Sample(0)
+	assert(err == nil && len(recs) == 0, "empty sample: %d records, %v", len(recs), err)
+
+	for _, n := range []int{1, 10, 500, 2000} {
+		recs, err := rd.Sample(n)
+		assert(err == nil, "%d: sample failed: %s", n, err)
+
+		exp := n
+		if exp > len(keys) {
+			exp = len(keys)
+		}
+		assert(len(recs) == exp, "%d: exp %d records, saw %d", n, exp, len(recs))
+
+		seen := make(map[string]bool)
+		for _, r := range recs {
+			k := string(r.Key)
+			assert(!seen[k], "%d: duplicate key %s", n, k)
+			seen[k] = true
+
+			v, err := rd.Find(r.Key)
+			assert(err == nil, "%d: can't find key %s: %s", n, k, err)
+			assert(bytes.Equal(v, r.Value), "%d: key %s: value mismatch", n, k)
+		}
+	}
+
+	// every index is about equally likely
+	const trials = 20000
+	var freq [10]int
+	for i := 0; i < trials; i++ {
+		for _, j := range sampleIndex(10, 3) {
+			freq[j]++
+		}
+	}
+	for j, f := range freq {
+		assert(f > 5000 && f < 7000, "index %d picked %d times; exp about 6000", j, f)
+	}
+}
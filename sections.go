@@ -0,0 +1,115 @@
+// sections.go -- optional sections in the constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Optional data in the DB (e.g., user metadata) is written as a series of
+// tagged sections immediately after the marshaled BBHash. The file header
+// records the offset of the first section; the sections are covered by the
+// strong checksum. Each section is:
+//   - tag    uint32  section type
+//   - len    uint64  length of the section data
+//   - data   []byte  len bytes of data
+//
+// The list of sections is terminated by a section with tag 'secEnd' and no
+// data. All integers are big-endian.
+const (
+	secEnd    uint32 = 0
+	secMeta   uint32 = 1 // user metadata
+	secBase   uint32 = 2 // checksum of the base DB of a delta DB
+	secBlocks uint32 = 3 // index of the compressed blocks (see compress.go)
+	secBloom  uint32 = 4 // Bloom filter of the keys (see bloom.go)
+	secSegs   uint32 = 5 // checksums of the segments of the records (see segments.go)
+	secNorm   uint32 = 6 // name of the key normalizer (see normalize.go)
+	secData   uint32 = 7 // checksum of the records (see datasum.go)
+)
+
+// a tagged section
+type section struct {
+	tag  uint32
+	data []byte
+}
+
+// size of the encoded sections in 's' - including the terminator
+func sectionsSize(s []section) uint64 {
+	z := uint64(12)
+	for i := range s {
+		z += 12 + uint64(len(s[i].data))
+	}
+	return z
+}
+
+// write sections 's' followed by the terminator
+func writeSections(w io.Writer, s []section) error {
+	var b [12]byte
+
+	be := binary.BigEndian
+	put := func(tag uint32, data []byte) error {
+		be.PutUint32(b[:4], tag)
+		be.PutUint64(b[4:], uint64(len(data)))
+		if _, err := w.Write(b[:]); err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := range s {
+		if err := put(s[i].tag, s[i].data); err != nil {
+			return err
+		}
+	}
+	return put(secEnd, nil)
+}
+
+// read sections from 'r' which has at most 'max' bytes of sections.
+// Unknown tags are ignored so that newer writers can add sections that older
+// readers don't know about.
+func readSections(r io.Reader, max uint64) (map[uint32][]byte, error) {
+	var b [12]byte
+
+	be := binary.BigEndian
+	m := make(map[uint32][]byte)
+	for {
+		if max < 12 {
+			return nil, fmt.Errorf("%w: truncated section list", ErrCorrupt)
+		}
+
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		max -= 12
+
+		tag := be.Uint32(b[:4])
+		n := be.Uint64(b[4:])
+		if tag == secEnd {
+			return m, nil
+		}
+
+		if n > max {
+			return nil, fmt.Errorf("%w: section %d: length %d out of bounds", ErrCorrupt, tag, n)
+		}
+
+		d := make([]byte, n)
+		if _, err := io.ReadFull(r, d); err != nil {
+			return nil, err
+		}
+		max -= n
+		m[tag] = d
+	}
+}
@@ -0,0 +1,232 @@
+// segments.go -- checksums of the segments of the records
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// A DB built with WriterOptions.SegmentSize splits the records - the
+// bytes of the file from the end of the file header to the end of the
+// last record (or compressed block) - into segments of SegmentSize bytes
+// and stores the SHA512-256 of each in the section 'secSegs':
+//   - size   uint64   size of a segment; the last may be shorter
+//   - end    uint64   file offset of the end of the records
+//   - sums   [][32]byte  checksum of each segment
+//
+// The section is covered by the strong checksum of the metadata; so the
+// checksums of the segments are trusted once the metadata is verified.
+// A reader can then verify just the segments it reads
+// (ReaderOptions.VerifySegments) and a verifier can tell which segments
+// of a damaged DB are corrupt (DBReader.VerifySegments()).
+
+// bounds of WriterOptions.SegmentSize
+const (
+	minSegmentSize = 4096
+	maxSegmentSize = 1 << 30
+
+	// DefaultSegmentSize is a good choice of WriterOptions.SegmentSize
+	DefaultSegmentSize = 16 * 1024 * 1024
+)
+
+// state of a segment
+const (
+	segUnknown uint32 = iota
+	segGood
+	segBad
+)
+
+// checksums of the segments of a DB
+type segments struct {
+	// segments are read from 'ra'
+	ra io.ReaderAt
+
+	size uint64
+	end  uint64
+
+	// SHA512-256 of each segment and its state
+	sums  []byte
+	state []uint32
+}
+
+// return the section 'secSegs' of the records of the DB in 'ra' that
+// end at 'end'
+func segmentSums(ra io.ReaderAt, size, end uint64) ([]byte, error) {
+	var b [16]byte
+
+	binary.BigEndian.PutUint64(b[:8], size)
+	binary.BigEndian.PutUint64(b[8:], end)
+
+	s := append([]byte{}, b[:]...)
+	sums, errs := chunkSums(ra, 64, int64(end-64), int64(size))
+	for i := range sums {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		s = append(s, sums[i]...)
+	}
+	return s, nil
+}
+
+// decode the section 'secSegs' of a DB whose offset table is at
+// 'offtbl'
+func newSegments(b []byte, offtbl uint64) (*segments, error) {
+	if len(b) < 16 {
+		return nil, fmt.Errorf("%w: segment checksums too small", ErrCorrupt)
+	}
+
+	be := binary.BigEndian
+	s := &segments{
+		size: be.Uint64(b[:8]),
+		end:  be.Uint64(b[8:16]),
+		sums: b[16:],
+	}
+
+	if s.size < minSegmentSize || s.size > maxSegmentSize || (s.size&(s.size-1)) != 0 {
+		return nil, fmt.Errorf("%w: invalid segment size %d", ErrCorrupt, s.size)
+	}
+	if s.end < 64 || s.end > offtbl {
+		return nil, fmt.Errorf("%w: segments end at %d; exp at most %d", ErrCorrupt, s.end, offtbl)
+	}
+
+	n := (s.end - 64 + s.size - 1) / s.size
+	if uint64(len(s.sums)) != n*32 {
+		return nil, fmt.Errorf("%w: %d bytes of checksums for %d segments", ErrCorrupt, len(s.sums), n)
+	}
+
+	s.state = make([]uint32, n)
+	return s, nil
+}
+
+// return the file offset and size of segment 'i'
+func (s *segments) segment(i int) (uint64, uint64) {
+	off := 64 + uint64(i)*s.size
+	sz := s.size
+	if off+sz > s.end {
+		sz = s.end - off
+	}
+	return off, sz
+}
+
+// verify segment 'i' - unless it was verified earlier
+func (s *segments) verify(i int) error {
+	switch atomic.LoadUint32(&s.state[i]) {
+	case segGood:
+		return nil
+	case segBad:
+		return s.badsum(i)
+	}
+
+	off, sz := s.segment(i)
+	h := sha512.New512_256()
+	nw, err := io.Copy(h, io.NewSectionReader(s.ra, int64(off), int64(sz)))
+	if err != nil {
+		return err
+	}
+	if nw != int64(sz) {
+		return fmt.Errorf("partial read of segment at off %d, exp %d, saw %d: %w", off, sz, nw, ErrTooSmall)
+	}
+	return s.check(i, h.Sum(nil))
+}
+
+// compare the checksum 'csum' of segment 'i' with the expected one and
+// record its state
+func (s *segments) check(i int, csum []byte) error {
+	if !bytes.Equal(csum, s.sums[i*32:i*32+32]) {
+		atomic.StoreUint32(&s.state[i], segBad)
+		return s.badsum(i)
+	}
+	atomic.StoreUint32(&s.state[i], segGood)
+	return nil
+}
+
+func (s *segments) badsum(i int) error {
+	off, _ := s.segment(i)
+	return &SegmentError{Size: s.size, Offsets: []uint64{off}}
+}
+
+// verify the segments that hold the 'n' bytes at 'off'
+func (s *segments) verifyRange(off int64, n int) error {
+	if n == 0 || uint64(off) >= s.end || off+int64(n) <= 64 {
+		return nil
+	}
+
+	first := 0
+	if off > 64 {
+		first = int((uint64(off) - 64) / s.size)
+	}
+
+	last := int((uint64(off+int64(n)) - 1 - 64) / s.size)
+	if last >= len(s.state) {
+		last = len(s.state) - 1
+	}
+
+	for i := first; i <= last; i++ {
+		if err := s.verify(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentReader verifies the segments of a DB before they are first read
+// - if the reader verifies segments (ReaderOptions.VerifySegments).
+type segmentReader struct {
+	io.ReaderAt
+	rd *DBReader
+}
+
+func (r *segmentReader) ReadAt(p []byte, off int64) (int, error) {
+	if r.rd.vsegs {
+		if err := r.rd.segs.verifyRange(off, len(p)); err != nil {
+			return 0, r.rd.badsum(err)
+		}
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// VerifySegments verifies the checksums of all the segments of the
+// records of a DB built with WriterOptions.SegmentSize; the segments are
+// verified concurrently. If any are corrupt, it returns a SegmentError
+// with the offsets of all of them. Unlike VerifyAll(), it doesn't decode
+// the records; it only reads the file.
+func (rd *DBReader) VerifySegments() error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	defer rd.leave()
+
+	s := rd.segs
+	if s == nil {
+		return fmt.Errorf("%s: DB has no segment checksums", rd.fn)
+	}
+
+	sums, errs := chunkSums(s.ra, 64, int64(s.end-64), int64(s.size))
+
+	var bad []uint64
+	for i := range sums {
+		if errs[i] != nil {
+			return fmt.Errorf("%s: i/o error: %w", rd.fn, errs[i])
+		}
+		if err := s.check(i, sums[i]); err != nil {
+			off, _ := s.segment(i)
+			bad = append(bad, off)
+		}
+	}
+
+	if len(bad) > 0 {
+		return rd.badsum(fmt.Errorf("%s: %w", rd.fn, &SegmentError{Size: s.size, Offsets: bad}))
+	}
+	return nil
+}
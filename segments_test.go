@@ -0,0 +1,100 @@
+// segments_test.go -- test suite for the segment checksums
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	_, err := NewDBWriterWithOptions(fn, WriterOptions{SegmentSize: 5000})
+	assert(err != nil, "created a DB with segments of 5000 bytes")
+
+	keys := make([][]byte, 2000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("%0200d", i))
+	}
+
+	modes := []LoadMode{LoadFile, LoadMmap, LoadMemory, LoadDirect}
+	for _, compress := range []bool{true, false} {
+		wr, err := NewDBWriterWithOptions(fn, WriterOptions{SegmentSize: 4096, Compress: compress})
+		assert(err == nil, "can't create db: %s", err)
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		for _, m := range modes {
+			rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, VerifySegments: true})
+			assert(err == nil, "%v: can't open db: %s", m, err)
+			assert(rd.Info().SegmentSize == 4096, "%v: segment size %d", m, rd.Info().SegmentSize)
+
+			for i, k := range keys {
+				v, err := rd.Find(k)
+				assert(err == nil, "%v: can't find key %s: %s", m, k, err)
+				assert(bytes.Equal(v, vals[i]), "%v: key %s: value mismatch", m, k)
+			}
+
+			err = rd.VerifySegments()
+			assert(err == nil, "%v: verify segments failed: %s", m, err)
+			rd.Close()
+		}
+	}
+
+	// corrupt a byte in the 6th segment of the uncompressed DB
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	bad := uint64(64 + 5*4096)
+	b[bad+100] ^= 0x1
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	for _, m := range modes {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, VerifySegments: true})
+		assert(err == nil, "%v: can't open db: %s", m, err)
+
+		var serr *SegmentError
+
+		err = rd.VerifySegments()
+		assert(errors.As(err, &serr), "%v: verify segments: %v", m, err)
+		assert(errors.Is(err, ErrBadChecksum) && errors.Is(err, ErrCorrupt), "%v: error doesn't match: %v", m, err)
+		assert(serr.Size == 4096, "%v: segment size %d", m, serr.Size)
+		assert(len(serr.Offsets) == 1 && serr.Offsets[0] == bad, "%v: bad segments %v", m, serr.Offsets)
+
+		var found, failed int
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			if err != nil {
+				assert(errors.As(err, &serr), "%v: key %s: %v", m, k, err)
+				assert(serr.Offsets[0] == bad, "%v: key %s: bad segment %v", m, k, serr.Offsets)
+				failed++
+				continue
+			}
+			assert(bytes.Equal(v, vals[i]), "%v: key %s: value mismatch", m, k)
+			found++
+		}
+		assert(failed > 0 && found > 0, "%v: found %d, failed %d", m, found, failed)
+		rd.Close()
+	}
+
+	// the corrupt record is found without verifying segments
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "can't open db: %s", err)
+	defer rd.Close()
+
+	err = rd.VerifyAll()
+	assert(errors.Is(err, ErrBadChecksum), "verify all: %v", err)
+}
@@ -0,0 +1,863 @@
+// shard.go -- constant DB split across several shard files
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A sharded DB is a set of N independent DBs (shards) and a small JSON
+// manifest that ties them together. Keys are routed to a shard by a hash of
+// the key with a seed recorded in the manifest. Each shard is a regular DB
+// and can be opened on its own by NewDBReader().
+//
+// The manifest names the shard files relative to the directory of the
+// manifest and records the strong checksum of each shard; readers refuse to
+// open shards that don't belong to the manifest. Keys of a DB built with
+// WriterOptions.StdlibHash are routed with the standard library hash; its
+// manifest says so in 'hash'.
+type manifest struct {
+	Version int             `json:"version"`
+	Seed    uint64          `json:"seed"`
+	Hash    string          `json:"hash,omitempty"`
+	Shards  []shardManifest `json:"shards"`
+}
+
+type shardManifest struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+}
+
+const manifestVersion = 1
+
+// name of the standard library hash in a manifest
+const manifestStdHash = "stdlib"
+
+// max number of shards in a sharded DB
+const maxShards = 65536
+
+// ShardedDBWriter constructs a DB as 'nshards' shard files and a manifest.
+// It has the same Add functions as DBWriter - and they are safe for
+// concurrent use; the DB is written to disk via Freeze(). Readers open it with NewShardedDBReader().
+type ShardedDBWriter struct {
+	shards []*DBWriter
+	seed   uint64
+	std    bool
+
+	// source of the seed, shard seeds and temp file names
+	rng *rng
+
+	keysOnly bool
+	strict   bool
+
+	perm   os.FileMode
+	fn     string
+	frozen bool
+
+	// set when the manifest can't be written; the shards are gone
+	closed bool
+
+	mu sync.Mutex
+}
+
+// NewShardedDBWriter prepares to write a sharded DB with 'nshards' shards.
+// The manifest is written to 'fn' and the shards to 'fn.0', 'fn.1' etc. Every
+// shard is built with the options in 'opt'; building a sharded delta DB is
+// not supported. The limits in 'opt' apply to each shard. In a
+// reproducible build, the seed of every shard is derived from opt.Seed.
+func NewShardedDBWriter(fn string, nshards int, opt WriterOptions) (*ShardedDBWriter, error) {
+	if nshards <= 0 || nshards > maxShards {
+		return nil, fmt.Errorf("%s: invalid number of shards %d", fn, nshards)
+	}
+
+	if opt.Base != nil {
+		return nil, fmt.Errorf("%s: sharded delta DBs are not supported", fn)
+	}
+
+	if opt.Perm == 0 {
+		opt.Perm = 0600
+	}
+
+	r := newRng(opt.Reproducible, opt.Seed)
+	s := &ShardedDBWriter{
+		shards:   make([]*DBWriter, nshards),
+		seed:     r.next(),
+		std:      opt.StdlibHash || !haveExtHash,
+		rng:      r,
+		keysOnly: opt.KeysOnly,
+		strict:   opt.Strict,
+		perm:     opt.Perm,
+		fn:       fn,
+	}
+
+	for i := range s.shards {
+		opt.Seed = r.next()
+		w, err := NewDBWriterWithOptions(shardName(fn, i), opt)
+		if err != nil {
+			s.abort(i)
+			return nil, err
+		}
+		s.shards[i] = w
+	}
+
+	return s, nil
+}
+
+// SetMetadata attaches an application defined blob 'b' to every shard of the
+// DB; see DBWriter.SetMetadata().
+func (s *ShardedDBWriter) SetMetadata(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.frozen {
+		return ErrFrozen
+	}
+
+	for _, w := range s.shards {
+		if err := w.SetMetadata(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TotalKeys returns the total number of distinct keys across all the shards.
+func (s *ShardedDBWriter) TotalKeys() int {
+	var n int
+	for _, w := range s.shards {
+		n += w.TotalKeys()
+	}
+	return n
+}
+
+// AddKeyVals adds a series of key-value matched pairs to the db; see
+// DBWriter.AddKeyVals().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddKeyVals(keys [][]byte, vals [][]byte) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
+	}
+
+	var z uint64
+	for i := 0; i < n; i++ {
+		r := &record{
+			key: keys[i],
+			val: vals[i],
+		}
+		ok, err := s.addRecord(r)
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// AddKeyValsWithExpiry adds a series of key-value matched pairs that expire
+// at time 'expiry'; see DBWriter.AddKeyValsWithExpiry().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddKeyValsWithExpiry(keys [][]byte, vals [][]byte, expiry time.Time) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
+	}
+
+	var z uint64
+	for i := 0; i < n; i++ {
+		w := s.shards[shardOf(s.std, s.seed, s.shards[0].normKey(keys[i]), len(s.shards))]
+		m, err := w.AddKeyValsWithExpiry(keys[i:i+1], vals[i:i+1], expiry)
+		if err != nil {
+			return z, err
+		}
+		z += m
+	}
+
+	return z, nil
+}
+
+// AddKeyValsWithFlags is like AddKeyVals except the records carry the
+// application flags 'flags'; see DBWriter.AddKeyValsWithFlags().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddKeyValsWithFlags(keys [][]byte, vals [][]byte, flags byte) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
+	}
+
+	var z uint64
+	for i := 0; i < n; i++ {
+		w := s.shards[shardOf(s.std, s.seed, s.shards[0].normKey(keys[i]), len(s.shards))]
+		m, err := w.AddKeyValsWithFlags(keys[i:i+1], vals[i:i+1], flags)
+		if err != nil {
+			return z, err
+		}
+		z += m
+	}
+
+	return z, nil
+}
+
+// AddKeys adds a series of keys with no values to a sharded key set; see
+// DBWriter.AddKeys().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddKeys(keys [][]byte) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	if !s.keysOnly {
+		return 0, ErrNotKeySet
+	}
+
+	var z uint64
+	for _, k := range keys {
+		ok, err := s.addRecord(&record{key: k})
+		if err != nil {
+			return z, err
+		}
+		if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// AddTextFile adds contents from text file 'fn' where key and value are separated
+// by one of the characters in 'delim'; see DBWriter.AddTextFile().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddTextFile(fn string, delim string) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(delim) == 0 {
+		delim = " \t"
+	}
+
+	defer fd.Close()
+
+	return s.AddTextStream(fd, delim)
+}
+
+// AddTextStream adds contents from text stream 'fd' where key and value are separated
+// by one of the characters in 'delim'; see DBWriter.AddTextStream().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddTextStream(fd io.Reader, delim string) (uint64, error) {
+	return s.AddTextStreamFunc(fd, delimParser(delim, s.keysOnly))
+}
+
+// AddTextStreamFunc adds contents from text stream 'fd' where each line is
+// parsed into a key and value by 'parse'; see DBWriter.AddTextStreamFunc().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddTextStreamFunc(fd io.Reader, parse func(line string) (key, val []byte, ok bool)) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	ch, ps := textRecords(fd, parse, s.strict)
+	n, err := addFromChan(ch, s.addParsed)
+	if err != nil {
+		return n, err
+	}
+
+	return n, ps.err
+}
+
+// AddGobStream adds the records from gob stream 'fd'; see
+// DBWriter.AddGobStream().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddGobStream(fd io.Reader) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	ch, ps := gobRecords(fd)
+	return s.addFromParser(ch, ps)
+}
+
+// AddMsgpackStream adds the records from msgpack stream 'fd'; see
+// DBWriter.AddMsgpackStream().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddMsgpackStream(fd io.Reader) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	ch, ps := msgpackRecords(fd)
+	return s.addFromParser(ch, ps)
+}
+
+// add the records sent by a parser on 'ch'
+func (s *ShardedDBWriter) addFromParser(ch chan *record, ps *parseState) (uint64, error) {
+	n, err := addFromChan(ch, s.addParsed)
+	if err != nil {
+		return n, err
+	}
+
+	// ps is safe to read once the channel is closed
+	return n, ps.err
+}
+
+// AddCSVFile adds contents from CSV file 'fn'; see DBWriter.AddCSVFile().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddCSVFile(fn string, comma, comment rune, kwfield, valfield int) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	return s.AddCSVStream(fd, comma, comment, kwfield, valfield)
+}
+
+// AddCSVStream adds contents from CSV stream 'fd'; see DBWriter.AddCSVStream().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddCSVStream(fd io.Reader, comma, comment rune, kwfield, valfield int) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	if kwfield < 0 {
+		kwfield = 0
+	}
+
+	if valfield < 0 {
+		valfield = 1
+	}
+
+	opt := &CSVOptions{
+		Comma:   comma,
+		Comment: comment,
+	}
+
+	ch, ps, err := csvRecords(fd, opt, kwfield, valfield, s.strict)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := addFromChan(ch, s.addParsed)
+	if err != nil {
+		return n, err
+	}
+
+	return n, ps.err
+}
+
+// AddCSVFileWithOptions adds contents from CSV file 'fn' parsed as described
+// by 'opt'; see DBWriter.AddCSVFileWithOptions().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddCSVFileWithOptions(fn string, opt CSVOptions) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	defer fd.Close()
+
+	return s.AddCSVStreamWithOptions(fd, opt)
+}
+
+// AddCSVStreamWithOptions adds contents from CSV stream 'fd' parsed as
+// described by 'opt'; see DBWriter.AddCSVStreamWithOptions().
+// Returns number of records added.
+func (s *ShardedDBWriter) AddCSVStreamWithOptions(fd io.Reader, opt CSVOptions) (uint64, error) {
+	if s.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	kwfield, valfield := opt.fields()
+	ch, ps, err := csvRecords(fd, &opt, kwfield, valfield, s.strict)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := addFromChan(ch, s.addParsed)
+	if err != nil {
+		return n, err
+	}
+
+	return n, ps.err
+}
+
+// Freeze builds the minimal perfect hash of every shard using gamma 'g',
+// writes the shards and finally the manifest. See DBWriter.Freeze(). If
+// the manifest can't be written, the shards are removed and the writer
+// is closed.
+func (s *ShardedDBWriter) Freeze(g float64) error {
+	return s.freeze(func(w *DBWriter) error {
+		return w.Freeze(g)
+	})
+}
+
+// FreezeAuto is like Freeze except the gamma of each shard is picked
+// automatically; see DBWriter.FreezeAuto().
+func (s *ShardedDBWriter) FreezeAuto() error {
+	return s.freeze(func(w *DBWriter) error {
+		return w.FreezeAuto()
+	})
+}
+
+// freeze every shard via 'freeze' and write the manifest
+func (s *ShardedDBWriter) freeze(freeze func(w *DBWriter) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.frozen {
+		return ErrFrozen
+	}
+	if s.closed {
+		return ErrClosed
+	}
+
+	m := &manifest{
+		Version: manifestVersion,
+		Seed:    s.seed,
+		Shards:  make([]shardManifest, len(s.shards)),
+	}
+
+	if s.std {
+		m.Hash = manifestStdHash
+	}
+
+	// shards frozen by a previous failed attempt are left alone; the
+	// caller can retry with a larger gamma or Abort().
+	for i, w := range s.shards {
+		if !w.frozen {
+			if err := freeze(w); err != nil {
+				return err
+			}
+		}
+
+		m.Shards[i] = shardManifest{
+			Name:     filepath.Base(w.fn),
+			Checksum: hex.EncodeToString(w.csum[:]),
+		}
+	}
+
+	// the shards are useless without the manifest; they are removed
+	// if it can't be written.
+	if err := s.writeManifest(m); err != nil {
+		s.abort(len(s.shards))
+		s.closed = true
+		return err
+	}
+
+	s.frozen = true
+	return syncDir(filepath.Dir(s.fn))
+}
+
+// write the manifest 'm' to a temp file and rename it to the DB; the
+// manifest is written last - readers never see a partially built
+// sharded DB.
+func (s *ShardedDBWriter) writeManifest(m *manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp.%d", s.fn, s.rng.next())
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.perm)
+	if err != nil {
+		return err
+	}
+
+	if err = fd.Chmod(s.perm); err == nil {
+		if _, err = fd.Write(b); err == nil {
+			err = fd.Sync()
+		}
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Abort stops the construction of the sharded DB; shards that are already
+// frozen are removed.
+func (s *ShardedDBWriter) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.abort(len(s.shards))
+}
+
+// abort the first 'n' shards
+func (s *ShardedDBWriter) abort(n int) {
+	for _, w := range s.shards[:n] {
+		if w.frozen {
+			os.Remove(w.fn)
+		} else {
+			w.Abort()
+		}
+	}
+}
+
+// return true if the DB is frozen
+func (s *ShardedDBWriter) isFrozen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.frozen
+}
+
+// route record 'r' to its shard; keys are routed by their normalized form
+func (s *ShardedDBWriter) addRecord(r *record) (bool, error) {
+	w := s.shards[shardOf(s.std, s.seed, s.shards[0].normKey(r.key), len(s.shards))]
+	return w.addRecord(r)
+}
+
+// add a record read from text or CSV input; oversized records are skipped
+// unless we are strict.
+func (s *ShardedDBWriter) addParsed(r *record) (bool, error) {
+	ok, err := s.addRecord(r)
+	if err != nil && !s.strict && isSizeLimit(err) {
+		return false, nil
+	}
+	return ok, err
+}
+
+// ShardedDBReader represents the query interface for a sharded DB built
+// with NewShardedDBWriter(). Lookups are routed to the shard holding the key.
+type ShardedDBReader struct {
+	shards []*DBReader
+	seed   uint64
+	std    bool
+
+	fn string
+}
+
+// NewShardedDBReader opens the sharded DB whose manifest is in 'fn' and
+// prepares it for querying. Each shard retains upto 'cache' number of
+// records in memory.
+func NewShardedDBReader(fn string, cache int) (*ShardedDBReader, error) {
+	return newShardedDBReader(fn, cache, nil)
+}
+
+// NewEncryptedShardedDBReader is like NewShardedDBReader except it opens a
+// sharded DB whose shards were encrypted with 'key'.
+func NewEncryptedShardedDBReader(fn string, cache int, key []byte) (*ShardedDBReader, error) {
+	return newShardedDBReader(fn, cache, key)
+}
+
+func newShardedDBReader(fn string, cache int, key []byte) (*ShardedDBReader, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: can't parse manifest: %w", fn, err)
+	}
+
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d", fn, m.Version)
+	}
+
+	if len(m.Shards) == 0 || len(m.Shards) > maxShards {
+		return nil, fmt.Errorf("%s: invalid number of shards %d", fn, len(m.Shards))
+	}
+
+	switch m.Hash {
+	case manifestStdHash:
+	case "":
+		if !haveExtHash {
+			return nil, fmt.Errorf("%s: DB needs the fasthash hash; not in a bbhash_stdlib build", fn)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported key hash %q", fn, m.Hash)
+	}
+
+	s := &ShardedDBReader{
+		shards: make([]*DBReader, 0, len(m.Shards)),
+		seed:   m.Seed,
+		std:    m.Hash == manifestStdHash,
+		fn:     fn,
+	}
+
+	dn := filepath.Dir(fn)
+	for i := range m.Shards {
+		sm := &m.Shards[i]
+
+		// shards always live next to the manifest
+		if sm.Name != filepath.Base(sm.Name) {
+			s.Close()
+			return nil, fmt.Errorf("%s: invalid shard name %q", fn, sm.Name)
+		}
+
+		rd, err := newDBReader(filepath.Join(dn, sm.Name), cache, key)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.shards = append(s.shards, rd)
+
+		csum, err := hex.DecodeString(sm.Checksum)
+		if err != nil || !bytes.Equal(csum, rd.csum[:]) {
+			s.Close()
+			return nil, fmt.Errorf("%s: %w", rd.fn, ErrShardMismatch)
+		}
+	}
+
+	return s, nil
+}
+
+// TotalKeys returns the total number of distinct keys across all the shards.
+func (s *ShardedDBReader) TotalKeys() int {
+	var n int
+	for _, rd := range s.shards {
+		n += rd.TotalKeys()
+	}
+	return n
+}
+
+// Metadata returns the application defined metadata of the DB; see
+// ShardedDBWriter.SetMetadata().
+func (s *ShardedDBReader) Metadata() []byte {
+	return s.shards[0].Metadata()
+}
+
+// Find looks up 'key' in its shard and returns the corresponding value.
+// If the key is not found, an error is returned.
+func (s *ShardedDBReader) Find(key []byte) ([]byte, error) {
+	return s.shard(key).Find(key)
+}
+
+// FindWithFlags is like Find except it also returns the application flags
+// of the record; see DBReader.FindWithFlags().
+func (s *ShardedDBReader) FindWithFlags(key []byte) ([]byte, byte, error) {
+	return s.shard(key).FindWithFlags(key)
+}
+
+// Lookup looks up 'key' in its shard. If the key is not found, value is nil
+// and returns false.
+func (s *ShardedDBReader) Lookup(key []byte) ([]byte, bool) {
+	return s.shard(key).Lookup(key)
+}
+
+// Contains returns true if 'key' is in the DB.
+func (s *ShardedDBReader) Contains(key []byte) bool {
+	return s.shard(key).Contains(key)
+}
+
+// Exists is like Contains except it returns an error if the record can't be
+// read; see DBReader.Exists().
+func (s *ShardedDBReader) Exists(key []byte) (bool, error) {
+	return s.shard(key).Exists(key)
+}
+
+// FindIn is like Find except it looks up 'key' in namespace 'ns'; see
+// DBReader.FindIn().
+func (s *ShardedDBReader) FindIn(ns uint8, key []byte) ([]byte, error) {
+	return s.shard(key).FindIn(ns, key)
+}
+
+// FindInto is like Find except the value is read into 'dst'; see
+// DBReader.FindInto().
+func (s *ShardedDBReader) FindInto(key, dst []byte) ([]byte, error) {
+	return s.shard(key).FindInto(key, dst)
+}
+
+// FindString is like Find except the key is a string; see
+// DBReader.FindString().
+func (s *ShardedDBReader) FindString(key string) ([]byte, error) {
+	return s.Find(stringBytes(key))
+}
+
+// LookupString is like Lookup except the key is a string; see
+// DBReader.FindString().
+func (s *ShardedDBReader) LookupString(key string) ([]byte, bool) {
+	return s.Lookup(stringBytes(key))
+}
+
+// GetRecord returns the record of 'key'; see DBReader.GetRecord(). The
+// offset of the record is in its shard.
+func (s *ShardedDBReader) GetRecord(key []byte) (*Record, error) {
+	return s.shard(key).GetRecord(key)
+}
+
+// FindMany looks up all the keys in 'keys' - in batches per shard; see
+// DBReader.FindMany().
+func (s *ShardedDBReader) FindMany(keys [][]byte) ([][]byte, []error) {
+	vals := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	// index of the keys in each shard
+	idx := make([][]int, len(s.shards))
+	for i, k := range keys {
+		j := shardOf(s.std, s.seed, s.shards[0].normKey(k), len(s.shards))
+		idx[j] = append(idx[j], i)
+	}
+
+	for j, v := range idx {
+		if len(v) == 0 {
+			continue
+		}
+
+		batch := make([][]byte, len(v))
+		for n, i := range v {
+			batch[n] = keys[i]
+		}
+
+		bv, be := s.shards[j].FindMany(batch)
+		for n, i := range v {
+			vals[i], errs[i] = bv[n], be[n]
+		}
+	}
+	return vals, errs
+}
+
+// Iter returns an iterator over all the records of all the shards; see
+// DBReader.Iter().
+func (s *ShardedDBReader) Iter() *Iterator {
+	return newIterator(s.shards)
+}
+
+// Range calls 'fp' for every record of the DB in the order of Iter();
+// iteration stops when 'fp' returns false.
+func (s *ShardedDBReader) Range(fp func(key, val []byte) bool) error {
+	return rangeIter(s.Iter(), fp)
+}
+
+// Keys calls 'fp' for the key of every record of the DB in the order of
+// Iter(); iteration stops when 'fp' returns false. See DBReader.Keys().
+func (s *ShardedDBReader) Keys(fp func(key []byte) bool) error {
+	return keysIter(s.Iter(), fp)
+}
+
+// VerifyAll verifies every record of every shard; see
+// DBReader.VerifyAll().
+func (s *ShardedDBReader) VerifyAll() error {
+	for _, rd := range s.shards {
+		if err := rd.VerifyAll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the lookup statistics of all the shards put together; see
+// DBReader.Stats().
+func (s *ShardedDBReader) Stats() ReaderStats {
+	var st ReaderStats
+	var nsec time.Duration
+
+	for _, rd := range s.shards {
+		x := rd.Stats()
+		st.Lookups += x.Lookups
+		st.CacheHits += x.CacheHits
+		st.CacheMisses += x.CacheMisses
+		st.NegativeHits += x.NegativeHits
+		st.BloomRejects += x.BloomRejects
+		st.FingerprintRejects += x.FingerprintRejects
+		st.Reads += x.Reads
+		st.BytesRead += x.BytesRead
+		st.ChecksumFailures += x.ChecksumFailures
+		nsec += x.Latency * time.Duration(x.Lookups)
+	}
+
+	if st.Lookups > 0 {
+		st.Latency = nsec / time.Duration(st.Lookups)
+	}
+	return st
+}
+
+// ResetStats resets the lookup statistics of all the shards
+func (s *ShardedDBReader) ResetStats() {
+	for _, rd := range s.shards {
+		rd.ResetStats()
+	}
+}
+
+// IgnoreExpiry controls whether lookups return expired records; see
+// DBReader.IgnoreExpiry().
+func (s *ShardedDBReader) IgnoreExpiry(ignore bool) {
+	for _, rd := range s.shards {
+		rd.IgnoreExpiry(ignore)
+	}
+}
+
+// Close closes all the shards and returns the first error
+func (s *ShardedDBReader) Close() error {
+	var err error
+	for _, rd := range s.shards {
+		if e := rd.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// return the shard that holds 'key'
+func (s *ShardedDBReader) shard(key []byte) *DBReader {
+	return s.shards[shardOf(s.std, s.seed, s.shards[0].normKey(key), len(s.shards))]
+}
+
+// return the name of shard 'i' of the sharded DB 'fn'
+func shardName(fn string, i int) string {
+	return fmt.Sprintf("%s.%d", fn, i)
+}
+
+// return the shard# of 'key' in a DB with 'n' shards; 'std' selects the
+// standard library hash.
+func shardOf(std bool, seed uint64, key []byte, n int) int {
+	return int(hashBytes(std, seed, key) % uint64(n))
+}
+
+// ErrShardMismatch is returned when a shard doesn't belong to the manifest of a
+// sharded DB.
+var ErrShardMismatch = errors.New("shard doesn't match the manifest")
@@ -0,0 +1,215 @@
+// shard_test.go -- test suite for sharded DBs
+
+package bbhash
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShardedDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+
+	const nshards = 4
+
+	defer func() {
+		os.Remove(fn)
+		for i := 0; i < nshards; i++ {
+			os.Remove(shardName(fn, i))
+		}
+	}()
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	_, err := NewShardedDBWriter(fn, 0, WriterOptions{})
+	assert(err != nil, "created a DB with no shards")
+
+	wr, err := NewShardedDBWriter(fn, nshards, WriterOptions{})
+	assert(err == nil, "can't create sharded db: %s", err)
+
+	err = wr.SetMetadata([]byte("sharded"))
+	assert(err == nil, "can't set metadata: %s", err)
+
+	n, err := wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-val: %s", err)
+	assert(int(n) == len(keys), "added %d keys; exp %d", n, len(keys))
+
+	n, err = wr.AddTextStream(strings.NewReader("textkey textval\n"), " ")
+	assert(err == nil, "can't add text: %s", err)
+	assert(n == 1, "text key not added")
+
+	// every shard gets some keys
+	for i, w := range wr.shards {
+		assert(w.TotalKeys() > 0, "shard %d is empty", i)
+	}
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewShardedDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	assert(rd.TotalKeys() == len(keys)+1, "total keys mismatch; exp %d, saw %d", len(keys)+1, rd.TotalKeys())
+	assert(string(rd.Metadata()) == "sharded", "metadata mismatch")
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(v) == string(vals[i]), "key %s: value mismatch; exp '%s', saw '%s'", k, vals[i], v)
+		assert(rd.Contains(k), "key %s not in db", k)
+	}
+
+	v, ok := rd.Lookup([]byte("textkey"))
+	assert(ok, "can't find text key")
+	assert(string(v) == " textval", "text key value mismatch; saw '%s'", v)
+
+	_, ok = rd.Lookup([]byte("this key doesn't exist"))
+	assert(!ok, "found non-existent key")
+
+	rd.Close()
+
+	// a shard from a different build is rejected
+	w, err := NewDBWriter(shardName(fn, 1))
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = w.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = w.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = NewShardedDBReader(fn, 10)
+	assert(errors.Is(err, ErrShardMismatch), "opened mismatched shard: %v", err)
+}
+
+func TestShardedReaderAPI(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+
+	const nshards = 3
+
+	defer func() {
+		os.Remove(fn)
+		for i := 0; i < nshards; i++ {
+			os.Remove(shardName(fn, i))
+		}
+	}()
+
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewShardedDBWriter(fn, nshards, WriterOptions{})
+	assert(err == nil, "can't create sharded db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewShardedDBReader(fn, 1000)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	var r Reader = rd
+	v, err := r.Find(keys[7])
+	assert(err == nil && string(v) == string(keys[7]), "can't find key via Reader: %v", err)
+
+	// every record is visited once
+	seen := make(map[string]bool)
+	it := rd.Iter()
+	for it.Next() {
+		k := string(it.Key())
+		assert(!seen[k], "key %s visited twice", k)
+		assert(k == string(it.Value()), "key %s: value mismatch", k)
+		seen[k] = true
+	}
+	assert(it.Err() == nil, "iter failed: %s", it.Err())
+	assert(len(seen) == len(keys), "exp %d records, saw %d", len(keys), len(seen))
+
+	var n int
+	err = rd.Keys(func(k []byte) bool {
+		n++
+		return n < 10
+	})
+	assert(err == nil && n == 10, "keys stopped after %d: %v", n, err)
+
+	q := append(keys[:0:0], keys[10], []byte("missing"), keys[20])
+	vals, errs := rd.FindMany(q)
+	assert(errs[0] == nil && string(vals[0]) == string(keys[10]), "find many: key 0: %v", errs[0])
+	assert(errs[1] == ErrNoKey, "find many: missing key: %v", errs[1])
+	assert(errs[2] == nil && string(vals[2]) == string(keys[20]), "find many: key 2: %v", errs[2])
+
+	v, err = rd.FindString("key-30")
+	assert(err == nil && string(v) == "key-30", "find string failed: %v", err)
+
+	g, err := rd.GetRecord(keys[40])
+	assert(err == nil && string(g.Key) == string(keys[40]), "get record failed: %v", err)
+
+	ok, err := rd.Exists([]byte("missing"))
+	assert(err == nil && !ok, "missing key exists: %v", err)
+
+	assert(rd.VerifyAll() == nil, "verify failed")
+
+	rd.ResetStats()
+	for _, k := range keys[:50] {
+		rd.Find(k)
+	}
+	st := rd.Stats()
+	assert(st.Lookups == 50, "exp 50 lookups, saw %d", st.Lookups)
+}
+
+func TestShardedManifestFail(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+
+	const nshards = 3
+
+	defer func() {
+		os.RemoveAll(fn)
+		for i := 0; i < nshards; i++ {
+			os.Remove(shardName(fn, i))
+		}
+	}()
+
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewShardedDBWriter(fn, nshards, WriterOptions{})
+	assert(err == nil, "can't create sharded db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-val: %s", err)
+
+	// a non-empty directory in place of the manifest fails the rename
+	err = os.MkdirAll(fn+"/x", 0700)
+	assert(err == nil, "can't make dir: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err != nil, "froze without a manifest")
+	assert(!wr.isFrozen(), "writer frozen without a manifest")
+
+	for i := 0; i < nshards; i++ {
+		_, err := os.Stat(shardName(fn, i))
+		assert(os.IsNotExist(err), "shard %d not removed: %v", i, err)
+	}
+
+	err = wr.Freeze(2.0)
+	assert(errors.Is(err, ErrClosed), "refroze a failed writer: %v", err)
+}
@@ -0,0 +1,145 @@
+// shared.go -- share one open DB between several readers
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DBs opened by NewSharedDBReader(); a DB is identified by its file (the
+// device and inode on unix) rather than its name.
+var shared struct {
+	sync.Mutex
+	dbs []*sharedDB
+}
+
+// a DB opened once and shared by several readers; 'rd' owns the file, the
+// mapping of the offset table and the MPH. It is closed when the last
+// reader sharing it is closed.
+type sharedDB struct {
+	fi   os.FileInfo
+	rd   *DBReader
+	refs int
+}
+
+// NewSharedDBReader is like NewDBReader except that readers of the same DB
+// file in a process share the file descriptor, the mapping of the offset
+// table and the MPH - which are released when the last of them is closed.
+// Each reader has its own record cache of 'cache' records and its own
+// statistics. A file that is replaced (e.g., by renaming a new DB over it)
+// is a different DB. Encrypted DBs can't be shared.
+func NewSharedDBReader(fn string, cache int) (*DBReader, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if s := findShared(fi); s != nil {
+		return s.newReader(fn, cache)
+	}
+
+	rd, err := newDBReader(fn, cache, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// identify the DB by the file that was opened - the name may have
+	// been replaced meanwhile.
+	if fi, err = rd.fd.Stat(); err != nil {
+		rd.Close()
+		return nil, fmt.Errorf("%s: can't stat: %w", fn, err)
+	}
+
+	s := findShared(fi)
+	if s == nil {
+		s = &sharedDB{
+			fi: fi,
+			rd: rd,
+		}
+		shared.dbs = append(shared.dbs, s)
+	} else {
+		rd.Close()
+	}
+
+	return s.newReader(fn, cache)
+}
+
+// return the shared DB for the file 'fi'; must be called with the lock held.
+func findShared(fi os.FileInfo) *sharedDB {
+	for _, s := range shared.dbs {
+		if sameFile(fi, s.fi) {
+			return s
+		}
+	}
+	return nil
+}
+
+// return a new reader of the shared DB; must be called with the lock held.
+func (s *sharedDB) newReader(fn string, cache int) (*DBReader, error) {
+	if cache <= 0 {
+		cache = 128
+	}
+
+	c, err := newARCCache(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reader has everything of the DB; but its own cache, settings,
+	// statistics and state. The mappings belong to the shared DB.
+	x := s.rd
+	rd := new(DBReader)
+	*rd = *x
+
+	rd.cache = c
+	rd.vcodec = nil
+	rd.pool = nil
+	rd.neg = nil
+	rd.noexpiry = false
+	rd.mmap = nil
+	rd.fmap = nil
+	rd.dfd = nil
+	rd.mem = nil
+	rd.fn = fn
+	rd.shared = s
+	rd.closed = 0
+	rd.busy = 0
+
+	rd.ctr = &readerCounters{}
+	rd.ra = rd.recordReader(x.fd)
+
+	s.refs++
+	return rd, nil
+}
+
+// drop a reader of the shared DB; the last one closes the DB.
+func (s *sharedDB) release() error {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+
+	for i, z := range shared.dbs {
+		if z == s {
+			n := len(shared.dbs) - 1
+			shared.dbs[i] = shared.dbs[n]
+			shared.dbs[n] = nil
+			shared.dbs = shared.dbs[:n]
+			break
+		}
+	}
+	return s.rd.Close()
+}
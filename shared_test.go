@@ -0,0 +1,87 @@
+// shared_test.go -- test suite for shared readers
+
+package bbhash
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSharedReader(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	buildVersion(t, fn, 1)
+
+	a, err := NewSharedDBReader(fn, 10)
+	assert(err == nil, "can't open shared db: %s", err)
+
+	b, err := NewSharedDBReader(fn, 10)
+	assert(err == nil, "can't open shared db: %s", err)
+
+	assert(len(shared.dbs) == 1, "exp 1 shared db, saw %d", len(shared.dbs))
+	assert(shared.dbs[0].refs == 2, "exp 2 refs, saw %d", shared.dbs[0].refs)
+	assert(a.bb == b.bb, "MPH not shared")
+	assert(&a.offsets[0] == &b.offsets[0], "offset table not shared")
+	assert(a.cache != b.cache, "cache is shared")
+
+	for _, s := range keyw {
+		v, err := a.Find([]byte(s))
+		assert(err == nil && string(v) == s+"-1", "key %s: saw %s: %s", s, v, err)
+	}
+	assert(b.Stats().Lookups == 0, "stats are shared")
+
+	// a replaced file is a different DB
+	buildVersion(t, fn, 2)
+	c, err := NewSharedDBReader(fn, 10)
+	assert(err == nil, "can't open shared db: %s", err)
+	assert(len(shared.dbs) == 2, "exp 2 shared dbs, saw %d", len(shared.dbs))
+
+	v, err := c.Find([]byte(keyw[0]))
+	assert(err == nil && string(v) == keyw[0]+"-2", "exp version 2, saw %s: %s", v, err)
+	c.Close()
+	assert(len(shared.dbs) == 1, "exp 1 shared db, saw %d", len(shared.dbs))
+
+	// the DB stays open until its last reader is closed
+	a.Close()
+	v, err = b.Find([]byte(keyw[1]))
+	assert(err == nil && string(v) == keyw[1]+"-1", "exp version 1, saw %s: %s", v, err)
+
+	b.Close()
+	assert(len(shared.dbs) == 0, "exp no shared dbs, saw %d", len(shared.dbs))
+}
+
+func TestSharedReaderFeatures(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{KeyNormalizerName: "lower"})
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals([][]byte{[]byte("Hello"), []byte("World")}, [][]byte{[]byte("1"), []byte("2")})
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	a, err := NewSharedDBReader(fn, 10)
+	assert(err == nil, "can't open shared db: %s", err)
+	defer a.Close()
+
+	b, err := NewSharedDBReader(fn, 10)
+	assert(err == nil, "can't open shared db: %s", err)
+	defer b.Close()
+
+	for _, rd := range []*DBReader{a, b} {
+		assert(rd.KeyNormalizer() == "lower", "exp normalizer lower, saw %q", rd.KeyNormalizer())
+
+		v, err := rd.Find([]byte("HELLO"))
+		assert(err == nil && string(v) == "1", "can't find normalized key: %v", err)
+
+		err = rd.VerifyData()
+		assert(err == nil, "can't verify data: %s", err)
+	}
+}
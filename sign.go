@@ -0,0 +1,50 @@
+// sign.go -- Ed25519 signatures of DBs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// A DB built with WriterOptions.SigningKey has the header flag
+// 'flagSigned' and ends with the Ed25519 signature of its strong checksum
+// - the 32 byte trailer. The checksum covers the header, offset table,
+// MPH and sections; the section of segment checksums (see segments.go)
+// covers the records. So a valid signature vouches for every byte of the
+// DB. The signature is not part of the checksum; readers treat the DB as
+// ending before it.
+
+// VerifySignature verifies that the DB is signed with the private key of
+// 'pub'; it returns an error matching ErrBadSignature if the DB isn't
+// signed or the signature doesn't match. The records aren't read; their
+// segments are verified by VerifySegments() or by lookups of a reader
+// opened with ReaderOptions.PublicKey.
+func (rd *DBReader) VerifySignature(pub ed25519.PublicKey) error {
+	if rd.isClosed() {
+		return ErrClosed
+	}
+
+	if rd.sig == nil {
+		return fmt.Errorf("%s: %w: DB isn't signed", rd.fn, ErrBadSignature)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("%s: invalid public key of %d bytes", rd.fn, len(pub))
+	}
+	if !ed25519.Verify(pub, rd.csum[:], rd.sig) {
+		return fmt.Errorf("%s: %w", rd.fn, ErrBadSignature)
+	}
+	return nil
+}
+
+// Signature returns the Ed25519 signature of a signed DB; nil if the DB
+// isn't signed.
+func (rd *DBReader) Signature() []byte {
+	return rd.sig
+}
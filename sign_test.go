@@ -0,0 +1,120 @@
+// sign_test.go -- test suite for signed DBs
+
+package bbhash
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert(err == nil, "can't generate key: %s", err)
+	other, _, err := ed25519.GenerateKey(nil)
+	assert(err == nil, "can't generate key: %s", err)
+
+	_, err = NewDBWriterWithOptions(fn, WriterOptions{SigningKey: priv[:10]})
+	assert(err != nil, "created a DB with a short signing key")
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("%0100d", i))
+	}
+
+	build := func(opt WriterOptions) {
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+	}
+
+	// an unsigned DB
+	build(WriterOptions{})
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{PublicKey: pub})
+	assert(errors.Is(err, ErrBadSignature), "opened unsigned db: %v", err)
+
+	build(WriterOptions{SigningKey: priv, SegmentSize: 4096})
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "can't stat db: %s", err)
+
+	for _, m := range []LoadMode{LoadFile, LoadMmap, LoadMemory} {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, PublicKey: pub})
+		assert(err == nil, "%v: can't open signed db: %s", m, err)
+
+		info := rd.Info()
+		assert(info.Size == st.Size(), "%v: size %d; exp %d", m, info.Size, st.Size())
+		assert(bytes.Equal(info.Signature, rd.Signature()), "%v: signature mismatch", m)
+		assert(info.SegmentSize == 4096, "%v: segment size %d", m, info.SegmentSize)
+		assert(info.Features[0] == "signed", "%v: features %v", m, info.Features)
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%v: can't find key %s: %s", m, k, err)
+			assert(bytes.Equal(v, vals[i]), "%v: key %s: value mismatch", m, k)
+		}
+
+		err = rd.VerifySignature(other)
+		assert(errors.Is(err, ErrBadSignature), "%v: verified with another key: %v", m, err)
+		err = rd.VerifyMetadata()
+		assert(err == nil, "%v: verify metadata failed: %s", m, err)
+		err = rd.VerifySegments()
+		assert(err == nil, "%v: verify segments failed: %s", m, err)
+		rd.Close()
+	}
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{PublicKey: other})
+	assert(errors.Is(err, ErrBadSignature), "opened db signed by another key: %v", err)
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{PublicKey: pub, FastOpen: true})
+	assert(err != nil, "opened signed db without verifying it")
+
+	// a signed DB can be read without checking the signature
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "can't open signed db: %s", err)
+	err = rd.VerifySignature(pub)
+	assert(err == nil, "bad signature: %s", err)
+	rd.Close()
+
+	good, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+
+	// a bad signature
+	b := append([]byte{}, good...)
+	b[len(b)-1] ^= 0x1
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReaderWithOptions(fn, ReaderOptions{PublicKey: pub})
+	assert(errors.Is(err, ErrBadSignature), "opened db with a bad signature: %v", err)
+
+	// an altered record is caught by the segment checksums before its
+	// record checksum is verified.
+	b = append([]byte{}, good...)
+	i := bytes.Index(b, vals[10])
+	assert(i > 0, "can't find value")
+	b[i+len(vals[10])-1] ^= 0x1
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err = NewDBReaderWithOptions(fn, ReaderOptions{PublicKey: pub})
+	assert(err == nil, "can't open signed db: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find(keys[10])
+	var serr *SegmentError
+	assert(errors.As(err, &serr), "altered record: %v", err)
+}
@@ -0,0 +1,157 @@
+// sql.go -- import records from and export records to SQL databases
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AddSQLQuery adds the rows returned by 'query' (with arguments 'args') on
+// database 'db'; the first column of each row is the key and the second
+// is the value. In a key set, the query may return just the key. Rows with
+// a NULL or empty key are skipped; a NULL value is an empty value. The
+// query is passed to the driver as is; so this works with SQLite and any
+// other database/sql driver.
+// Returns number of records added.
+func (w *DBWriter) AddSQLQuery(db *sql.DB, query string, args ...interface{}) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	keysOnly := (w.flags & flagKeysOnly) > 0
+	if len(cols) != 2 && !(keysOnly && len(cols) == 1) {
+		return 0, fmt.Errorf("%s: query returns %d columns; exp 2", w.fn, len(cols))
+	}
+
+	src := SourceStats{}
+
+	var n uint64
+	for rows.Next() {
+		var k, v []byte
+
+		dst := []interface{}{&k, &v}
+		if err = rows.Scan(dst[:len(cols)]...); err != nil {
+			return n, err
+		}
+
+		if len(k) == 0 {
+			src.Skipped++
+			continue
+		}
+
+		r := &record{
+			key: k,
+			val: v,
+		}
+
+		ok, err := w.addRecord(r)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+		src.account(r, ok)
+	}
+
+	if err = rows.Err(); err != nil {
+		return n, err
+	}
+
+	w.addSource(&src)
+	return n, nil
+}
+
+// ExportSQLite writes the records of the DB into table 'table' of SQLite
+// database 'db'; the table is created if it doesn't exist and has the
+// columns "key" and "value" (just "key" for a key set), both BLOBs. The
+// records are inserted in one transaction. Expired records are not
+// exported.
+// Returns number of records exported.
+func (rd *DBReader) ExportSQLite(db *sql.DB, table string) (uint64, error) {
+	tbl := sqlQuote(table)
+	keysOnly := (rd.flags & flagKeysOnly) > 0
+
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key BLOB PRIMARY KEY, value BLOB)", tbl)
+	insert := fmt.Sprintf("INSERT INTO %s (key, value) VALUES (?, ?)", tbl)
+	if keysOnly {
+		create = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key BLOB PRIMARY KEY)", tbl)
+		insert = fmt.Sprintf("INSERT INTO %s (key) VALUES (?)", tbl)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec(create); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(insert)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	defer stmt.Close()
+
+	now := time.Now()
+
+	var n uint64
+	err = rd.iterate(func(r *record) error {
+		if rd.expired(r, now) || r.deleted {
+			return nil
+		}
+
+		var err error
+		if keysOnly {
+			_, err = stmt.Exec(r.key)
+		} else {
+			_, err = stmt.Exec(r.key, r.val)
+		}
+		if err != nil {
+			return err
+		}
+
+		n++
+		return nil
+	})
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// quote SQL identifier 's'
+func sqlQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,165 @@
+// sql_test.go -- test suite for the SQL importer and exporter
+
+package bbhash
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSQL(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	db, err := sql.Open("bbtest", "src")
+	assert(err == nil, "can't open sql db: %s", err)
+	defer db.Close()
+
+	tdb.tables["src"] = [][]driver.Value{
+		{[]byte("k1"), []byte("v1")},
+		{"k2", int64(2)},
+		{nil, []byte("nokey")},
+		{[]byte("k3"), nil},
+		{[]byte("k1"), []byte("dup")},
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddSQLQuery(db, "SELECT key, value FROM src")
+	assert(err == nil, "can't add query: %s", err)
+	assert(n == 3, "exp 3 records, saw %d", n)
+
+	src := wr.Sources()
+	assert(len(src) == 1, "exp 1 source, saw %d", len(src))
+	assert(src[0].Dups == 1 && src[0].Skipped == 1, "wrong counts: %d dups, %d skipped", src[0].Dups, src[0].Skipped)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	exp := map[string]string{"k1": "v1", "k2": "2", "k3": ""}
+	for k, v := range exp {
+		x, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(string(x) == v, "key %s: exp '%s', saw '%s'", k, v, x)
+	}
+
+	n, err = rd.ExportSQLite(db, "dst")
+	assert(err == nil, "can't export: %s", err)
+	assert(n == 3, "exp 3 exported records, saw %d", n)
+
+	rows := tdb.tables["dst"]
+	assert(len(rows) == 3, "exp 3 rows, saw %d", len(rows))
+	for _, row := range rows {
+		k := string(row[0].([]byte))
+		v := string(row[1].([]byte))
+		assert(exp[k] == v, "exported key %s: exp '%s', saw '%s'", k, exp[k], v)
+	}
+}
+
+// A minimal database/sql driver for the statements used by the SQL
+// importer and exporter; tables are rows of values held in memory.
+type testDB struct {
+	sync.Mutex
+	tables map[string][][]driver.Value
+}
+
+var tdb = &testDB{tables: make(map[string][][]driver.Value)}
+
+func init() {
+	sql.Register("bbtest", tdb)
+}
+
+func (d *testDB) Open(name string) (driver.Conn, error) {
+	return &testConn{}, nil
+}
+
+type testConn struct{}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) {
+	return &testStmt{q: query}, nil
+}
+
+func (c *testConn) Close() error              { return nil }
+func (c *testConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *testConn) Commit() error             { return nil }
+func (c *testConn) Rollback() error           { return nil }
+
+type testStmt struct {
+	q string
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return strings.Count(s.q, "?") }
+
+// return the table named by the word following 'kw' in the statement
+func (s *testStmt) table(kw string) string {
+	f := strings.Fields(s.q)
+	for i := range f[:len(f)-1] {
+		if strings.EqualFold(f[i], kw) {
+			return strings.Trim(f[i+1], `"`)
+		}
+	}
+	return ""
+}
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	tdb.Lock()
+	defer tdb.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.q, "CREATE TABLE IF NOT EXISTS"):
+		nm := s.table("EXISTS")
+		if _, ok := tdb.tables[nm]; !ok {
+			tdb.tables[nm] = nil
+		}
+
+	case strings.HasPrefix(s.q, "INSERT INTO"):
+		nm := s.table("INTO")
+		tdb.tables[nm] = append(tdb.tables[nm], args)
+
+	default:
+		return nil, fmt.Errorf("unsupported statement: %s", s.q)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	tdb.Lock()
+	defer tdb.Unlock()
+
+	rows, ok := tdb.tables[s.table("FROM")]
+	if !ok {
+		return nil, fmt.Errorf("no table in: %s", s.q)
+	}
+	return &testRows{rows: rows}, nil
+}
+
+type testRows struct {
+	rows [][]driver.Value
+}
+
+func (r *testRows) Columns() []string { return []string{"key", "value"} }
+func (r *testRows) Close() error      { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,83 @@
+// staticset.go -- a read-only set of keys built on BBHash
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"io"
+)
+
+// StaticSet is a read-only set of keys - e.g., an allow or deny list: it
+// is built once and answers membership queries from a minimal perfect hash
+// of the keys and a 32-bit fingerprint of each key. The keys themselves
+// aren't stored; so a StaticSet takes about 4.5 bytes per key regardless of
+// the size of the keys. All but 1 in 2^32 keys that aren't in the set are
+// rejected. Queries don't allocate. A StaticSet is safe for concurrent use.
+type StaticSet struct {
+	fpTable
+}
+
+// NewStaticSet returns a set of the keys in 'keys'; repeated keys are
+// added once.
+func NewStaticSet(keys [][]byte) (*StaticSet, error) {
+	s := &StaticSet{}
+	s.std = !haveExtHash
+
+	hash := func(salt uint64, i int) uint64 {
+		return hashBytes(s.std, salt, keys[i])
+	}
+	eq := func(i, j int) bool {
+		return bytes.Equal(keys[i], keys[j])
+	}
+
+	if _, _, err := s.build(len(keys), hash, eq); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the number of keys in the set
+func (s *StaticSet) Len() int {
+	return len(s.fps)
+}
+
+// Contains returns true if 'key' is in the set
+func (s *StaticSet) Contains(key []byte) bool {
+	_, ok := s.find(hashBytes(s.std, s.salt, key))
+	return ok
+}
+
+// ContainsString is like Contains except the key is a string; the key isn't
+// copied.
+func (s *StaticSet) ContainsString(key string) bool {
+	return s.Contains(stringBytes(key))
+}
+
+// MarshalBinary encodes the set into a compact binary form suitable for
+// durable storage: the encoding of an MPHMap (see MPHMap.MarshalBinary())
+// with the magic "MPHS" and without the values. UnmarshalStaticSet()
+// reconstructs it.
+func (s *StaticSet) MarshalBinary(w io.Writer) error {
+	return s.marshal(w, "MPHS", 0)
+}
+
+// MarshalBinarySize returns the size of the encoded set
+func (s *StaticSet) MarshalBinarySize() uint64 {
+	return s.marshalSize()
+}
+
+// UnmarshalStaticSet reads a set marshaled by StaticSet.MarshalBinary()
+// from 'r'.
+func UnmarshalStaticSet(r io.Reader) (*StaticSet, error) {
+	s := &StaticSet{}
+	if _, err := s.unmarshal(r, "MPHS", "StaticSet"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,57 @@
+// staticset_test.go -- test suite for StaticSet
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestStaticSet(t *testing.T) {
+	assert := newAsserter(t)
+
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+
+	// repeated keys are added once
+	s, err := NewStaticSet(append(keys, keys[:10]...))
+	assert(err == nil, "can't build set: %s", err)
+	assert(s.Len() == len(keys), "len mismatch: exp %d, saw %d", len(keys), s.Len())
+
+	for _, k := range keys {
+		assert(s.Contains(k), "can't find %s", k)
+	}
+
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("192.168.%d.%d", i/256, i%256)
+		assert(!s.ContainsString(k), "found absent key %s", k)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s.ContainsString("10.0.1.1")
+	})
+	assert(allocs == 0, "Contains allocates: %v", allocs)
+
+	var b bytes.Buffer
+	err = s.MarshalBinary(&b)
+	assert(err == nil, "can't marshal: %s", err)
+	assert(uint64(b.Len()) == s.MarshalBinarySize(), "size mismatch: exp %d, saw %d", s.MarshalBinarySize(), b.Len())
+
+	_, err = UnmarshalMPHMap[string, int](bytes.NewReader(b.Bytes()))
+	assert(err != nil, "unmarshaled set as a map")
+
+	us, err := UnmarshalStaticSet(&b)
+	assert(err == nil, "can't unmarshal: %s", err)
+	assert(us.Len() == len(keys), "unmarshaled len mismatch: exp %d, saw %d", len(keys), us.Len())
+	for _, k := range keys {
+		assert(us.Contains(k), "unmarshaled: can't find %s", k)
+	}
+	assert(!us.Contains([]byte("192.168.0.1")), "unmarshaled: found absent key")
+
+	empty, err := NewStaticSet(nil)
+	assert(err == nil, "can't build empty set: %s", err)
+	assert(!empty.Contains([]byte("a")), "found key in empty set")
+}
@@ -0,0 +1,360 @@
+// stats.go -- statistics about the construction and use of a constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BuildStats describes a DB built by DBWriter; see DBWriter.Stats().
+type BuildStats struct {
+	// Number of records in the DB
+	Records uint64
+
+	// Total size of the keys and values added; this is before any
+	// front coding or value deduplication. In low memory mode, this
+	// includes duplicate records.
+	KeyBytes uint64
+	ValBytes uint64
+
+	// Size of the record region (compressed, in a compressed DB), the
+	// padding that aligns the offset table and the offset table itself.
+	RecordBytes   uint64
+	PadBytes      uint64
+	OffsetTblSize uint64
+
+	// Number of levels, total bits and bits per key of the MPH; and
+	// the size of the marshaled MPH.
+	MPHLevels     int
+	MPHBits       uint64
+	MPHBitsPerKey float64
+	MPHSize       uint64
+
+	// Statistics of each level of the MPH construction
+	MPHConstruction ConstructionStats
+
+	// Size of the DB file
+	FileSize uint64
+
+	// Wall clock time of each phase of the build:
+	//   - Ingest: from creating the writer until Freeze()
+	//   - MPH: building the MPH
+	//   - Offsets: building the offset table
+	//   - Layout: rewriting the records (WriterOptions.Locality)
+	//   - Write: writing and syncing the rest of the DB
+	Ingest  time.Duration
+	MPH     time.Duration
+	Offsets time.Duration
+	Layout  time.Duration
+	Write   time.Duration
+}
+
+// String returns a human readable description of the stats
+func (s *BuildStats) String() string {
+	var b bytes.Buffer
+
+	b.WriteString(fmt.Sprintf("%d records; keys %s, values %s; file %s\n",
+		s.Records, humansize(s.KeyBytes), humansize(s.ValBytes), humansize(s.FileSize)))
+	b.WriteString(fmt.Sprintf("  records %s, padding %s, offset table %s\n",
+		humansize(s.RecordBytes), humansize(s.PadBytes), humansize(s.OffsetTblSize)))
+	b.WriteString(fmt.Sprintf("  MPH: %d levels, %d bits (%4.2f bits/key), %s\n",
+		s.MPHLevels, s.MPHBits, s.MPHBitsPerKey, humansize(s.MPHSize)))
+	b.WriteString(fmt.Sprintf("  time: ingest %s, mph %s, offsets %s, layout %s, write %s\n",
+		s.Ingest, s.MPH, s.Offsets, s.Layout, s.Write))
+
+	return b.String()
+}
+
+// SourceStats describes the records read from one input file or stream;
+// see DBWriter.Sources().
+type SourceStats struct {
+	// Name of the file; empty for streams
+	Name string
+
+	// Number of records added
+	Records uint64
+
+	// Number of records that weren't added: duplicate keys or, in a delta
+	// DB, records that are unchanged from the base. In low memory mode,
+	// duplicates are only detected in Freeze().
+	Dups uint64
+
+	// Number of lines or rows that couldn't be parsed; blank lines aren't
+	// counted.
+	Skipped uint64
+
+	// Total and largest size of the keys and values added
+	KeyBytes  uint64
+	ValBytes  uint64
+	MaxKeyLen uint64
+	MaxValLen uint64
+}
+
+// account for record 'r'; 'added' is true if it was added to the DB
+func (s *SourceStats) account(r *record, added bool) {
+	if !added {
+		s.Dups++
+		return
+	}
+
+	klen, vlen := uint64(len(r.key)), uint64(len(r.val))
+
+	s.Records++
+	s.KeyBytes += klen
+	s.ValBytes += vlen
+	if klen > s.MaxKeyLen {
+		s.MaxKeyLen = klen
+	}
+	if vlen > s.MaxValLen {
+		s.MaxValLen = vlen
+	}
+}
+
+// String returns a human readable description of the stats
+func (s *SourceStats) String() string {
+	nm := s.Name
+	if len(nm) == 0 {
+		nm = "<stream>"
+	}
+
+	return fmt.Sprintf("%s: %d records, %d dups, %d skipped; keys %s (max %d), values %s (max %d)",
+		nm, s.Records, s.Dups, s.Skipped, humansize(s.KeyBytes), s.MaxKeyLen,
+		humansize(s.ValBytes), s.MaxValLen)
+}
+
+// DBInfo describes a DB opened by DBReader; see DBReader.Info().
+type DBInfo struct {
+	// Name of the DB file; "<reader>" for DBs opened by NewDBReaderAt()
+	Name string
+
+	// Format version of the DB. The features the DB uses are
+	// described by Features.
+	Version  int
+	Features []string
+
+	// Hash salt and number of keys
+	Salt uint64
+	Keys uint64
+
+	// Size of the DB file; the file offset and size of the offset
+	// table and of the value region of a split DB (0 if the DB isn't
+	// split).
+	Size          int64
+	OffsetTbl     uint64
+	OffsetTblSize uint64
+	ValueRegion   uint64
+
+	// Alignment of the records; 0 if they aren't aligned
+	RecordAlign uint64
+
+	// Size of the checksummed segments of the records; 0 if the DB has
+	// no segment checksums.
+	SegmentSize uint64
+
+	// Strong checksum (SHA512-256) of the DB; and of the base DB of a
+	// delta DB (nil otherwise).
+	Checksum     [32]byte
+	BaseChecksum []byte
+
+	// Ed25519 signature of Checksum; nil if the DB isn't signed
+	Signature []byte
+
+	// Checksum of the records; nil if the DB doesn't have one. See
+	// DBReader.VerifyData().
+	DataChecksum []byte
+
+	// Application defined metadata; see DBWriter.SetMetadata()
+	Metadata []byte
+
+	// Number of levels, total bits and bits per key of the MPH; and
+	// the size of the marshaled MPH.
+	MPHLevels     int
+	MPHBits       uint64
+	MPHBitsPerKey float64
+	MPHSize       uint64
+}
+
+// names of the header flags for DBInfo.Features
+var flagNames = []struct {
+	flag uint32
+	name string
+}{
+	{flagEncrypted, "encrypted"},
+	{flagEncOffsets, "encrypted-offsets"},
+	{flagSigned, "signed"},
+	{flagVarlen, "varlen"},
+	{flagChunkSum, "chunked-checksum"},
+	{flagCRC32C, "crc32c"},
+	{flagKeysOnly, "keys-only"},
+	{flagPrefix, "prefix-compressed"},
+	{flagValRef, "dedup-values"},
+	{flagExpiry, "expiry"},
+	{flagAppFlags, "app-flags"},
+	{flagSplit, "split-values"},
+	{flagNamespaces, "namespaces"},
+	{flagCompressed, "compressed"},
+	{flagFingerprint, "fingerprints"},
+	{flagStdHash, "stdlib-hash"},
+	{flagXXH3, "xxh3"},
+	{flagCompactOffsets, "compact-offsets"},
+	{flagTombstones, "tombstones"},
+}
+
+// String returns a human readable description of the DB
+func (s *DBInfo) String() string {
+	var b bytes.Buffer
+
+	b.WriteString(fmt.Sprintf("%s: version %d, %d keys, salt %#x; file %s\n",
+		s.Name, s.Version, s.Keys, s.Salt, humansize(uint64(s.Size))))
+	if len(s.Features) > 0 {
+		b.WriteString(fmt.Sprintf("  features: %s\n", strings.Join(s.Features, ", ")))
+	}
+	b.WriteString(fmt.Sprintf("  offset table at %d, %s\n", s.OffsetTbl, humansize(s.OffsetTblSize)))
+	if s.ValueRegion > 0 {
+		b.WriteString(fmt.Sprintf("  value region at %d\n", s.ValueRegion))
+	}
+	b.WriteString(fmt.Sprintf("  MPH: %d levels, %d bits (%4.2f bits/key), %s\n",
+		s.MPHLevels, s.MPHBits, s.MPHBitsPerKey, humansize(s.MPHSize)))
+	b.WriteString(fmt.Sprintf("  checksum %x\n", s.Checksum[:]))
+	if len(s.BaseChecksum) > 0 {
+		b.WriteString(fmt.Sprintf("  base checksum %x\n", s.BaseChecksum))
+	}
+	if len(s.Signature) > 0 {
+		b.WriteString(fmt.Sprintf("  signature %x\n", s.Signature))
+	}
+	if len(s.Metadata) > 0 {
+		b.WriteString(fmt.Sprintf("  metadata: %s\n", humansize(uint64(len(s.Metadata)))))
+	}
+
+	return b.String()
+}
+
+// ReaderStats describes the lookups done by a DBReader; see
+// DBReader.Stats().
+type ReaderStats struct {
+	// Number of keys looked up; and the number of them found in the
+	// record cache or not.
+	Lookups     uint64
+	CacheHits   uint64
+	CacheMisses uint64
+
+	// Number of cache misses answered by the negative cache; see
+	// DBReader.SetNegativeCache().
+	NegativeHits uint64
+
+	// Number of cache misses rejected by the Bloom filter of the DB; see
+	// WriterOptions.BloomBits.
+	BloomRejects uint64
+
+	// Number of cache misses rejected by the key fingerprints in the
+	// offset table; see WriterOptions.Fingerprints.
+	FingerprintRejects uint64
+
+	// Number of reads of the DB and the bytes read
+	Reads     uint64
+	BytesRead uint64
+
+	// Number of records that failed their checksum
+	ChecksumFailures uint64
+
+	// Average time taken by a lookup
+	Latency time.Duration
+}
+
+// String returns a human readable description of the stats
+func (s *ReaderStats) String() string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%d lookups, %d cache hits, %d cache misses, %d negative hits\n",
+		s.Lookups, s.CacheHits, s.CacheMisses, s.NegativeHits)
+	fmt.Fprintf(&b, "%d bloom rejects, %d fingerprint rejects\n",
+		s.BloomRejects, s.FingerprintRejects)
+	fmt.Fprintf(&b, "%d reads, %s read, %d checksum failures\n",
+		s.Reads, humansize(s.BytesRead), s.ChecksumFailures)
+	fmt.Fprintf(&b, "%s per lookup", s.Latency)
+	return b.String()
+}
+
+// counters behind ReaderStats; they are updated atomically and exported
+// to 'm' if it isn't nil.
+type readerCounters struct {
+	nlookup  uint64
+	nsec     uint64
+	hits     uint64
+	misses   uint64
+	neghits  uint64
+	bloomrej uint64
+	fprej    uint64
+	reads    uint64
+	bytes    uint64
+	badsum   uint64
+
+	m Metrics
+}
+
+// add 'n' to the counter 'p' whose metric is 'name'
+func (c *readerCounters) add(p *uint64, name string, n uint64) {
+	atomic.AddUint64(p, n)
+	if c.m != nil {
+		c.m.Counter(name, float64(n))
+	}
+}
+
+// count 'n' lookups that took 'd' in all
+func (c *readerCounters) lookups(n uint64, d time.Duration) {
+	atomic.AddUint64(&c.nlookup, n)
+	atomic.AddUint64(&c.nsec, uint64(d))
+	if c.m != nil {
+		c.m.Counter(MetricLookups, float64(n))
+		c.m.Counter(MetricLookupSeconds, d.Seconds())
+	}
+}
+
+func (c *readerCounters) stats() ReaderStats {
+	s := ReaderStats{
+		Lookups:            atomic.LoadUint64(&c.nlookup),
+		CacheHits:          atomic.LoadUint64(&c.hits),
+		CacheMisses:        atomic.LoadUint64(&c.misses),
+		NegativeHits:       atomic.LoadUint64(&c.neghits),
+		BloomRejects:       atomic.LoadUint64(&c.bloomrej),
+		FingerprintRejects: atomic.LoadUint64(&c.fprej),
+		Reads:              atomic.LoadUint64(&c.reads),
+		BytesRead:          atomic.LoadUint64(&c.bytes),
+		ChecksumFailures:   atomic.LoadUint64(&c.badsum),
+	}
+
+	if s.Lookups > 0 {
+		s.Latency = time.Duration(atomic.LoadUint64(&c.nsec) / s.Lookups)
+	}
+	return s
+}
+
+func (c *readerCounters) reset() {
+	for _, p := range []*uint64{&c.nlookup, &c.nsec, &c.hits, &c.misses, &c.neghits, &c.bloomrej, &c.fprej, &c.reads, &c.bytes, &c.badsum} {
+		atomic.StoreUint64(p, 0)
+	}
+}
+
+// an io.ReaderAt that counts the reads of the DB
+type countingReader struct {
+	ra  io.ReaderAt
+	ctr *readerCounters
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.ra.ReadAt(p, off)
+	c.ctr.add(&c.ctr.reads, MetricReads, 1)
+	c.ctr.add(&c.ctr.bytes, MetricBytesRead, uint64(n))
+	return n, err
+}
@@ -0,0 +1,74 @@
+// stdhash.go -- key hash and record checksum from the standard library
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// A DB built with WriterOptions.StdlibHash (header flag 'flagStdHash')
+// hashes its keys with a salted FNV-1a and checksums its records with
+// HMAC-SHA256 truncated to 64 bits; both are built from the standard
+// library. Every other DB uses fasthash and siphash-2-4 (see hash_ext.go).
+// A program built with the 'bbhash_stdlib' tag has no third-party
+// dependencies; it only reads and writes DBs with the standard library
+// hashes.
+
+// FNV-1a parameters
+const (
+	fnvOffset64 uint64 = 14695981039346656037
+	fnvPrime64  uint64 = 1099511628211
+)
+
+// return the 64-bit hash of 'b' salted with 'salt'; 'std' selects the
+// standard library hash.
+func hashBytes(std bool, salt uint64, b []byte) uint64 {
+	if std {
+		return stdHash64(salt, b)
+	}
+	return extHash64(salt, b)
+}
+
+// FNV-1a of 'b' seeded with 'salt'; the result is mixed so that every
+// bit of the hash depends on every bit of the input.
+func stdHash64(salt uint64, b []byte) uint64 {
+	h := fnvOffset64 ^ salt
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+	return mix(h ^ uint64(len(b)))
+}
+
+// a keyed 64-bit hash of the bytes written to it
+type hash64 interface {
+	io.Writer
+	Sum64() uint64
+}
+
+// HMAC-SHA256 truncated to 64 bits
+type truncHash struct {
+	io.Writer
+	sum func(b []byte) []byte
+}
+
+// return HMAC-SHA256 keyed with 'key' and truncated to 64 bits
+func newStdHash64(key []byte) hash64 {
+	m := hmac.New(sha256.New, key)
+	return &truncHash{m, m.Sum}
+}
+
+func (h *truncHash) Sum64() uint64 {
+	var b [sha256.Size]byte
+
+	return binary.BigEndian.Uint64(h.sum(b[:0]))
+}
@@ -0,0 +1,146 @@
+// stdhash_test.go -- test suite for DBs hashed with the standard library
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStdlibHash(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+	}
+
+	key := []byte("0123456789abcdef")
+	for _, opt := range []WriterOptions{
+		{StdlibHash: true},
+		{StdlibHash: true, Key: key, EncryptOffsets: true},
+		{StdlibHash: true, SplitValues: true},
+	} {
+		wr, err := NewDBWriterWithOptions(fn, opt)
+		assert(err == nil, "can't create db: %s", err)
+
+		_, err = wr.AddKeyVals(keys, vals)
+		assert(err == nil, "can't add key-vals: %s", err)
+		err = wr.Freeze(2.0)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewEncryptedDBReader(fn, 10, opt.Key)
+		assert(err == nil, "read failed: %s", err)
+		assert((rd.flags&flagStdHash) > 0, "stdlib hash not in header: %#x", rd.flags)
+		assert(rd.keyHash(0, keys[0]) == stdHash64(rd.salt, keys[0]), "key hash mismatch")
+
+		for i, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "can't find key %s: %s", k, err)
+			assert(bytes.Equal(v, vals[i]), "key %s: value mismatch; exp %s, saw %s", k, vals[i], v)
+		}
+
+		_, err = rd.Find([]byte("key-1000"))
+		assert(err == ErrNoKey, "absent key: %v", err)
+
+		err = rd.VerifyAll()
+		assert(err == nil, "verify failed: %s", err)
+		rd.Close()
+	}
+
+	// the record checksum is the truncated HMAC
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	i := bytes.Index(b, []byte("key-999"))
+	assert(i > 0, "can't find key")
+	b[i] ^= 0xff
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find([]byte("key-999"))
+	assert(err != nil && err != ErrNoKey, "corrupt record found: %v", err)
+}
+
+func TestStdlibHashSharded(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+
+	const nshards = 3
+
+	defer func() {
+		os.Remove(fn)
+		for i := 0; i < nshards; i++ {
+			os.Remove(shardName(fn, i))
+		}
+	}()
+
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	wr, err := NewShardedDBWriter(fn, nshards, WriterOptions{StdlibHash: true})
+	assert(err == nil, "can't create sharded db: %s", err)
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read manifest: %s", err)
+
+	var m manifest
+	err = json.Unmarshal(b, &m)
+	assert(err == nil, "can't parse manifest: %s", err)
+	assert(m.Hash == manifestStdHash, "manifest hash %q", m.Hash)
+
+	rd, err := NewShardedDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch %s", k, v)
+	}
+
+	m.Hash = "md5"
+	b, _ = json.Marshal(&m)
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write manifest: %s", err)
+
+	_, err = NewShardedDBReader(fn, 10)
+	assert(err != nil, "opened a manifest with an unknown hash")
+}
+
+func TestStdHash64(t *testing.T) {
+	assert := newAsserter(t)
+
+	a := stdHash64(1, []byte("abc"))
+	assert(a == stdHash64(1, []byte("abc")), "hash isn't stable")
+	assert(a != stdHash64(2, []byte("abc")), "hash ignores the salt")
+	assert(a != stdHash64(1, []byte("abd")), "hash ignores the key")
+	assert(stdHash64(1, nil) != stdHash64(1, []byte{0}), "hash ignores the length")
+
+	h := newStdHash64([]byte("key"))
+	h.Write([]byte("abc"))
+	x := h.Sum64()
+
+	h = newStdHash64([]byte("yek"))
+	h.Write([]byte("abc"))
+	assert(x != h.Sum64(), "checksum ignores the key")
+}
@@ -0,0 +1,239 @@
+// stream.go -- add records from gob and msgpack record streams
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// KeyVal is a key-value pair in a gob record stream; see AddGobStream().
+type KeyVal struct {
+	Key []byte
+	Val []byte
+}
+
+// AddGobStream adds the records from stream 'fd': a series of gob encoded
+// KeyVal values. Records with an empty key and duplicates are skipped.
+// Returns number of records added.
+func (w *DBWriter) AddGobStream(fd io.Reader) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	ch, ps := gobRecords(fd)
+	return w.addFromSource("", ch, ps)
+}
+
+// AddMsgpackStream adds the records from stream 'fd': a series of msgpack
+// arrays of two elements - the key and value. Keys and values can be
+// msgpack str, bin or integers (which are added as decimal text); a nil
+// value is an empty value. In a key set, the arrays may have just the key.
+// Records with an empty key and duplicates are skipped.
+// Returns number of records added.
+func (w *DBWriter) AddMsgpackStream(fd io.Reader) (uint64, error) {
+	if w.isFrozen() {
+		return 0, ErrFrozen
+	}
+
+	ch, ps := msgpackRecords(fd)
+	return w.addFromSource("", ch, ps)
+}
+
+// decode the gob stream 'fd' into records and send them on the returned
+// chan. Decoding errors are available via the returned parseState once
+// the chan is closed.
+func gobRecords(fd io.Reader) (chan *record, *parseState) {
+	ch := make(chan *record, 10)
+	ps := &parseState{}
+
+	go func(dec *gob.Decoder, ch chan *record) {
+		for {
+			var kv KeyVal
+			if err := dec.Decode(&kv); err != nil {
+				if err != io.EOF {
+					ps.err = fmt.Errorf("gob stream: %w", err)
+				}
+				break
+			}
+
+			if len(kv.Key) == 0 {
+				ps.skipped++
+				continue
+			}
+
+			ch <- &record{
+				key: kv.Key,
+				val: kv.Val,
+			}
+		}
+		close(ch)
+	}(gob.NewDecoder(fd), ch)
+
+	return ch, ps
+}
+
+// decode the msgpack stream 'fd' into records and send them on the
+// returned chan. Decoding errors are available via the returned
+// parseState once the chan is closed.
+func msgpackRecords(fd io.Reader) (chan *record, *parseState) {
+	ch := make(chan *record, 10)
+	ps := &parseState{}
+
+	go func(rd *bufio.Reader, ch chan *record) {
+		for n := 1; ; n++ {
+			k, v, err := msgpackTuple(rd)
+			if err != nil {
+				if err != io.EOF {
+					ps.err = fmt.Errorf("msgpack stream: tuple %d: %w", n, err)
+				}
+				break
+			}
+
+			if len(k) == 0 {
+				ps.skipped++
+				continue
+			}
+
+			ch <- &record{
+				key: k,
+				val: v,
+			}
+		}
+		close(ch)
+	}(bufio.NewReader(fd), ch)
+
+	return ch, ps
+}
+
+// read one (key, value) tuple from 'rd'; io.EOF means there are no more
+// tuples.
+func msgpackTuple(rd *bufio.Reader) ([]byte, []byte, error) {
+	b, err := rd.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var n uint32
+	switch {
+	case b >= 0x90 && b <= 0x9f:
+		n = uint32(b & 0x0f)
+	case b == 0xdc:
+		x, err := msgpackUint(rd, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		n = uint32(x)
+	case b == 0xdd:
+		x, err := msgpackUint(rd, 4)
+		if err != nil {
+			return nil, nil, err
+		}
+		n = uint32(x)
+	default:
+		return nil, nil, fmt.Errorf("type %#x is not an array", b)
+	}
+
+	if n < 1 || n > 2 {
+		return nil, nil, fmt.Errorf("array of %d elements; exp 2", n)
+	}
+
+	k, err := msgpackBytes(rd)
+	if err != nil {
+		return nil, nil, eofIsShort(err)
+	}
+
+	var v []byte
+	if n == 2 {
+		if v, err = msgpackBytes(rd); err != nil {
+			return nil, nil, eofIsShort(err)
+		}
+	}
+	return k, v, nil
+}
+
+// read a msgpack str, bin, nil or integer from 'rd' as bytes
+func msgpackBytes(rd *bufio.Reader) ([]byte, error) {
+	b, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint64
+	switch {
+	case b <= 0x7f:
+		return strconv.AppendUint(nil, uint64(b), 10), nil
+	case b >= 0xe0:
+		return strconv.AppendInt(nil, int64(int8(b)), 10), nil
+	case b >= 0xa0 && b <= 0xbf:
+		n = uint64(b & 0x1f)
+	case b == 0xc0:
+		return nil, nil
+	case b == 0xc4 || b == 0xd9:
+		n, err = msgpackUint(rd, 1)
+	case b == 0xc5 || b == 0xda:
+		n, err = msgpackUint(rd, 2)
+	case b == 0xc6 || b == 0xdb:
+		n, err = msgpackUint(rd, 4)
+	case b >= 0xcc && b <= 0xcf:
+		x, err := msgpackUint(rd, 1<<(b-0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendUint(nil, x, 10), nil
+	case b >= 0xd0 && b <= 0xd3:
+		sz := 1 << (b - 0xd0)
+		x, err := msgpackUint(rd, sz)
+		if err != nil {
+			return nil, err
+		}
+
+		// sign extend
+		shift := uint(64 - 8*sz)
+		return strconv.AppendInt(nil, int64(x<<shift)>>shift, 10), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %#x", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the buffer grows as the bytes arrive; a corrupt length can't make
+	// us allocate a lot of memory up front.
+	var buf bytes.Buffer
+	if n <= 65536 {
+		buf.Grow(int(n))
+	}
+	if _, err = io.CopyN(&buf, rd, int64(n)); err != nil {
+		return nil, eofIsShort(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// read a 'sz' byte big-endian unsigned integer from 'rd'
+func msgpackUint(rd *bufio.Reader, sz int) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(rd, b[8-sz:]); err != nil {
+		return 0, eofIsShort(err)
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// a stream that ends in the middle of a tuple is truncated
+func eofIsShort(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+// stream_test.go -- test suite for gob and msgpack record streams
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestGobStream(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	for _, s := range keyw {
+		err := enc.Encode(&KeyVal{Key: []byte(s), Val: []byte{0, 1, '\n', 0xff}})
+		assert(err == nil, "can't encode: %s", err)
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddGobStream(&b)
+	assert(err == nil, "can't add gob stream: %s", err)
+	assert(int(n) == len(keyw), "exp %d records, saw %d", len(keyw), n)
+
+	_, err = wr.AddGobStream(bytes.NewReader([]byte("garbage")))
+	assert(err != nil, "added a corrupt gob stream")
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, s := range keyw {
+		v, err := rd.Find([]byte(s))
+		assert(err == nil, "can't find key %s: %s", s, err)
+		assert(bytes.Equal(v, []byte{0, 1, '\n', 0xff}), "key %s: value mismatch; saw %x", s, v)
+	}
+}
+
+func TestMsgpackStream(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	long := bytes.Repeat([]byte("x"), 300)
+
+	var b bytes.Buffer
+	b.Write([]byte{0x92, 0xa2, 'k', '1', 0xc4, 2, 0, 0xff})    // fixstr, bin8
+	b.Write([]byte{0x92, 0xc4, 2, 'k', '2', 0xc0})             // bin8, nil
+	b.Write([]byte{0x92, 0xd9, 2, 'k', '3', 0xcd, 0x01, 0x00}) // str8, uint16
+	b.Write([]byte{0xdc, 0, 2, 0x07, 0xd1, 0xff, 0x38})        // array16, fixint, int16
+	b.Write([]byte{0x92, 0xa2, 'k', '5', 0xc5, 0x01, 0x2c})    // bin16
+	b.Write(long)
+	b.Write([]byte{0x92, 0xa0, 0xa1, 'v'}) // empty key
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	n, err := wr.AddMsgpackStream(&b)
+	assert(err == nil, "can't add msgpack stream: %s", err)
+	assert(n == 5, "exp 5 records, saw %d", n)
+
+	src := wr.Sources()
+	assert(src[0].Skipped == 1, "exp 1 skipped tuple, saw %d", src[0].Skipped)
+
+	bad := [][]byte{
+		{0x93, 0xa1, 'a', 0xa1, 'b', 0xa1, 'c'}, // 3 elements
+		{0xa1, 'a'},                             // not an array
+		{0x92, 0xa1, 'a', 0xc4, 10, 'b'},        // truncated
+		{0x92, 0xa1, 'a', 0xcb, 0, 0, 0, 0},     // float
+	}
+	for i, x := range bad {
+		_, err = wr.AddMsgpackStream(bytes.NewReader(x))
+		assert(err != nil, "added bad stream %d", i)
+	}
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	exp := map[string][]byte{
+		"k1": {0, 0xff},
+		"k2": {},
+		"k3": []byte("256"),
+		"7":  []byte("-200"),
+		"k5": long,
+	}
+	for k, x := range exp {
+		v, err := rd.Find([]byte(k))
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, x), "key %s: exp %x, saw %x", k, x, v)
+	}
+}
@@ -0,0 +1,46 @@
+// valcodec.go -- application codecs of the values of a DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+)
+
+// Codec decodes the values of a DB that an application encoded before
+// adding them - e.g., compressed, encrypted or framed. Decode is called
+// with the application flags of the record (see
+// DBWriter.AddKeyValsWithFlags()) and the stored value - after its
+// checksum is verified; it returns the value seen by lookups. The flags
+// can tell Decode how a value was encoded. 'raw' must not be modified or
+// retained. Decode must be safe for concurrent use.
+type Codec interface {
+	Decode(flags byte, raw []byte) ([]byte, error)
+}
+
+// SetCodec decodes the values returned by lookups (Find(), FindMany(),
+// GetRecord() etc.), iterators and Sample() with 'c'; decoded values are
+// cached. Records copied to another DB (e.g., DBWriter.AddAll()) keep
+// their stored values. This must be called before the DB is queried.
+func (rd *DBReader) SetCodec(c Codec) {
+	rd.vcodec = c
+}
+
+// decode the value of record 'r' with the codec of the DB
+func (rd *DBReader) decodeValue(r *record) error {
+	if rd.vcodec == nil || r.deleted {
+		return nil
+	}
+
+	v, err := rd.vcodec.Decode(r.appflags, r.val)
+	if err != nil {
+		return fmt.Errorf("%s: can't decode value of record at off %d: %w", rd.fn, r.off, err)
+	}
+	r.val = v
+	return nil
+}
@@ -0,0 +1,119 @@
+// valcodec_test.go -- test suite for value codecs
+
+package bbhash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// values with flag 1 are reversed; flag 2 is an unknown encoding
+type revCodec struct{}
+
+var errBadEncoding = errors.New("bad encoding")
+
+func (revCodec) Decode(flags byte, raw []byte) ([]byte, error) {
+	switch flags {
+	case 0:
+		return raw, nil
+	case 1:
+		v := make([]byte, len(raw))
+		for i := range raw {
+			v[len(raw)-1-i] = raw[i]
+		}
+		return v, nil
+	}
+	return nil, errBadEncoding
+}
+
+func TestCodec(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	copyfn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+	defer os.Remove(copyfn)
+
+	keys := make([][]byte, 100)
+	vals := make([][]byte, len(keys))
+	enc := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		vals[i] = []byte(fmt.Sprintf("val-%d", i))
+		enc[i], _ = revCodec{}.Decode(1, vals[i])
+	}
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddKeyVals(keys[:50], vals[:50])
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddKeyValsWithFlags(keys[50:], enc[50:], 1)
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddKeyValsWithFlags([][]byte{[]byte("bad")}, [][]byte{[]byte("bad")}, 2)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Codec: revCodec{}})
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for i, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, vals[i]), "key %s: exp %s, saw %s", k, vals[i], v)
+
+		// cached values are decoded once
+		v, err = rd.Find(k)
+		assert(err == nil && bytes.Equal(v, vals[i]), "cached key %s: exp %s, saw %s", k, vals[i], v)
+
+		r, err := rd.GetRecord(k)
+		assert(err == nil && bytes.Equal(r.Value, vals[i]), "record %s: exp %s, saw %s", k, vals[i], r.Value)
+	}
+
+	_, err = rd.Find([]byte("bad"))
+	assert(errors.Is(err, errBadEncoding), "decoded a bad value: %v", err)
+
+	rd2, err := NewDBReaderWithOptions(fn, ReaderOptions{Codec: revCodec{}})
+	assert(err == nil, "read failed: %s", err)
+	defer rd2.Close()
+
+	v, errs := rd2.FindMany(keys)
+	for i, k := range keys {
+		assert(errs[i] == nil, "batch: can't find key %s: %s", k, errs[i])
+		assert(bytes.Equal(v[i], vals[i]), "batch: key %s: exp %s, saw %s", k, vals[i], v[i])
+	}
+
+	// the iterator stops at the value it can't decode
+	it := rd2.Iter()
+	for it.Next() {
+		var i int
+		fmt.Sscanf(string(it.Key()), "key-%d", &i)
+		assert(bytes.Equal(it.Value(), vals[i]), "iter: key %s: exp %s, saw %s", it.Key(), vals[i], it.Value())
+	}
+	assert(errors.Is(it.Err(), errBadEncoding), "iter: decoded a bad value: %v", it.Err())
+
+	// a copy of the DB keeps the stored values
+	wr, err = NewDBWriter(copyfn)
+	assert(err == nil, "can't create db: %s", err)
+	_, err = wr.AddAll(rd)
+	assert(err == nil, "can't add db: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	cp, err := NewDBReader(copyfn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer cp.Close()
+
+	for i, k := range keys {
+		v, err := cp.Find(k)
+		exp := vals[i]
+		if i >= 50 {
+			exp = enc[i]
+		}
+		assert(err == nil && bytes.Equal(v, exp), "copy: key %s: exp %s, saw %s", k, exp, v)
+	}
+}
@@ -0,0 +1,124 @@
+// verify.go -- deep verification of a constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VerifyAllProgress calls its progress callback after every
+// 'verifyInterval' records.
+const verifyInterval = 1024
+
+// VerifyAll reads every record in the offset table, verifies its checksum
+// (or authenticates it in an encrypted DB) and confirms that its key hashes
+// back to the same slot of the MPH. It returns the first error it finds; a
+// nil error means every record of the DB is intact. The metadata of the DB
+// is verified when it is opened - or by VerifyMetadata(). Records of a DB loaded by
+// NewDBReaderInMemory() with 'verify' set are not verified again.
+func (rd *DBReader) VerifyAll() error {
+	return rd.VerifyAllProgress(nil)
+}
+
+// VerifyMetadata verifies the strong checksum of the file header, offset
+// table and MPH of the DB - the check that opening a DB with
+// ReaderOptions.FastOpen or QuickCheck skips. It reads all of the metadata;
+// it is safe to call concurrently with lookups, e.g. in a goroutine after
+// opening the DB.
+// It returns an error matching ErrBadChecksum if the metadata is corrupt or
+// was changed after the DB was opened.
+func (rd *DBReader) VerifyMetadata() error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	defer rd.leave()
+
+	var hdrb [64]byte
+
+	if _, err := rd.mra.ReadAt(hdrb[:], 0); err != nil {
+		return fmt.Errorf("%s: can't read header: %w", rd.fn, err)
+	}
+
+	hdr, err := rd.decodeHeader(hdrb[:], rd.size)
+	if err != nil {
+		return err
+	}
+
+	csum, err := rd.verifyChecksum(rd.mra, hdrb[:], hdr, rd.size)
+	if err != nil {
+		return err
+	}
+	if csum != rd.csum {
+		return fmt.Errorf("%s: %w; DB changed after it was opened", rd.fn, ErrBadChecksum)
+	}
+	return nil
+}
+
+// VerifyAllProgress is like VerifyAll except it calls 'fp' periodically with
+// the number of records verified so far and the total number of records.
+func (rd *DBReader) VerifyAllProgress(fp func(done, total uint64)) error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+
+	// 'fp' may close the DB; it isn't called with the DB held
+	held := true
+	defer func() {
+		if held {
+			rd.leave()
+		}
+	}()
+
+	type slot struct {
+		off uint64
+		i   uint64
+	}
+
+	// read the records in the order they are stored in the file
+	slots := make([]slot, rd.nkeys)
+	for i := range slots {
+		slots[i] = slot{rd.offset(uint64(i)), uint64(i)}
+	}
+
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].off < slots[j].off
+	})
+
+	total := uint64(len(slots))
+	for n, s := range slots {
+		r, err := rd.decodeRecord(s.off)
+		if err != nil {
+			return err
+		}
+
+		j, err := rd.bb.find(r.hash)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rd.fn, err)
+		}
+		if j != s.i+1 {
+			return fmt.Errorf("%s: %w: record %d at off %d maps to slot %d", rd.fn, ErrCorrupt, s.i, s.off, j)
+		}
+		if _, ok := rd.slotOffset(s.i+1, r.hash); !ok {
+			return fmt.Errorf("%s: %w: record %d at off %d: fingerprint mismatch", rd.fn, ErrCorrupt, s.i, s.off)
+		}
+
+		if done := uint64(n + 1); fp != nil && (done%verifyInterval == 0 || done == total) {
+			rd.leave()
+			held = false
+			fp(done, total)
+			if !rd.enter() {
+				return ErrClosed
+			}
+			held = true
+		}
+	}
+
+	return nil
+}
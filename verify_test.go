@@ -0,0 +1,145 @@
+// verify_test.go -- test suite for deep verification
+
+package bbhash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerifyAll(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{PrefixCompress: true, DedupValues: true})
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 3000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("/a/common/prefix/%d", i))
+		vals[i] = []byte(fmt.Sprintf("value %d", i%50))
+	}
+
+	_, err = wr.AddKeyVals(keys, vals)
+	assert(err == nil, "can't add key-vals: %s", err)
+
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	var calls, last uint64
+	err = rd.VerifyAllProgress(func(done, total uint64) {
+		assert(total == uint64(len(keys)), "exp total %d, saw %d", len(keys), total)
+		assert(done > last, "progress went backwards: %d after %d", done, last)
+		calls++
+		last = done
+	})
+	assert(err == nil, "verify failed: %s", err)
+	assert(last == uint64(len(keys)), "exp %d verified, saw %d", len(keys), last)
+	assert(calls == 3, "exp 3 progress calls, saw %d", calls)
+
+	// corrupt the key of the first record - an anchor with an 11 byte
+	// header; the metadata is intact.
+	off := uint64(rd.size)
+	for i := range rd.offsets {
+		if x := toLittleEndianUint64(rd.offsets[i]); x < off {
+			off = x
+		}
+	}
+	rd.Close()
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	b[off+12] ^= 0xff
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	err = rd.VerifyAll()
+	assert(err != nil, "corrupt record not detected")
+	assert(rd.Stats().ChecksumFailures == 1, "exp 1 checksum failure, saw %d", rd.Stats().ChecksumFailures)
+}
+
+func TestVerifyMetadata(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	modes := []LoadMode{LoadFile, LoadMmap, LoadMemory}
+	for _, m := range modes {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, FastOpen: true})
+		assert(err == nil, "%d: read failed: %s", m, err)
+
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			assert(err == nil, "%d: can't find key %s: %s", m, k, err)
+			assert(bytes.Equal(v, k), "%d: key %s: value mismatch", m, k)
+		}
+
+		err = rd.VerifyMetadata()
+		assert(err == nil, "%d: verify failed: %s", m, err)
+		rd.Close()
+
+		err = rd.VerifyMetadata()
+		assert(err == ErrClosed, "%d: verified a closed DB: %v", m, err)
+	}
+
+	// corrupt the most significant byte of the first entry of the offset
+	// table; the records are intact.
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read db: %s", err)
+	offtbl := binary.BigEndian.Uint64(b[24:32])
+	b[offtbl+7] ^= 0x80
+	err = ioutil.WriteFile(fn, b, 0600)
+	assert(err == nil, "can't write db: %s", err)
+
+	_, err = NewDBReader(fn, 10)
+	assert(errors.Is(err, ErrBadChecksum), "opened a corrupt db: %v", err)
+
+	for _, m := range modes {
+		rd, err := NewDBReaderWithOptions(fn, ReaderOptions{Mode: m, FastOpen: true})
+		assert(err == nil, "%d: fast open failed: %s", m, err)
+
+		nerr := 0
+		for _, k := range keys {
+			v, err := rd.Find(k)
+			if err != nil {
+				nerr++
+				continue
+			}
+			assert(bytes.Equal(v, k), "%d: key %s: value mismatch", m, k)
+		}
+		assert(nerr == 1, "%d: exp 1 failed lookup, saw %d", m, nerr)
+
+		err = rd.VerifyMetadata()
+		assert(errors.Is(err, ErrBadChecksum), "%d: corrupt metadata not detected: %v", m, err)
+		rd.Close()
+	}
+}
@@ -0,0 +1,67 @@
+// warm.go -- prefetch records into the cache
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"runtime"
+)
+
+// size of the pages touched when warming a memory mapped DB
+const warmPageSize = 4096
+
+// Warm reads the records of 'keys' into the cache - e.g., the hot keys of a
+// service at startup - so that their first lookups don't wait for the disk.
+// Keys that aren't in the DB are skipped; it returns the first other error.
+// The reads are done like FindMany() and are counted in Stats().
+func (rd *DBReader) Warm(keys [][]byte) error {
+	_, errs := rd.FindMany(keys)
+	for _, err := range errs {
+		if err != nil && err != ErrNoKey {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarmAll touches the pages of a memory mapped offset table and reads
+// records into the cache in the order they are stored in the file - until
+// the cached keys and values add up to 'maxBytes'; if 'maxBytes' is not
+// positive, every record is read. The cache keeps its own bound: records
+// read past it evict the earlier ones.
+func (rd *DBReader) WarmAll(maxBytes int64) error {
+	if !rd.enter() {
+		return ErrClosed
+	}
+	runtime.KeepAlive(touch(rd.mmap))
+	rd.leave()
+
+	var sz int64
+	it := rd.Iter()
+	for it.Next() {
+		r := it.r
+		z := recordSize(r)
+		if maxBytes > 0 && sz+z > maxBytes {
+			break
+		}
+
+		rd.cache.Add(r.hash, r)
+		sz += z
+	}
+	return it.Err()
+}
+
+// read a byte from every page of 'b' to fault it in; the caller keeps the
+// sum alive so that the reads aren't optimized away.
+func touch(b []byte) byte {
+	var x byte
+	for i := 0; i < len(b); i += warmPageSize {
+		x += b[i]
+	}
+	return x
+}
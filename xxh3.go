@@ -0,0 +1,276 @@
+// xxh3.go -- XXH3-64 hash of byte slices
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package bbhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// KeyHash selects the hash function that turns keys into the uint64 keys
+// of a BBHash; see WriterOptions.KeyHash.
+type KeyHash int
+
+const (
+	// KeyHashDefault is fasthash - or a salted FNV-1a in a DB built with
+	// WriterOptions.StdlibHash and in a 'bbhash_stdlib' build.
+	KeyHashDefault KeyHash = iota
+
+	// KeyHashXXH3 is the 64-bit XXH3 hash seeded with the salt. It is
+	// faster than fasthash on large keys and has implementations in many
+	// languages.
+	KeyHashXXH3
+)
+
+// Hash64 returns the hash of 'key' with salt 'salt'; the result can be
+// used as a key of New().
+func (h KeyHash) Hash64(salt uint64, key []byte) uint64 {
+	if h == KeyHashXXH3 {
+		return xxh3Hash64(salt, key)
+	}
+	return hashBytes(!haveExtHash, salt, key)
+}
+
+// String returns the name of the hash function
+func (h KeyHash) String() string {
+	switch h {
+	case KeyHashDefault:
+		return "default"
+	case KeyHashXXH3:
+		return "xxh3"
+	}
+	return fmt.Sprintf("KeyHash(%d)", int(h))
+}
+
+// This is a portable implementation of the 64-bit XXH3 hash with a seed
+// (XXH3_64bits_withSeed() of the reference implementation, v0.8). It
+// produces the same hashes as the reference implementation; so a DB built
+// with KeyHashXXH3 can be read by programs in other languages.
+
+const (
+	xxPrime32_1 uint64 = 0x9E3779B1
+	xxPrime32_2 uint64 = 0x85EBCA77
+	xxPrime32_3 uint64 = 0xC2B2AE3D
+
+	xxPrime64_1 uint64 = 0x9E3779B185EBCA87
+	xxPrime64_2 uint64 = 0xC2B2AE3D27D4EB4F
+	xxPrime64_3 uint64 = 0x165667B19E3779F9
+	xxPrime64_4 uint64 = 0x85EBCA77C2B2AE63
+	xxPrime64_5 uint64 = 0x27D4EB2F165667C5
+
+	// size of the secret and of the stripes and blocks of a long input
+	xxSecretSize = 192
+	xxStripe     = 64
+	xxBlock      = 1024
+)
+
+// the default secret of XXH3
+var xxSecret = [xxSecretSize]byte{
+	0xb8, 0xfe, 0x6c, 0x39, 0x23, 0xa4, 0x4b, 0xbe, 0x7c, 0x01, 0x81, 0x2c, 0xf7, 0x21, 0xad, 0x1c,
+	0xde, 0xd4, 0x6d, 0xe9, 0x83, 0x90, 0x97, 0xdb, 0x72, 0x40, 0xa4, 0xa4, 0xb7, 0xb3, 0x67, 0x1f,
+	0xcb, 0x79, 0xe6, 0x4e, 0xcc, 0xc0, 0xe5, 0x78, 0x82, 0x5a, 0xd0, 0x7d, 0xcc, 0xff, 0x72, 0x21,
+	0xb8, 0x08, 0x46, 0x74, 0xf7, 0x43, 0x24, 0x8e, 0xe0, 0x35, 0x90, 0xe6, 0x81, 0x3a, 0x26, 0x4c,
+	0x3c, 0x28, 0x52, 0xbb, 0x91, 0xc3, 0x00, 0xcb, 0x88, 0xd0, 0x65, 0x8b, 0x1b, 0x53, 0x2e, 0xa3,
+	0x71, 0x64, 0x48, 0x97, 0xa2, 0x0d, 0xf9, 0x4e, 0x38, 0x19, 0xef, 0x46, 0xa9, 0xde, 0xac, 0xd8,
+	0xa8, 0xfa, 0x76, 0x3f, 0xe3, 0x9c, 0x34, 0x3f, 0xf9, 0xdc, 0xbb, 0xc7, 0xc7, 0x0b, 0x4f, 0x1d,
+	0x8a, 0x51, 0xe0, 0x4b, 0xcd, 0xb4, 0x59, 0x31, 0xc8, 0x9f, 0x7e, 0xc9, 0xd9, 0x78, 0x73, 0x64,
+	0xea, 0xc5, 0xac, 0x83, 0x34, 0xd3, 0xeb, 0xc3, 0xc5, 0x81, 0xa0, 0xff, 0xfa, 0x13, 0x63, 0xeb,
+	0x17, 0x0d, 0xdd, 0x51, 0xb7, 0xf0, 0xda, 0x49, 0xd3, 0x16, 0x55, 0x26, 0x29, 0xd4, 0x68, 0x9e,
+	0x2b, 0x16, 0xbe, 0x58, 0x7d, 0x47, 0xa1, 0xfc, 0x8f, 0xf8, 0xb8, 0xd1, 0x7a, 0xd0, 0x31, 0xce,
+	0x45, 0xcb, 0x3a, 0x8f, 0x95, 0x16, 0x04, 0x28, 0xaf, 0xd7, 0xfb, 0xca, 0xbb, 0x4b, 0x40, 0x7e,
+}
+
+// return the XXH3-64 hash of 'b' with seed 'seed'
+func xxh3Hash64(seed uint64, b []byte) uint64 {
+	n := len(b)
+	switch {
+	case n <= 16:
+		return xxh3Short(seed, b)
+	case n <= 128:
+		return xxh3Medium(seed, b)
+	case n <= 240:
+		return xxh3Large(seed, b)
+	}
+	return xxh3Long(seed, b)
+}
+
+// inputs of upto 16 bytes
+func xxh3Short(seed uint64, b []byte) uint64 {
+	s := xxSecret[:]
+	n := len(b)
+
+	switch {
+	case n > 8:
+		lo := le64(b) ^ (le64(s[24:]) ^ le64(s[32:]) + seed)
+		hi := le64(b[n-8:]) ^ (le64(s[40:]) ^ le64(s[48:]) - seed)
+		acc := uint64(n) + bits.ReverseBytes64(lo) + hi + mulFold64(lo, hi)
+		return xxh3Avalanche(acc)
+
+	case n >= 4:
+		seed ^= uint64(bits.ReverseBytes32(uint32(seed))) << 32
+		v := uint64(le32(b[n-4:])) + uint64(le32(b))<<32
+		return rrmxmx(v^(le64(s[8:])^le64(s[16:])-seed), uint64(n))
+
+	case n > 0:
+		c1, c2, c3 := b[0], b[n>>1], b[n-1]
+		v := uint64(c1)<<16 | uint64(c2)<<24 | uint64(c3) | uint64(n)<<8
+		v ^= uint64(le32(s)^le32(s[4:])) + seed
+		return xxh64Avalanche(v)
+	}
+	return xxh64Avalanche(seed ^ le64(s[56:]) ^ le64(s[64:]))
+}
+
+// inputs of 17 to 128 bytes
+func xxh3Medium(seed uint64, b []byte) uint64 {
+	s := xxSecret[:]
+	n := len(b)
+
+	acc := uint64(n) * xxPrime64_1
+	if n > 32 {
+		if n > 64 {
+			if n > 96 {
+				acc += mix16(b[48:], s[96:], seed)
+				acc += mix16(b[n-64:], s[112:], seed)
+			}
+			acc += mix16(b[32:], s[64:], seed)
+			acc += mix16(b[n-48:], s[80:], seed)
+		}
+		acc += mix16(b[16:], s[32:], seed)
+		acc += mix16(b[n-32:], s[48:], seed)
+	}
+	acc += mix16(b, s, seed)
+	acc += mix16(b[n-16:], s[16:], seed)
+	return xxh3Avalanche(acc)
+}
+
+// inputs of 129 to 240 bytes
+func xxh3Large(seed uint64, b []byte) uint64 {
+	s := xxSecret[:]
+	n := len(b)
+
+	acc := uint64(n) * xxPrime64_1
+	for i := 0; i < 8; i++ {
+		acc += mix16(b[16*i:], s[16*i:], seed)
+	}
+	acc = xxh3Avalanche(acc)
+
+	for i := 8; i < n/16; i++ {
+		acc += mix16(b[16*i:], s[16*(i-8)+3:], seed)
+	}
+	acc += mix16(b[n-16:], s[136-17:], seed)
+	return xxh3Avalanche(acc)
+}
+
+// inputs longer than 240 bytes; a non-zero seed derives a new secret
+func xxh3Long(seed uint64, b []byte) uint64 {
+	var sb [xxSecretSize]byte
+
+	s := xxSecret[:]
+	if seed != 0 {
+		for i := 0; i < xxSecretSize; i += 16 {
+			binary.LittleEndian.PutUint64(sb[i:], le64(s[i:])+seed)
+			binary.LittleEndian.PutUint64(sb[i+8:], le64(s[i+8:])-seed)
+		}
+		s = sb[:]
+	}
+
+	acc := [8]uint64{
+		xxPrime32_3, xxPrime64_1, xxPrime64_2, xxPrime64_3,
+		xxPrime64_4, xxPrime32_2, xxPrime64_5, xxPrime32_1,
+	}
+
+	n := len(b)
+	nstripes := (xxSecretSize - xxStripe) / 8
+	nblocks := (n - 1) / xxBlock
+	for i := 0; i < nblocks; i++ {
+		blk := b[i*xxBlock:]
+		for j := 0; j < nstripes; j++ {
+			xxh3Accumulate(&acc, blk[j*xxStripe:], s[j*8:])
+		}
+		xxh3Scramble(&acc, s[xxSecretSize-xxStripe:])
+	}
+
+	// the partial last block and the last stripe
+	blk := b[nblocks*xxBlock:]
+	m := (n - 1 - nblocks*xxBlock) / xxStripe
+	for j := 0; j < m; j++ {
+		xxh3Accumulate(&acc, blk[j*xxStripe:], s[j*8:])
+	}
+	xxh3Accumulate(&acc, b[n-xxStripe:], s[xxSecretSize-xxStripe-7:])
+
+	h := uint64(n) * xxPrime64_1
+	for i := 0; i < 4; i++ {
+		ms := s[11+16*i:]
+		h += mulFold64(acc[2*i]^le64(ms), acc[2*i+1]^le64(ms[8:]))
+	}
+	return xxh3Avalanche(h)
+}
+
+// accumulate a stripe of 64 bytes
+func xxh3Accumulate(acc *[8]uint64, b, s []byte) {
+	for i := 0; i < 8; i++ {
+		v := le64(b[8*i:])
+		k := v ^ le64(s[8*i:])
+		acc[i^1] += v
+		acc[i] += (k & 0xffffffff) * (k >> 32)
+	}
+}
+
+func xxh3Scramble(acc *[8]uint64, s []byte) {
+	for i := range acc {
+		a := acc[i]
+		a ^= a >> 47
+		a ^= le64(s[8*i:])
+		acc[i] = a * xxPrime32_1
+	}
+}
+
+// mix 16 bytes of input with 16 bytes of secret and the seed
+func mix16(b, s []byte, seed uint64) uint64 {
+	lo := le64(b) ^ (le64(s) + seed)
+	hi := le64(b[8:]) ^ (le64(s[8:]) - seed)
+	return mulFold64(lo, hi)
+}
+
+// fold the 128-bit product of x and y into 64 bits
+func mulFold64(x, y uint64) uint64 {
+	hi, lo := bits.Mul64(x, y)
+	return hi ^ lo
+}
+
+func xxh3Avalanche(h uint64) uint64 {
+	h ^= h >> 37
+	h *= 0x165667919E3779F9
+	return h ^ (h >> 32)
+}
+
+func xxh64Avalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= xxPrime64_2
+	h ^= h >> 29
+	h *= xxPrime64_3
+	return h ^ (h >> 32)
+}
+
+func rrmxmx(h uint64, n uint64) uint64 {
+	h ^= bits.RotateLeft64(h, 49) ^ bits.RotateLeft64(h, 24)
+	h *= 0x9FB21C651E98DF25
+	h ^= (h >> 35) + n
+	h *= 0x9FB21C651E98DF25
+	return h ^ (h >> 28)
+}
+
+func le64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+func le32(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b)
+}
@@ -0,0 +1,100 @@
+// xxh3_test.go -- test suite for the XXH3 key hash
+
+package bbhash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// hashes of the reference implementation of XXH3 for an input of 'n'
+// bytes b[i] = (i+1) % 251; without a seed and with the unseeded hash of
+// the input as the seed.
+var xxh3Vectors = []struct {
+	n          int
+	hash, seed uint64
+}{
+	{0, 0x2d06800538d394c2, 0x412f1275e10017f3},
+	{1, 0xe12ef9d2eb86ceeb, 0x4262213496108755},
+	{3, 0xebce9b7632ae733b, 0xfb7293fb3dbdac25},
+	{4, 0x988b7b9033ac4622, 0x48f347023f9c957e},
+	{8, 0x16f217ea16232297, 0xdccb3547423b9f24},
+	{9, 0x17d143e7f447850a, 0xe1b6f82d24211d46},
+	{16, 0xeb5aeb9a32450f6a, 0xe9a6d2d94e8991c1},
+	{17, 0x6d458e1fff494078, 0x54019c5cc05b1fcc},
+	{100, 0xd53e74fac84fa8fb, 0x6f67e6c565344887},
+	{129, 0x7d4fc663f5958d40, 0x5d32d64c42cb3d9e},
+	{240, 0xa5a910b2d7e065b0, 0x80e2216803241284},
+	{241, 0xb6515f490cdd4ce5, 0x5d5615c096fc7d65},
+	{1024, 0x546f61a5b0b850c1, 0x64e1b7584551d825},
+	{1025, 0xa58696e72de6df58, 0xb9220915b62d7f85},
+	{3000, 0x50860bf64d1dac3c, 0x8e9fe04c01acbc1f},
+}
+
+func TestXXH3(t *testing.T) {
+	assert := newAsserter(t)
+
+	buf := make([]byte, 4096)
+	for i := range buf {
+		buf[i] = byte((i + 1) % 251)
+	}
+
+	for _, v := range xxh3Vectors {
+		b := buf[:v.n]
+		h := xxh3Hash64(0, b)
+		assert(h == v.hash, "%d: exp %#x, saw %#x", v.n, v.hash, h)
+
+		s := xxh3Hash64(h, b)
+		assert(s == v.seed, "%d: seeded: exp %#x, saw %#x", v.n, v.seed, s)
+		assert(KeyHashXXH3.Hash64(h, b) == s, "%d: KeyHash mismatch", v.n)
+	}
+}
+
+func TestXXH3DB(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand64())
+	defer os.Remove(fn)
+
+	_, err := NewDBWriterWithOptions(fn, WriterOptions{KeyHash: KeyHash(42)})
+	assert(err != nil, "created a DB with an unknown key hash")
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%0300d", i))
+	}
+
+	wr, err := NewDBWriterWithOptions(fn, WriterOptions{KeyHash: KeyHashXXH3})
+	assert(err == nil, "can't create db: %s", err)
+
+	_, err = wr.AddKeyVals(keys, keys)
+	assert(err == nil, "can't add key-vals: %s", err)
+	_, err = wr.AddKeyValsIn(1, keys[:10], keys[:10])
+	assert(err == nil, "can't add key-vals: %s", err)
+	err = wr.Freeze(2.0)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert((rd.flags&flagXXH3) > 0, "xxh3 not in header: %#x", rd.flags)
+	assert(rd.keyHash(0, keys[0]) == xxh3Hash64(rd.salt, keys[0]), "key hash mismatch")
+
+	for _, k := range keys {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %s: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+
+	for _, k := range keys[:10] {
+		v, err := rd.FindIn(1, k)
+		assert(err == nil, "can't find key %s in ns 1: %s", k, err)
+		assert(bytes.Equal(v, k), "key %s: value mismatch", k)
+	}
+
+	err = rd.VerifyAll()
+	assert(err == nil, "verify failed: %s", err)
+}